@@ -0,0 +1,85 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/base58btc/btcpp-web/external/getters"
+	"github.com/base58btc/btcpp-web/internal/handlers"
+	"github.com/base58btc/btcpp-web/internal/types"
+)
+
+/* Single use discount codes in bulk, for sponsors and speakers.
+ *
+ *   btcpp-web discounts gen -conf atx25 -campaign sponsors -n 20 -comp -type sponsor
+ *   btcpp-web discounts gen -conf atx25 -campaign speakers -n 40 -amount 50 -expires 2025-04-01
+ *   btcpp-web discounts export -conf atx25 -campaign sponsors
+ *
+ * Both print the campaign's codes as CSV; export says which
+ * have been used, and on what ticket. */
+func runDiscountsCmd(env *types.EnvConfig, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: discounts gen|export")
+	}
+
+	store, err := getters.NewStore(env)
+	if err != nil {
+		return err
+	}
+
+	cmd := flag.NewFlagSet("discounts "+args[0], flag.ExitOnError)
+	confTag := cmd.String("conf", "", "conf tag")
+	campaign := cmd.String("campaign", "", "what the codes are for, e.g. sponsors")
+	count := cmd.Int("n", 0, "how many codes to make")
+	percent := cmd.Uint("percent", 0, "percent off")
+	amount := cmd.Uint("amount", 0, "amount off each ticket, in its currency")
+	expires := cmd.String("expires", "", "when the codes stop working (YYYY-MM-DD)")
+	comp := cmd.Bool("comp", false, "free tickets, that skip paying")
+	tixType := cmd.String("type", "", "what comps are issued as, e.g. speaker")
+	cmd.Parse(args[1:])
+
+	confRefs, err := confTagsToRefs(store, *confTag)
+	if err != nil {
+		return err
+	}
+	if len(confRefs) != 1 {
+		return fmt.Errorf("discounts need one -conf")
+	}
+
+	switch args[0] {
+	case "gen":
+		var pct, amt string
+		if *percent > 0 {
+			pct = strconv.FormatUint(uint64(*percent), 10)
+		}
+		if *amount > 0 {
+			amt = strconv.FormatUint(uint64(*amount), 10)
+		}
+		batch, err := handlers.ParseDiscountBatch(confRefs[0], *campaign, strconv.Itoa(*count), pct, amt, *expires)
+		if err != nil {
+			return err
+		}
+		batch.Comp, batch.TixType = *comp, *tixType
+		codes, err := getters.GenerateDiscounts(store, batch)
+		if len(codes) > 0 {
+			fmt.Fprintf(os.Stderr, "Made %d codes for %s\n", len(codes), batch.Campaign)
+		}
+		if err != nil {
+			return err
+		}
+	case "export":
+	default:
+		return fmt.Errorf("unknown discounts command %q", args[0])
+	}
+
+	redeemed, err := getters.CampaignRedemptions(store, confRefs[0], *campaign)
+	if err != nil {
+		return err
+	}
+	if len(redeemed) == 0 {
+		return fmt.Errorf("no codes for %q at %s", *campaign, *confTag)
+	}
+	return handlers.WriteCampaignCSV(os.Stdout, redeemed)
+}
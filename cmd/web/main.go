@@ -38,7 +38,9 @@ func loadConfig() *types.EnvConfig {
 		config.Prod = true
 
 		config.Host = os.Getenv("HOST")
+		config.ClientIPHeader = os.Getenv("CLIENT_IP_HEADER")
 		config.MailerSecret = os.Getenv("MAILER_SECRET")
+		config.MailerEndpoint = os.Getenv("MAILER_ENDPOINT")
 		config.MailOff = false
 
 		mailSec, err := strconv.ParseInt(os.Getenv("MAILER_JOB_SEC"), 10, 32)
@@ -51,9 +53,31 @@ func loadConfig() *types.EnvConfig {
 		config.OpenNode.Key = os.Getenv("OPENNODE_KEY")
 		config.OpenNode.Endpoint = os.Getenv("OPENNODE_ENDPOINT")
 
+		config.BTCPay = types.BTCPayConfig{
+			Host:          os.Getenv("BTCPAY_HOST"),
+			StoreID:       os.Getenv("BTCPAY_STORE"),
+			APIKey:        os.Getenv("BTCPAY_KEY"),
+			WebhookSecret: os.Getenv("BTCPAY_WEBHOOK_SECRET"),
+		}
+
+		config.Payments = types.PaymentsConfig{
+			BTC:  os.Getenv("PAYMENTS_BTC"),
+			Fiat: os.Getenv("PAYMENTS_FIAT"),
+		}
+
+		/* Optional, off unless RECONCILE_JOB_SEC is set */
+		reconcileSec, _ := strconv.Atoi(os.Getenv("RECONCILE_JOB_SEC"))
+		reconcileHours, _ := strconv.Atoi(os.Getenv("RECONCILE_HOURS"))
+		config.Reconcile = types.ReconcileConfig{
+			JobSec:        reconcileSec,
+			LookbackHours: reconcileHours,
+			Repair:        os.Getenv("RECONCILE_REPAIR") == "true",
+		}
+
 		config.StripeKey = os.Getenv("STRIPE_KEY")
 		config.StripeEndpointSec = os.Getenv("STRIPE_END_SECRET")
-		config.RegistryPin = os.Getenv("REGISTRY_PIN")
+		config.Store = os.Getenv("STORE")
+		config.SQLite = types.SQLiteConfig{Path: os.Getenv("SQLITE_PATH")}
 		config.Notion = types.NotionConfig{
 			Token:       os.Getenv("NOTION_TOKEN"),
 			PurchasesDb: os.Getenv("NOTION_PURCHASES_DB"),
@@ -62,6 +86,11 @@ func loadConfig() *types.EnvConfig {
 			ConfsDb:     os.Getenv("NOTION_CONFS_DB"),
 			ConfsTixDb:  os.Getenv("NOTION_CONFSTIX_DB"),
 			DiscountsDb:  os.Getenv("NOTION_DISCOUNT_DB"),
+			OutboxDb:    os.Getenv("NOTION_OUTBOX_DB"),
+			StaffDb:     os.Getenv("NOTION_STAFF_DB"),
+			WebhooksDb:  os.Getenv("NOTION_WEBHOOKS_DB"),
+			HoldsDb:     os.Getenv("NOTION_HOLDS_DB"),
+			WaitlistDb:  os.Getenv("NOTION_WAITLIST_DB"),
 		}
 		config.Google = types.GoogleConfig{Key: os.Getenv("GOOGLE_KEY")}
 
@@ -72,12 +101,25 @@ func loadConfig() *types.EnvConfig {
 	return &config
 }
 
-/* Every XX seconds, try to send new ticket emails. */
+/* Every XX seconds, check paid orders have their tickets */
+func RunReconcile(ctx *config.AppContext) {
+	/* Wait a bit, so server can start up */
+	time.Sleep(30 * time.Second)
+	ctx.Infos.Println("Starting up reconcile job...")
+	for true {
+		handlers.RunReconcile(ctx)
+		time.Sleep(time.Duration(ctx.Env.Reconcile.JobSec) * time.Second)
+	}
+}
+
+/* Every XX seconds, invite whoever's next off the waitlist,
+ * then try to send new ticket emails. */
 func RunNewMails(ctx *config.AppContext) {
 	/* Wait a bit, so server can start up */
 	time.Sleep(4 * time.Second)
 	ctx.Infos.Println("Starting up mailer job...")
 	for true {
+		handlers.CheckWaitlist(ctx)
 		handlers.CheckForNewMails(ctx)
 		time.Sleep(time.Duration(ctx.Env.MailerJob) * time.Second)
 	}
@@ -86,13 +128,34 @@ func RunNewMails(ctx *config.AppContext) {
 func main() {
 	/* Load configs from config.toml */
 	app.Env = loadConfig()
+
+	/* Not a server, just running a command */
+	if len(os.Args) > 1 && os.Args[1] == "staff" {
+		if err := runStaffCmd(app.Env, os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "discounts" {
+		if err := runDiscountsCmd(app.Env, os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "reconcile" {
+		if err := runReconcileCmd(app.Env, os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	err := run(app.Env)
 	if err != nil {
 		log.Fatal(err)
 	}
 
 	/* Load up conference info */
-	app.Confs, err = getters.ListConferences(app.Notion)
+	app.Confs, err = getters.ListConferences(app.Store)
 	if err != nil {
 		app.Err.Fatal(err)
 	}
@@ -113,6 +176,11 @@ func main() {
 		go RunNewMails(&app)
 	}
 
+	/* Kick off job to check payments made it into purchases */
+	if app.Env.Reconcile.JobSec > 0 {
+		go RunReconcile(&app)
+	}
+
 	/* Start the server */
 	app.Infos.Printf("Starting application on port %s\n", app.Env.Port)
 	app.Infos.Printf("... Current domain is %s\n", app.Env.GetDomain())
@@ -143,7 +211,7 @@ func run(env *types.EnvConfig) error {
 	// Initialize the application configuration
 	app.InProduction = env.Prod
 
-	app.Infos.Println("\n\n\n")
+	app.Infos.Print("\n\n\n")
 	app.Infos.Println("~~~~app restarted, here we go~~~~~")
 	app.Infos.Println("Running in prod?", env.Prod)
 
@@ -154,8 +222,11 @@ func run(env *types.EnvConfig) error {
 	app.Session.Cookie.SameSite = http.SameSiteLaxMode
 	app.Session.Cookie.Secure = app.InProduction
 
-	app.Notion = &types.Notion{Config: &env.Notion}
-	app.Notion.Setup(env.Notion.Token)
+	app.Store, err = getters.NewStore(env)
+	if err != nil {
+		return err
+	}
+	app.Payments = getters.NewPayments(env)
 
 	return nil
 }
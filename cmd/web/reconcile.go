@@ -0,0 +1,41 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/base58btc/btcpp-web/external/getters"
+	"github.com/base58btc/btcpp-web/internal/handlers"
+	"github.com/base58btc/btcpp-web/internal/types"
+)
+
+/* Checks paid orders against the purchases, on demand.
+ *
+ *   btcpp-web reconcile -since 168h
+ *   btcpp-web reconcile -repair
+ *
+ * Without -repair it only reports. */
+func runReconcileCmd(env *types.EnvConfig, args []string) error {
+	cmd := flag.NewFlagSet("reconcile", flag.ExitOnError)
+	since := cmd.Duration("since", 72*time.Hour, "how far back to look")
+	repair := cmd.Bool("repair", false, "add any missing tickets")
+	cmd.Parse(args)
+
+	if err := run(env); err != nil {
+		return err
+	}
+
+	var err error
+	app.Confs, err = getters.ListConferences(app.Store)
+	if err != nil {
+		return err
+	}
+
+	report, err := handlers.Reconcile(&app, time.Now().Add(-*since), *repair)
+	if err != nil {
+		return err
+	}
+	fmt.Print(report)
+	return nil
+}
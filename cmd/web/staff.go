@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/base58btc/btcpp-web/external/getters"
+	"github.com/base58btc/btcpp-web/internal/types"
+)
+
+/* Staff accounts from the command line; mostly for making
+ * the first admin, everyone else can be added at /staff.
+ *
+ *   btcpp-web staff add -login nifty -role admin
+ *   btcpp-web staff add -login sam -role door -conf atx25,berlin25
+ *   btcpp-web staff revoke -login sam
+ *   btcpp-web staff list
+ *
+ * Secrets are read from stdin, so they stay out of your
+ * shell history. */
+func runStaffCmd(env *types.EnvConfig, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: staff add|revoke|list")
+	}
+
+	store, err := getters.NewStore(env)
+	if err != nil {
+		return err
+	}
+
+	cmd := flag.NewFlagSet("staff "+args[0], flag.ExitOnError)
+	login := cmd.String("login", "", "what they log in with")
+	name := cmd.String("name", "", "their name")
+	role := cmd.String("role", string(types.RoleDoor), "door, organizer or admin")
+	confTags := cmd.String("conf", "", "comma separated conf tags (not needed for admins)")
+	cmd.Parse(args[1:])
+
+	switch args[0] {
+	case "add":
+		staffRole, ok := types.ParseStaffRole(*role)
+		if !ok {
+			return fmt.Errorf("unknown role %q", *role)
+		}
+
+		confRefs, err := confTagsToRefs(store, *confTags)
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(os.Stderr, "Secret for %s: ", *login)
+		secret, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil {
+			return err
+		}
+
+		staff, err := getters.NewStaff(store, *login, *name, strings.TrimSpace(secret), staffRole, confRefs)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Added %s staff %s\n", staff.Role, staff.Login)
+	case "revoke":
+		staff, err := getters.FindStaff(store, *login)
+		if err != nil {
+			return err
+		}
+		if staff == nil {
+			return fmt.Errorf("no staff with login %q", *login)
+		}
+		if err = getters.RevokeStaff(store, staff); err != nil {
+			return err
+		}
+		fmt.Printf("Revoked %s\n", staff.Login)
+	case "list":
+		staff, err := store.ListStaff()
+		if err != nil {
+			return err
+		}
+		for _, st := range staff {
+			revoked := ""
+			if st.Revoked {
+				revoked = " (revoked)"
+			}
+			fmt.Printf("%s\t%s\t%s\t%s%s\n", st.Login, st.Name, st.Role, strings.Join(st.ConfRefs, ","), revoked)
+		}
+	default:
+		return fmt.Errorf("unknown staff command %q", args[0])
+	}
+
+	return nil
+}
+
+func confTagsToRefs(store types.Store, tags string) ([]string, error) {
+	if tags == "" {
+		return nil, nil
+	}
+
+	confs, err := store.ListConfs()
+	if err != nil {
+		return nil, err
+	}
+
+	var refs []string
+	for _, tag := range strings.Split(tags, ",") {
+		var found bool
+		for _, conf := range confs {
+			if conf.Tag == strings.TrimSpace(tag) {
+				refs = append(refs, conf.Ref)
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("no conf with tag %q", tag)
+		}
+	}
+	return refs, nil
+}
@@ -0,0 +1,307 @@
+package getters
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/base58btc/btcpp-web/internal/types"
+)
+
+/* BTCPayProvider takes payments into our own BTCPay Server,
+ * over the Greenfield API */
+type BTCPayProvider struct {
+	Host          string
+	StoreID       string
+	APIKey        string
+	WebhookSecret string
+}
+
+func NewBTCPayProvider(conf types.BTCPayConfig) *BTCPayProvider {
+	return &BTCPayProvider{
+		Host:          strings.TrimSuffix(conf.Host, "/"),
+		StoreID:       conf.StoreID,
+		APIKey:        conf.APIKey,
+		WebhookSecret: conf.WebhookSecret,
+	}
+}
+
+func (p *BTCPayProvider) Name() string {
+	return "btcpay"
+}
+
+func (p *BTCPayProvider) NeedsEmail() bool {
+	return true
+}
+
+func (p *BTCPayProvider) do(method, path string, body interface{}, out interface{}) error {
+	var payload []byte
+	if body != nil {
+		var err error
+		payload, err = json.Marshal(body)
+		if err != nil {
+			return err
+		}
+	}
+
+	url := fmt.Sprintf("%s/api/v1/stores/%s%s", p.Host, p.StoreID, path)
+	req, err := http.NewRequest(method, url, bytes.NewBuffer(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Authorization", "token "+p.APIKey)
+	req.Header.Add("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("error returned from btcpay %d: %s", resp.StatusCode, respBody)
+	}
+
+	return json.Unmarshal(respBody, out)
+}
+
+func btcpayAmount(cents int64) string {
+	return strconv.FormatFloat(float64(cents)/100, 'f', 2, 64)
+}
+
+func (p *BTCPayProvider) CreateCheckout(order *types.Order) (*types.Checkout, error) {
+	if len(order.Items) == 0 {
+		return nil, fmt.Errorf("nothing to check out")
+	}
+	item := order.Items[0]
+
+	invReq := &types.BTCPayInvoiceRequest{
+		Amount:   btcpayAmount(order.Total()),
+		Currency: order.Currency,
+		Metadata: &types.BTCPayMetadata{
+			BuyerEmail: order.Email,
+			ItemDesc:   item.Desc,
+			OpenNodeMetadata: types.OpenNodeMetadata{
+				Email:       order.Email,
+				Quantity:    float64(len(order.Items)),
+				ConfRef:     order.ConfRef,
+				TixLocal:    item.Type == "local",
+				DiscountRef: order.DiscountRef,
+				Currency:    order.Currency,
+				TixID:       item.TixID,
+				Cart:        order.Cart(),
+			},
+		},
+		Checkout: &types.BTCPayCheckoutOptions{
+			RedirectURL:           order.SuccessURL,
+			RedirectAutomatically: true,
+			ExpirationMinutes:     60,
+		},
+	}
+
+	if !order.Expires.IsZero() {
+		invReq.Checkout.ExpirationMinutes = int(time.Until(order.Expires).Minutes())
+	}
+
+	var invoice types.BTCPayInvoice
+	if err := p.do("POST", "/invoices", invReq, &invoice); err != nil {
+		return nil, err
+	}
+
+	return &types.Checkout{
+		OrderID:   invoice.ID,
+		URL:       invoice.CheckoutLink,
+		ExpiresAt: time.Unix(invoice.ExpirationTime, 0),
+	}, nil
+}
+
+/* BTCPay signs the body with the webhook's secret:
+ * BTCPay-Sig: sha256=HMAC_SHA256(secret, body) */
+func (p *BTCPayProvider) VerifyWebhook(r *http.Request) (*types.PaymentEvent, error) {
+	const MaxBodyBytes = int64(65536)
+	payload, err := ioutil.ReadAll(io.LimitReader(r.Body, MaxBodyBytes))
+	if err != nil {
+		return nil, err
+	}
+
+	mac := hmac.New(sha256.New, []byte(p.WebhookSecret))
+	mac.Write(payload)
+	expected := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	if p.WebhookSecret == "" || !hmac.Equal([]byte(expected), []byte(r.Header.Get("BTCPay-Sig"))) {
+		return nil, fmt.Errorf("invalid BTCPay-Sig")
+	}
+
+	var ev types.BTCPayEvent
+	if err = json.Unmarshal(payload, &ev); err != nil {
+		return nil, err
+	}
+	if ev.StoreID != "" && ev.StoreID != p.StoreID {
+		return nil, fmt.Errorf("event for another store %s", ev.StoreID)
+	}
+
+	/* Redeliveries are the same event */
+	id := ev.DeliveryID
+	if ev.OriginalDeliveryID != "" {
+		id = ev.OriginalDeliveryID
+	}
+
+	event := &types.PaymentEvent{
+		ID:      id,
+		Type:    ev.Type,
+		OrderID: ev.InvoiceID,
+		Status:  types.OrderPending,
+	}
+	switch ev.Type {
+	case "InvoiceSettled":
+		event.Status = types.OrderPaid
+	case "InvoiceExpired", "InvoiceInvalid":
+		event.Status = types.OrderExpired
+	}
+	return event, nil
+}
+
+func btcpayStatus(status string) types.OrderStatus {
+	switch status {
+	case "Settled":
+		return types.OrderPaid
+	case "Expired", "Invalid":
+		return types.OrderExpired
+	}
+	return types.OrderPending
+}
+
+func (p *BTCPayProvider) FetchCharge(orderID string) (*types.Order, error) {
+	var invoice types.BTCPayInvoice
+	if err := p.do("GET", "/invoices/"+orderID, nil, &invoice); err != nil {
+		return nil, err
+	}
+	if invoice.Metadata == nil {
+		return nil, fmt.Errorf("btcpay invoice %s has no metadata", orderID)
+	}
+	return invoiceOrder(p.Name(), &invoice)
+}
+
+func (p *BTCPayProvider) ListPaidOrders(since time.Time) ([]*types.Order, error) {
+	var invoices []*types.BTCPayInvoice
+	path := fmt.Sprintf("/invoices?status=Settled&startDate=%d", since.Unix())
+	if err := p.do("GET", path, nil, &invoices); err != nil {
+		return nil, err
+	}
+
+	var orders []*types.Order
+	for _, invoice := range invoices {
+		/* Not one of ours */
+		if invoice.Metadata == nil {
+			continue
+		}
+		order, err := invoiceOrder(p.Name(), invoice)
+		if err != nil {
+			return nil, err
+		}
+		if order.Status == types.OrderPaid {
+			orders = append(orders, order)
+		}
+	}
+	return orders, nil
+}
+
+func invoiceOrder(provider string, invoice *types.BTCPayInvoice) (*types.Order, error) {
+	meta := invoice.Metadata
+
+	order := &types.Order{
+		ID:          invoice.ID,
+		Provider:    provider,
+		Status:      btcpayStatus(invoice.Status),
+		ConfRef:     meta.ConfRef,
+		Email:       meta.Email,
+		Currency:    meta.Currency,
+		DiscountRef: meta.DiscountRef,
+		Created:     time.Unix(invoice.CreatedTime, 0).UTC(),
+	}
+
+	if meta.Cart != "" {
+		items, err := types.ParseCart(meta.Cart, meta.ItemDesc)
+		if err != nil {
+			return nil, fmt.Errorf("btcpay invoice %s: %s", invoice.ID, err)
+		}
+		order.Items = items
+		return order, nil
+	}
+
+	tixType := "genpop"
+	if meta.TixLocal {
+		tixType = "local"
+	}
+	count := int(meta.Quantity)
+	if count < 1 {
+		return order, nil
+	}
+	amount, err := strconv.ParseFloat(invoice.Amount, 64)
+	if err != nil {
+		return nil, fmt.Errorf("btcpay invoice %s amount %q: %s", invoice.ID, invoice.Amount, err)
+	}
+	total := int64(math.Round(amount * 100))
+	for i := 0; i < count; i++ {
+		each := total / int64(count)
+		if i == 0 {
+			each += total % int64(count)
+		}
+		order.Items = append(order.Items, types.Item{
+			Total: each,
+			Desc:  meta.ItemDesc,
+			Type:  tixType,
+			TixID: meta.TixID,
+		})
+	}
+
+	return order, nil
+}
+
+/* How the invoice was actually paid, on-chain or lightning */
+func (p *BTCPayProvider) paidMethod(invoiceID string) (string, error) {
+	var methods []*types.BTCPayPaymentMethod
+	if err := p.do("GET", "/invoices/"+invoiceID+"/payment-methods", nil, &methods); err != nil {
+		return "", err
+	}
+	for _, method := range methods {
+		if len(method.Payments) > 0 {
+			return method.PaymentMethod, nil
+		}
+	}
+	return "", fmt.Errorf("btcpay invoice %s has no payments to refund", invoiceID)
+}
+
+/* Makes a pull payment the buyer claims to their own wallet */
+func (p *BTCPayProvider) Refund(order *types.Order, amount int64) (*types.Refund, error) {
+	method, err := p.paidMethod(order.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	refReq := &types.BTCPayRefundRequest{PaymentMethod: method, RefundVariant: "Fiat"}
+	if amount > 0 {
+		refReq.RefundVariant = "Custom"
+		refReq.CustomAmount = btcpayAmount(amount)
+		refReq.CustomCurrency = order.Currency
+	}
+
+	var pull types.BTCPayPullPayment
+	if err := p.do("POST", "/invoices/"+order.ID+"/refund", refReq, &pull); err != nil {
+		return nil, err
+	}
+	return &types.Refund{ID: pull.ID, Link: pull.ViewLink}, nil
+}
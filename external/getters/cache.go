@@ -0,0 +1,389 @@
+package getters
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/base58btc/btcpp-web/internal/types"
+)
+
+const (
+	cacheConfs     = "confs"
+	cacheConfTix   = "conftix"
+	cacheSpeakers  = "speakers"
+	cacheTalks     = "talks:"
+	cacheDiscounts = "discounts"
+	cacheRegis     = "registrations"
+	cacheSold      = "sold:"
+	cacheStaff     = "staff"
+	cacheHolds     = "holds"
+)
+
+/* Defaults for when the config doesn't say */
+var defaultCacheTTLs = types.CacheConfig{
+	ConfsSec:     600,
+	TalksSec:     300,
+	SpeakersSec:  300,
+	DiscountsSec: 60,
+	PurchasesSec: 30,
+	StaffSec:     60,
+}
+
+type cacheEntry struct {
+	val     interface{}
+	fetched time.Time
+}
+
+/* One fetch in progress; everyone else asking waits on it */
+type cacheFlight struct {
+	wg  sync.WaitGroup
+	val interface{}
+	err error
+}
+
+/* CachedStore is a read-through cache in front of another
+ * store. Each entity gets its own TTL, and concurrent misses
+ * for the same thing share a single fetch.
+ *
+ * Anything handed back is shared; don't modify it! */
+type CachedStore struct {
+	store types.Store
+	ttls  types.CacheConfig
+
+	mu      sync.Mutex
+	entries map[string]*cacheEntry
+	flights map[string]*cacheFlight
+	/* Bumped on invalidation, so fetches that started before
+	 * an invalidate don't write stale data back */
+	gens map[string]uint64
+}
+
+func NewCachedStore(store types.Store, ttls types.CacheConfig) *CachedStore {
+	if ttls.ConfsSec == 0 {
+		ttls.ConfsSec = defaultCacheTTLs.ConfsSec
+	}
+	if ttls.TalksSec == 0 {
+		ttls.TalksSec = defaultCacheTTLs.TalksSec
+	}
+	if ttls.SpeakersSec == 0 {
+		ttls.SpeakersSec = defaultCacheTTLs.SpeakersSec
+	}
+	if ttls.DiscountsSec == 0 {
+		ttls.DiscountsSec = defaultCacheTTLs.DiscountsSec
+	}
+	if ttls.PurchasesSec == 0 {
+		ttls.PurchasesSec = defaultCacheTTLs.PurchasesSec
+	}
+	if ttls.StaffSec == 0 {
+		ttls.StaffSec = defaultCacheTTLs.StaffSec
+	}
+
+	return &CachedStore{
+		store:   store,
+		ttls:    ttls,
+		entries: make(map[string]*cacheEntry),
+		flights: make(map[string]*cacheFlight),
+		gens:    make(map[string]uint64),
+	}
+}
+
+func secs(s int) time.Duration {
+	return time.Duration(s) * time.Second
+}
+
+func (c *CachedStore) get(key string, ttl time.Duration, fetch func() (interface{}, error)) (interface{}, error) {
+	c.mu.Lock()
+	if entry, ok := c.entries[key]; ok && time.Since(entry.fetched) < ttl {
+		c.mu.Unlock()
+		return entry.val, nil
+	}
+
+	if flight, ok := c.flights[key]; ok {
+		c.mu.Unlock()
+		flight.wg.Wait()
+		return flight.val, flight.err
+	}
+
+	flight := &cacheFlight{}
+	flight.wg.Add(1)
+	c.flights[key] = flight
+	gen := c.gens[key]
+	c.mu.Unlock()
+
+	flight.val, flight.err = fetch()
+
+	c.mu.Lock()
+	if c.flights[key] == flight {
+		delete(c.flights, key)
+	}
+	/* Errors don't get cached, we'll try again next time */
+	if flight.err == nil && c.gens[key] == gen {
+		c.entries[key] = &cacheEntry{val: flight.val, fetched: time.Now()}
+	}
+	c.mu.Unlock()
+	flight.wg.Done()
+
+	return flight.val, flight.err
+}
+
+func (c *CachedStore) invalidate(match func(key string) bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key := range c.entries {
+		if match(key) {
+			delete(c.entries, key)
+		}
+	}
+	/* Anyone asking from now on starts a fresh fetch */
+	for key := range c.flights {
+		if match(key) {
+			c.gens[key]++
+			delete(c.flights, key)
+		}
+	}
+}
+
+/* New purchases change the sold counts + registrations */
+func (c *CachedStore) InvalidatePurchases() {
+	c.invalidate(func(key string) bool {
+		return key == cacheRegis || strings.HasPrefix(key, cacheSold)
+	})
+}
+
+func (c *CachedStore) InvalidateAll() {
+	c.invalidate(func(string) bool { return true })
+}
+
+/* Drop everything cached, if the store is caching */
+func InvalidateCache(s types.Store) {
+	if c, ok := s.(*CachedStore); ok {
+		c.InvalidateAll()
+	}
+}
+
+/* Same, for just the purchases */
+func InvalidatePurchases(s types.Store) {
+	if c, ok := s.(*CachedStore); ok {
+		c.InvalidatePurchases()
+	}
+}
+
+func (c *CachedStore) ListConfs() ([]*types.Conf, error) {
+	val, err := c.get(cacheConfs, secs(c.ttls.ConfsSec), func() (interface{}, error) {
+		return c.store.ListConfs()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return val.([]*types.Conf), nil
+}
+
+func (c *CachedStore) ListConfTickets() ([]*types.ConfTicket, error) {
+	val, err := c.get(cacheConfTix, secs(c.ttls.ConfsSec), func() (interface{}, error) {
+		return c.store.ListConfTickets()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return val.([]*types.ConfTicket), nil
+}
+
+func (c *CachedStore) ListSpeakers() ([]*types.Speaker, error) {
+	val, err := c.get(cacheSpeakers, secs(c.ttls.SpeakersSec), func() (interface{}, error) {
+		return c.store.ListSpeakers()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return val.([]*types.Speaker), nil
+}
+
+/* Talks link up to whichever speakers we're handed, so
+ * each set of speakers gets its own entry */
+func talksKey(speakers []*types.Speaker) string {
+	if speakers == nil {
+		return cacheTalks
+	}
+
+	ids := make([]string, 0, len(speakers))
+	for _, speaker := range speakers {
+		ids = append(ids, speaker.ID)
+	}
+	sort.Strings(ids)
+	sum := sha256.Sum256([]byte(strings.Join(ids, "\n")))
+	return cacheTalks + hex.EncodeToString(sum[:8])
+}
+
+func (c *CachedStore) ListTalks(speakers []*types.Speaker) ([]*types.Talk, error) {
+	key := talksKey(speakers)
+	val, err := c.get(key, secs(c.ttls.TalksSec), func() (interface{}, error) {
+		return c.store.ListTalks(speakers)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return val.([]*types.Talk), nil
+}
+
+func (c *CachedStore) ListDiscounts() ([]*types.DiscountCode, error) {
+	val, err := c.get(cacheDiscounts, secs(c.ttls.DiscountsSec), func() (interface{}, error) {
+		return c.store.ListDiscounts()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return val.([]*types.DiscountCode), nil
+}
+
+func (c *CachedStore) AddDiscount(discount *types.DiscountCode) error {
+	defer c.invalidate(func(key string) bool { return key == cacheDiscounts })
+	return c.store.AddDiscount(discount)
+}
+
+func (c *CachedStore) ListRegistrations() ([]*types.Registration, error) {
+	val, err := c.get(cacheRegis, secs(c.ttls.PurchasesSec), func() (interface{}, error) {
+		return c.store.ListRegistrations()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return val.([]*types.Registration), nil
+}
+
+func (c *CachedStore) SoldTixCount(confRef string) (uint, error) {
+	val, err := c.get(cacheSold+confRef, secs(c.ttls.PurchasesSec), func() (interface{}, error) {
+		return c.store.SoldTixCount(confRef)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return val.(uint), nil
+}
+
+func (c *CachedStore) AddTickets(entry *types.Entry, src string) error {
+	/* Even a partial failure may have added some */
+	defer c.InvalidatePurchases()
+	return c.store.AddTickets(entry, src)
+}
+
+func (c *CachedStore) CheckIn(ticket string, at time.Time, by string) (string, bool, error) {
+	/* Never cached, the door needs the real answer */
+	defer c.invalidate(func(key string) bool { return key == cacheRegis })
+	return c.store.CheckIn(ticket, at, by)
+}
+
+func (c *CachedStore) VoidTicket(ticket string, at time.Time, by string, refundRef string) error {
+	/* Frees up a seat, so the sold counts go too */
+	defer c.InvalidatePurchases()
+	return c.store.VoidTicket(ticket, at, by, refundRef)
+}
+
+func (c *CachedStore) UpdateAttendee(ticket string, attendee *types.Attendee) error {
+	defer c.invalidate(func(key string) bool { return key == cacheRegis })
+	return c.store.UpdateAttendee(ticket, attendee)
+}
+
+func (c *CachedStore) TransferTicket(xfer *types.Transfer, to *types.Attendee) error {
+	defer c.InvalidatePurchases()
+	return c.store.TransferTicket(xfer, to)
+}
+
+/* The mailer wants the outbox as it is, no caching */
+func (c *CachedStore) ListOutbox() ([]*types.OutboxMail, error) {
+	return c.store.ListOutbox()
+}
+
+func (c *CachedStore) AddOutbox(mail *types.OutboxMail) error {
+	return c.store.AddOutbox(mail)
+}
+
+func (c *CachedStore) UpdateOutbox(mail *types.OutboxMail) error {
+	return c.store.UpdateOutbox(mail)
+}
+
+func (c *CachedStore) ListStaff() ([]*types.Staff, error) {
+	val, err := c.get(cacheStaff, secs(c.ttls.StaffSec), func() (interface{}, error) {
+		return c.store.ListStaff()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return val.([]*types.Staff), nil
+}
+
+func (c *CachedStore) invalidateStaff() {
+	c.invalidate(func(key string) bool { return key == cacheStaff })
+}
+
+/* Revoking someone should take right away */
+func (c *CachedStore) AddStaff(staff *types.Staff) error {
+	defer c.invalidateStaff()
+	return c.store.AddStaff(staff)
+}
+
+func (c *CachedStore) UpdateStaff(staff *types.Staff) error {
+	defer c.invalidateStaff()
+	return c.store.UpdateStaff(staff)
+}
+
+/* Cached like the purchases; ours are invalidated
+ * as soon as we change one */
+func (c *CachedStore) ListHolds() ([]*types.Hold, error) {
+	val, err := c.get(cacheHolds, secs(c.ttls.PurchasesSec), func() (interface{}, error) {
+		return c.store.ListHolds()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return val.([]*types.Hold), nil
+}
+
+func (c *CachedStore) invalidateHolds() {
+	c.invalidate(func(key string) bool { return key == cacheHolds })
+}
+
+func (c *CachedStore) AddHold(hold *types.Hold) error {
+	defer c.invalidateHolds()
+	return c.store.AddHold(hold)
+}
+
+func (c *CachedStore) UpdateHold(hold *types.Hold) error {
+	defer c.invalidateHolds()
+	return c.store.UpdateHold(hold)
+}
+
+/* Only read when it's about to change, no caching */
+func (c *CachedStore) ListWaitlist() ([]*types.WaitlistEntry, error) {
+	return c.store.ListWaitlist()
+}
+
+func (c *CachedStore) AddWaitlist(entry *types.WaitlistEntry) error {
+	return c.store.AddWaitlist(entry)
+}
+
+func (c *CachedStore) UpdateWaitlist(entry *types.WaitlistEntry) error {
+	return c.store.UpdateWaitlist(entry)
+}
+
+/* The admin log wants the latest too */
+func (c *CachedStore) ListWebhookEvents() ([]*types.WebhookEvent, error) {
+	return c.store.ListWebhookEvents()
+}
+
+/* Dedup needs to see the latest, no caching */
+func (c *CachedStore) FindWebhookEvent(key string) (*types.WebhookEvent, error) {
+	return c.store.FindWebhookEvent(key)
+}
+
+func (c *CachedStore) AddWebhookEvent(ev *types.WebhookEvent) error {
+	return c.store.AddWebhookEvent(ev)
+}
+
+func (c *CachedStore) UpdateWebhookEvent(ev *types.WebhookEvent) error {
+	return c.store.UpdateWebhookEvent(ev)
+}
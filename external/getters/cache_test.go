@@ -0,0 +1,50 @@
+package getters
+
+import (
+	"testing"
+
+	"github.com/base58btc/btcpp-web/internal/types"
+)
+
+func TestCachedTalksBySpeakers(t *testing.T) {
+	store := newTestSQLite(t)
+	_, err := store.db.Exec(`INSERT INTO speakers (id, name) VALUES ('spk-ada', 'Ada'), ('spk-bob', 'Bob');
+		INSERT INTO talks (id, name, event) VALUES ('talk-1', 'Lightning', 'atx25');
+		INSERT INTO talk_speakers (talk_id, speaker_id) VALUES ('talk-1', 'spk-ada'), ('talk-1', 'spk-bob')`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cached := NewCachedStore(store, types.CacheConfig{})
+
+	ada := &types.Speaker{ID: "spk-ada", Name: "Ada"}
+	bob := &types.Speaker{ID: "spk-bob", Name: "Bob"}
+	tests := []struct {
+		name     string
+		speakers []*types.Speaker
+		want     int
+	}{
+		{"no speakers", nil, 0},
+		{"just ada", []*types.Speaker{ada}, 1},
+		{"both", []*types.Speaker{ada, bob}, 2},
+		{"both, other order", []*types.Speaker{bob, ada}, 2},
+		{"just ada again", []*types.Speaker{ada}, 1},
+	}
+
+	/* Each call has to link up the speakers it was handed,
+	 * whatever's been cached before it */
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			talks, err := cached.ListTalks(tc.speakers)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(talks) != 1 || len(talks[0].Speakers) != tc.want {
+				t.Fatalf("expected a talk with %d speakers, got %+v", tc.want, talks)
+			}
+		})
+	}
+
+	if talksKey([]*types.Speaker{ada, bob}) != talksKey([]*types.Speaker{bob, ada}) {
+		t.Fatalf("expected the same speakers to share an entry")
+	}
+}
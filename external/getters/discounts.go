@@ -0,0 +1,185 @@
+package getters
+
+import (
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/base58btc/btcpp-web/internal/types"
+)
+
+/* No 0/O or 1/I, so codes can be read out loud */
+const discountAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+const (
+	discountCodeLen  = 8
+	maxDiscountBatch = 500
+)
+
+/* What a batch of codes is for */
+type DiscountBatch struct {
+	Campaign   string
+	ConfRef    string
+	Count      int
+	PercentOff uint
+	AmountOff  uint
+	/* Zero is no expiry */
+	ValidUntil time.Time
+	/* Free tickets, issued as TixType; 100% off
+	 * unless it says otherwise */
+	Comp    bool
+	TixType string
+}
+
+/* One code, and the ticket it went on (if it has) */
+type Redemption struct {
+	Code   *types.DiscountCode
+	Ticket *types.Registration
+}
+
+func randomCode(prefix string) (string, error) {
+	code := make([]byte, discountCodeLen)
+	max := big.NewInt(int64(len(discountAlphabet)))
+	for i := range code {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		code[i] = discountAlphabet[n.Int64()]
+	}
+	return prefix + string(code), nil
+}
+
+/* The campaign name, squashed into something to start codes with */
+func campaignPrefix(campaign string) string {
+	var prefix []rune
+	for _, r := range strings.ToUpper(campaign) {
+		if (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			prefix = append(prefix, r)
+		}
+		if len(prefix) == 8 {
+			break
+		}
+	}
+	if len(prefix) == 0 {
+		return ""
+	}
+	return string(prefix) + "-"
+}
+
+/* Makes batch.Count new single use codes, none the same as
+ * any code already in the store */
+func GenerateDiscounts(s types.Store, batch *DiscountBatch) ([]*types.DiscountCode, error) {
+	batch.Campaign = strings.TrimSpace(batch.Campaign)
+	if batch.Comp && batch.PercentOff == 0 && batch.AmountOff == 0 {
+		batch.PercentOff = 100
+	}
+	switch {
+	case batch.Campaign == "":
+		return nil, fmt.Errorf("Codes need a campaign")
+	case batch.ConfRef == "":
+		return nil, fmt.Errorf("Codes need a conf")
+	case batch.Count < 1 || batch.Count > maxDiscountBatch:
+		return nil, fmt.Errorf("Can make 1 to %d codes at a time", maxDiscountBatch)
+	case batch.PercentOff > 100:
+		return nil, fmt.Errorf("Can't take more than 100%% off")
+	case (batch.PercentOff == 0) == (batch.AmountOff == 0):
+		return nil, fmt.Errorf("Codes need a percent or an amount off, not both")
+	}
+
+	existing, err := s.ListDiscounts()
+	if err != nil {
+		return nil, err
+	}
+	taken := make(map[string]bool)
+	for _, discount := range existing {
+		taken[strings.ToUpper(discount.CodeName)] = true
+	}
+
+	prefix := campaignPrefix(batch.Campaign)
+	var codes []*types.DiscountCode
+	for len(codes) < batch.Count {
+		name, err := randomCode(prefix)
+		if err != nil {
+			return codes, err
+		}
+		if taken[name] {
+			continue
+		}
+		taken[name] = true
+
+		discount := &types.DiscountCode{
+			CodeName:   name,
+			PercentOff: batch.PercentOff,
+			AmountOff:  batch.AmountOff,
+			ConfRef:    batch.ConfRef,
+			SingleUse:  true,
+			ValidUntil: batch.ValidUntil,
+			Campaign:   batch.Campaign,
+			Comp:       batch.Comp,
+			TixType:    batch.TixType,
+		}
+		if err = s.AddDiscount(discount); err != nil {
+			return codes, err
+		}
+		codes = append(codes, discount)
+	}
+	return codes, nil
+}
+
+/* The campaigns at a conf, by name */
+func DiscountCampaigns(s types.Store, confRef string) ([]string, error) {
+	discounts, err := s.ListDiscounts()
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	var campaigns []string
+	for _, discount := range discounts {
+		if discount.ConfRef != confRef || discount.Campaign == "" || seen[discount.Campaign] {
+			continue
+		}
+		seen[discount.Campaign] = true
+		campaigns = append(campaigns, discount.Campaign)
+	}
+	sort.Strings(campaigns)
+	return campaigns, nil
+}
+
+/* Every code in the campaign, with the live ticket it's on */
+func CampaignRedemptions(s types.Store, confRef, campaign string) ([]*Redemption, error) {
+	discounts, err := s.ListDiscounts()
+	if err != nil {
+		return nil, err
+	}
+	rezzies, err := s.ListRegistrations()
+	if err != nil {
+		return nil, err
+	}
+
+	used := make(map[string]*types.Registration)
+	for _, rez := range rezzies {
+		if rez.DiscountRef != "" && rez.Voided.IsZero() {
+			used[rez.DiscountRef] = rez
+		}
+	}
+
+	var redeemed []*Redemption
+	for _, discount := range discounts {
+		if discount.ConfRef != confRef || discount.Campaign != campaign {
+			continue
+		}
+		redeemed = append(redeemed, &Redemption{
+			Code:   discount,
+			Ticket: used[discount.Ref],
+		})
+	}
+	sort.Slice(redeemed, func(i, j int) bool {
+		return redeemed[i].Code.CodeName < redeemed[j].Code.CodeName
+	})
+	return redeemed, nil
+}
@@ -0,0 +1,51 @@
+package getters
+
+import (
+	"time"
+
+	"github.com/base58btc/btcpp-web/internal/types"
+)
+
+/* Tickets held for checkouts that are still open at time now */
+func HeldTixCount(s types.Store, confRef string, now time.Time) (uint, error) {
+	holds, err := s.ListHolds()
+	if err != nil {
+		return 0, err
+	}
+
+	var held uint
+	for _, hold := range holds {
+		if hold.ConfRef == confRef && hold.Active(now) {
+			held += hold.Count
+		}
+	}
+	return held, nil
+}
+
+func FindHold(s types.Store, provider, orderID string) (*types.Hold, error) {
+	holds, err := s.ListHolds()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, hold := range holds {
+		if hold.Provider == provider && hold.OrderID == orderID {
+			return hold, nil
+		}
+	}
+	return nil, nil
+}
+
+func FindHoldByRef(s types.Store, ref string) (*types.Hold, error) {
+	holds, err := s.ListHolds()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, hold := range holds {
+		if hold.Ref == ref {
+			return hold, nil
+		}
+	}
+	return nil, nil
+}
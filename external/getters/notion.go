@@ -2,17 +2,24 @@ package getters
 
 import (
 	"context"
-	"crypto/sha256"
-	"encoding/binary"
-	"encoding/hex"
 	"fmt"
-	"github.com/base58btc/btcpp-web/internal/config"
 	"github.com/base58btc/btcpp-web/internal/types"
 	"github.com/sorcererxw/go-notion"
+	"math"
 	"strings"
 	"time"
 )
 
+/* NotionStore keeps everything in the Notion databases
+ * listed in NotionConfig */
+type NotionStore struct {
+	n *types.Notion
+}
+
+func NewNotionStore(n *types.Notion) *NotionStore {
+	return &NotionStore{n: n}
+}
+
 func parseRichText(key string, props map[string]notion.PropertyValue) string {
 	val, ok := props[key]
 	if !ok {
@@ -45,23 +52,76 @@ func parseDiscount(pageID string, props map[string]notion.PropertyValue) *types.
 		Ref:            pageID,
 		CodeName:	parseRichText("CodeName", props),
 		PercentOff:     uint(props["PercentOff"].Number),
+		AmountOff:      uint(props["AmountOff"].Number),
+		MaxUses:        uint(props["MaxUses"].Number),
+		SingleUse:      props["Single Use"].Checkbox,
+		TixID:          parseRelation("tier", props),
+		Currency:       parseRichText("Currency", props),
+		LocalOnly:      props["Local Only"].Checkbox,
+		Campaign:       parseSelect("Campaign", props),
+		Comp:           props["Comp"].Checkbox,
+		TixType:        parseSelect("Ticket Type", props),
 	}
 
 	if len(props["Conference"].Relation) > 0 {
 		discount.ConfRef = props["Conference"].Relation[0].ID
 	}
 
+	if props["Valid From"].Date != nil {
+		discount.ValidFrom = props["Valid From"].Date.Start
+	}
+	if props["Valid Until"].Date != nil {
+		discount.ValidUntil = props["Valid Until"].Date.Start
+	}
+
 	return discount
 }
 
-func parseSpeaker(pageID string, props map[string]notion.PropertyValue) *types.Speaker {
-	var twitter string
-	parseTwitter := parseRichText("Twitter", props)
-	if strings.Contains(parseTwitter, "http") {
-		twitter = parseTwitter
-	} else if parseTwitter != "" {
-		twitter = fmt.Sprintf("https://twitter.com/%s", parseTwitter)
+func discountVals(discount *types.DiscountCode) map[string]*notion.PropertyValue {
+	vals := map[string]*notion.PropertyValue{
+		"CodeName":   newTitle(discount.CodeName),
+		"PercentOff": notion.NewNumberPropertyValue(float64(discount.PercentOff)),
+		"AmountOff":  notion.NewNumberPropertyValue(float64(discount.AmountOff)),
+		"MaxUses":    notion.NewNumberPropertyValue(float64(discount.MaxUses)),
+		"Single Use": notion.NewCheckboxPropertyValue(discount.SingleUse),
+		"Local Only": notion.NewCheckboxPropertyValue(discount.LocalOnly),
+		"Comp":       notion.NewCheckboxPropertyValue(discount.Comp),
+		"Currency":   newRichText(discount.Currency),
+		"Conference": notion.NewRelationPropertyValue(
+			[]*notion.ObjectReference{{ID: discount.ConfRef}}...,
+		),
+	}
+	if discount.Campaign != "" {
+		vals["Campaign"] = newSelect(discount.Campaign)
+	}
+	if discount.TixType != "" {
+		vals["Ticket Type"] = newSelect(discount.TixType)
+	}
+	if discount.TixID != "" {
+		vals["tier"] = notion.NewRelationPropertyValue(
+			[]*notion.ObjectReference{{ID: discount.TixID}}...,
+		)
+	}
+	if !discount.ValidFrom.IsZero() {
+		vals["Valid From"] = notion.NewDatePropertyValue(&notion.Date{Start: discount.ValidFrom})
+	}
+	if !discount.ValidUntil.IsZero() {
+		vals["Valid Until"] = notion.NewDatePropertyValue(&notion.Date{Start: discount.ValidUntil})
 	}
+	return vals
+}
+
+func twitterURL(handle string) string {
+	if strings.Contains(handle, "http") {
+		return handle
+	} else if handle != "" {
+		return fmt.Sprintf("https://twitter.com/%s", handle)
+	}
+	return ""
+}
+
+func parseSpeaker(pageID string, props map[string]notion.PropertyValue) *types.Speaker {
+	twitter := twitterURL(parseRichText("Twitter", props))
 
 	speaker := &types.Speaker{
 		ID:          pageID,
@@ -108,10 +168,6 @@ func parseTalk(pageID string, props map[string]notion.PropertyValue, speakers []
 		}
 	}
 
-	if len(talk.Clipart) > 4 {
-		talk.AnchorTag = talk.Clipart[:len(talk.Clipart)-4]
-	}
-
 	if props["Venue"].Select != nil {
 		talk.Venue = props["Venue"].Select.Name
 	}
@@ -120,10 +176,6 @@ func parseTalk(pageID string, props map[string]notion.PropertyValue, speakers []
 		talk.Event = props["Event"].Select.Name
 	}
 
-	if sched != nil {
-		talk.TimeDesc = sched.Desc()
-		talk.DayTag = sched.Day()
-	}
 	if props["Talk Type"].Select != nil {
 		talk.Type = props["Talk Type"].Select.Name
 	}
@@ -132,6 +184,7 @@ func parseTalk(pageID string, props map[string]notion.PropertyValue, speakers []
 		talk.Section = props["Section"].Select.Name
 	}
 
+	finishTalk(talk)
 	return talk
 }
 
@@ -180,7 +233,8 @@ func parseConfTicket(pageID string, props map[string]notion.PropertyValue) *type
 	return ticket
 }
 
-func ListConfTickets(n *types.Notion) ([]*types.ConfTicket, error) {
+func (s *NotionStore) ListConfTickets() ([]*types.ConfTicket, error) {
+	n := s.n
 	var confTix []*types.ConfTicket
 
 	hasMore := true
@@ -206,10 +260,10 @@ func ListConfTickets(n *types.Notion) ([]*types.ConfTicket, error) {
 	return confTix, nil
 }
 
-/* Grabs the conferences + their tickets buckets */
-func ListConferences(n *types.Notion) ([]*types.Conf, error) {
+func (s *NotionStore) ListConfs() ([]*types.Conf, error) {
 	var confs []*types.Conf
 
+	n := s.n
 	hasMore := true
 	nextCursor := ""
 	for hasMore {
@@ -230,27 +284,13 @@ func ListConferences(n *types.Notion) ([]*types.Conf, error) {
 		}
 	}
 
-	confTix, err := ListConfTickets(n)
-	if err != nil {
-		return nil, err
-	}
-
-	/* Add conf tixs to confs */
-	for _, tix := range confTix {
-		for _, conf := range confs {
-			if conf.Ref == tix.ConfRef {
-				conf.Tickets = append(conf.Tickets, tix)
-				break
-			}
-		}
-	}
-
 	return confs, nil
 }
 
-func ListTalks(n *types.Notion, speakers []*types.Speaker) ([]*types.Talk, error) {
+func (s *NotionStore) ListTalks(speakers []*types.Speaker) ([]*types.Talk, error) {
 	var talks []*types.Talk
 
+	n := s.n
 	hasMore := true
 	nextCursor := ""
 	for hasMore {
@@ -274,9 +314,10 @@ func ListTalks(n *types.Notion, speakers []*types.Speaker) ([]*types.Talk, error
 	return talks, nil
 }
 
-func ListSpeakers(n *types.Notion) ([]*types.Speaker, error) {
+func (s *NotionStore) ListSpeakers() ([]*types.Speaker, error) {
 	var speakers []*types.Speaker
 
+	n := s.n
 	hasMore := true
 	nextCursor := ""
 	for hasMore {
@@ -300,23 +341,10 @@ func ListSpeakers(n *types.Notion) ([]*types.Speaker, error) {
 	return speakers, nil
 }
 
-func GetTalksFor(n *types.Notion, event string, speakers []*types.Speaker) ([]*types.Talk, error) {
-	talks, err := ListTalks(n, speakers)
-	if err != nil {
-		return nil, err
-	}
-	var filtered []*types.Talk
-	for _, talk := range talks {
-		if talk.Event == event {
-			filtered = append(filtered, talk)
-		}
-	}
-	return filtered, nil
-}
-
-func ListDiscounts(n *types.Notion) ([]*types.DiscountCode, error) {
+func (s *NotionStore) ListDiscounts() ([]*types.DiscountCode, error) {
 	var discounts []*types.DiscountCode
 
+	n := s.n
 	hasMore := true
 	nextCursor := ""
 	for hasMore {
@@ -340,51 +368,23 @@ func ListDiscounts(n *types.Notion) ([]*types.DiscountCode, error) {
 	return discounts, nil
 }
 
-func FindDiscount(n *types.Notion, code string) (*types.DiscountCode, error) {
-	discounts, err := ListDiscounts(n)
-	if err != nil {
-		return nil, err
-	}
-
-	upcode := strings.ToUpper(code)
-	for _, discount := range discounts {
-		if strings.ToUpper(discount.CodeName) == upcode {
-			return discount, nil
-		}
-	}
-	return nil, nil
-}
-
-func CalcDiscount(n *types.Notion, confRef string, code string, tixPrice uint) (uint, *types.DiscountCode, error) {
-	discount, err := FindDiscount(n, code)
+func (s *NotionStore) AddDiscount(discount *types.DiscountCode) error {
+	n := s.n
+	parent := notion.NewDatabaseParent(n.Config.DiscountsDb)
 
+	page, err := n.Client.CreatePage(context.Background(), parent, discountVals(discount))
 	if err != nil {
-		return tixPrice, nil, err
-	}
-
-	/* Discount not found! */
-	if discount == nil {
-		return tixPrice, nil, fmt.Errorf("Discount code \"%s\" not found", code)
-	}
-
-	if discount.ConfRef != confRef {
-		return tixPrice, nil, fmt.Errorf("%s not a valid code for conference (%s != %s)", code, discount.ConfRef, confRef)
+		return err
 	}
-
-	discountTix := float64(100 - discount.PercentOff) * float64(tixPrice) / float64(100)
-	
-	tix := uint(discountTix)
-	/* Overflows are a thing */
-	if tix == 0 || tix > tixPrice {
-		tix = 1	
-	}
-	return tix, discount, nil
+	discount.Ref = page.ID
+	return nil
 }
 
-func CheckIn(n *types.Notion, ticket string) (string, bool, error) {
+func (s *NotionStore) CheckIn(ticket string, at time.Time, by string) (string, bool, error) {
+	n := s.n
 	/* Make sure that the ticket is in the Purchases table and
 	is *NOT* already checked in */
-	pages, _, _, _ := n.Client.QueryDatabase(context.Background(), n.Config.PurchasesDb,
+	pages, _, _, err := n.Client.QueryDatabase(context.Background(), n.Config.PurchasesDb,
 		notion.QueryDatabaseParam{
 			Filter: &notion.Filter{
 				Property: "RefID",
@@ -393,22 +393,29 @@ func CheckIn(n *types.Notion, ticket string) (string, bool, error) {
 				},
 			},
 		})
+	/* Not an answer; they'll want to try again */
+	if err != nil {
+		return "", false, err
+	}
 
 	if len(pages) != 1 {
 		return "", true, fmt.Errorf("Ticket not found")
 	}
 
 	page := pages[0]
+	if len(page.Properties["Voided"].RichText) > 0 {
+		return "", true, fmt.Errorf("Ticket was cancelled")
+	}
 	if len(page.Properties["Checked In"].RichText) == 0 {
-		/* Update to checked in at time.now() */
-		now := time.Now()
+		/* Update to checked in at 'at' */
 		_, err := n.Client.UpdatePageProperties(context.Background(), page.ID,
 			map[string]*notion.PropertyValue{
 				"Checked In": notion.NewRichTextPropertyValue(
 					[]*notion.RichText{
 						{Type: notion.RichTextText,
-							Text: &notion.Text{Content: now.Format(time.RFC3339)}},
+							Text: &notion.Text{Content: at.Format(time.RFC3339)}},
 					}...),
+				"Checked In By": newRichText(by),
 			})
 
 		/* I need to know what role this is, so I can flash it! */
@@ -422,22 +429,227 @@ func CheckIn(n *types.Notion, ticket string) (string, bool, error) {
 	return "", true, fmt.Errorf("Already checked in")
 }
 
+func (s *NotionStore) VoidTicket(ticket string, at time.Time, by string, refundRef string) error {
+	n := s.n
+	pages, _, _, err := n.Client.QueryDatabase(context.Background(), n.Config.PurchasesDb,
+		notion.QueryDatabaseParam{
+			Filter: &notion.Filter{
+				Property: "RefID",
+				Text: &notion.TextFilterCondition{
+					Equals: ticket,
+				},
+			},
+		})
+	if err != nil {
+		return err
+	}
+	if len(pages) != 1 {
+		return fmt.Errorf("Ticket not found")
+	}
+
+	page := pages[0]
+	if len(page.Properties["Voided"].RichText) > 0 {
+		return fmt.Errorf("Ticket already cancelled")
+	}
+
+	_, err = n.Client.UpdatePageProperties(context.Background(), page.ID,
+		map[string]*notion.PropertyValue{
+			"Voided":    newRichText(at.Format(time.RFC3339)),
+			"Voided By": newRichText(by),
+			"Refund":    newRichText(refundRef),
+		})
+	return err
+}
+
+/* The purchase page for a ticket, or nil if there isn't one */
+func (s *NotionStore) findPurchase(ticket string) (*notion.Page, error) {
+	n := s.n
+	pages, _, _, err := n.Client.QueryDatabase(context.Background(), n.Config.PurchasesDb,
+		notion.QueryDatabaseParam{
+			Filter: &notion.Filter{
+				Property: "RefID",
+				Text: &notion.TextFilterCondition{
+					Equals: ticket,
+				},
+			},
+		})
+	if err != nil || len(pages) == 0 {
+		return nil, err
+	}
+	return pages[0], nil
+}
+
+func attendeeProps(attendee *types.Attendee) map[string]*notion.PropertyValue {
+	vals := map[string]*notion.PropertyValue{
+		"Name":          newRichText(attendee.Name),
+		"Dietary":       newRichText(attendee.Dietary),
+		"Accessibility": newRichText(attendee.Accessibility),
+		"Attendee Email": {
+			Type:  notion.PropertyEmail,
+			Email: attendee.Email,
+		},
+	}
+	if attendee.ShirtSize != "" {
+		vals["Shirt Size"] = &notion.PropertyValue{
+			Type: notion.PropertySelect,
+			Select: &notion.SelectOption{
+				Name: attendee.ShirtSize.String(),
+			},
+		}
+	}
+	return vals
+}
+
+func (s *NotionStore) UpdateAttendee(ticket string, attendee *types.Attendee) error {
+	page, err := s.findPurchase(ticket)
+	if err != nil {
+		return err
+	}
+	if page == nil {
+		return fmt.Errorf("Ticket not found")
+	}
+
+	_, err = s.n.Client.UpdatePageProperties(context.Background(), page.ID, attendeeProps(attendee))
+	return err
+}
+
+/* A whole purchase, for reissuing a ticket */
+func purchaseProps(rez *types.Registration) map[string]*notion.PropertyValue {
+	vals := attendeeProps(&rez.Attendee)
+	vals["RefID"] = newTitle(rez.RefID)
+	vals["Timestamp"] = newRichText(rez.Created.Format(time.RFC3339))
+	vals["Platform"] = &notion.PropertyValue{
+		Type:   notion.PropertySelect,
+		Select: &notion.SelectOption{Name: rez.Platform},
+	}
+	vals["conf"] = notion.NewRelationPropertyValue(
+		[]*notion.ObjectReference{{ID: rez.ConfRef}}...,
+	)
+	vals["Type"] = &notion.PropertyValue{
+		Type:   notion.PropertySelect,
+		Select: &notion.SelectOption{Name: rez.Type},
+	}
+	vals["Amount Paid"] = &notion.PropertyValue{
+		Type:   notion.PropertyNumber,
+		Number: float64(rez.AmountPaid) / 100,
+	}
+	vals["Currency"] = &notion.PropertyValue{
+		Type:   notion.PropertySelect,
+		Select: &notion.SelectOption{Name: rez.Currency},
+	}
+	vals["Email"] = &notion.PropertyValue{
+		Type:  notion.PropertyEmail,
+		Email: rez.Email,
+	}
+	vals["Item Bought"] = newRichText(rez.ItemBought)
+	vals["Lookup ID"] = newRichText(rez.LookupID)
+	vals["Transfers"] = newRichText(encodeTransfers(rez.Transfers))
+	if rez.DiscountRef != "" {
+		vals["discount"] = notion.NewRelationPropertyValue(
+			[]*notion.ObjectReference{{ID: rez.DiscountRef}}...,
+		)
+	}
+	if rez.TixID != "" {
+		vals["tier"] = notion.NewRelationPropertyValue(
+			[]*notion.ObjectReference{{ID: rez.TixID}}...,
+		)
+	}
+	return vals
+}
+
+func (s *NotionStore) TransferTicket(xfer *types.Transfer, to *types.Attendee) error {
+	n := s.n
+	page, err := s.findPurchase(xfer.FromRef)
+	if err != nil {
+		return err
+	}
+	if page == nil {
+		return fmt.Errorf("Ticket not found")
+	}
+	old := parseRegistration(page.Properties)
+	if !old.Voided.IsZero() {
+		return fmt.Errorf("Ticket was cancelled")
+	}
+	if !old.CheckedIn.IsZero() {
+		return fmt.Errorf("Already checked in")
+	}
+	transfers := append(old.Transfers, *xfer)
+
+	/* A retry may have made it already */
+	issued, err := s.findPurchase(xfer.ToRef)
+	if err != nil {
+		return err
+	}
+	if issued == nil {
+		rez := *old
+		rez.RefID = xfer.ToRef
+		rez.Attendee = *to
+		rez.Transfers = transfers
+		_, err = n.Client.CreatePage(context.Background(),
+			notion.NewDatabaseParent(n.Config.PurchasesDb), purchaseProps(&rez))
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = n.Client.UpdatePageProperties(context.Background(), page.ID,
+		map[string]*notion.PropertyValue{
+			"Voided":    newRichText(xfer.At.Format(time.RFC3339)),
+			"Voided By": newRichText(types.VoidedByTransfer),
+			"Transfers": newRichText(encodeTransfers(transfers)),
+		})
+	return err
+}
+
+func parseSelect(key string, props map[string]notion.PropertyValue) string {
+	if props[key].Select == nil {
+		return ""
+	}
+	return props[key].Select.Name
+}
+
+func parseRelation(key string, props map[string]notion.PropertyValue) string {
+	if len(props[key].Relation) == 0 {
+		return ""
+	}
+	return props[key].Relation[0].ID
+}
+
 func parseRegistration(props map[string]notion.PropertyValue) *types.Registration {
 	regis := &types.Registration{
-		RefID:      parseRichText("RefID", props),
-		Type:       props["Type"].Select.Name,
-		Email:      props["Email"].Email,
-		ItemBought: parseRichText("Item Bought", props),
-	}
-	if len(props["conf"].Relation) > 0 {
-		regis.ConfRef = props["conf"].Relation[0].ID
+		RefID:       parseRichText("RefID", props),
+		Type:        props["Type"].Select.Name,
+		Email:       props["Email"].Email,
+		ItemBought:  parseRichText("Item Bought", props),
+		LookupID:    parseRichText("Lookup ID", props),
+		Platform:    parseSelect("Platform", props),
+		Currency:    parseSelect("Currency", props),
+		AmountPaid:  int64(math.Round(props["Amount Paid"].Number * 100)),
+		DiscountRef: parseRelation("discount", props),
+		TixID:       parseRelation("tier", props),
+		Created:     parseTime("Timestamp", props),
+		CheckedIn:   parseTime("Checked In", props),
+		CheckedInBy: parseRichText("Checked In By", props),
+		Voided:      parseTime("Voided", props),
+		VoidedBy:    parseRichText("Voided By", props),
+		RefundRef:   parseRichText("Refund", props),
+		Attendee: types.Attendee{
+			Name:          parseRichText("Name", props),
+			Email:         props["Attendee Email"].Email,
+			ShirtSize:     types.ShirtSize(parseSelect("Shirt Size", props)),
+			Dietary:       parseRichText("Dietary", props),
+			Accessibility: parseRichText("Accessibility", props),
+		},
+		Transfers: decodeTransfers(parseRichText("Transfers", props)),
 	}
+	regis.ConfRef = parseRelation("conf", props)
 	return regis
 }
 
-func SoldTixCount(n *types.Notion, confRef string) (uint, error) {
+func (s *NotionStore) SoldTixCount(confRef string) (uint, error) {
 	var regisCount uint
 
+	n := s.n
 	hasMore := true
 	nextCursor := ""
 	db := n.Config.PurchasesDb
@@ -447,9 +659,20 @@ func SoldTixCount(n *types.Notion, confRef string) (uint, error) {
 		pages, nextCursor, hasMore, err = n.Client.QueryDatabase(context.Background(), db,
 			notion.QueryDatabaseParam{
 				Filter: &notion.Filter{
-					Property: "conf",
-					Relation: &notion.RelationFilterCondition{
-						Contains: confRef,
+					And: []*notion.Filter{
+						{
+							Property: "conf",
+							Relation: &notion.RelationFilterCondition{
+								Contains: confRef,
+							},
+						},
+						/* Cancelled ones free up their seat */
+						{
+							Property: "Voided",
+							Text: &notion.TextFilterCondition{
+								IsEmpty: true,
+							},
+						},
 					},
 				},
 				StartCursor: nextCursor,
@@ -464,13 +687,13 @@ func SoldTixCount(n *types.Notion, confRef string) (uint, error) {
 	return regisCount, nil
 }
 
-func fetchRegistrations(ctx *config.AppContext) ([]*types.Registration, error) {
+func (s *NotionStore) ListRegistrations() ([]*types.Registration, error) {
 	var regis []*types.Registration
 
 	hasMore := true
 	nextCursor := ""
-	n := ctx.Notion
-	db := ctx.Env.Notion.PurchasesDb
+	n := s.n
+	db := n.Config.PurchasesDb
 	for hasMore {
 		var err error
 		var pages []*notion.Page
@@ -490,66 +713,53 @@ func fetchRegistrations(ctx *config.AppContext) ([]*types.Registration, error) {
 	return regis, nil
 }
 
-func ticketMatch(tickets []string, rez *types.Registration) bool {
-	for _, tix := range tickets {
-		if strings.Contains(rez.ItemBought, tix) {
-			return true
-		}
-	}
-
-	return false
-}
+/* The RefIDs already in for a purchase */
+func (s *NotionStore) purchaseRefIDs(lookupID string) (map[string]bool, error) {
+	refIDs := make(map[string]bool)
 
-func checkActive(ctx *config.AppContext, confRef string) bool {
-	for _, conf := range ctx.Confs {
-		if confRef == conf.Ref {
-			return conf.Active
+	n := s.n
+	hasMore := true
+	nextCursor := ""
+	for hasMore {
+		var err error
+		var pages []*notion.Page
+		pages, nextCursor, hasMore, err = n.Client.QueryDatabase(context.Background(), n.Config.PurchasesDb,
+			notion.QueryDatabaseParam{
+				Filter: &notion.Filter{
+					Property: "Lookup ID",
+					Text: &notion.TextFilterCondition{
+						Equals: lookupID,
+					},
+				},
+				StartCursor: nextCursor,
+			})
+		if err != nil {
+			return nil, err
+		}
+		for _, page := range pages {
+			refIDs[parseRichText("RefID", page.Properties)] = true
 		}
 	}
 
-	return false
+	return refIDs, nil
 }
 
-func FetchBtcppRegistrations(ctx *config.AppContext, activeOnly bool) ([]*types.Registration, error) {
-	var btcppres []*types.Registration
-	rezzies, err := fetchRegistrations(ctx)
+func (s *NotionStore) AddTickets(entry *types.Entry, src string) error {
+	n := s.n
+	parent := notion.NewDatabaseParent(n.Config.PurchasesDb)
 
+	/* Notion will happily make a second page with the same
+	 * RefID, so skip any we got to last time */
+	existing, err := s.purchaseRefIDs(entry.ID)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	for _, r := range rezzies {
-		if r.RefID == "" {
-			continue
-		}
-
-		if activeOnly && !checkActive(ctx, r.ConfRef) {
-			continue
-		}
-
-		btcppres = append(btcppres, r)
-	}
-
-	return btcppres, nil
-}
-
-func UniqueID(email string, ref string, counter int32) string {
-	// sha256 of ref || email || count (4, le)
-	h := sha256.New()
-	h.Write([]byte(email))
-	h.Write([]byte(ref))
-
-	b := make([]byte, 4)
-	binary.LittleEndian.PutUint32(b, uint32(counter))
-	h.Write(b)
-	return hex.EncodeToString(h.Sum(nil))
-}
-
-func AddTickets(n *types.Notion, entry *types.Entry, src string) error {
-	parent := notion.NewDatabaseParent(n.Config.PurchasesDb)
-
 	for i, item := range entry.Items {
 		uniqID := UniqueID(entry.Email, entry.ID, int32(i))
+		if existing[uniqID] {
+			continue
+		}
 		vals := map[string]*notion.PropertyValue{
 			"RefID": notion.NewTitlePropertyValue(
 				[]*notion.RichText{
@@ -607,6 +817,11 @@ func AddTickets(n *types.Notion, entry *types.Entry, src string) error {
 				[]*notion.ObjectReference{{ID: entry.DiscountRef}}...,
 			)
 		}
+		if item.TixID != "" {
+			vals["tier"] = notion.NewRelationPropertyValue(
+				[]*notion.ObjectReference{{ID: item.TixID}}...,
+			)
+		}
 		_, err := n.Client.CreatePage(context.Background(), parent, vals)
 		if err != nil {
 			return err
@@ -615,3 +830,497 @@ func AddTickets(n *types.Notion, entry *types.Entry, src string) error {
 
 	return nil
 }
+
+func newRichText(content string) *notion.PropertyValue {
+	return notion.NewRichTextPropertyValue(
+		[]*notion.RichText{
+			{Type: notion.RichTextText,
+				Text: &notion.Text{Content: content}},
+		}...)
+}
+
+func newTitle(content string) *notion.PropertyValue {
+	return notion.NewTitlePropertyValue(
+		[]*notion.RichText{
+			{Type: notion.RichTextText,
+				Text: &notion.Text{Content: content}},
+		}...)
+}
+
+func newSelect(name string) *notion.PropertyValue {
+	return &notion.PropertyValue{
+		Type:   notion.PropertySelect,
+		Select: &notion.SelectOption{Name: name},
+	}
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+func parseTime(key string, props map[string]notion.PropertyValue) time.Time {
+	t, _ := time.Parse(time.RFC3339, parseRichText(key, props))
+	return t
+}
+
+func parseOutboxMail(page *notion.Page) *types.OutboxMail {
+	props := page.Properties
+	mail := &types.OutboxMail{
+		Ref:      page.ID,
+		JobKey:   parseRichText("JobKey", props),
+		RefID:    parseRichText("RefID", props),
+		Email:    props["Email"].Email,
+		Attempts: uint(props["Attempts"].Number),
+		RetryAt:  parseTime("Retry At", props),
+		LastErr:  parseRichText("Last Error", props),
+		Created:  page.CreatedTime,
+		Updated:  parseTime("Updated", props),
+	}
+
+	if len(props["conf"].Relation) > 0 {
+		mail.ConfRef = props["conf"].Relation[0].ID
+	}
+	if props["Type"].Select != nil {
+		mail.Type = props["Type"].Select.Name
+	}
+	if props["Status"].Select != nil {
+		mail.Status = types.MailStatus(props["Status"].Select.Name)
+	}
+
+	return mail
+}
+
+func outboxStateVals(mail *types.OutboxMail) map[string]*notion.PropertyValue {
+	return map[string]*notion.PropertyValue{
+		"Status": newSelect(string(mail.Status)),
+		"Attempts": {
+			Type:   notion.PropertyNumber,
+			Number: float64(mail.Attempts),
+		},
+		"Retry At":   newRichText(formatTime(mail.RetryAt)),
+		"Last Error": newRichText(mail.LastErr),
+		"Updated":    newRichText(formatTime(mail.Updated)),
+	}
+}
+
+func (s *NotionStore) ListOutbox() ([]*types.OutboxMail, error) {
+	var mails []*types.OutboxMail
+
+	n := s.n
+	hasMore := true
+	nextCursor := ""
+	for hasMore {
+		var err error
+		var pages []*notion.Page
+
+		pages, nextCursor, hasMore, err = n.Client.QueryDatabase(context.Background(),
+			n.Config.OutboxDb, notion.QueryDatabaseParam{
+				StartCursor: nextCursor,
+			})
+
+		if err != nil {
+			return nil, err
+		}
+		for _, page := range pages {
+			mails = append(mails, parseOutboxMail(page))
+		}
+	}
+
+	return mails, nil
+}
+
+func (s *NotionStore) AddOutbox(mail *types.OutboxMail) error {
+	n := s.n
+	parent := notion.NewDatabaseParent(n.Config.OutboxDb)
+
+	vals := outboxStateVals(mail)
+	vals["JobKey"] = newTitle(mail.JobKey)
+	vals["RefID"] = newRichText(mail.RefID)
+	vals["Type"] = newSelect(mail.Type)
+	vals["Email"] = &notion.PropertyValue{
+		Type:  notion.PropertyEmail,
+		Email: mail.Email,
+	}
+	if mail.ConfRef != "" {
+		vals["conf"] = notion.NewRelationPropertyValue(
+			[]*notion.ObjectReference{{ID: mail.ConfRef}}...,
+		)
+	}
+
+	page, err := n.Client.CreatePage(context.Background(), parent, vals)
+	if err != nil {
+		return err
+	}
+	mail.Ref = page.ID
+	return nil
+}
+
+func (s *NotionStore) UpdateOutbox(mail *types.OutboxMail) error {
+	_, err := s.n.Client.UpdatePageProperties(context.Background(), mail.Ref, outboxStateVals(mail))
+	return err
+}
+
+func parseStaff(page *notion.Page) *types.Staff {
+	props := page.Properties
+	staff := &types.Staff{
+		Ref:     page.ID,
+		Login:   parseRichText("Login", props),
+		Name:    parseRichText("Name", props),
+		Hash:    parseRichText("Hash", props),
+		Revoked: props["Revoked"].Checkbox,
+		Created: page.CreatedTime,
+	}
+	if props["Role"].Select != nil {
+		staff.Role = types.StaffRole(props["Role"].Select.Name)
+	}
+	for _, rel := range props["confs"].Relation {
+		staff.ConfRefs = append(staff.ConfRefs, rel.ID)
+	}
+	return staff
+}
+
+func staffVals(staff *types.Staff) map[string]*notion.PropertyValue {
+	var confs []*notion.ObjectReference
+	for _, ref := range staff.ConfRefs {
+		confs = append(confs, &notion.ObjectReference{ID: ref})
+	}
+
+	return map[string]*notion.PropertyValue{
+		"Name":  newRichText(staff.Name),
+		"Hash":  newRichText(staff.Hash),
+		"Role":  newSelect(string(staff.Role)),
+		"confs": notion.NewRelationPropertyValue(confs...),
+		"Revoked": {
+			Type:     notion.PropertyCheckbox,
+			Checkbox: staff.Revoked,
+		},
+	}
+}
+
+func (s *NotionStore) ListStaff() ([]*types.Staff, error) {
+	var staff []*types.Staff
+
+	n := s.n
+	hasMore := true
+	nextCursor := ""
+	for hasMore {
+		var err error
+		var pages []*notion.Page
+
+		pages, nextCursor, hasMore, err = n.Client.QueryDatabase(context.Background(),
+			n.Config.StaffDb, notion.QueryDatabaseParam{
+				StartCursor: nextCursor,
+			})
+
+		if err != nil {
+			return nil, err
+		}
+		for _, page := range pages {
+			staff = append(staff, parseStaff(page))
+		}
+	}
+
+	return staff, nil
+}
+
+func (s *NotionStore) AddStaff(staff *types.Staff) error {
+	n := s.n
+	parent := notion.NewDatabaseParent(n.Config.StaffDb)
+
+	vals := staffVals(staff)
+	vals["Login"] = newTitle(staff.Login)
+
+	page, err := n.Client.CreatePage(context.Background(), parent, vals)
+	if err != nil {
+		return err
+	}
+	staff.Ref = page.ID
+	staff.Created = page.CreatedTime
+	return nil
+}
+
+func (s *NotionStore) UpdateStaff(staff *types.Staff) error {
+	_, err := s.n.Client.UpdatePageProperties(context.Background(), staff.Ref, staffVals(staff))
+	return err
+}
+
+func parseWebhookEvent(page *notion.Page) *types.WebhookEvent {
+	props := page.Properties
+	return &types.WebhookEvent{
+		Ref:         page.ID,
+		Key:         parseRichText("Key", props),
+		Provider:    parseSelect("Provider", props),
+		EventID:     parseRichText("EventID", props),
+		Type:        parseRichText("Type", props),
+		OrderID:     parseRichText("OrderID", props),
+		OrderStatus: types.OrderStatus(parseSelect("Order Status", props)),
+		Status:      types.WebhookStatus(parseSelect("Status", props)),
+		Result:      parseRichText("Result", props),
+		Attempts:    uint(props["Attempts"].Number),
+		Created:     page.CreatedTime,
+		Updated:     parseTime("Updated", props),
+	}
+}
+
+func webhookStateVals(ev *types.WebhookEvent) map[string]*notion.PropertyValue {
+	return map[string]*notion.PropertyValue{
+		"Status": newSelect(string(ev.Status)),
+		"Result": newRichText(ev.Result),
+		"Attempts": {
+			Type:   notion.PropertyNumber,
+			Number: float64(ev.Attempts),
+		},
+		"Updated": newRichText(formatTime(ev.Updated)),
+	}
+}
+
+func (s *NotionStore) ListWebhookEvents() ([]*types.WebhookEvent, error) {
+	var events []*types.WebhookEvent
+
+	n := s.n
+	hasMore := true
+	nextCursor := ""
+	for hasMore {
+		var err error
+		var pages []*notion.Page
+
+		pages, nextCursor, hasMore, err = n.Client.QueryDatabase(context.Background(),
+			n.Config.WebhooksDb, notion.QueryDatabaseParam{
+				StartCursor: nextCursor,
+			})
+
+		if err != nil {
+			return nil, err
+		}
+		for _, page := range pages {
+			events = append(events, parseWebhookEvent(page))
+		}
+	}
+
+	return events, nil
+}
+
+func (s *NotionStore) FindWebhookEvent(key string) (*types.WebhookEvent, error) {
+	n := s.n
+	pages, _, _, err := n.Client.QueryDatabase(context.Background(), n.Config.WebhooksDb,
+		notion.QueryDatabaseParam{
+			Filter: &notion.Filter{
+				Property: "Key",
+				Text: &notion.TextFilterCondition{
+					Equals: key,
+				},
+			},
+		})
+	if err != nil {
+		return nil, err
+	}
+	if len(pages) == 0 {
+		return nil, nil
+	}
+	return parseWebhookEvent(pages[0]), nil
+}
+
+func (s *NotionStore) AddWebhookEvent(ev *types.WebhookEvent) error {
+	n := s.n
+	parent := notion.NewDatabaseParent(n.Config.WebhooksDb)
+
+	vals := webhookStateVals(ev)
+	vals["Key"] = newTitle(ev.Key)
+	vals["Provider"] = newSelect(ev.Provider)
+	vals["EventID"] = newRichText(ev.EventID)
+	vals["Type"] = newRichText(ev.Type)
+	vals["OrderID"] = newRichText(ev.OrderID)
+	vals["Order Status"] = newSelect(string(ev.OrderStatus))
+
+	page, err := n.Client.CreatePage(context.Background(), parent, vals)
+	if err != nil {
+		return err
+	}
+	ev.Ref = page.ID
+	ev.Created = page.CreatedTime
+	return nil
+}
+
+func (s *NotionStore) UpdateWebhookEvent(ev *types.WebhookEvent) error {
+	_, err := s.n.Client.UpdatePageProperties(context.Background(), ev.Ref, webhookStateVals(ev))
+	return err
+}
+
+func parseHold(page *notion.Page) *types.Hold {
+	props := page.Properties
+	hold := &types.Hold{
+		Ref:      page.ID,
+		Provider: parseSelect("Provider", props),
+		OrderID:  parseRichText("OrderID", props),
+		Count:    uint(props["Count"].Number),
+		Status:   types.HoldStatus(parseSelect("Status", props)),
+		Expires:  parseTime("Expires", props),
+		Created:  page.CreatedTime,
+		Updated:  parseTime("Updated", props),
+	}
+	if len(props["conf"].Relation) > 0 {
+		hold.ConfRef = props["conf"].Relation[0].ID
+	}
+	if len(props["discount"].Relation) > 0 {
+		hold.DiscountRef = props["discount"].Relation[0].ID
+		hold.Discounted = uint(props["Discounted"].Number)
+	}
+	return hold
+}
+
+func holdStateVals(hold *types.Hold) map[string]*notion.PropertyValue {
+	return map[string]*notion.PropertyValue{
+		"OrderID": newRichText(hold.OrderID),
+		"Status":  newSelect(string(hold.Status)),
+		"Expires": newRichText(formatTime(hold.Expires)),
+		"Updated": newRichText(formatTime(hold.Updated)),
+	}
+}
+
+func (s *NotionStore) ListHolds() ([]*types.Hold, error) {
+	var holds []*types.Hold
+
+	n := s.n
+	hasMore := true
+	nextCursor := ""
+	for hasMore {
+		var err error
+		var pages []*notion.Page
+
+		pages, nextCursor, hasMore, err = n.Client.QueryDatabase(context.Background(),
+			n.Config.HoldsDb, notion.QueryDatabaseParam{
+				StartCursor: nextCursor,
+			})
+
+		if err != nil {
+			return nil, err
+		}
+		for _, page := range pages {
+			holds = append(holds, parseHold(page))
+		}
+	}
+
+	return holds, nil
+}
+
+func (s *NotionStore) AddHold(hold *types.Hold) error {
+	n := s.n
+	parent := notion.NewDatabaseParent(n.Config.HoldsDb)
+
+	vals := holdStateVals(hold)
+	vals["Name"] = newTitle(fmt.Sprintf("%d held", hold.Count))
+	vals["Provider"] = newSelect(hold.Provider)
+	vals["Count"] = &notion.PropertyValue{
+		Type:   notion.PropertyNumber,
+		Number: float64(hold.Count),
+	}
+	if hold.ConfRef != "" {
+		vals["conf"] = notion.NewRelationPropertyValue(
+			[]*notion.ObjectReference{{ID: hold.ConfRef}}...,
+		)
+	}
+	if hold.DiscountRef != "" {
+		vals["discount"] = notion.NewRelationPropertyValue(
+			[]*notion.ObjectReference{{ID: hold.DiscountRef}}...,
+		)
+		vals["Discounted"] = notion.NewNumberPropertyValue(float64(hold.Discounted))
+	}
+
+	page, err := n.Client.CreatePage(context.Background(), parent, vals)
+	if err != nil {
+		return err
+	}
+	hold.Ref = page.ID
+	hold.Created = page.CreatedTime
+	return nil
+}
+
+func (s *NotionStore) UpdateHold(hold *types.Hold) error {
+	_, err := s.n.Client.UpdatePageProperties(context.Background(), hold.Ref, holdStateVals(hold))
+	return err
+}
+
+func parseWaitlistEntry(page *notion.Page) *types.WaitlistEntry {
+	props := page.Properties
+	entry := &types.WaitlistEntry{
+		Ref:     page.ID,
+		TixID:   parseRichText("TixID", props),
+		Email:   parseRichText("Email", props),
+		Status:  types.WaitStatus(parseSelect("Status", props)),
+		HoldRef: parseRichText("HoldRef", props),
+		Invited: parseTime("Invited", props),
+		Expires: parseTime("Expires", props),
+		Created: page.CreatedTime,
+		Updated: parseTime("Updated", props),
+	}
+	if len(props["conf"].Relation) > 0 {
+		entry.ConfRef = props["conf"].Relation[0].ID
+	}
+	return entry
+}
+
+func waitlistStateVals(entry *types.WaitlistEntry) map[string]*notion.PropertyValue {
+	return map[string]*notion.PropertyValue{
+		"Status":  newSelect(string(entry.Status)),
+		"HoldRef": newRichText(entry.HoldRef),
+		"Invited": newRichText(formatTime(entry.Invited)),
+		"Expires": newRichText(formatTime(entry.Expires)),
+		"Updated": newRichText(formatTime(entry.Updated)),
+	}
+}
+
+func (s *NotionStore) ListWaitlist() ([]*types.WaitlistEntry, error) {
+	var entries []*types.WaitlistEntry
+
+	n := s.n
+	hasMore := true
+	nextCursor := ""
+	for hasMore {
+		var err error
+		var pages []*notion.Page
+
+		pages, nextCursor, hasMore, err = n.Client.QueryDatabase(context.Background(),
+			n.Config.WaitlistDb, notion.QueryDatabaseParam{
+				StartCursor: nextCursor,
+			})
+
+		if err != nil {
+			return nil, err
+		}
+		for _, page := range pages {
+			entries = append(entries, parseWaitlistEntry(page))
+		}
+	}
+
+	return entries, nil
+}
+
+func (s *NotionStore) AddWaitlist(entry *types.WaitlistEntry) error {
+	n := s.n
+	parent := notion.NewDatabaseParent(n.Config.WaitlistDb)
+
+	vals := waitlistStateVals(entry)
+	vals["Email"] = newTitle(entry.Email)
+	vals["TixID"] = newRichText(entry.TixID)
+	if entry.ConfRef != "" {
+		vals["conf"] = notion.NewRelationPropertyValue(
+			[]*notion.ObjectReference{{ID: entry.ConfRef}}...,
+		)
+	}
+
+	page, err := n.Client.CreatePage(context.Background(), parent, vals)
+	if err != nil {
+		return err
+	}
+	entry.Ref = page.ID
+	entry.Created = page.CreatedTime
+	return nil
+}
+
+func (s *NotionStore) UpdateWaitlist(entry *types.WaitlistEntry) error {
+	_, err := s.n.Client.UpdatePageProperties(context.Background(), entry.Ref, waitlistStateVals(entry))
+	return err
+}
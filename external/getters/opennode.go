@@ -2,74 +2,315 @@ package getters
 
 import (
 	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"math"
 	"net/http"
+	"time"
 
-	"github.com/base58btc/btcpp-web/internal/config"
 	"github.com/base58btc/btcpp-web/internal/types"
+	"github.com/gorilla/schema"
 )
 
 const CHARGES_ENDPOINT string = "/charges"
 
-func InitOpenNodeCheckout(ctx *config.AppContext, tixPrice uint, tix *types.ConfTicket, conf *types.Conf, isLocal bool, count uint, email string, discountRef string) (*types.OpenNodePayment, error) {
+type (
+	/* What OpenNode posts to our callback */
+	OpenNodeEvent struct {
+		ID          string `schema:"id"`
+		Status      string `schema:"status"`
+		Description string `schema:"description"`
+		HashedOrder string `schema:"hashed_order"`
+	}
+
+	OpenNodeCharge struct {
+		ID          string                  `json:"id"`
+		Status      string                  `json:"status"`
+		Description string                  `json:"description"`
+		FiatVal     float64                 `json:"fiat_value"`
+		Price       int64                   `json:"price"`
+		CreatedAt   time.Time               `json:"created_at"`
+		Metadata    *types.OpenNodeMetadata `json:"metadata"`
+	}
+
+	OpenNodeProvider struct {
+		Key      string
+		Endpoint string
+		/* Outside of prod, everything costs a cent */
+		Prod bool
+	}
+)
+
+var openNodeDecoder = schema.NewDecoder()
+
+func init() {
+	openNodeDecoder.IgnoreUnknownKeys(true)
+}
+
+func NewOpenNodeProvider(conf types.OpenNodeConfig, prod bool) *OpenNodeProvider {
+	return &OpenNodeProvider{
+		Key:      conf.Key,
+		Endpoint: conf.Endpoint,
+		Prod:     prod,
+	}
+}
+
+func (p *OpenNodeProvider) Name() string {
+	return "opennode"
+}
+
+/* OpenNode doesn't ask for it, so we do */
+func (p *OpenNodeProvider) NeedsEmail() bool {
+	return true
+}
+
+func (p *OpenNodeProvider) do(method, path string, body interface{}, out interface{}) error {
+	var payload []byte
+	if body != nil {
+		var err error
+		payload, err = json.Marshal(body)
+		if err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequest(method, p.Endpoint+path, bytes.NewBuffer(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Authorization", p.Key)
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("accept", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("error returned from opennode %d: %s", resp.StatusCode, respBody)
+	}
+
+	return json.Unmarshal(respBody, out)
+}
+
+func (p *OpenNodeProvider) CreateCheckout(order *types.Order) (*types.Checkout, error) {
+	if len(order.Items) == 0 {
+		return nil, fmt.Errorf("nothing to check out")
+	}
+	item := order.Items[0]
 
 	metadata := &types.OpenNodeMetadata{
-		Email:    email,
-		Quantity: float64(count),
-		ConfRef:  conf.Ref,
-		TixLocal: isLocal,
-		DiscountRef: discountRef,
+		Email:       order.Email,
+		Quantity:    float64(len(order.Items)),
+		ConfRef:     order.ConfRef,
+		TixLocal:    item.Type == "local",
+		DiscountRef: order.DiscountRef,
 		/* We have to save it b/c OpenNode doesnt */
-		Currency: tix.Currency,
+		Currency: order.Currency,
+		TixID:    item.TixID,
+		Cart:     order.Cart(),
 	}
 
-	domain := ctx.Env.GetURI()
 	onReq := &types.OpenNodeRequest{
-		Amount:        float64(tixPrice),
-		Description:   conf.Desc,
-		Currency:      tix.Currency,
-		CallbackURL:   domain + "/callback/opennode",
-		SuccessURL:    domain + "/conf/" + conf.Tag + "/success",
+		Amount:        float64(order.Total()) / 100,
+		Description:   item.Desc,
+		Currency:      order.Currency,
+		CallbackURL:   order.CallbackURL,
+		SuccessURL:    order.SuccessURL,
 		AutoSettle:    false,
 		TTL:           360,
 		Metadata:      metadata,
-		NotifEmail:    email,
-		CustomerEmail: email,
+		NotifEmail:    order.Email,
+		CustomerEmail: order.Email,
 	}
 
-	if !ctx.Env.Prod {
+	if !order.Expires.IsZero() {
+		onReq.TTL = uint(time.Until(order.Expires).Minutes())
+	}
+	if !p.Prod {
 		onReq.Amount = float64(0.01)
 	}
 
-	payload, err := json.Marshal(onReq)
+	var onresp types.OpenNodeResponse
+	err := p.do("POST", CHARGES_ENDPOINT, onReq, &onresp)
 	if err != nil {
 		return nil, err
 	}
+	if onresp.Data == nil {
+		return nil, fmt.Errorf("opennode returned no charge")
+	}
 
-	chargesURL := ctx.Env.OpenNode.Endpoint + CHARGES_ENDPOINT
-	req, _ := http.NewRequest("POST", chargesURL, bytes.NewBuffer(payload))
-	req.Header.Add("Authorization", ctx.Env.OpenNode.Key)
-	req.Header.Add("Content-Type", "application/json")
+	charge := onresp.Data
+	return &types.Checkout{
+		OrderID:   charge.ID,
+		URL:       charge.HostedCheckoutURL,
+		ExpiresAt: time.Unix(int64(charge.LNInvoice.ExpiresAt), 0),
+		Lightning: charge.LNInvoice.Invoice,
+		Address:   charge.ChainInvoice.BTCAddress,
+		URI:       charge.URI,
+		Sats:      charge.Amount,
+	}, nil
+}
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+func computeHash(key, id string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(id))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+/* OpenNode signs the charge id with our api key */
+func (p *OpenNodeProvider) VerifyWebhook(r *http.Request) (*types.PaymentEvent, error) {
+	if err := r.ParseForm(); err != nil {
+		return nil, err
+	}
+
+	var ev OpenNodeEvent
+	if err := openNodeDecoder.Decode(&ev, r.PostForm); err != nil {
+		return nil, err
+	}
+
+	expected := computeHash(p.Key, ev.ID)
+	if !hmac.Equal([]byte(expected), []byte(ev.HashedOrder)) {
+		return nil, fmt.Errorf("invalid hashed_order for %s", ev.ID)
+	}
+
+	return &types.PaymentEvent{
+		ID:      ev.ID + ":" + ev.Status,
+		Type:    ev.Status,
+		OrderID: ev.ID,
+		Status:  openNodeStatus(ev.Status),
+	}, nil
+}
+
+func openNodeStatus(status string) types.OrderStatus {
+	switch status {
+	case "paid":
+		return types.OrderPaid
+	case "expired":
+		return types.OrderExpired
+	case "refunded":
+		return types.OrderRefunded
+	}
+	return types.OrderPending
+}
+
+func (p *OpenNodeProvider) FetchCharge(orderID string) (*types.Order, error) {
+	var envel struct {
+		Data *OpenNodeCharge `json:"data"`
+	}
+	err := p.do("GET", "/charge/"+orderID, nil, &envel)
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
-	body, err := ioutil.ReadAll(resp.Body)
+	if envel.Data == nil || envel.Data.Metadata == nil {
+		return nil, fmt.Errorf("opennode charge %s has no metadata", orderID)
+	}
+	return p.chargeOrder(envel.Data), nil
+}
+
+/* OpenNode only lists paid charges */
+func (p *OpenNodeProvider) ListPaidOrders(since time.Time) ([]*types.Order, error) {
+	var envel struct {
+		Data []*OpenNodeCharge `json:"data"`
+	}
+	err := p.do("GET", CHARGES_ENDPOINT, nil, &envel)
 	if err != nil {
 		return nil, err
 	}
 
-	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("error returned from opennode %d: %s", resp.StatusCode, body)
+	var orders []*types.Order
+	for _, charge := range envel.Data {
+		/* Not one of ours */
+		if charge.Metadata == nil || charge.CreatedAt.Before(since) {
+			continue
+		}
+		order := p.chargeOrder(charge)
+		if order.Status == types.OrderPaid {
+			orders = append(orders, order)
+		}
 	}
+	return orders, nil
+}
 
-	var onresp types.OpenNodeResponse
-	json.Unmarshal(body, &onresp)
+func (p *OpenNodeProvider) chargeOrder(charge *OpenNodeCharge) *types.Order {
+	order := &types.Order{
+		ID:          charge.ID,
+		Provider:    p.Name(),
+		Status:      openNodeStatus(charge.Status),
+		ConfRef:     charge.Metadata.ConfRef,
+		Email:       charge.Metadata.Email,
+		Currency:    charge.Metadata.Currency,
+		DiscountRef: charge.Metadata.DiscountRef,
+		Created:     charge.CreatedAt,
+	}
+
+	/* Older charges only have the one kind of ticket */
+	if charge.Metadata.Cart != "" {
+		items, err := types.ParseCart(charge.Metadata.Cart, charge.Description)
+		if err == nil {
+			order.Items = items
+			return order
+		}
+	}
+
+	tixType := "genpop"
+	if charge.Metadata.TixLocal {
+		tixType = "local"
+	}
+	count := int(charge.Metadata.Quantity)
+	if count < 1 {
+		return order
+	}
+	/* The fiat value is for the whole charge */
+	total := int64(math.Round(charge.FiatVal * 100))
+	for i := 0; i < count; i++ {
+		each := total / int64(count)
+		if i == 0 {
+			each += total % int64(count)
+		}
+		order.Items = append(order.Items, types.Item{
+			Total: each,
+			Desc:  charge.Description,
+			Type:  tixType,
+			TixID: charge.Metadata.TixID,
+		})
+	}
 
-	return onresp.Data, nil
+	return order
+}
+
+/* OpenNode refunds the whole charge, on-chain, to an address
+ * the buyer gives us. There's no partial refund */
+func (p *OpenNodeProvider) Refund(order *types.Order, amount int64) (*types.Refund, error) {
+	if order.RefundAddress == "" {
+		return nil, fmt.Errorf("opennode refunds need a bitcoin address from the buyer")
+	}
+	if amount > 0 && amount != order.Total() {
+		return nil, fmt.Errorf("opennode only refunds whole charges; refund %s from the OpenNode dashboard", order.ID)
+	}
+
+	var envel struct {
+		Data struct {
+			ID string `json:"id"`
+		} `json:"data"`
+	}
+	err := p.do("POST", "/refunds", map[string]string{
+		"checkout_id": order.ID,
+		"address":     order.RefundAddress,
+		"email":       order.Email,
+	}, &envel)
+	if err != nil {
+		return nil, err
+	}
+	return &types.Refund{ID: envel.Data.ID}, nil
 }
@@ -0,0 +1,39 @@
+package getters
+
+import (
+	"github.com/base58btc/btcpp-web/internal/types"
+)
+
+/* Every payment provider we're set up for, by name. A new
+ * provider goes in here and nowhere else in the ticket flow */
+func NewPayments(env *types.EnvConfig) map[string]types.PaymentProvider {
+	providers := make(map[string]types.PaymentProvider)
+	if env.StripeKey != "" {
+		providers["stripe"] = NewStripeProvider(env.StripeKey, env.StripeEndpointSec)
+	}
+	if env.OpenNode.Key != "" {
+		providers["opennode"] = NewOpenNodeProvider(env.OpenNode, env.Prod)
+	}
+	if env.BTCPay.APIKey != "" {
+		providers["btcpay"] = NewBTCPayProvider(env.BTCPay)
+	}
+	return providers
+}
+
+/* Who takes "btc" and who takes "fiat" payments */
+func PaymentFor(env *types.EnvConfig, providers map[string]types.PaymentProvider, method string) types.PaymentProvider {
+	var name string
+	switch method {
+	case "btc":
+		name = env.Payments.BTC
+		if name == "" {
+			name = "opennode"
+		}
+	case "fiat":
+		name = env.Payments.Fiat
+		if name == "" {
+			name = "stripe"
+		}
+	}
+	return providers[name]
+}
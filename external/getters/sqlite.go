@@ -0,0 +1,961 @@
+package getters
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/base58btc/btcpp-web/internal/types"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+/* SQLiteStore keeps everything in a local sqlite file.
+ * The tables mirror the Notion databases, one for one */
+type SQLiteStore struct {
+	db *sql.DB
+}
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS confs (
+	ref            TEXT PRIMARY KEY,
+	tag            TEXT NOT NULL UNIQUE,
+	active         BOOLEAN NOT NULL DEFAULT 0,
+	description    TEXT NOT NULL DEFAULT '',
+	date_desc      TEXT NOT NULL DEFAULT '',
+	venue          TEXT NOT NULL DEFAULT '',
+	template       TEXT NOT NULL DEFAULT '',
+	show_agenda    BOOLEAN NOT NULL DEFAULT 0,
+	show_talks     BOOLEAN NOT NULL DEFAULT 0,
+	has_satellites BOOLEAN NOT NULL DEFAULT 0,
+	color          TEXT NOT NULL DEFAULT ''
+);
+
+CREATE TABLE IF NOT EXISTS conf_tickets (
+	id       TEXT PRIMARY KEY,
+	conf_ref TEXT NOT NULL REFERENCES confs(ref),
+	tier     TEXT NOT NULL DEFAULT '',
+	local    INTEGER NOT NULL DEFAULT 0,
+	btc      INTEGER NOT NULL DEFAULT 0,
+	usd      INTEGER NOT NULL DEFAULT 0,
+	max      INTEGER NOT NULL DEFAULT 0,
+	currency TEXT NOT NULL DEFAULT '',
+	expires  TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS speakers (
+	id        TEXT PRIMARY KEY,
+	name      TEXT NOT NULL DEFAULT '',
+	photo     TEXT NOT NULL DEFAULT '',
+	org_photo TEXT NOT NULL DEFAULT '',
+	twitter   TEXT NOT NULL DEFAULT '',
+	github    TEXT NOT NULL DEFAULT '',
+	website   TEXT NOT NULL DEFAULT '',
+	nostr     TEXT NOT NULL DEFAULT '',
+	company   TEXT NOT NULL DEFAULT ''
+);
+
+CREATE TABLE IF NOT EXISTS talks (
+	id          TEXT PRIMARY KEY,
+	name        TEXT NOT NULL DEFAULT '',
+	description TEXT NOT NULL DEFAULT '',
+	clipart     TEXT NOT NULL DEFAULT '',
+	sched_start TIMESTAMP,
+	sched_end   TIMESTAMP,
+	venue       TEXT NOT NULL DEFAULT '',
+	event       TEXT NOT NULL DEFAULT '',
+	talk_type   TEXT NOT NULL DEFAULT '',
+	section     TEXT NOT NULL DEFAULT ''
+);
+
+CREATE TABLE IF NOT EXISTS talk_speakers (
+	talk_id    TEXT NOT NULL REFERENCES talks(id),
+	speaker_id TEXT NOT NULL REFERENCES speakers(id),
+	PRIMARY KEY (talk_id, speaker_id)
+);
+
+CREATE TABLE IF NOT EXISTS discounts (
+	ref         TEXT PRIMARY KEY,
+	code_name   TEXT NOT NULL,
+	percent_off INTEGER NOT NULL DEFAULT 0,
+	conf_ref    TEXT NOT NULL DEFAULT '',
+	amount_off  INTEGER NOT NULL DEFAULT 0,
+	max_uses    INTEGER NOT NULL DEFAULT 0,
+	single_use  BOOLEAN NOT NULL DEFAULT 0,
+	valid_from  TIMESTAMP,
+	valid_until TIMESTAMP,
+	tix_id      TEXT NOT NULL DEFAULT '',
+	currency    TEXT NOT NULL DEFAULT '',
+	local_only  BOOLEAN NOT NULL DEFAULT 0,
+	campaign    TEXT NOT NULL DEFAULT '',
+	comp        BOOLEAN NOT NULL DEFAULT 0,
+	tix_type    TEXT NOT NULL DEFAULT ''
+);
+
+CREATE TABLE IF NOT EXISTS purchases (
+	ref_id        TEXT PRIMARY KEY,
+	conf_ref      TEXT NOT NULL,
+	type          TEXT NOT NULL DEFAULT '',
+	email         TEXT NOT NULL DEFAULT '',
+	item_bought   TEXT NOT NULL DEFAULT '',
+	timestamp     TIMESTAMP NOT NULL,
+	platform      TEXT NOT NULL DEFAULT '',
+	amount_paid   REAL NOT NULL DEFAULT 0,
+	currency      TEXT NOT NULL DEFAULT '',
+	lookup_id     TEXT NOT NULL DEFAULT '',
+	discount_ref  TEXT NOT NULL DEFAULT '',
+	checked_in    TIMESTAMP,
+	checked_in_by TEXT NOT NULL DEFAULT '',
+	tix_id        TEXT NOT NULL DEFAULT '',
+	voided        TIMESTAMP,
+	voided_by     TEXT NOT NULL DEFAULT '',
+	refund_ref    TEXT NOT NULL DEFAULT '',
+	attendee_name  TEXT NOT NULL DEFAULT '',
+	attendee_email TEXT NOT NULL DEFAULT '',
+	shirt_size     TEXT NOT NULL DEFAULT '',
+	dietary        TEXT NOT NULL DEFAULT '',
+	accessibility  TEXT NOT NULL DEFAULT '',
+	transfers      TEXT NOT NULL DEFAULT ''
+);
+CREATE INDEX IF NOT EXISTS purchases_conf ON purchases(conf_ref);
+
+CREATE TABLE IF NOT EXISTS outbox (
+	job_key  TEXT PRIMARY KEY,
+	ref_id   TEXT NOT NULL DEFAULT '',
+	conf_ref TEXT NOT NULL DEFAULT '',
+	type     TEXT NOT NULL DEFAULT '',
+	email    TEXT NOT NULL DEFAULT '',
+	status   TEXT NOT NULL,
+	attempts INTEGER NOT NULL DEFAULT 0,
+	retry_at TIMESTAMP,
+	last_err TEXT NOT NULL DEFAULT '',
+	created  TIMESTAMP NOT NULL,
+	updated  TIMESTAMP NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS staff (
+	ref     TEXT PRIMARY KEY,
+	login   TEXT NOT NULL UNIQUE,
+	name    TEXT NOT NULL DEFAULT '',
+	hash    TEXT NOT NULL,
+	role    TEXT NOT NULL,
+	revoked BOOLEAN NOT NULL DEFAULT 0,
+	created TIMESTAMP NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS staff_confs (
+	staff_ref TEXT NOT NULL REFERENCES staff(ref),
+	conf_ref  TEXT NOT NULL,
+	PRIMARY KEY (staff_ref, conf_ref)
+);
+
+CREATE TABLE IF NOT EXISTS webhooks (
+	key          TEXT PRIMARY KEY,
+	provider     TEXT NOT NULL,
+	event_id     TEXT NOT NULL,
+	type         TEXT NOT NULL DEFAULT '',
+	order_id     TEXT NOT NULL DEFAULT '',
+	order_status TEXT NOT NULL DEFAULT '',
+	status       TEXT NOT NULL,
+	result       TEXT NOT NULL DEFAULT '',
+	attempts     INTEGER NOT NULL DEFAULT 0,
+	created      TIMESTAMP NOT NULL,
+	updated      TIMESTAMP NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS waitlist (
+	ref      TEXT PRIMARY KEY,
+	conf_ref TEXT NOT NULL,
+	tix_id   TEXT NOT NULL DEFAULT '',
+	email    TEXT NOT NULL,
+	status   TEXT NOT NULL,
+	hold_ref TEXT NOT NULL DEFAULT '',
+	invited  TIMESTAMP,
+	expires  TIMESTAMP,
+	created  TIMESTAMP NOT NULL,
+	updated  TIMESTAMP NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS holds (
+	ref      TEXT PRIMARY KEY,
+	conf_ref TEXT NOT NULL,
+	provider TEXT NOT NULL DEFAULT '',
+	order_id TEXT NOT NULL DEFAULT '',
+	count    INTEGER NOT NULL DEFAULT 0,
+	status   TEXT NOT NULL,
+	expires  TIMESTAMP NOT NULL,
+	created  TIMESTAMP NOT NULL,
+	updated  TIMESTAMP NOT NULL,
+	discount_ref TEXT NOT NULL DEFAULT '',
+	discounted   INTEGER NOT NULL DEFAULT 0
+);
+`
+
+/* Columns added after a table first shipped. CREATE TABLE
+ * won't add them to an existing db, so we do it here */
+var sqliteColumns = []struct{ table, column, def string }{
+	{"purchases", "checked_in_by", "TEXT NOT NULL DEFAULT ''"},
+	{"purchases", "tix_id", "TEXT NOT NULL DEFAULT ''"},
+	{"purchases", "voided", "TIMESTAMP"},
+	{"purchases", "voided_by", "TEXT NOT NULL DEFAULT ''"},
+	{"purchases", "refund_ref", "TEXT NOT NULL DEFAULT ''"},
+	{"purchases", "attendee_name", "TEXT NOT NULL DEFAULT ''"},
+	{"purchases", "attendee_email", "TEXT NOT NULL DEFAULT ''"},
+	{"purchases", "shirt_size", "TEXT NOT NULL DEFAULT ''"},
+	{"purchases", "dietary", "TEXT NOT NULL DEFAULT ''"},
+	{"purchases", "accessibility", "TEXT NOT NULL DEFAULT ''"},
+	{"purchases", "transfers", "TEXT NOT NULL DEFAULT ''"},
+	{"discounts", "amount_off", "INTEGER NOT NULL DEFAULT 0"},
+	{"discounts", "max_uses", "INTEGER NOT NULL DEFAULT 0"},
+	{"discounts", "single_use", "BOOLEAN NOT NULL DEFAULT 0"},
+	{"discounts", "valid_from", "TIMESTAMP"},
+	{"discounts", "valid_until", "TIMESTAMP"},
+	{"discounts", "tix_id", "TEXT NOT NULL DEFAULT ''"},
+	{"discounts", "currency", "TEXT NOT NULL DEFAULT ''"},
+	{"discounts", "local_only", "BOOLEAN NOT NULL DEFAULT 0"},
+	{"discounts", "campaign", "TEXT NOT NULL DEFAULT ''"},
+	{"discounts", "comp", "BOOLEAN NOT NULL DEFAULT 0"},
+	{"discounts", "tix_type", "TEXT NOT NULL DEFAULT ''"},
+	{"holds", "discount_ref", "TEXT NOT NULL DEFAULT ''"},
+	{"holds", "discounted", "INTEGER NOT NULL DEFAULT 0"},
+}
+
+func migrateSQLite(db *sql.DB) error {
+	for _, col := range sqliteColumns {
+		var count int
+		err := db.QueryRow(`SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?`,
+			col.table, col.column).Scan(&count)
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			continue
+		}
+		_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", col.table, col.column, col.def))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func NewSQLiteStore(path string) (*SQLiteStore, error) {
+	if path == "" {
+		return nil, fmt.Errorf("sqlite store needs a path")
+	}
+
+	db, err := sql.Open("sqlite3", path+"?_foreign_keys=on&_busy_timeout=5000")
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err = migrateSQLite(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &SQLiteStore{db: db}, nil
+}
+
+func (s *SQLiteStore) ListConfs() ([]*types.Conf, error) {
+	rows, err := s.db.Query(`SELECT ref, tag, active, description, date_desc, venue,
+		template, show_agenda, show_talks, has_satellites, color FROM confs`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var confs []*types.Conf
+	for rows.Next() {
+		conf := &types.Conf{}
+		err = rows.Scan(&conf.Ref, &conf.Tag, &conf.Active, &conf.Desc,
+			&conf.DateDesc, &conf.Venue, &conf.Template, &conf.ShowAgenda,
+			&conf.ShowTalks, &conf.HasSatellites, &conf.Color)
+		if err != nil {
+			return nil, err
+		}
+		confs = append(confs, conf)
+	}
+
+	return confs, rows.Err()
+}
+
+func (s *SQLiteStore) ListConfTickets() ([]*types.ConfTicket, error) {
+	rows, err := s.db.Query(`SELECT id, conf_ref, tier, local, btc, usd,
+		max, currency, expires FROM conf_tickets`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var confTix []*types.ConfTicket
+	for rows.Next() {
+		var expires sql.NullTime
+		tix := &types.ConfTicket{}
+		err = rows.Scan(&tix.ID, &tix.ConfRef, &tix.Tier, &tix.Local,
+			&tix.BTC, &tix.USD, &tix.Max, &tix.Currency, &expires)
+		if err != nil {
+			return nil, err
+		}
+		if expires.Valid {
+			tix.Expires = &types.Times{Start: expires.Time}
+		}
+		confTix = append(confTix, tix)
+	}
+
+	return confTix, rows.Err()
+}
+
+func (s *SQLiteStore) ListSpeakers() ([]*types.Speaker, error) {
+	rows, err := s.db.Query(`SELECT id, name, photo, org_photo, twitter,
+		github, website, nostr, company FROM speakers`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var speakers []*types.Speaker
+	for rows.Next() {
+		var twitter string
+		speaker := &types.Speaker{}
+		err = rows.Scan(&speaker.ID, &speaker.Name, &speaker.Photo,
+			&speaker.OrgPhoto, &twitter, &speaker.Github,
+			&speaker.Website, &speaker.Nostr, &speaker.Company)
+		if err != nil {
+			return nil, err
+		}
+		speaker.Twitter = twitterURL(twitter)
+		speakers = append(speakers, speaker)
+	}
+
+	return speakers, rows.Err()
+}
+
+func (s *SQLiteStore) ListTalks(speakers []*types.Speaker) ([]*types.Talk, error) {
+	rows, err := s.db.Query(`SELECT id, name, description, clipart,
+		sched_start, sched_end, venue, event, talk_type, section FROM talks`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var talks []*types.Talk
+	talkMap := make(map[string]*types.Talk)
+	for rows.Next() {
+		var start, end sql.NullTime
+		talk := &types.Talk{}
+		err = rows.Scan(&talk.ID, &talk.Name, &talk.Description,
+			&talk.Clipart, &start, &end, &talk.Venue, &talk.Event,
+			&talk.Type, &talk.Section)
+		if err != nil {
+			return nil, err
+		}
+		if start.Valid {
+			talk.Sched = &types.Times{Start: start.Time}
+			if end.Valid {
+				talk.Sched.End = &end.Time
+			}
+		}
+		finishTalk(talk)
+		talks = append(talks, talk)
+		talkMap[talk.ID] = talk
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	/* Find all speakers for these talks */
+	if speakers == nil {
+		return talks, nil
+	}
+
+	speakerMap := make(map[string]*types.Speaker)
+	for _, speaker := range speakers {
+		speakerMap[speaker.ID] = speaker
+	}
+
+	links, err := s.db.Query(`SELECT talk_id, speaker_id FROM talk_speakers`)
+	if err != nil {
+		return nil, err
+	}
+	defer links.Close()
+
+	for links.Next() {
+		var talkID, speakerID string
+		if err = links.Scan(&talkID, &speakerID); err != nil {
+			return nil, err
+		}
+		talk, ok := talkMap[talkID]
+		if !ok {
+			continue
+		}
+		if speaker, ok := speakerMap[speakerID]; ok {
+			talk.Speakers = append(talk.Speakers, speaker)
+		}
+	}
+
+	return talks, links.Err()
+}
+
+func (s *SQLiteStore) ListDiscounts() ([]*types.DiscountCode, error) {
+	rows, err := s.db.Query(`SELECT ref, code_name, percent_off, conf_ref, amount_off,
+		max_uses, single_use, valid_from, valid_until, tix_id, currency, local_only, campaign, comp, tix_type FROM discounts`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var discounts []*types.DiscountCode
+	for rows.Next() {
+		discount := &types.DiscountCode{}
+		var from, until sql.NullTime
+		err = rows.Scan(&discount.Ref, &discount.CodeName,
+			&discount.PercentOff, &discount.ConfRef, &discount.AmountOff,
+			&discount.MaxUses, &discount.SingleUse, &from, &until,
+			&discount.TixID, &discount.Currency, &discount.LocalOnly, &discount.Campaign,
+			&discount.Comp, &discount.TixType)
+		if err != nil {
+			return nil, err
+		}
+		discount.ValidFrom = from.Time
+		discount.ValidUntil = until.Time
+		discounts = append(discounts, discount)
+	}
+
+	return discounts, rows.Err()
+}
+
+func (s *SQLiteStore) AddDiscount(discount *types.DiscountCode) error {
+	ref := make([]byte, 16)
+	if _, err := rand.Read(ref); err != nil {
+		return err
+	}
+	discount.Ref = hex.EncodeToString(ref)
+
+	_, err := s.db.Exec(`INSERT INTO discounts (ref, code_name, percent_off, conf_ref,
+		amount_off, max_uses, single_use, valid_from, valid_until, tix_id, currency,
+		local_only, campaign, comp, tix_type) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		discount.Ref, discount.CodeName, discount.PercentOff, discount.ConfRef,
+		discount.AmountOff, discount.MaxUses, discount.SingleUse, nullTime(discount.ValidFrom),
+		nullTime(discount.ValidUntil), discount.TixID, discount.Currency,
+		discount.LocalOnly, discount.Campaign, discount.Comp, discount.TixType)
+	return err
+}
+
+func (s *SQLiteStore) ListRegistrations() ([]*types.Registration, error) {
+	rows, err := s.db.Query(`SELECT ref_id, conf_ref, type, email, item_bought,
+		lookup_id, platform, currency, amount_paid, discount_ref, tix_id,
+		timestamp, checked_in, checked_in_by, voided, voided_by,
+		refund_ref, attendee_name, attendee_email, shirt_size, dietary,
+		accessibility, transfers FROM purchases`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var regis []*types.Registration
+	for rows.Next() {
+		var paid float64
+		var checkedIn, voided sql.NullTime
+		var transfers string
+		r := &types.Registration{}
+		err = rows.Scan(&r.RefID, &r.ConfRef, &r.Type, &r.Email, &r.ItemBought,
+			&r.LookupID, &r.Platform, &r.Currency, &paid, &r.DiscountRef, &r.TixID,
+			&r.Created, &checkedIn, &r.CheckedInBy, &voided, &r.VoidedBy,
+			&r.RefundRef, &r.Attendee.Name, &r.Attendee.Email, &r.Attendee.ShirtSize,
+			&r.Attendee.Dietary, &r.Attendee.Accessibility, &transfers)
+		if err != nil {
+			return nil, err
+		}
+		r.AmountPaid = int64(math.Round(paid * 100))
+		r.CheckedIn = checkedIn.Time
+		r.Voided = voided.Time
+		r.Transfers = decodeTransfers(transfers)
+		regis = append(regis, r)
+	}
+
+	return regis, rows.Err()
+}
+
+func (s *SQLiteStore) SoldTixCount(confRef string) (uint, error) {
+	var count uint
+	err := s.db.QueryRow(`SELECT COUNT(*) FROM purchases
+		WHERE conf_ref = ? AND voided IS NULL`, confRef).Scan(&count)
+	return count, err
+}
+
+func (s *SQLiteStore) AddTickets(entry *types.Entry, src string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for i, item := range entry.Items {
+		uniqID := UniqueID(entry.Email, entry.ID, int32(i))
+		/* Already in from an earlier try */
+		_, err = tx.Exec(`INSERT OR IGNORE INTO purchases (ref_id, conf_ref, type,
+			email, item_bought, timestamp, platform, amount_paid,
+			currency, lookup_id, discount_ref, tix_id)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			uniqID, entry.ConfRef, item.Type, entry.Email, item.Desc,
+			entry.Created, src, float64(item.Total)/100,
+			entry.Currency, entry.ID, entry.DiscountRef, item.TixID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (s *SQLiteStore) CheckIn(ticket string, at time.Time, by string) (string, bool, error) {
+	var tixType string
+	var checkedIn, voided sql.NullTime
+	err := s.db.QueryRow(`SELECT type, checked_in, voided FROM purchases WHERE ref_id = ?`,
+		ticket).Scan(&tixType, &checkedIn, &voided)
+	if err == sql.ErrNoRows {
+		return "", true, fmt.Errorf("Ticket not found")
+	}
+	if err != nil {
+		return "", false, err
+	}
+
+	if voided.Valid {
+		return "", true, fmt.Errorf("Ticket was cancelled")
+	}
+	if checkedIn.Valid {
+		return "", true, fmt.Errorf("Already checked in")
+	}
+
+	/* Only the first check-in wins */
+	res, err := s.db.Exec(`UPDATE purchases SET checked_in = ?, checked_in_by = ?
+		WHERE ref_id = ? AND checked_in IS NULL AND voided IS NULL`, at.UTC(), by, ticket)
+	if err != nil {
+		return "", false, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return "", true, fmt.Errorf("Already checked in")
+	}
+
+	return tixType, true, nil
+}
+
+func (s *SQLiteStore) VoidTicket(ticket string, at time.Time, by string, refundRef string) error {
+	res, err := s.db.Exec(`UPDATE purchases SET voided = ?, voided_by = ?, refund_ref = ?
+		WHERE ref_id = ? AND voided IS NULL`, at.UTC(), by, refundRef, ticket)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		return nil
+	}
+
+	var count int
+	err = s.db.QueryRow(`SELECT COUNT(*) FROM purchases WHERE ref_id = ?`, ticket).Scan(&count)
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return fmt.Errorf("Ticket not found")
+	}
+	return fmt.Errorf("Ticket already cancelled")
+}
+
+func (s *SQLiteStore) UpdateAttendee(ticket string, attendee *types.Attendee) error {
+	res, err := s.db.Exec(`UPDATE purchases SET attendee_name = ?, attendee_email = ?,
+		shirt_size = ?, dietary = ?, accessibility = ? WHERE ref_id = ?`,
+		attendee.Name, attendee.Email, string(attendee.ShirtSize),
+		attendee.Dietary, attendee.Accessibility, ticket)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("Ticket not found")
+	}
+	return nil
+}
+
+func (s *SQLiteStore) TransferTicket(xfer *types.Transfer, to *types.Attendee) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var checkedIn, voided sql.NullTime
+	var history string
+	err = tx.QueryRow(`SELECT checked_in, voided, transfers FROM purchases WHERE ref_id = ?`,
+		xfer.FromRef).Scan(&checkedIn, &voided, &history)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("Ticket not found")
+	}
+	if err != nil {
+		return err
+	}
+	if voided.Valid {
+		return fmt.Errorf("Ticket was cancelled")
+	}
+	if checkedIn.Valid {
+		return fmt.Errorf("Already checked in")
+	}
+	transfers := encodeTransfers(append(decodeTransfers(history), *xfer))
+
+	_, err = tx.Exec(`INSERT INTO purchases (ref_id, conf_ref, type, email,
+		item_bought, timestamp, platform, amount_paid, currency, lookup_id,
+		discount_ref, tix_id, attendee_name, attendee_email, shirt_size,
+		dietary, accessibility, transfers)
+		SELECT ?, conf_ref, type, email, item_bought, timestamp, platform,
+		amount_paid, currency, lookup_id, discount_ref, tix_id, ?, ?, ?, ?, ?, ?
+		FROM purchases WHERE ref_id = ?`,
+		xfer.ToRef, to.Name, to.Email, string(to.ShirtSize), to.Dietary,
+		to.Accessibility, transfers, xfer.FromRef)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`UPDATE purchases SET voided = ?, voided_by = ?, transfers = ?
+		WHERE ref_id = ?`, xfer.At.UTC(), types.VoidedByTransfer, transfers, xfer.FromRef)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func nullTime(t time.Time) sql.NullTime {
+	return sql.NullTime{Time: t, Valid: !t.IsZero()}
+}
+
+func (s *SQLiteStore) ListOutbox() ([]*types.OutboxMail, error) {
+	rows, err := s.db.Query(`SELECT job_key, ref_id, conf_ref, type, email,
+		status, attempts, retry_at, last_err, created, updated FROM outbox`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var mails []*types.OutboxMail
+	for rows.Next() {
+		var retryAt sql.NullTime
+		m := &types.OutboxMail{}
+		err = rows.Scan(&m.JobKey, &m.RefID, &m.ConfRef, &m.Type, &m.Email,
+			&m.Status, &m.Attempts, &retryAt, &m.LastErr, &m.Created, &m.Updated)
+		if err != nil {
+			return nil, err
+		}
+		m.Ref = m.JobKey
+		m.RetryAt = retryAt.Time
+		mails = append(mails, m)
+	}
+
+	return mails, rows.Err()
+}
+
+func (s *SQLiteStore) AddOutbox(mail *types.OutboxMail) error {
+	_, err := s.db.Exec(`INSERT INTO outbox (job_key, ref_id, conf_ref, type,
+		email, status, attempts, retry_at, last_err, created, updated)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		mail.JobKey, mail.RefID, mail.ConfRef, mail.Type, mail.Email,
+		mail.Status, mail.Attempts, nullTime(mail.RetryAt), mail.LastErr,
+		mail.Created, mail.Updated)
+	if err != nil {
+		return err
+	}
+	mail.Ref = mail.JobKey
+	return nil
+}
+
+func (s *SQLiteStore) UpdateOutbox(mail *types.OutboxMail) error {
+	res, err := s.db.Exec(`UPDATE outbox SET status = ?, attempts = ?,
+		retry_at = ?, last_err = ?, updated = ? WHERE job_key = ?`,
+		mail.Status, mail.Attempts, nullTime(mail.RetryAt), mail.LastErr,
+		mail.Updated, mail.Ref)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("outbox mail %s not found", mail.Ref)
+	}
+	return nil
+}
+
+func (s *SQLiteStore) ListStaff() ([]*types.Staff, error) {
+	rows, err := s.db.Query(`SELECT ref, login, name, hash, role, revoked, created FROM staff`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var staff []*types.Staff
+	byRef := make(map[string]*types.Staff)
+	for rows.Next() {
+		st := &types.Staff{}
+		err = rows.Scan(&st.Ref, &st.Login, &st.Name, &st.Hash, &st.Role, &st.Revoked, &st.Created)
+		if err != nil {
+			return nil, err
+		}
+		staff = append(staff, st)
+		byRef[st.Ref] = st
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	confs, err := s.db.Query(`SELECT staff_ref, conf_ref FROM staff_confs`)
+	if err != nil {
+		return nil, err
+	}
+	defer confs.Close()
+	for confs.Next() {
+		var staffRef, confRef string
+		if err = confs.Scan(&staffRef, &confRef); err != nil {
+			return nil, err
+		}
+		if st, ok := byRef[staffRef]; ok {
+			st.ConfRefs = append(st.ConfRefs, confRef)
+		}
+	}
+
+	return staff, confs.Err()
+}
+
+func setStaffConfs(tx *sql.Tx, staff *types.Staff) error {
+	if _, err := tx.Exec(`DELETE FROM staff_confs WHERE staff_ref = ?`, staff.Ref); err != nil {
+		return err
+	}
+	for _, confRef := range staff.ConfRefs {
+		_, err := tx.Exec(`INSERT INTO staff_confs (staff_ref, conf_ref) VALUES (?, ?)`, staff.Ref, confRef)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *SQLiteStore) AddStaff(staff *types.Staff) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	ref := make([]byte, 16)
+	if _, err = rand.Read(ref); err != nil {
+		return err
+	}
+	staff.Ref = hex.EncodeToString(ref)
+	staff.Created = time.Now().UTC()
+
+	_, err = tx.Exec(`INSERT INTO staff (ref, login, name, hash, role, revoked, created)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		staff.Ref, staff.Login, staff.Name, staff.Hash, staff.Role, staff.Revoked, staff.Created)
+	if err != nil {
+		return err
+	}
+	if err = setStaffConfs(tx, staff); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *SQLiteStore) UpdateStaff(staff *types.Staff) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`UPDATE staff SET name = ?, hash = ?, role = ?, revoked = ?
+		WHERE ref = ?`, staff.Name, staff.Hash, staff.Role, staff.Revoked, staff.Ref)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("staff %s not found", staff.Ref)
+	}
+	if err = setStaffConfs(tx, staff); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *SQLiteStore) ListWebhookEvents() ([]*types.WebhookEvent, error) {
+	rows, err := s.db.Query(`SELECT key, provider, event_id, type, order_id,
+		order_status, status, result, attempts, created, updated FROM webhooks`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []*types.WebhookEvent
+	for rows.Next() {
+		ev := &types.WebhookEvent{}
+		err = rows.Scan(&ev.Key, &ev.Provider, &ev.EventID, &ev.Type, &ev.OrderID,
+			&ev.OrderStatus, &ev.Status, &ev.Result, &ev.Attempts, &ev.Created, &ev.Updated)
+		if err != nil {
+			return nil, err
+		}
+		ev.Ref = ev.Key
+		events = append(events, ev)
+	}
+
+	return events, rows.Err()
+}
+
+func (s *SQLiteStore) FindWebhookEvent(key string) (*types.WebhookEvent, error) {
+	ev := &types.WebhookEvent{}
+	err := s.db.QueryRow(`SELECT key, provider, event_id, type, order_id,
+		order_status, status, result, attempts, created, updated
+		FROM webhooks WHERE key = ?`, key).Scan(&ev.Key, &ev.Provider,
+		&ev.EventID, &ev.Type, &ev.OrderID, &ev.OrderStatus, &ev.Status,
+		&ev.Result, &ev.Attempts, &ev.Created, &ev.Updated)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	ev.Ref = ev.Key
+	return ev, nil
+}
+
+func (s *SQLiteStore) AddWebhookEvent(ev *types.WebhookEvent) error {
+	_, err := s.db.Exec(`INSERT INTO webhooks (key, provider, event_id, type,
+		order_id, order_status, status, result, attempts, created, updated)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		ev.Key, ev.Provider, ev.EventID, ev.Type, ev.OrderID, ev.OrderStatus,
+		ev.Status, ev.Result, ev.Attempts, ev.Created, ev.Updated)
+	if err != nil {
+		return err
+	}
+	ev.Ref = ev.Key
+	return nil
+}
+
+func (s *SQLiteStore) UpdateWebhookEvent(ev *types.WebhookEvent) error {
+	res, err := s.db.Exec(`UPDATE webhooks SET status = ?, result = ?,
+		attempts = ?, updated = ? WHERE key = ?`,
+		ev.Status, ev.Result, ev.Attempts, ev.Updated, ev.Ref)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("webhook event %s not found", ev.Ref)
+	}
+	return nil
+}
+
+func (s *SQLiteStore) ListHolds() ([]*types.Hold, error) {
+	rows, err := s.db.Query(`SELECT ref, conf_ref, provider, order_id, count,
+		status, expires, created, updated, discount_ref, discounted FROM holds`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var holds []*types.Hold
+	for rows.Next() {
+		hold := &types.Hold{}
+		err = rows.Scan(&hold.Ref, &hold.ConfRef, &hold.Provider, &hold.OrderID, &hold.Count,
+			&hold.Status, &hold.Expires, &hold.Created, &hold.Updated,
+			&hold.DiscountRef, &hold.Discounted)
+		if err != nil {
+			return nil, err
+		}
+		holds = append(holds, hold)
+	}
+
+	return holds, rows.Err()
+}
+
+func (s *SQLiteStore) AddHold(hold *types.Hold) error {
+	ref := make([]byte, 16)
+	if _, err := rand.Read(ref); err != nil {
+		return err
+	}
+	hold.Ref = hex.EncodeToString(ref)
+	hold.Created = time.Now().UTC()
+
+	_, err := s.db.Exec(`INSERT INTO holds (ref, conf_ref, provider, order_id,
+		count, status, expires, created, updated, discount_ref, discounted)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		hold.Ref, hold.ConfRef, hold.Provider, hold.OrderID, hold.Count,
+		hold.Status, hold.Expires, hold.Created, hold.Updated,
+		hold.DiscountRef, hold.Discounted)
+	return err
+}
+
+func (s *SQLiteStore) UpdateHold(hold *types.Hold) error {
+	res, err := s.db.Exec(`UPDATE holds SET order_id = ?, status = ?,
+		expires = ?, updated = ? WHERE ref = ?`,
+		hold.OrderID, hold.Status, hold.Expires, hold.Updated, hold.Ref)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("hold %s not found", hold.Ref)
+	}
+	return nil
+}
+
+func (s *SQLiteStore) ListWaitlist() ([]*types.WaitlistEntry, error) {
+	rows, err := s.db.Query(`SELECT ref, conf_ref, tix_id, email, status, hold_ref,
+		invited, expires, created, updated FROM waitlist ORDER BY created, rowid`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []*types.WaitlistEntry
+	for rows.Next() {
+		entry := &types.WaitlistEntry{}
+		var invited, expires sql.NullTime
+		err = rows.Scan(&entry.Ref, &entry.ConfRef, &entry.TixID, &entry.Email, &entry.Status,
+			&entry.HoldRef, &invited, &expires, &entry.Created, &entry.Updated)
+		if err != nil {
+			return nil, err
+		}
+		entry.Invited = invited.Time
+		entry.Expires = expires.Time
+		entries = append(entries, entry)
+	}
+
+	return entries, rows.Err()
+}
+
+func (s *SQLiteStore) AddWaitlist(entry *types.WaitlistEntry) error {
+	ref := make([]byte, 16)
+	if _, err := rand.Read(ref); err != nil {
+		return err
+	}
+	entry.Ref = hex.EncodeToString(ref)
+	entry.Created = time.Now().UTC()
+
+	_, err := s.db.Exec(`INSERT INTO waitlist (ref, conf_ref, tix_id, email, status,
+		hold_ref, invited, expires, created, updated) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		entry.Ref, entry.ConfRef, entry.TixID, entry.Email, entry.Status, entry.HoldRef,
+		nullTime(entry.Invited), nullTime(entry.Expires), entry.Created, entry.Updated)
+	return err
+}
+
+func (s *SQLiteStore) UpdateWaitlist(entry *types.WaitlistEntry) error {
+	res, err := s.db.Exec(`UPDATE waitlist SET status = ?, hold_ref = ?, invited = ?,
+		expires = ?, updated = ? WHERE ref = ?`,
+		entry.Status, entry.HoldRef, nullTime(entry.Invited), nullTime(entry.Expires),
+		entry.Updated, entry.Ref)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("waitlist entry %s not found", entry.Ref)
+	}
+	return nil
+}
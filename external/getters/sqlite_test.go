@@ -0,0 +1,477 @@
+package getters
+
+import (
+	"database/sql"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/base58btc/btcpp-web/internal/types"
+)
+
+func newTestSQLite(t *testing.T) *SQLiteStore {
+	t.Helper()
+	store, err := NewSQLiteStore(filepath.Join(t.TempDir(), "btcpp.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.db.Close() })
+	return store
+}
+
+func testEntry(id, email string, count int) *types.Entry {
+	entry := &types.Entry{
+		ID:       id,
+		ConfRef:  "conf-atx25",
+		Currency: "usd",
+		Created:  time.Now().UTC(),
+		Email:    email,
+	}
+	for i := 0; i < count; i++ {
+		entry.Items = append(entry.Items, types.Item{Total: 10000, Desc: "atx25 ticket", Type: "genpop", TixID: "tix-atx25-early"})
+	}
+	return entry
+}
+
+func TestSQLiteAddTickets(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []*types.Entry
+		want    int
+	}{
+		{"one order", []*types.Entry{testEntry("ord_1", "bob@example.com", 2)}, 2},
+		{"webhook redelivered", []*types.Entry{testEntry("ord_1", "bob@example.com", 2), testEntry("ord_1", "bob@example.com", 2)}, 2},
+		{"two orders", []*types.Entry{testEntry("ord_1", "bob@example.com", 1), testEntry("ord_2", "bob@example.com", 1)}, 2},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			store := newTestSQLite(t)
+			for _, entry := range tc.entries {
+				if err := store.AddTickets(entry, "stripe"); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			rezzies, err := store.ListRegistrations()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(rezzies) != tc.want {
+				t.Fatalf("expected %d tickets, got %d", tc.want, len(rezzies))
+			}
+			for _, rez := range rezzies {
+				if rez.Platform != "stripe" || rez.AmountPaid != 10000 || rez.TixID != "tix-atx25-early" {
+					t.Fatalf("ticket didn't round trip: %+v", rez)
+				}
+			}
+			sold, err := store.SoldTixCount("conf-atx25")
+			if err != nil || sold != uint(tc.want) {
+				t.Fatalf("expected %d sold, got %d (%v)", tc.want, sold, err)
+			}
+		})
+	}
+}
+
+func TestSQLiteCheckIn(t *testing.T) {
+	store := newTestSQLite(t)
+	if err := store.AddTickets(testEntry("ord_1", "bob@example.com", 2), "stripe"); err != nil {
+		t.Fatal(err)
+	}
+	first := UniqueID("bob@example.com", "ord_1", 0)
+	voided := UniqueID("bob@example.com", "ord_1", 1)
+	if err := store.VoidTicket(voided, time.Now(), "organizer", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		ticket  string
+		by      string
+		wantErr string
+	}{
+		{"first scan", first, "door", ""},
+		{"second scan", first, "door2", "Already checked in"},
+		{"cancelled", voided, "door", "Ticket was cancelled"},
+		{"unknown", "nope", "door", "Ticket not found"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tixType, ok, err := store.CheckIn(tc.ticket, time.Now(), tc.by)
+			if tc.wantErr == "" {
+				if err != nil || !ok || tixType != "genpop" {
+					t.Fatalf("expected check in, got %q %v %v", tixType, ok, err)
+				}
+				return
+			}
+			if err == nil || err.Error() != tc.wantErr || !ok {
+				t.Fatalf("expected %q, got %v (ok %v)", tc.wantErr, err, ok)
+			}
+		})
+	}
+
+	/* The first scan's the one on record */
+	rezzies, err := store.ListRegistrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rez := range rezzies {
+		if rez.RefID == first && (rez.CheckedIn.IsZero() || rez.CheckedInBy != "door") {
+			t.Fatalf("expected the first check in to stick, got %+v", rez)
+		}
+		if rez.RefID == voided && !rez.CheckedIn.IsZero() {
+			t.Fatalf("cancelled ticket got checked in: %+v", rez)
+		}
+	}
+}
+
+func TestSQLiteVoidTicket(t *testing.T) {
+	store := newTestSQLite(t)
+	if err := store.AddTickets(testEntry("ord_1", "bob@example.com", 2), "stripe"); err != nil {
+		t.Fatal(err)
+	}
+	ticket := UniqueID("bob@example.com", "ord_1", 0)
+
+	tests := []struct {
+		name    string
+		ticket  string
+		wantErr string
+	}{
+		{"live ticket", ticket, ""},
+		{"already cancelled", ticket, "Ticket already cancelled"},
+		{"unknown", "nope", "Ticket not found"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := store.VoidTicket(tc.ticket, time.Now(), "organizer", "re_1")
+			if tc.wantErr == "" && err != nil {
+				t.Fatal(err)
+			}
+			if tc.wantErr != "" && (err == nil || err.Error() != tc.wantErr) {
+				t.Fatalf("expected %q, got %v", tc.wantErr, err)
+			}
+		})
+	}
+
+	rezzies, err := store.ListRegistrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rez := range rezzies {
+		if rez.RefID != ticket {
+			continue
+		}
+		if rez.Voided.IsZero() || rez.VoidedBy != "organizer" || rez.RefundRef != "re_1" {
+			t.Fatalf("void not recorded: %+v", rez)
+		}
+	}
+	sold, err := store.SoldTixCount("conf-atx25")
+	if err != nil || sold != 1 {
+		t.Fatalf("expected the void to free a seat, got %d (%v)", sold, err)
+	}
+}
+
+func TestSQLiteOutbox(t *testing.T) {
+	store := newTestSQLite(t)
+	now := time.Now().UTC()
+	mail := &types.OutboxMail{
+		JobKey: "btcpp-tix1", RefID: "tix1", ConfRef: "conf-atx25", Type: "ticket",
+		Email: "bob@example.com", Status: types.MailPending, Created: now, Updated: now,
+	}
+	if err := store.AddOutbox(mail); err != nil {
+		t.Fatal(err)
+	}
+	/* One mail per job */
+	if err := store.AddOutbox(&types.OutboxMail{JobKey: "btcpp-tix1", Status: types.MailPending, Created: now, Updated: now}); err == nil {
+		t.Fatalf("expected a second mail with the same job key to be refused")
+	}
+
+	mail.Status = types.MailFailed
+	mail.Attempts = 2
+	mail.RetryAt = now.Add(time.Hour)
+	mail.LastErr = "smtp down"
+	mail.Updated = now.Add(time.Minute)
+	if err := store.UpdateOutbox(mail); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.UpdateOutbox(&types.OutboxMail{Ref: "nope"}); err == nil {
+		t.Fatalf("expected updating a missing mail to fail")
+	}
+
+	mails, err := store.ListOutbox()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mails) != 1 {
+		t.Fatalf("expected one mail, got %d", len(mails))
+	}
+	got := mails[0]
+	if got.Ref != "btcpp-tix1" || got.Status != types.MailFailed || got.Attempts != 2 ||
+		!got.RetryAt.Equal(mail.RetryAt) || got.LastErr != "smtp down" || got.Email != "bob@example.com" {
+		t.Fatalf("mail didn't round trip: %+v", got)
+	}
+}
+
+func TestSQLiteHolds(t *testing.T) {
+	store := newTestSQLite(t)
+	now := time.Now().UTC()
+	hold := &types.Hold{
+		ConfRef: "conf-atx25", Provider: "stripe", Count: 2, Status: types.HoldActive,
+		Expires: now.Add(30 * time.Minute), Updated: now,
+		DiscountRef: "discount-hodl", Discounted: 2,
+	}
+	if err := store.AddHold(hold); err != nil {
+		t.Fatal(err)
+	}
+	if hold.Ref == "" {
+		t.Fatalf("expected the hold to get a ref")
+	}
+
+	hold.OrderID = "cs_1"
+	hold.Status = types.HoldConverted
+	hold.Updated = now.Add(time.Minute)
+	if err := store.UpdateHold(hold); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.UpdateHold(&types.Hold{Ref: "nope"}); err == nil {
+		t.Fatalf("expected updating a missing hold to fail")
+	}
+
+	holds, err := store.ListHolds()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(holds) != 1 {
+		t.Fatalf("expected one hold, got %d", len(holds))
+	}
+	got := holds[0]
+	if got.Ref != hold.Ref || got.OrderID != "cs_1" || got.Status != types.HoldConverted || got.Count != 2 ||
+		!got.Expires.Equal(hold.Expires) || got.DiscountRef != "discount-hodl" || got.Discounted != 2 {
+		t.Fatalf("hold didn't round trip: %+v", got)
+	}
+}
+
+func TestSQLiteWaitlist(t *testing.T) {
+	store := newTestSQLite(t)
+	now := time.Now().UTC()
+	for _, email := range []string{"amy@example.com", "bob@example.com"} {
+		entry := &types.WaitlistEntry{ConfRef: "conf-atx25", Email: email, Status: types.WaitWaiting, Updated: now}
+		if err := store.AddWaitlist(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	entries, err := store.ListWaitlist()
+	if err != nil {
+		t.Fatal(err)
+	}
+	/* First come, first served */
+	if len(entries) != 2 || entries[0].Email != "amy@example.com" {
+		t.Fatalf("expected the list in order, got %+v", entries)
+	}
+	if !entries[0].Invited.IsZero() || !entries[0].Expires.IsZero() {
+		t.Fatalf("expected no invite yet, got %+v", entries[0])
+	}
+
+	invited := entries[0]
+	invited.Status = types.WaitInvited
+	invited.HoldRef = "hold1"
+	invited.Invited = now
+	invited.Expires = now.Add(24 * time.Hour)
+	invited.Updated = now
+	if err = store.UpdateWaitlist(invited); err != nil {
+		t.Fatal(err)
+	}
+	if err = store.UpdateWaitlist(&types.WaitlistEntry{Ref: "nope"}); err == nil {
+		t.Fatalf("expected updating a missing entry to fail")
+	}
+
+	entries, err = store.ListWaitlist()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := entries[0]
+	if got.Status != types.WaitInvited || got.HoldRef != "hold1" || !got.Invited.Equal(now) || !got.Expires.Equal(invited.Expires) {
+		t.Fatalf("invite didn't round trip: %+v", got)
+	}
+}
+
+func TestSQLiteWebhookEvents(t *testing.T) {
+	store := newTestSQLite(t)
+	now := time.Now().UTC()
+	ev := &types.WebhookEvent{
+		Key: types.WebhookKey("stripe", "evt_1"), Provider: "stripe", EventID: "evt_1",
+		Type: "checkout.session.completed", OrderID: "cs_1", OrderStatus: "paid",
+		Status: types.WebhookReceived, Attempts: 1, Created: now, Updated: now,
+	}
+	if err := store.AddWebhookEvent(ev); err != nil {
+		t.Fatal(err)
+	}
+	/* A redelivery is the same event */
+	dup := *ev
+	if err := store.AddWebhookEvent(&dup); err == nil {
+		t.Fatalf("expected a second event with the same key to be refused")
+	}
+
+	ev.Status = types.WebhookFailed
+	ev.Result = "conf not found"
+	ev.Attempts = 2
+	ev.Updated = now.Add(time.Minute)
+	if err := store.UpdateWebhookEvent(ev); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.UpdateWebhookEvent(&types.WebhookEvent{Ref: "nope"}); err == nil {
+		t.Fatalf("expected updating a missing event to fail")
+	}
+
+	events, err := store.ListWebhookEvents()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 {
+		t.Fatalf("expected one event, got %d", len(events))
+	}
+	got := events[0]
+	if got.Ref != ev.Key || got.Status != types.WebhookFailed || got.Result != "conf not found" ||
+		got.Attempts != 2 || got.OrderID != "cs_1" || !got.Updated.Equal(ev.Updated) {
+		t.Fatalf("event didn't round trip: %+v", got)
+	}
+
+	found, err := store.FindWebhookEvent(ev.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found == nil || found.Ref != ev.Key || found.Status != types.WebhookFailed || found.Attempts != 2 {
+		t.Fatalf("expected to find the event by key, got %+v", found)
+	}
+	if found, err = store.FindWebhookEvent(types.WebhookKey("stripe", "evt_2")); err != nil || found != nil {
+		t.Fatalf("expected no event for an unknown key, got %+v, %v", found, err)
+	}
+}
+
+/* The tables as they first shipped, before any columns were added */
+const sqliteFirstSchema = `
+CREATE TABLE discounts (
+	ref         TEXT PRIMARY KEY,
+	code_name   TEXT NOT NULL,
+	percent_off INTEGER NOT NULL DEFAULT 0,
+	conf_ref    TEXT NOT NULL DEFAULT ''
+);
+CREATE TABLE purchases (
+	ref_id       TEXT PRIMARY KEY,
+	conf_ref     TEXT NOT NULL,
+	type         TEXT NOT NULL DEFAULT '',
+	email        TEXT NOT NULL DEFAULT '',
+	item_bought  TEXT NOT NULL DEFAULT '',
+	timestamp    TIMESTAMP NOT NULL,
+	platform     TEXT NOT NULL DEFAULT '',
+	amount_paid  REAL NOT NULL DEFAULT 0,
+	currency     TEXT NOT NULL DEFAULT '',
+	lookup_id    TEXT NOT NULL DEFAULT '',
+	discount_ref TEXT NOT NULL DEFAULT '',
+	checked_in   TIMESTAMP
+);
+CREATE TABLE holds (
+	ref      TEXT PRIMARY KEY,
+	conf_ref TEXT NOT NULL,
+	provider TEXT NOT NULL DEFAULT '',
+	order_id TEXT NOT NULL DEFAULT '',
+	count    INTEGER NOT NULL DEFAULT 0,
+	status   TEXT NOT NULL,
+	expires  TIMESTAMP NOT NULL,
+	created  TIMESTAMP NOT NULL,
+	updated  TIMESTAMP NOT NULL
+);
+INSERT INTO discounts (ref, code_name, percent_off, conf_ref) VALUES ('discount-hodl', 'HODL', 20, 'conf-atx25');
+INSERT INTO purchases (ref_id, conf_ref, type, email, timestamp, platform, amount_paid, currency, lookup_id)
+	VALUES ('tix-old', 'conf-atx25', 'genpop', 'old@example.com', '2024-01-02 03:04:05+00:00', 'stripe', 100, 'usd', 'ord_old');
+`
+
+func TestSQLiteMigrate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "btcpp.db")
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.Exec(sqliteFirstSchema); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	/* Twice, to be sure it's safe to rerun */
+	for i := 0; i < 2; i++ {
+		store, err := NewSQLiteStore(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		store.db.Close()
+	}
+	store, err := NewSQLiteStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.db.Close()
+
+	rezzies, err := store.ListRegistrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rezzies) != 1 || rezzies[0].RefID != "tix-old" || rezzies[0].AmountPaid != 10000 ||
+		rezzies[0].TixID != "" || !rezzies[0].Voided.IsZero() {
+		t.Fatalf("old purchase didn't survive: %+v", rezzies)
+	}
+	discounts, err := store.ListDiscounts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(discounts) != 1 || discounts[0].CodeName != "HODL" || discounts[0].MaxUses != 0 || discounts[0].Comp {
+		t.Fatalf("old discount didn't survive: %+v", discounts)
+	}
+
+	/* The new columns work on the old tables */
+	if err = store.VoidTicket("tix-old", time.Now(), "organizer", "re_1"); err != nil {
+		t.Fatal(err)
+	}
+	hold := &types.Hold{ConfRef: "conf-atx25", Status: types.HoldActive, Expires: time.Now().Add(time.Hour), DiscountRef: "discount-hodl", Discounted: 1}
+	if err = store.AddHold(hold); err != nil {
+		t.Fatal(err)
+	}
+	holds, err := store.ListHolds()
+	if err != nil || len(holds) != 1 || holds[0].Discounted != 1 {
+		t.Fatalf("expected a hold with its discount, got %+v (%v)", holds, err)
+	}
+}
+
+func TestSQLiteNoExpiry(t *testing.T) {
+	store := newTestSQLite(t)
+	_, err := store.db.Exec(`INSERT INTO confs (ref, tag) VALUES ('conf-atx25', 'atx25');
+		INSERT INTO conf_tickets (id, conf_ref, tier, usd, max, expires) VALUES
+			('tix-late', 'conf-atx25', 'late', 200, 100, '2099-02-01 00:00:00+00:00'),
+			('tix-door', 'conf-atx25', 'door', 300, 100, NULL),
+			('tix-early', 'conf-atx25', 'early', 100, 10, '2099-01-01 00:00:00+00:00')`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	confTix, err := store.ListConfTickets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tiers []string
+	tixs := types.ConfTickets(confTix)
+	sort.Sort(&tixs)
+	for _, tix := range tixs {
+		if tix.ID == "tix-door" && tix.Expires != nil {
+			t.Fatalf("expected no expiry for a NULL date, got %+v", tix.Expires)
+		}
+		tiers = append(tiers, tix.Tier)
+	}
+	/* No date sorts last */
+	if got := strings.Join(tiers, ","); got != "early,late,door" {
+		t.Fatalf("expected tiers by date, got %s", got)
+	}
+}
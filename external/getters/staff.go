@@ -0,0 +1,110 @@
+package getters
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/base58btc/btcpp-web/internal/types"
+	"golang.org/x/crypto/bcrypt"
+)
+
+/* Compared against when there's no such login, so a
+ * miss takes as long as a wrong secret */
+var noStaffHash, _ = bcrypt.GenerateFromPassword([]byte("no such staff"), bcrypt.DefaultCost)
+
+const minStaffSecret = 8
+
+func normLogin(login string) string {
+	return strings.ToLower(strings.TrimSpace(login))
+}
+
+func FindStaff(s types.Store, login string) (*types.Staff, error) {
+	staff, err := s.ListStaff()
+	if err != nil {
+		return nil, err
+	}
+
+	login = normLogin(login)
+	for _, st := range staff {
+		if normLogin(st.Login) == login {
+			return st, nil
+		}
+	}
+	return nil, nil
+}
+
+func FindStaffByRef(s types.Store, ref string) (*types.Staff, error) {
+	staff, err := s.ListStaff()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, st := range staff {
+		if st.Ref == ref {
+			return st, nil
+		}
+	}
+	return nil, nil
+}
+
+func NewStaff(s types.Store, login, name, secret string, role types.StaffRole, confRefs []string) (*types.Staff, error) {
+	login = normLogin(login)
+	if login == "" {
+		return nil, fmt.Errorf("Staff need a login")
+	}
+	if len(secret) < minStaffSecret {
+		return nil, fmt.Errorf("Secret must be at least %d characters", minStaffSecret)
+	}
+	if role != types.RoleAdmin && len(confRefs) == 0 {
+		return nil, fmt.Errorf("%s staff need at least one conf", role)
+	}
+
+	existing, err := FindStaff(s, login)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		return nil, fmt.Errorf("There's already staff with login %s", login)
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(secret), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, err
+	}
+
+	staff := &types.Staff{
+		Login:    login,
+		Name:     name,
+		Hash:     string(hash),
+		Role:     role,
+		ConfRefs: confRefs,
+	}
+	return staff, s.AddStaff(staff)
+}
+
+/* Returns nil (and no error) for a bad login or secret */
+func AuthStaff(s types.Store, login, secret string) (*types.Staff, error) {
+	staff, err := FindStaff(s, login)
+	if err != nil {
+		return nil, err
+	}
+
+	hash := noStaffHash
+	if staff != nil {
+		hash = []byte(staff.Hash)
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(secret)) != nil {
+		return nil, nil
+	}
+	if staff == nil || staff.Revoked {
+		return nil, nil
+	}
+	return staff, nil
+}
+
+func RevokeStaff(s types.Store, staff *types.Staff) error {
+	/* Might be a cached copy; don't touch it */
+	revoked := *staff
+	revoked.Revoked = true
+	return s.UpdateStaff(&revoked)
+}
@@ -0,0 +1,303 @@
+package getters
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/base58btc/btcpp-web/internal/config"
+	"github.com/base58btc/btcpp-web/internal/types"
+)
+
+/* Pick a store backend, based on what's in the config */
+func NewStore(env *types.EnvConfig) (types.Store, error) {
+	var store types.Store
+	switch env.Store {
+	case "", "notion":
+		n := &types.Notion{Config: &env.Notion}
+		n.Setup(env.Notion.Token)
+		store = NewNotionStore(n)
+	case "sqlite":
+		var err error
+		store, err = NewSQLiteStore(env.SQLite.Path)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown store type '%s' (expected notion or sqlite)", env.Store)
+	}
+
+	if env.Cache.Off {
+		return store, nil
+	}
+	return NewCachedStore(store, env.Cache), nil
+}
+
+/* Some talk fields are derived from the others */
+func finishTalk(talk *types.Talk) {
+	if len(talk.Clipart) > 4 {
+		talk.AnchorTag = talk.Clipart[:len(talk.Clipart)-4]
+	}
+
+	if talk.Sched != nil {
+		talk.TimeDesc = talk.Sched.Desc()
+		talk.DayTag = talk.Sched.Day()
+	}
+}
+
+/* Grabs the conferences + their tickets buckets */
+func ListConferences(s types.Store) ([]*types.Conf, error) {
+	listed, err := s.ListConfs()
+	if err != nil {
+		return nil, err
+	}
+
+	/* Copy them, the store's list may be cached */
+	confs := make([]*types.Conf, len(listed))
+	for i, conf := range listed {
+		c := *conf
+		c.Tickets = nil
+		confs[i] = &c
+	}
+
+	confTix, err := s.ListConfTickets()
+	if err != nil {
+		return nil, err
+	}
+
+	/* Add conf tixs to confs */
+	for _, tix := range confTix {
+		for _, conf := range confs {
+			if conf.Ref == tix.ConfRef {
+				conf.Tickets = append(conf.Tickets, tix)
+				break
+			}
+		}
+	}
+
+	return confs, nil
+}
+
+func GetTalksFor(s types.Store, event string, speakers []*types.Speaker) ([]*types.Talk, error) {
+	talks, err := s.ListTalks(speakers)
+	if err != nil {
+		return nil, err
+	}
+	var filtered []*types.Talk
+	for _, talk := range talks {
+		if talk.Event == event {
+			filtered = append(filtered, talk)
+		}
+	}
+	return filtered, nil
+}
+
+func FindDiscount(s types.Store, code string) (*types.DiscountCode, error) {
+	discounts, err := s.ListDiscounts()
+	if err != nil {
+		return nil, err
+	}
+
+	upcode := strings.ToUpper(code)
+	for _, discount := range discounts {
+		if strings.ToUpper(discount.CodeName) == upcode {
+			return discount, nil
+		}
+	}
+	return nil, nil
+}
+
+/* How many live tickets were bought with the discount, plus
+ * those held for checkouts still open. Cancelled ones don't
+ * count; a transferred one counts once */
+func DiscountUses(s types.Store, discountRef string) (uint, error) {
+	rezzies, err := s.ListRegistrations()
+	if err != nil {
+		return 0, err
+	}
+
+	var uses uint
+	for _, rez := range rezzies {
+		if rez.DiscountRef == discountRef && rez.Voided.IsZero() {
+			uses++
+		}
+	}
+
+	holds, err := s.ListHolds()
+	if err != nil {
+		return 0, err
+	}
+	now := time.Now()
+	for _, hold := range holds {
+		if hold.DiscountRef == discountRef && hold.Active(now) {
+			uses += hold.Discounted
+		}
+	}
+	return uses, nil
+}
+
+func FindDiscountByRef(s types.Store, ref string) (*types.DiscountCode, error) {
+	discounts, err := s.ListDiscounts()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, discount := range discounts {
+		if discount.Ref == ref {
+			return discount, nil
+		}
+	}
+	return nil, nil
+}
+
+/* Finds the code, and checks it's good at the conf right now */
+func CalcDiscount(s types.Store, confRef string, code string) (*types.DiscountCode, error) {
+	discount, err := FindDiscount(s, code)
+
+	if err != nil {
+		return nil, err
+	}
+
+	/* Discount not found! */
+	if discount == nil {
+		return nil, fmt.Errorf("Discount code \"%s\" not found", code)
+	}
+
+	if discount.ConfRef != confRef {
+		return nil, fmt.Errorf("%s not a valid code for conference (%s != %s)", code, discount.ConfRef, confRef)
+	}
+
+	now := time.Now()
+	if !discount.Open(now) {
+		if now.Before(discount.ValidFrom) {
+			return nil, fmt.Errorf("Discount code \"%s\" isn't valid until %s", code, discount.ValidFrom.Format("Jan 2, 2006"))
+		}
+		return nil, fmt.Errorf("Discount code \"%s\" has expired", code)
+	}
+
+	return discount, nil
+}
+
+/* Checks the discount has 'count' more tickets left in it */
+func CheckDiscountUses(s types.Store, discount *types.DiscountCode, count uint) error {
+	limit := discount.Limit()
+	if limit == 0 {
+		return nil
+	}
+
+	uses, err := DiscountUses(s, discount.Ref)
+	if err != nil {
+		return err
+	}
+	if uses >= limit {
+		return fmt.Errorf("Discount code \"%s\" has been used up", discount.CodeName)
+	}
+	if uses+count > limit {
+		return fmt.Errorf("Discount code \"%s\" only has %d use(s) left", discount.CodeName, limit-uses)
+	}
+	return nil
+}
+
+/* What a ticket costs with the discount; a nil discount is no discount */
+func ApplyDiscount(discount *types.DiscountCode, tixPrice uint) uint {
+	if discount == nil {
+		return tixPrice
+	}
+
+	var tix uint
+	if discount.AmountOff > 0 {
+		if discount.AmountOff < tixPrice {
+			tix = tixPrice - discount.AmountOff
+		}
+	} else {
+		discountTix := float64(100-discount.PercentOff) * float64(tixPrice) / float64(100)
+		tix = uint(discountTix)
+	}
+
+	/* Only comps go all the way to free */
+	if tix == 0 && discount.Comp {
+		return 0
+	}
+
+	/* Overflows are a thing */
+	if tix == 0 || tix > tixPrice {
+		tix = 1
+	}
+	return tix
+}
+
+func ticketMatch(tickets []string, rez *types.Registration) bool {
+	for _, tix := range tickets {
+		if strings.Contains(rez.ItemBought, tix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func checkActive(ctx *config.AppContext, confRef string) bool {
+	for _, conf := range ctx.Confs {
+		if confRef == conf.Ref {
+			return conf.Active
+		}
+	}
+
+	return false
+}
+
+func FetchBtcppRegistrations(ctx *config.AppContext, activeOnly bool) ([]*types.Registration, error) {
+	var btcppres []*types.Registration
+	rezzies, err := ctx.Store.ListRegistrations()
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, r := range rezzies {
+		if r.RefID == "" {
+			continue
+		}
+
+		if activeOnly && !checkActive(ctx, r.ConfRef) {
+			continue
+		}
+
+		btcppres = append(btcppres, r)
+	}
+
+	return btcppres, nil
+}
+
+func UniqueID(email string, ref string, counter int32) string {
+	// sha256 of ref || email || count (4, le)
+	h := sha256.New()
+	h.Write([]byte(email))
+	h.Write([]byte(ref))
+
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, uint32(counter))
+	h.Write(b)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+/* Transfer history is kept as JSON, in one text field */
+func encodeTransfers(transfers []types.Transfer) string {
+	if len(transfers) == 0 {
+		return ""
+	}
+	data, _ := json.Marshal(transfers)
+	return string(data)
+}
+
+func decodeTransfers(data string) []types.Transfer {
+	var transfers []types.Transfer
+	if data != "" {
+		json.Unmarshal([]byte(data), &transfers)
+	}
+	return transfers
+}
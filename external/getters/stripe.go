@@ -0,0 +1,317 @@
+package getters
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/base58btc/btcpp-web/internal/types"
+	stripe "github.com/stripe/stripe-go/v76"
+	"github.com/stripe/stripe-go/v76/client"
+	"github.com/stripe/stripe-go/v76/webhook"
+)
+
+type StripeProvider struct {
+	api            *client.API
+	endpointSecret string
+}
+
+func NewStripeProvider(key, endpointSecret string) *StripeProvider {
+	return NewStripeProviderAt(key, endpointSecret, "")
+}
+
+/* Against some other Stripe API, e.g. stripe-mock; "" is Stripe's */
+func NewStripeProviderAt(key, endpointSecret, apiURL string) *StripeProvider {
+	var backends *stripe.Backends
+	if apiURL != "" {
+		backends = stripe.NewBackendsWithConfig(&stripe.BackendConfig{
+			URL: stripe.String(apiURL),
+		})
+	}
+	api := &client.API{}
+	api.Init(key, backends)
+	return &StripeProvider{
+		api:            api,
+		endpointSecret: endpointSecret,
+	}
+}
+
+func (p *StripeProvider) Name() string {
+	return "stripe"
+}
+
+/* Stripe's checkout asks them for it */
+func (p *StripeProvider) NeedsEmail() bool {
+	return false
+}
+
+/* Everything we need to make the tickets, once it's paid */
+func orderMetadata(order *types.Order) map[string]string {
+	metadata := make(map[string]string)
+	metadata["conf-tag"] = order.ConfTag
+	metadata["conf-ref"] = order.ConfRef
+	if len(order.Items) > 0 {
+		metadata["tix-id"] = order.Items[0].TixID
+		if order.Items[0].Type == "local" {
+			metadata["tix-local"] = "yes"
+		}
+	}
+	if order.DiscountRef != "" {
+		metadata["discount"] = order.DiscountRef
+	}
+	return metadata
+}
+
+func (p *StripeProvider) CreateCheckout(order *types.Order) (*types.Checkout, error) {
+	if len(order.Items) == 0 {
+		return nil, fmt.Errorf("nothing to check out")
+	}
+	desc := order.Items[0].Desc
+	metadata := orderMetadata(order)
+	metadata["cart"] = order.Cart()
+
+	/* One line per kind of ticket; the product says which.
+	 * Discounts are already in the prices, so no promo codes
+	 * on Stripe's end: they'd never make it to the store */
+	var lineItems []*stripe.CheckoutSessionLineItemParams
+	for _, line := range order.Lines() {
+		lineMeta := orderMetadata(order)
+		lineMeta["tix-id"] = line.TixID
+		delete(lineMeta, "tix-local")
+		if line.Type == "local" {
+			lineMeta["tix-local"] = "yes"
+		}
+
+		what := "ticket"
+		if line.Count > 1 {
+			what = "tickets"
+		}
+		if line.Type == "local" {
+			what = "local " + what
+		}
+		lineItems = append(lineItems, &stripe.CheckoutSessionLineItemParams{
+			PriceData: &stripe.CheckoutSessionLineItemPriceDataParams{
+				ProductData: &stripe.CheckoutSessionLineItemPriceDataProductDataParams{
+					Description: stripe.String(fmt.Sprintf("%d %s for the %s", line.Count, what, desc)),
+					Name:        stripe.String(desc),
+					Metadata:    lineMeta,
+				},
+				UnitAmount: stripe.Int64(line.Each),
+				Currency:   stripe.String(order.Currency),
+			},
+			Quantity: stripe.Int64(int64(line.Count)),
+		})
+	}
+
+	params := &stripe.CheckoutSessionParams{
+		LineItems:    lineItems,
+		Metadata:     metadata,
+		Mode:         stripe.String(string(stripe.CheckoutSessionModePayment)),
+		SuccessURL:   stripe.String(order.SuccessURL),
+		CancelURL:    stripe.String(order.CancelURL),
+		AutomaticTax: &stripe.CheckoutSessionAutomaticTaxParams{Enabled: stripe.Bool(true)},
+	}
+	if order.Email != "" {
+		params.CustomerEmail = stripe.String(order.Email)
+	}
+	/* Stripe wants 30m to 24h out */
+	if !order.Expires.IsZero() {
+		params.ExpiresAt = stripe.Int64(order.Expires.Unix())
+	}
+
+	s, err := p.api.CheckoutSessions.New(params)
+	if err != nil {
+		return nil, err
+	}
+
+	return &types.Checkout{
+		OrderID:   s.ID,
+		URL:       s.URL,
+		ExpiresAt: time.Unix(s.ExpiresAt, 0),
+	}, nil
+}
+
+func (p *StripeProvider) VerifyWebhook(r *http.Request) (*types.PaymentEvent, error) {
+	const MaxBodyBytes = int64(65536)
+	payload, err := ioutil.ReadAll(io.LimitReader(r.Body, MaxBodyBytes))
+	if err != nil {
+		return nil, err
+	}
+
+	event, err := webhook.ConstructEvent(payload, r.Header.Get("Stripe-Signature"), p.endpointSecret)
+	if err != nil {
+		return nil, err
+	}
+
+	ev := &types.PaymentEvent{
+		ID:   event.ID,
+		Type: string(event.Type),
+	}
+
+	switch event.Type {
+	case "checkout.session.completed",
+		"checkout.session.async_payment_succeeded",
+		"checkout.session.expired":
+		var checkout stripe.CheckoutSession
+		if err := json.Unmarshal(event.Data.Raw, &checkout); err != nil {
+			return nil, err
+		}
+		ev.OrderID = checkout.ID
+		ev.Status = stripeStatus(&checkout)
+	case "charge.refunded":
+		var charge stripe.Charge
+		if err := json.Unmarshal(event.Data.Raw, &charge); err != nil {
+			return nil, err
+		}
+		/* Partial refunds leave the tickets alone */
+		if !charge.Refunded || charge.PaymentIntent == nil {
+			break
+		}
+		orderID, err := p.paymentSession(charge.PaymentIntent.ID)
+		if err != nil {
+			return nil, err
+		}
+		ev.OrderID = orderID
+		ev.Status = types.OrderRefunded
+	}
+
+	return ev, nil
+}
+
+/* The checkout session a payment came from */
+func (p *StripeProvider) paymentSession(paymentIntent string) (string, error) {
+	sessions := p.api.CheckoutSessions.List(&stripe.CheckoutSessionListParams{
+		PaymentIntent: stripe.String(paymentIntent),
+	})
+	for sessions.Next() {
+		return sessions.CheckoutSession().ID, nil
+	}
+	if err := sessions.Err(); err != nil {
+		return "", err
+	}
+	return "", nil
+}
+
+func stripeStatus(s *stripe.CheckoutSession) types.OrderStatus {
+	switch {
+	case s.PaymentStatus == stripe.CheckoutSessionPaymentStatusPaid:
+		return types.OrderPaid
+	case s.Status == stripe.CheckoutSessionStatusExpired:
+		return types.OrderExpired
+	}
+	return types.OrderPending
+}
+
+func (p *StripeProvider) FetchCharge(orderID string) (*types.Order, error) {
+	s, err := p.api.CheckoutSessions.Get(orderID, nil)
+	if err != nil {
+		return nil, err
+	}
+	return p.sessionOrder(s)
+}
+
+/* Newest first; we stop once they're older than 'since' */
+func (p *StripeProvider) ListPaidOrders(since time.Time) ([]*types.Order, error) {
+	params := &stripe.CheckoutSessionListParams{}
+	params.Filters.AddFilter("created", "gte", strconv.FormatInt(since.Unix(), 10))
+
+	var orders []*types.Order
+	sessions := p.api.CheckoutSessions.List(params)
+	for sessions.Next() {
+		s := sessions.CheckoutSession()
+		if time.Unix(s.Created, 0).Before(since) {
+			break
+		}
+		if stripeStatus(s) != types.OrderPaid {
+			continue
+		}
+		order, err := p.sessionOrder(s)
+		if err != nil {
+			return nil, err
+		}
+		orders = append(orders, order)
+	}
+	if err := sessions.Err(); err != nil {
+		return nil, err
+	}
+
+	return orders, nil
+}
+
+func (p *StripeProvider) sessionOrder(s *stripe.CheckoutSession) (*types.Order, error) {
+	order := &types.Order{
+		ID:          s.ID,
+		Provider:    p.Name(),
+		Status:      stripeStatus(s),
+		ConfRef:     s.Metadata["conf-ref"],
+		ConfTag:     s.Metadata["conf-tag"],
+		Currency:    string(s.Currency),
+		DiscountRef: s.Metadata["discount"],
+		Created:     time.Unix(s.Created, 0).UTC(),
+	}
+	if s.CustomerDetails != nil {
+		order.Email = s.CustomerDetails.Email
+	}
+	if s.PaymentIntent != nil {
+		order.PaymentRef = s.PaymentIntent.ID
+	}
+
+	params := &stripe.CheckoutSessionListLineItemsParams{
+		Session: stripe.String(s.ID),
+	}
+	params.AddExpand("data.price.product")
+	items := p.api.CheckoutSessions.ListLineItems(params)
+	for items.Next() {
+		si := items.LineItem()
+		/* Each line's product knows its ticket; the session's
+		 * metadata is the first one's */
+		meta := s.Metadata
+		if si.Price != nil && si.Price.Product != nil && si.Price.Product.Metadata["tix-id"] != "" {
+			meta = si.Price.Product.Metadata
+		}
+		tixType := "genpop"
+		if _, isLocal := meta["tix-local"]; isLocal {
+			tixType = "local"
+		}
+
+		for i := int64(0); i < si.Quantity; i++ {
+			each := si.AmountTotal / si.Quantity
+			if i == 0 {
+				each += si.AmountTotal % si.Quantity
+			}
+			order.Items = append(order.Items, types.Item{
+				Total: each,
+				Desc:  si.Description,
+				Type:  tixType,
+				TixID: meta["tix-id"],
+			})
+		}
+	}
+	if err := items.Err(); err != nil {
+		return nil, err
+	}
+
+	return order, nil
+}
+
+func (p *StripeProvider) Refund(order *types.Order, amount int64) (*types.Refund, error) {
+	if order.PaymentRef == "" {
+		return nil, fmt.Errorf("stripe order %s has no payment to refund", order.ID)
+	}
+
+	params := &stripe.RefundParams{
+		PaymentIntent: stripe.String(order.PaymentRef),
+	}
+	if amount > 0 {
+		params.Amount = stripe.Int64(amount)
+	}
+	refund, err := p.api.Refunds.New(params)
+	if err != nil {
+		return nil, err
+	}
+	return &types.Refund{ID: refund.ID}, nil
+}
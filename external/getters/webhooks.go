@@ -0,0 +1,19 @@
+package getters
+
+import (
+	"github.com/base58btc/btcpp-web/internal/types"
+)
+
+func FindWebhookEventByRef(s types.Store, ref string) (*types.WebhookEvent, error) {
+	events, err := s.ListWebhookEvents()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, ev := range events {
+		if ev.Ref == ref {
+			return ev, nil
+		}
+	}
+	return nil, nil
+}
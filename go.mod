@@ -6,32 +6,25 @@ require (
 	github.com/BurntSushi/toml v1.2.1
 	github.com/alexedwards/scs/v2 v2.5.1
 	github.com/base58btc/mailer v0.0.0-20230403043105-589977adb995
-	github.com/chromedp/cdproto v0.0.0-20230329100754-6125fc8d7142
-	github.com/chromedp/chromedp v0.9.1
+	github.com/go-pdf/fpdf v0.9.0
 	github.com/gorilla/mux v1.8.0
 	github.com/gorilla/schema v1.2.0
+	github.com/mattn/go-sqlite3 v1.14.16
 	github.com/skip2/go-qrcode v0.0.0-20200617195104-da1b6568686e
 	github.com/sorcererxw/go-notion v0.2.4
 	github.com/stripe/stripe-go/v76 v76.3.0
+	golang.org/x/crypto v0.17.0
 )
 
 require (
-	github.com/chromedp/sysutil v1.0.0 // indirect
-	github.com/gobwas/httphead v0.1.0 // indirect
-	github.com/gobwas/pool v0.2.1 // indirect
-	github.com/gobwas/ws v1.1.0 // indirect
 	github.com/jmoiron/sqlx v1.3.5 // indirect
-	github.com/josharian/intern v1.0.0 // indirect
 	github.com/json-iterator/go v1.1.10 // indirect
 	github.com/mailgun/mailgun-go/v4 v4.8.2 // indirect
-	github.com/mailru/easyjson v0.7.7 // indirect
-	github.com/mattn/go-sqlite3 v1.14.16 // indirect
 	github.com/modern-go/concurrent v0.0.0-20180228061459-e0a39a4cb421 // indirect
 	github.com/modern-go/reflect2 v0.0.0-20180701023420-4b7aa43c6742 // indirect
-	github.com/pkg/errors v0.8.1 // indirect
+	github.com/pkg/errors v0.9.1 // indirect
 	github.com/sendgrid/rest v2.6.9+incompatible // indirect
 	github.com/sendgrid/sendgrid-go v3.12.0+incompatible // indirect
-	golang.org/x/sys v0.6.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
 
@@ -0,0 +1,298 @@
+/* Package btcpaytest is an in-process stub of the bits of the
+ * BTCPay Server Greenfield API that we use: creating + fetching
+ * invoices, their payment methods and refunds. It can also send signed webhooks, the
+ * way BTCPay does when an invoice changes.
+ *
+ * Point BTCPayConfig.Host at Server.URL to use it. */
+package btcpaytest
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/base58btc/btcpp-web/internal/types"
+)
+
+type Server struct {
+	*httptest.Server
+
+	StoreID string
+	APIKey  string
+	/* Where webhooks go, and what they're signed with */
+	WebhookURL    string
+	WebhookSecret string
+
+	mu       sync.Mutex
+	invoices map[string]*types.BTCPayInvoice
+	refunds  map[string]*types.BTCPayRefundRequest
+	/* How each paid invoice was paid */
+	paidWith map[string]string
+}
+
+func NewServer(storeID, apiKey string) *Server {
+	s := &Server{
+		StoreID:  storeID,
+		APIKey:   apiKey,
+		invoices: make(map[string]*types.BTCPayInvoice),
+		refunds:  make(map[string]*types.BTCPayRefundRequest),
+		paidWith: make(map[string]string),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.route))
+	return s
+}
+
+func newID() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+/* A copy of the invoice, if we have it */
+func (s *Server) Invoice(id string) *types.BTCPayInvoice {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	inv, ok := s.invoices[id]
+	if !ok {
+		return nil
+	}
+	cp := *inv
+	return &cp
+}
+
+func (s *Server) Invoices() []*types.BTCPayInvoice {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var invs []*types.BTCPayInvoice
+	for _, inv := range s.invoices {
+		cp := *inv
+		invs = append(invs, &cp)
+	}
+	return invs
+}
+
+/* The refund asked for on an invoice, if any */
+func (s *Server) Refund(invoiceID string) *types.BTCPayRefundRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.refunds[invoiceID]
+}
+
+func (s *Server) SetStatus(id, status string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if inv, ok := s.invoices[id]; ok {
+		inv.Status = status
+	}
+}
+
+/* Settles the invoice, paid by method (BTC or BTC-LightningNetwork) */
+func (s *Server) PayWith(id, method string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if inv, ok := s.invoices[id]; ok {
+		inv.Status = "Settled"
+		s.paidWith[id] = method
+	}
+}
+
+/* Send a webhook for the invoice, like BTCPay would. Returns
+ * our side's response code */
+func (s *Server) Deliver(evType, invoiceID, deliveryID string) (int, error) {
+	payload, err := json.Marshal(&types.BTCPayEvent{
+		DeliveryID: deliveryID,
+		WebhookID:  "webhook-test",
+		Type:       evType,
+		Timestamp:  time.Now().Unix(),
+		StoreID:    s.StoreID,
+		InvoiceID:  invoiceID,
+	})
+	if err != nil {
+		return 0, err
+	}
+	return s.DeliverRaw(payload, s.Sign(payload))
+}
+
+func (s *Server) Sign(payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(s.WebhookSecret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (s *Server) DeliverRaw(payload []byte, sig string) (int, error) {
+	req, err := http.NewRequest("POST", s.WebhookURL, bytes.NewReader(payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("BTCPay-Sig", sig)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeErr(w http.ResponseWriter, status int, code, msg string) {
+	writeJSON(w, status, map[string]string{
+		"code":    code,
+		"message": msg,
+	})
+}
+
+func (s *Server) route(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "token "+s.APIKey {
+		writeErr(w, http.StatusUnauthorized, "unauthenticated", "Authentication is required for accessing this endpoint")
+		return
+	}
+
+	prefix := "/api/v1/stores/" + s.StoreID + "/invoices"
+	if !strings.HasPrefix(r.URL.Path, prefix) {
+		writeErr(w, http.StatusNotFound, "store-not-found", "The store was not found")
+		return
+	}
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, prefix), "/"), "/")
+
+	switch {
+	case r.Method == "POST" && parts[0] == "":
+		s.createInvoice(w, r)
+	case r.Method == "GET" && parts[0] == "":
+		s.listInvoices(w, r)
+	case r.Method == "GET" && len(parts) == 1:
+		s.getInvoice(w, parts[0])
+	case r.Method == "GET" && len(parts) == 2 && parts[1] == "payment-methods":
+		s.paymentMethods(w, parts[0])
+	case r.Method == "POST" && len(parts) == 2 && parts[1] == "refund":
+		s.refund(w, r, parts[0])
+	default:
+		writeErr(w, http.StatusNotFound, "not-found", "Not found")
+	}
+}
+
+func (s *Server) createInvoice(w http.ResponseWriter, r *http.Request) {
+	var req types.BTCPayInvoiceRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErr(w, http.StatusBadRequest, "invalid-request", err.Error())
+		return
+	}
+
+	now := time.Now()
+	inv := &types.BTCPayInvoice{
+		ID:             newID(),
+		StoreID:        s.StoreID,
+		Status:         "New",
+		Amount:         req.Amount,
+		Currency:       req.Currency,
+		CreatedTime:    now.Unix(),
+		ExpirationTime: now.Add(15 * time.Minute).Unix(),
+		Metadata:       req.Metadata,
+	}
+	if req.Checkout != nil && req.Checkout.ExpirationMinutes > 0 {
+		inv.ExpirationTime = now.Add(time.Duration(req.Checkout.ExpirationMinutes) * time.Minute).Unix()
+	}
+	inv.CheckoutLink = fmt.Sprintf("%s/i/%s", s.URL, inv.ID)
+
+	s.mu.Lock()
+	s.invoices[inv.ID] = inv
+	s.mu.Unlock()
+
+	writeJSON(w, http.StatusOK, inv)
+}
+
+/* Only the status + startDate filters */
+func (s *Server) listInvoices(w http.ResponseWriter, r *http.Request) {
+	status := r.URL.Query().Get("status")
+	start, _ := strconv.ParseInt(r.URL.Query().Get("startDate"), 10, 64)
+
+	invs := []*types.BTCPayInvoice{}
+	for _, inv := range s.Invoices() {
+		if status != "" && inv.Status != status {
+			continue
+		}
+		if inv.CreatedTime < start {
+			continue
+		}
+		invs = append(invs, inv)
+	}
+	writeJSON(w, http.StatusOK, invs)
+}
+
+func (s *Server) getInvoice(w http.ResponseWriter, id string) {
+	inv := s.Invoice(id)
+	if inv == nil {
+		writeErr(w, http.StatusNotFound, "invoice-not-found", "The invoice was not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, inv)
+}
+
+func (s *Server) paymentMethods(w http.ResponseWriter, id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	inv, ok := s.invoices[id]
+	if !ok {
+		writeErr(w, http.StatusNotFound, "invoice-not-found", "The invoice was not found")
+		return
+	}
+
+	var methods []*types.BTCPayPaymentMethod
+	for _, name := range []string{"BTC", "BTC-LightningNetwork"} {
+		method := &types.BTCPayPaymentMethod{PaymentMethod: name, Payments: []*types.BTCPayPayment{}}
+		if s.paidWith[id] == name {
+			method.Payments = append(method.Payments, &types.BTCPayPayment{ID: newID(), Value: inv.Amount, Status: "Settled"})
+		}
+		methods = append(methods, method)
+	}
+	writeJSON(w, http.StatusOK, methods)
+}
+
+func (s *Server) refund(w http.ResponseWriter, r *http.Request, id string) {
+	var req types.BTCPayRefundRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErr(w, http.StatusBadRequest, "invalid-request", err.Error())
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	inv, ok := s.invoices[id]
+	if !ok {
+		writeErr(w, http.StatusNotFound, "invoice-not-found", "The invoice was not found")
+		return
+	}
+	if inv.Status != "Settled" {
+		writeErr(w, http.StatusBadRequest, "non-refundable", "Cannot refund this invoice")
+		return
+	}
+	if req.PaymentMethod == "" || req.PaymentMethod != s.paidWith[id] {
+		writeErr(w, http.StatusBadRequest, "invalid-payment-method", "Please select one of the payment methods which were available for the original invoice")
+		return
+	}
+	s.refunds[id] = &req
+
+	pullID := newID()
+	writeJSON(w, http.StatusOK, &types.BTCPayPullPayment{
+		ID:       pullID,
+		ViewLink: fmt.Sprintf("%s/pull-payments/%s", s.URL, pullID),
+	})
+}
@@ -3,7 +3,8 @@ package config
 import (
 	"html/template"
 	"log"
-	"time"
+	"sync"
+	texttemplate "text/template"
 
 	"github.com/alexedwards/scs/v2"
 	"github.com/base58btc/btcpp-web/internal/types"
@@ -11,15 +12,40 @@ import (
 
 /* application configuration settings */
 type AppContext struct {
-	Env    *types.EnvConfig
-	Notion *types.Notion
-
-	InProduction  bool
-	Err           *log.Logger
-	Infos         *log.Logger
-	Session       *scs.SessionManager
-	TemplateCache map[string]*template.Template
-	Confs         []*types.Conf
-	Speakers      []*types.Speaker
-	LastSpeakerFetch time.Time
+	Env   *types.EnvConfig
+	Store types.Store
+
+	InProduction bool
+	Err          *log.Logger
+	Infos        *log.Logger
+	Session      *scs.SessionManager
+	Confs        []*types.Conf
+	/* By provider name; see getters.NewPayments */
+	Payments map[string]types.PaymentProvider
+
+	/* Dev mode reloads these while pages are being served */
+	tmplMu        sync.RWMutex
+	templates     map[string]*template.Template
+	textTemplates map[string]*texttemplate.Template
+}
+
+func (ctx *AppContext) Template(name string) *template.Template {
+	ctx.tmplMu.RLock()
+	defer ctx.tmplMu.RUnlock()
+	return ctx.templates[name]
+}
+
+/* For plain text emails; html/template would escape them */
+func (ctx *AppContext) TextTemplate(name string) *texttemplate.Template {
+	ctx.tmplMu.RLock()
+	defer ctx.tmplMu.RUnlock()
+	return ctx.textTemplates[name]
+}
+
+/* Swaps in a freshly parsed set, all at once */
+func (ctx *AppContext) SetTemplates(html map[string]*template.Template, text map[string]*texttemplate.Template) {
+	ctx.tmplMu.Lock()
+	defer ctx.tmplMu.Unlock()
+	ctx.templates = html
+	ctx.textTemplates = text
 }
@@ -0,0 +1,484 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/base58btc/btcpp-web/external/getters"
+	"github.com/base58btc/btcpp-web/internal/config"
+	"github.com/base58btc/btcpp-web/internal/types"
+	"github.com/gorilla/mux"
+)
+
+/* How a conf is doing, from the purchases + outbox. Organizers
+ * see their confs, admins see all of them */
+
+type AdminPage struct {
+	Me       *types.Staff
+	Confs    []*AdminConf
+	Conf     *AdminConf
+	Webhooks *AdminWebhooks
+	/* Bulk discount codes, for one conf */
+	Discounts *AdminDiscounts
+	Msg       string
+	Updated   time.Time
+	/* Goes in every form that changes something */
+	CSRF string
+}
+
+/* Payment webhooks, newest first. Failed ones can be replayed */
+type AdminWebhooks struct {
+	Failed []*types.WebhookEvent
+	/* Paid for tickets that had gone to someone else */
+	Oversold []*types.WebhookEvent
+	Recent []*types.WebhookEvent
+}
+
+type AdminConf struct {
+	Conf        *types.Conf
+	Sold        int
+	CheckedIn   int
+	Cancelled   int
+	Transferred int
+	/* Tickets whose buyer hasn't said who's coming */
+	Unclaimed int
+	Shirts    []*ShirtStat
+	Tiers     []*TierStat
+	Revenue   []*RevenueStat
+	Discounts []*DiscountStat
+	CheckIns  []*CheckInStat
+	Mail      []*MailStat
+	Waitlist  *WaitlistStat
+	/* Mails that need a look */
+	Stuck []*types.OutboxMail
+}
+
+type TierStat struct {
+	Tier    string
+	Max     uint
+	Sold    int
+	Expires string
+}
+
+type RevenueStat struct {
+	Currency string
+	Platform string
+	Tickets  int
+	Amount   int64
+}
+
+type DiscountStat struct {
+	Code       string
+	PercentOff uint
+	AmountOff  uint
+	/* Tickets it's good for; 0 is no limit */
+	Limit     uint
+	Purchases int
+	Tickets   int
+	Amount    int64
+	Currency  string
+}
+
+type CheckInStat struct {
+	Type      string
+	Sold      int
+	CheckedIn int
+}
+
+type ShirtStat struct {
+	Size  types.ShirtSize
+	Count int
+}
+
+/* Who's waiting, and how the invites went */
+type WaitlistStat struct {
+	Waiting int
+	/* Invites still open */
+	Invited int
+	/* Bought after being invited */
+	Converted int
+	Lapsed    int
+	/* Bought without needing an invite */
+	BoughtAnyway int
+}
+
+/* Of the invites that are done with, how many bought */
+func (s *WaitlistStat) Conversion() string {
+	done := s.Converted + s.Lapsed
+	if done == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%d%%", s.Converted*100/done)
+}
+
+type MailStat struct {
+	Status types.MailStatus
+	Count  int
+}
+
+func fmtAmount(cents int64, currency string) string {
+	return fmt.Sprintf("%.2f %s", float64(cents)/100, strings.ToUpper(currency))
+}
+
+func (r *RevenueStat) Total() string {
+	return fmtAmount(r.Amount, r.Currency)
+}
+
+func (d *DiscountStat) Total() string {
+	return fmtAmount(d.Amount, d.Currency)
+}
+
+/* Revenue in each currency, for the summary line */
+func (a *AdminConf) RevenueDesc() string {
+	totals := make(map[string]int64)
+	var currencies []string
+	for _, rev := range a.Revenue {
+		if _, ok := totals[rev.Currency]; !ok {
+			currencies = append(currencies, rev.Currency)
+		}
+		totals[rev.Currency] += rev.Amount
+	}
+	var parts []string
+	for _, cur := range currencies {
+		parts = append(parts, fmtAmount(totals[cur], cur))
+	}
+	return strings.Join(parts, " + ")
+}
+
+func adminConfs(ctx *config.AppContext, me *types.Staff) []*types.Conf {
+	var confs []*types.Conf
+	for _, conf := range ctx.Confs {
+		if me.Can(types.RoleOrganizer, conf.Ref) {
+			confs = append(confs, conf)
+		}
+	}
+	return confs
+}
+
+var adminMailOrder = []types.MailStatus{
+	types.MailPending,
+	types.MailRendering,
+	types.MailSent,
+	types.MailFailed,
+	types.MailDead,
+}
+
+func buildAdminConf(conf *types.Conf, rezzies []*types.Registration, outbox []*types.OutboxMail, discounts map[string]*types.DiscountCode, waitlist []*types.WaitlistEntry) *AdminConf {
+	stats := &AdminConf{Conf: conf, Waitlist: &WaitlistStat{}}
+
+	tixs := types.ConfTickets(append([]*types.ConfTicket{}, conf.Tickets...))
+	sort.Sort(&tixs)
+	tiers := make(map[string]*TierStat)
+	for _, tix := range tixs {
+		tier := &TierStat{Tier: tix.Tier, Max: tix.Max}
+		if tix.Expires != nil {
+			tier.Expires = tix.Expires.Start.Format("Jan 2, 2006")
+		}
+		tiers[tix.ID] = tier
+		stats.Tiers = append(stats.Tiers, tier)
+	}
+	/* Purchases from before we kept track of tiers */
+	unknownTier := &TierStat{Tier: "(not recorded)"}
+
+	revenue := make(map[string]*RevenueStat)
+	discountStats := make(map[string]*DiscountStat)
+	discountBuys := make(map[string]map[string]bool)
+	checkins := make(map[string]*CheckInStat)
+	orders := orderSizes(rezzies)
+	shirts := make(map[types.ShirtSize]int)
+
+	for _, rez := range rezzies {
+		if rez.ConfRef != conf.Ref {
+			continue
+		}
+		if rez.TransferredTo() != "" {
+			stats.Transferred++
+			continue
+		}
+		if !rez.Voided.IsZero() {
+			stats.Cancelled++
+			continue
+		}
+		stats.Sold++
+		if awaitingClaim(rez, orders) {
+			stats.Unclaimed++
+		}
+		if rez.Attendee.ShirtSize != "" {
+			shirts[rez.Attendee.ShirtSize]++
+		}
+
+		tier, ok := tiers[rez.TixID]
+		if !ok {
+			tier = unknownTier
+		}
+		tier.Sold++
+
+		revKey := rez.Currency + "/" + rez.Platform
+		rev, ok := revenue[revKey]
+		if !ok {
+			rev = &RevenueStat{Currency: rez.Currency, Platform: rez.Platform}
+			revenue[revKey] = rev
+			stats.Revenue = append(stats.Revenue, rev)
+		}
+		rev.Tickets++
+		rev.Amount += rez.AmountPaid
+
+		if rez.DiscountRef != "" {
+			disc, ok := discountStats[rez.DiscountRef]
+			if !ok {
+				disc = &DiscountStat{Code: rez.DiscountRef, Currency: rez.Currency}
+				if code, ok := discounts[rez.DiscountRef]; ok {
+					disc.Code = code.CodeName
+					disc.PercentOff = code.PercentOff
+					disc.AmountOff = code.AmountOff
+					disc.Limit = code.Limit()
+				}
+				discountStats[rez.DiscountRef] = disc
+				discountBuys[rez.DiscountRef] = make(map[string]bool)
+				stats.Discounts = append(stats.Discounts, disc)
+			}
+			disc.Tickets++
+			disc.Amount += rez.AmountPaid
+			discountBuys[rez.DiscountRef][rez.LookupID] = true
+			disc.Purchases = len(discountBuys[rez.DiscountRef])
+		}
+
+		checkin, ok := checkins[rez.Type]
+		if !ok {
+			checkin = &CheckInStat{Type: rez.Type}
+			checkins[rez.Type] = checkin
+			stats.CheckIns = append(stats.CheckIns, checkin)
+		}
+		checkin.Sold++
+		if !rez.CheckedIn.IsZero() {
+			checkin.CheckedIn++
+			stats.CheckedIn++
+		}
+	}
+	if unknownTier.Sold > 0 {
+		stats.Tiers = append(stats.Tiers, unknownTier)
+	}
+	for _, size := range types.ShirtSizes() {
+		if shirts[size] > 0 {
+			stats.Shirts = append(stats.Shirts, &ShirtStat{Size: size, Count: shirts[size]})
+		}
+	}
+
+	sort.Slice(stats.Revenue, func(i, j int) bool {
+		if stats.Revenue[i].Currency != stats.Revenue[j].Currency {
+			return stats.Revenue[i].Currency < stats.Revenue[j].Currency
+		}
+		return stats.Revenue[i].Platform < stats.Revenue[j].Platform
+	})
+	sort.Slice(stats.Discounts, func(i, j int) bool {
+		return stats.Discounts[i].Tickets > stats.Discounts[j].Tickets
+	})
+	sort.Slice(stats.CheckIns, func(i, j int) bool {
+		return stats.CheckIns[i].Type < stats.CheckIns[j].Type
+	})
+
+	for _, entry := range waitlist {
+		if entry.ConfRef != conf.Ref {
+			continue
+		}
+		switch {
+		case entry.Status == types.WaitWaiting:
+			stats.Waitlist.Waiting++
+		case entry.Status == types.WaitInvited:
+			stats.Waitlist.Invited++
+		case entry.Status == types.WaitLapsed:
+			stats.Waitlist.Lapsed++
+		case entry.Status == types.WaitBought && !entry.Invited.IsZero():
+			stats.Waitlist.Converted++
+		case entry.Status == types.WaitBought:
+			stats.Waitlist.BoughtAnyway++
+		}
+	}
+
+	mail := make(map[types.MailStatus]int)
+	for _, m := range outbox {
+		if m.ConfRef != conf.Ref {
+			continue
+		}
+		mail[m.Status]++
+		if m.Status == types.MailFailed || m.Status == types.MailDead {
+			stats.Stuck = append(stats.Stuck, m)
+		}
+	}
+	for _, status := range adminMailOrder {
+		stats.Mail = append(stats.Mail, &MailStat{Status: status, Count: mail[status]})
+	}
+	sort.Slice(stats.Stuck, func(i, j int) bool {
+		return stats.Stuck[i].Updated.After(stats.Stuck[j].Updated)
+	})
+
+	return stats
+}
+
+func loadAdminConfs(ctx *config.AppContext, confs []*types.Conf) ([]*AdminConf, error) {
+	rezzies, err := ctx.Store.ListRegistrations()
+	if err != nil {
+		return nil, err
+	}
+	outbox, err := ctx.Store.ListOutbox()
+	if err != nil {
+		return nil, err
+	}
+	codes, err := ctx.Store.ListDiscounts()
+	if err != nil {
+		return nil, err
+	}
+	discounts := make(map[string]*types.DiscountCode)
+	for _, code := range codes {
+		discounts[code.Ref] = code
+	}
+
+	waitlist, err := ctx.Store.ListWaitlist()
+	if err != nil {
+		return nil, err
+	}
+
+	var stats []*AdminConf
+	for _, conf := range confs {
+		stats = append(stats, buildAdminConf(conf, rezzies, outbox, discounts, waitlist))
+	}
+	return stats, nil
+}
+
+func renderAdmin(w http.ResponseWriter, ctx *config.AppContext, page *AdminPage) {
+	err := ctx.Template("admin.tmpl").ExecuteTemplate(w, "admin.tmpl", page)
+	if err != nil {
+		http.Error(w, "Unable to load page, please try again later", http.StatusInternalServerError)
+		ctx.Err.Printf("/admin ExecuteTemplate failed ! %s", err.Error())
+	}
+}
+
+func Admin(w http.ResponseWriter, r *http.Request, ctx *config.AppContext) {
+	me := requireStaff(w, r, ctx, types.RoleOrganizer, "")
+	if me == nil {
+		return
+	}
+
+	stats, err := loadAdminConfs(ctx, adminConfs(ctx, me))
+	if err != nil {
+		http.Error(w, "Unable to load page, please try again later", http.StatusInternalServerError)
+		ctx.Err.Printf("/admin unable to load stats: %s", err)
+		return
+	}
+
+	renderAdmin(w, ctx, &AdminPage{
+		Me:      me,
+		Confs:   stats,
+		Updated: time.Now(),
+	})
+}
+
+func AdminConfStats(w http.ResponseWriter, r *http.Request, ctx *config.AppContext) {
+	conf, err := findConf(r, ctx)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	me := requireStaff(w, r, ctx, types.RoleOrganizer, conf.Ref)
+	if me == nil {
+		return
+	}
+
+	stats, err := loadAdminConfs(ctx, []*types.Conf{conf})
+	if err != nil {
+		http.Error(w, "Unable to load page, please try again later", http.StatusInternalServerError)
+		ctx.Err.Printf("/admin/%s unable to load stats: %s", conf.Tag, err)
+		return
+	}
+
+	renderAdmin(w, ctx, &AdminPage{
+		Me:      me,
+		Conf:    stats[0],
+		Msg:     r.URL.Query().Get("msg"),
+		Updated: time.Now(),
+		CSRF:    csrfToken(ctx, r),
+	})
+}
+
+const adminRecentWebhooks = 50
+
+func AdminWebhookLog(w http.ResponseWriter, r *http.Request, ctx *config.AppContext) {
+	me := requireStaff(w, r, ctx, types.RoleAdmin, "")
+	if me == nil {
+		return
+	}
+
+	events, err := ctx.Store.ListWebhookEvents()
+	if err != nil {
+		http.Error(w, "Unable to load page, please try again later", http.StatusInternalServerError)
+		ctx.Err.Printf("/admin/webhooks unable to list events: %s", err)
+		return
+	}
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].Updated.After(events[j].Updated)
+	})
+
+	hooks := &AdminWebhooks{}
+	for _, ev := range events {
+		switch ev.Status {
+		case types.WebhookFailed:
+			hooks.Failed = append(hooks.Failed, ev)
+		case types.WebhookOversold:
+			hooks.Oversold = append(hooks.Oversold, ev)
+		}
+		if len(hooks.Recent) < adminRecentWebhooks {
+			hooks.Recent = append(hooks.Recent, ev)
+		}
+	}
+
+	renderAdmin(w, ctx, &AdminPage{
+		Me:       me,
+		Webhooks: hooks,
+		Msg:      r.URL.Query().Get("msg"),
+		Updated:  time.Now(),
+		CSRF:     csrfToken(ctx, r),
+	})
+}
+
+/* Once whatever made it fail is fixed, run it again */
+func AdminWebhookReplay(w http.ResponseWriter, r *http.Request, ctx *config.AppContext) {
+	me := requireStaff(w, r, ctx, types.RoleAdmin, "")
+	if me == nil || !requireCSRF(w, r, ctx) {
+		return
+	}
+
+	webhookMu.Lock()
+	defer webhookMu.Unlock()
+
+	ref := mux.Vars(r)["ref"]
+	ev, err := getters.FindWebhookEventByRef(ctx.Store, ref)
+	if err != nil {
+		http.Error(w, "Unable to load page, please try again later", http.StatusInternalServerError)
+		ctx.Err.Printf("/admin/webhooks unable to find %s: %s", ref, err)
+		return
+	}
+	if ev == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	var msg string
+	provider, ok := ctx.Payments[ev.Provider]
+	switch {
+	case ev.Status != types.WebhookFailed:
+		msg = fmt.Sprintf("%s is %s, only failed events can be replayed", ev.EventID, ev.Status)
+	case !ok:
+		msg = fmt.Sprintf("%s isn't set up here", ev.Provider)
+	default:
+		ctx.Infos.Printf("%s replaying %s webhook %s", me.Login, ev.Provider, ev.EventID)
+		runWebhookEvent(ctx, provider, ev)
+		msg = "Replayed " + ev.EventID
+	}
+
+	http.Redirect(w, r, "/admin/webhooks?msg="+url.QueryEscape(msg), http.StatusSeeOther)
+}
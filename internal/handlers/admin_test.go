@@ -0,0 +1,137 @@
+package handlers
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/base58btc/btcpp-web/external/getters"
+	"github.com/base58btc/btcpp-web/internal/types"
+)
+
+func TestAdminDashboard(t *testing.T) {
+	ta := newTestApp(t)
+
+	entries := []struct {
+		entry *types.Entry
+		src   string
+	}{
+		{&types.Entry{
+			ID: "cs_test_admin", ConfRef: "conf-atx25", Currency: "usd", Email: "ross@example.com",
+			Items: []types.Item{
+				{Total: 10000, Type: "genpop", TixID: "tix-atx25-early"},
+				{Total: 10000, Type: "genpop", TixID: "tix-atx25-early"},
+			},
+		}, "stripe"},
+		{&types.Entry{
+			ID: "on_test_admin", ConfRef: "conf-atx25", Currency: "usd", Email: "gavin@example.com",
+			DiscountRef: "discount-hodl",
+			Items:       []types.Item{{Total: 8000, Type: "local", TixID: "tix-atx25-late"}},
+		}, "opennode"},
+		{&types.Entry{
+			ID: "cs_test_admin_old", ConfRef: "conf-atx25", Currency: "usd", Email: "wei@example.com",
+			Items: []types.Item{{Total: 5000, Type: "genpop"}},
+		}, "stripe"},
+		{&types.Entry{
+			ID: "cs_test_admin_berlin", ConfRef: "conf-berlin23", Currency: "eur", Email: "satoshi@example.com",
+			Items: []types.Item{{Total: 99900, Type: "genpop"}},
+		}, "stripe"},
+	}
+	for _, e := range entries {
+		e.entry.Created = time.Now()
+		if err := ta.Store.AddTickets(e.entry, e.src); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, _, err := ta.Store.CheckIn(getters.UniqueID("gavin@example.com", "on_test_admin", 0), time.Now(), "door"); err != nil {
+		t.Fatal(err)
+	}
+
+	/* Door volunteers don't get the numbers */
+	door := ta.client(t)
+	resp, err := door.PostForm(ta.Server.URL+"/admin", loginForm("door"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	readBody(t, resp)
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected door to be kept out of /admin, got %d", resp.StatusCode)
+	}
+
+	org := ta.client(t)
+	resp, err = org.PostForm(ta.Server.URL+"/admin", loginForm("organizer"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := readBody(t, resp)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(body, "/admin/atx25") || !strings.Contains(body, "4 sold") {
+		t.Fatalf("expected atx25 summary (%d): %s", resp.StatusCode, body)
+	}
+	if strings.Contains(body, "/admin/berlin23") {
+		t.Fatalf("organizer can see a conf that isn't theirs: %s", body)
+	}
+
+	resp, err = org.Get(ta.Server.URL + "/admin/berlin23")
+	if err != nil {
+		t.Fatal(err)
+	}
+	readBody(t, resp)
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected berlin23 to be off limits, got %d", resp.StatusCode)
+	}
+
+	resp, err = org.Get(ta.Server.URL + "/admin/atx25")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body = readBody(t, resp)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("admin/atx25 failed (%d): %s", resp.StatusCode, body)
+	}
+
+	conf := findConfByRef(ta.AppContext, "conf-atx25")
+	stats, err := loadAdminConfs(ta.AppContext, []*types.Conf{conf})
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := stats[0]
+	if st.Sold != 4 || st.CheckedIn != 1 {
+		t.Fatalf("expected 4 sold, 1 checked in; got %d, %d", st.Sold, st.CheckedIn)
+	}
+
+	tiers := make(map[string]int)
+	for _, tier := range st.Tiers {
+		tiers[tier.Tier] = tier.Sold
+	}
+	if tiers["early"] != 2 || tiers["late"] != 1 || tiers["(not recorded)"] != 1 {
+		t.Fatalf("unexpected tiers: %v", tiers)
+	}
+
+	revenue := make(map[string]string)
+	for _, rev := range st.Revenue {
+		revenue[rev.Platform] = rev.Total()
+	}
+	if revenue["stripe"] != "250.00 USD" || revenue["opennode"] != "80.00 USD" {
+		t.Fatalf("unexpected revenue: %v", revenue)
+	}
+
+	if len(st.Discounts) != 1 || st.Discounts[0].Code != "HODL" || st.Discounts[0].Tickets != 1 {
+		t.Fatalf("unexpected discounts: %+v", st.Discounts)
+	}
+
+	for _, checkin := range st.CheckIns {
+		if checkin.Type == "local" && checkin.CheckedIn != 1 {
+			t.Fatalf("expected local check-in, got %+v", checkin)
+		}
+		if checkin.Type == "genpop" && (checkin.Sold != 3 || checkin.CheckedIn != 0) {
+			t.Fatalf("unexpected genpop check-ins: %+v", checkin)
+		}
+	}
+
+	for _, needle := range []string{"HODL", "250.00 USD", "(not recorded)"} {
+		if !strings.Contains(body, needle) {
+			t.Fatalf("expected %q on the page: %s", needle, body)
+		}
+	}
+}
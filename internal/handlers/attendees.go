@@ -0,0 +1,309 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/base58btc/btcpp-web/internal/config"
+	"github.com/base58btc/btcpp-web/internal/types"
+	mailer "github.com/base58btc/mailer/mail"
+	"github.com/gorilla/mux"
+)
+
+/* Whoever buys more than one ticket tells us who's coming on
+ * each, at a signed /claim/{order} link we mail them. Those
+ * tickets wait in the outbox until they've got someone on them,
+ * then go straight to that person. Every ticket mail links to
+ * /attendee/{ticket}, so people can fix their own details */
+
+type ClaimTmpl struct {
+	URI   string
+	Conf  string
+	Count int
+	Link  string
+}
+
+type ClaimTicket struct {
+	Rez  *types.Registration
+	Num  int
+	Tier string
+}
+
+type ClaimPage struct {
+	Conf    *types.Conf
+	Tickets []*ClaimTicket
+	Sizes   []types.ShirtSize
+	Msg     string
+	Err     string
+}
+
+type AttendeePage struct {
+	Conf         *types.Conf
+	Rez          *types.Registration
+	Sizes        []types.ShirtSize
+	TransferLink string
+	Msg          string
+	Err          string
+}
+
+func linkSig(ctx *config.AppContext, kind, id string) string {
+	mac := hmac.New(sha256.New, ctx.Env.HMACKey[:])
+	mac.Write([]byte("btcpp-" + kind + "\n" + id))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func linkSigOk(ctx *config.AppContext, kind, id, sig string) bool {
+	return hmac.Equal([]byte(linkSig(ctx, kind, id)), []byte(sig))
+}
+
+func claimLink(ctx *config.AppContext, orderID string) string {
+	return fmt.Sprintf("%s/claim/%s?s=%s", ctx.Env.GetURI(), url.PathEscape(orderID), linkSig(ctx, "claim", orderID))
+}
+
+func attendeeLink(ctx *config.AppContext, ticket string) string {
+	return fmt.Sprintf("%s/attendee/%s?s=%s", ctx.Env.GetURI(), url.PathEscape(ticket), linkSig(ctx, "attendee", ticket))
+}
+
+/* Tickets per order, so we know which ones need claiming */
+func orderSizes(rezzies []*types.Registration) map[string]int {
+	sizes := make(map[string]int)
+	for _, rez := range rezzies {
+		if rez.LookupID != "" && rez.TransferredFrom() == "" {
+			sizes[rez.LookupID]++
+		}
+	}
+	return sizes
+}
+
+/* A ticket from a multi-ticket order that nobody's on yet */
+func awaitingClaim(rez *types.Registration, sizes map[string]int) bool {
+	return rez.Attendee.Email == "" && sizes[rez.LookupID] > 1
+}
+
+/* Reads and checks one attendee's fields, named prefix+field */
+func attendeeForm(r *http.Request, prefix string) (*types.Attendee, error) {
+	attendee := &types.Attendee{
+		Name:          strings.TrimSpace(r.PostForm.Get(prefix + "name")),
+		Email:         strings.TrimSpace(r.PostForm.Get(prefix + "email")),
+		Dietary:       strings.TrimSpace(r.PostForm.Get(prefix + "dietary")),
+		Accessibility: strings.TrimSpace(r.PostForm.Get(prefix + "accessibility")),
+	}
+
+	if size := r.PostForm.Get(prefix + "shirt"); size != "" {
+		shirt, ok := types.ParseShirtSize(size)
+		if !ok {
+			return nil, fmt.Errorf("%q isn't a shirt size we have", size)
+		}
+		attendee.ShirtSize = shirt
+	}
+	if attendee.Name == "" {
+		return nil, fmt.Errorf("Every ticket needs a name")
+	}
+	if !strings.Contains(attendee.Email, "@") {
+		return nil, fmt.Errorf("%q doesn't look like an email", attendee.Email)
+	}
+	return attendee, nil
+}
+
+func orderTickets(ctx *config.AppContext, orderID string) ([]*types.Registration, error) {
+	rezzies, err := ctx.Store.ListRegistrations()
+	if err != nil {
+		return nil, err
+	}
+	var tickets []*types.Registration
+	for _, rez := range rezzies {
+		if rez.LookupID == orderID && rez.Voided.IsZero() {
+			tickets = append(tickets, rez)
+		}
+	}
+	return tickets, nil
+}
+
+func claimPage(conf *types.Conf, tickets []*types.Registration) *ClaimPage {
+	page := &ClaimPage{Conf: conf, Sizes: types.ShirtSizes()}
+	for i, rez := range tickets {
+		tier := prettyTixType(rez.Type)
+		for _, tix := range conf.Tickets {
+			if tix.ID == rez.TixID {
+				tier = tix.Tier
+			}
+		}
+		page.Tickets = append(page.Tickets, &ClaimTicket{Rez: rez, Num: i + 1, Tier: tier})
+	}
+	return page
+}
+
+/* The buyer's page. Tickets that are already someone's are
+ * shown but left alone; that person has their own link */
+func ClaimTickets(w http.ResponseWriter, r *http.Request, ctx *config.AppContext) {
+	orderID := mux.Vars(r)["order"]
+	if !linkSigOk(ctx, "claim", orderID, r.URL.Query().Get("s")) {
+		http.NotFound(w, r)
+		return
+	}
+
+	tickets, err := orderTickets(ctx, orderID)
+	if err != nil {
+		http.Error(w, "Unable to load page, please try again later", http.StatusInternalServerError)
+		ctx.Err.Printf("/claim/%s unable to load tickets: %s", orderID, err)
+		return
+	}
+	if len(tickets) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	conf := findConfByRef(ctx, tickets[0].ConfRef)
+	if conf == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	page := claimPage(conf, tickets)
+	page.Msg = r.URL.Query().Get("msg")
+
+	if r.Method == http.MethodPost {
+		r.ParseForm()
+		/* All or nothing, so a typo doesn't half-save it */
+		claims := make(map[string]*types.Attendee)
+		for _, rez := range tickets {
+			prefix := rez.RefID + "-"
+			if rez.Attendee.Email != "" || (r.PostForm.Get(prefix+"name") == "" && r.PostForm.Get(prefix+"email") == "") {
+				continue
+			}
+			attendee, err := attendeeForm(r, prefix)
+			if err != nil {
+				page.Err = err.Error()
+				break
+			}
+			claims[rez.RefID] = attendee
+		}
+
+		if page.Err == "" {
+			for ticket, attendee := range claims {
+				if err = ctx.Store.UpdateAttendee(ticket, attendee); err != nil {
+					http.Error(w, "Unable to load page, please try again later", http.StatusInternalServerError)
+					ctx.Err.Printf("/claim/%s unable to update %s: %s", orderID, ticket, err)
+					return
+				}
+			}
+			ctx.Infos.Printf("%d tickets claimed on order %s", len(claims), orderID)
+			msg := fmt.Sprintf("Saved! %d tickets are on their way", len(claims))
+			http.Redirect(w, r, r.URL.Path+"?s="+r.URL.Query().Get("s")+"&msg="+url.QueryEscape(msg), http.StatusSeeOther)
+			return
+		}
+		w.WriteHeader(http.StatusBadRequest)
+	}
+
+	err = ctx.Template("claim.tmpl").ExecuteTemplate(w, "claim.tmpl", page)
+	if err != nil {
+		http.Error(w, "Unable to load page, please try again later", http.StatusInternalServerError)
+		ctx.Err.Printf("/claim/%s ExecuteTemplate failed ! %s", orderID, err.Error())
+	}
+}
+
+/* An attendee's own page. Their email stays put; handing
+ * the ticket to someone else is a transfer */
+func EditAttendee(w http.ResponseWriter, r *http.Request, ctx *config.AppContext) {
+	ticket := mux.Vars(r)["ticket"]
+	if !linkSigOk(ctx, "attendee", ticket, r.URL.Query().Get("s")) {
+		http.NotFound(w, r)
+		return
+	}
+
+	rez, err := findRegistration(ctx, ticket)
+	if err != nil {
+		http.Error(w, "Unable to load page, please try again later", http.StatusInternalServerError)
+		ctx.Err.Printf("/attendee/%s unable to load ticket: %s", ticket, err)
+		return
+	}
+	if rez == nil || !rez.Voided.IsZero() {
+		http.NotFound(w, r)
+		return
+	}
+	conf := findConfByRef(ctx, rez.ConfRef)
+	if conf == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	page := &AttendeePage{
+		Conf:         conf,
+		Rez:          rez,
+		Sizes:        types.ShirtSizes(),
+		TransferLink: ticketTransferLink(ctx, rez.RefID),
+		Msg:          r.URL.Query().Get("msg"),
+	}
+
+	if r.Method == http.MethodPost {
+		r.ParseForm()
+		r.PostForm.Set("email", rez.MailTo())
+		attendee, err := attendeeForm(r, "")
+		if err == nil {
+			err = ctx.Store.UpdateAttendee(rez.RefID, attendee)
+			if err != nil {
+				http.Error(w, "Unable to load page, please try again later", http.StatusInternalServerError)
+				ctx.Err.Printf("/attendee/%s unable to update: %s", ticket, err)
+				return
+			}
+			http.Redirect(w, r, r.URL.Path+"?s="+r.URL.Query().Get("s")+"&msg=Saved!", http.StatusSeeOther)
+			return
+		}
+		page.Err = err.Error()
+		w.WriteHeader(http.StatusBadRequest)
+	}
+
+	err = ctx.Template("attendee.tmpl").ExecuteTemplate(w, "attendee.tmpl", page)
+	if err != nil {
+		http.Error(w, "Unable to load page, please try again later", http.StatusInternalServerError)
+		ctx.Err.Printf("/attendee/%s ExecuteTemplate failed ! %s", ticket, err.Error())
+	}
+}
+
+/* Asks the buyer who's coming; mail.RefID is the order */
+func SendClaimMail(ctx *config.AppContext, mail *types.OutboxMail) error {
+	conf := findConfByRef(ctx, mail.ConfRef)
+	if conf == nil {
+		return fmt.Errorf("No conference found for ref %s", mail.ConfRef)
+	}
+	tickets, err := orderTickets(ctx, mail.RefID)
+	if err != nil {
+		return err
+	}
+
+	data := &ClaimTmpl{
+		URI:   ctx.Env.GetURI(),
+		Conf:  conf.Desc,
+		Count: len(tickets),
+		Link:  claimLink(ctx, mail.RefID),
+	}
+	var htmlBody, textBody bytes.Buffer
+	if err := ctx.Template("email-html-claim").Execute(&htmlBody, data); err != nil {
+		return err
+	}
+	if err := ctx.TextTemplate("email-text-claim").Execute(&textBody, data); err != nil {
+		return err
+	}
+
+	if !ctx.Env.Prod {
+		ctx.Infos.Printf("About to send claim link to %s, but desisting, not prod!\n", mail.Email)
+		return nil
+	}
+
+	return SendMailRequest(ctx, &mailer.MailRequest{
+		JobKey:   "btcpp-claim-" + mail.RefID,
+		ToAddr:   mail.Email,
+		FromAddr: "hello@btcpp.dev",
+		FromName: "bitcoin++ ✨",
+		Title:    fmt.Sprintf("[%s] Who's coming? Send out your tickets", conf.Desc),
+		HTMLBody: htmlBody.String(),
+		TextBody: textBody.String(),
+		SendAt:   float64(time.Now().UTC().Unix()),
+	})
+}
@@ -0,0 +1,174 @@
+package handlers
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/base58btc/btcpp-web/external/getters"
+	"github.com/base58btc/btcpp-web/internal/types"
+)
+
+func TestClaimTickets(t *testing.T) {
+	ta := newTestApp(t)
+	buyer := "boss@example.com"
+	err := ta.Store.AddTickets(&types.Entry{
+		ID:       "cs_team",
+		ConfRef:  "conf-atx25",
+		Currency: "usd",
+		Created:  time.Now(),
+		Email:    buyer,
+		Items: []types.Item{
+			{Total: 10000, Desc: "atx25 ticket", Type: "genpop", TixID: "tix-atx25-early"},
+			{Total: 10000, Desc: "atx25 ticket", Type: "genpop", TixID: "tix-atx25-early"},
+			{Total: 10000, Desc: "atx25 ticket", Type: "genpop", TixID: "tix-atx25-early"},
+		},
+	}, "stripe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tickets := make([]string, 3)
+	for i := range tickets {
+		tickets[i] = getters.UniqueID(buyer, "cs_team", int32(i))
+	}
+
+	/* The buyer gets a link, not three tickets */
+	CheckForNewMails(ta.AppContext)
+	CheckForNewMails(ta.AppContext)
+	mails := ta.Mailer.Mails()
+	if len(mails) != 1 || mails[0].ToAddr != buyer || len(mails[0].Attachments) != 0 {
+		t.Fatalf("expected just a claim mail, got %d", len(mails))
+	}
+	link := claimLink(ta.AppContext, "cs_team")
+	if !strings.Contains(mails[0].TextBody, link) {
+		t.Fatalf("claim mail is missing its link: %s", mails[0].TextBody)
+	}
+	claimURL := ta.Server.URL + strings.TrimPrefix(link, ta.Env.GetURI())
+
+	client := noRedirects(ta.client(t))
+	resp, err := client.Get(ta.Server.URL + "/claim/cs_team?s=nope")
+	if err != nil {
+		t.Fatal(err)
+	}
+	readBody(t, resp)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected a bad link to 404, got %d", resp.StatusCode)
+	}
+	resp, err = client.Get(claimURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := readBody(t, resp); resp.StatusCode != http.StatusOK || !strings.Contains(body, tickets[2]+"-shirt") {
+		t.Fatalf("expected claim page, got %d", resp.StatusCode)
+	}
+
+	form := url.Values{
+		tickets[0] + "-name":    {"Hal"},
+		tickets[0] + "-email":   {"hal@example.com"},
+		tickets[0] + "-shirt":   {"large"},
+		tickets[0] + "-dietary": {"vegan"},
+		tickets[1] + "-name":    {"Adam"},
+		tickets[1] + "-email":   {"adam@example.com"},
+		tickets[1] + "-shirt":   {"huge"},
+	}
+	resp, err = client.PostForm(claimURL, form)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := readBody(t, resp); resp.StatusCode != http.StatusBadRequest || !strings.Contains(body, "shirt size") {
+		t.Fatalf("expected bad shirt size to be refused, got %d", resp.StatusCode)
+	}
+
+	/* The third one can wait */
+	form.Set(tickets[1]+"-shirt", "XL")
+	resp, err = client.PostForm(claimURL, form)
+	if err != nil {
+		t.Fatal(err)
+	}
+	readBody(t, resp)
+	if resp.StatusCode != http.StatusSeeOther {
+		t.Fatalf("expected claim to save, got %d", resp.StatusCode)
+	}
+
+	rez, err := findRegistration(ta.AppContext, tickets[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := types.Attendee{Name: "Adam", Email: "adam@example.com", ShirtSize: types.XL}
+	if rez.Attendee != want || rez.Email != buyer {
+		t.Fatalf("attendee not saved right: %+v", rez.Attendee)
+	}
+
+	CheckForNewMails(ta.AppContext)
+	mails = ta.Mailer.Mails()[1:]
+	if len(mails) != 2 {
+		t.Fatalf("expected 2 ticket mails, got %d", len(mails))
+	}
+	var editLink string
+	for _, mail := range mails {
+		if mail.ToAddr == "hal@example.com" {
+			editLink = attendeeLink(ta.AppContext, tickets[0])
+			if !strings.Contains(mail.TextBody, editLink) || len(mail.Attachments) != 1 {
+				t.Fatalf("ticket mail is missing its edit link: %s", mail.TextBody)
+			}
+		} else if mail.ToAddr != "adam@example.com" {
+			t.Fatalf("ticket mailed to %s", mail.ToAddr)
+		}
+	}
+
+	/* Hal fixes his own details, but can't move the ticket */
+	editURL := ta.Server.URL + strings.TrimPrefix(editLink, ta.Env.GetURI())
+	resp, err = client.PostForm(editURL, url.Values{
+		"name":          {"Hal F."},
+		"email":         {"someone@else.com"},
+		"shirt":         {"med"},
+		"accessibility": {"step-free"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	readBody(t, resp)
+	if resp.StatusCode != http.StatusSeeOther {
+		t.Fatalf("expected edit to save, got %d", resp.StatusCode)
+	}
+	rez, err = findRegistration(ta.AppContext, tickets[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = types.Attendee{Name: "Hal F.", Email: "hal@example.com", ShirtSize: types.Med, Accessibility: "step-free"}
+	if rez.Attendee != want {
+		t.Fatalf("attendee not updated right: %+v", rez.Attendee)
+	}
+
+	resp, err = client.Get(ta.Server.URL + "/attendee/" + tickets[1] + "?s=" + linkSig(ta.AppContext, "attendee", tickets[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	readBody(t, resp)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected another ticket's link to 404, got %d", resp.StatusCode)
+	}
+
+	/* Claimed ones are left alone on the buyer's page */
+	resp, err = client.PostForm(claimURL, url.Values{
+		tickets[1] + "-name":  {"Mallory"},
+		tickets[1] + "-email": {"mallory@example.com"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	readBody(t, resp)
+	rez, err = findRegistration(ta.AppContext, tickets[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rez.Attendee.Email != "adam@example.com" {
+		t.Fatalf("claimed ticket was changed: %+v", rez.Attendee)
+	}
+	CheckForNewMails(ta.AppContext)
+	if len(ta.Mailer.Mails()) != 3 {
+		t.Fatalf("expected the last ticket to wait, got %d mails", len(ta.Mailer.Mails()))
+	}
+}
@@ -0,0 +1,262 @@
+package handlers
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/base58btc/btcpp-web/internal/config"
+	"github.com/base58btc/btcpp-web/internal/types"
+	mailer "github.com/base58btc/mailer/mail"
+)
+
+/* Cancelling voids the tickets (so they won't check in or count
+ * as sold), refunds them through whoever took the payment, and
+ * lets the attendee know. A refund that fails stops the whole
+ * thing, so nobody's cancelled without their money back by
+ * accident; untick 'refund' to cancel without one */
+
+type CancelTmpl struct {
+	URI        string
+	Conf       string
+	Count      int
+	Reason     string
+	Refunded   bool
+	RefundLink string
+}
+
+type CancelResult struct {
+	Tickets []*types.Registration
+	Refund  *types.Refund
+	/* Set if we couldn't mail them; the cancel still stands */
+	MailErr error
+}
+
+/* 'ticket' is a ticket's RefID, or an order's Lookup ID for all of it */
+func cancelMatches(rezzies []*types.Registration, confRef, ticket string) []*types.Registration {
+	var matched []*types.Registration
+	for _, rez := range rezzies {
+		if rez.ConfRef != confRef {
+			continue
+		}
+		if rez.RefID == ticket || (rez.LookupID != "" && rez.LookupID == ticket) {
+			matched = append(matched, rez)
+		}
+	}
+	return matched
+}
+
+func refundTickets(ctx *config.AppContext, rezzies, tickets []*types.Registration, address string) (*types.Refund, error) {
+	lookupID := tickets[0].LookupID
+	platform := tickets[0].Platform
+	if lookupID == "" {
+		return nil, fmt.Errorf("ticket %s has no order to refund", tickets[0].RefID)
+	}
+	provider, ok := ctx.Payments[platform]
+	if !ok {
+		return nil, fmt.Errorf("can't refund %s payments here", platform)
+	}
+
+	/* The whole order, unless some of it is staying (or went already) */
+	var amount int64
+	var inOrder int
+	for _, rez := range rezzies {
+		if rez.LookupID == lookupID {
+			inOrder++
+		}
+	}
+	for _, rez := range tickets {
+		if rez.LookupID != lookupID || rez.Platform != platform {
+			return nil, fmt.Errorf("tickets are from more than one order")
+		}
+		amount += rez.AmountPaid
+	}
+	if inOrder == len(tickets) {
+		amount = 0
+	}
+
+	order, err := provider.FetchCharge(lookupID)
+	if err != nil {
+		return nil, err
+	}
+	order.RefundAddress = address
+	return provider.Refund(order, amount)
+}
+
+func CancelTickets(ctx *config.AppContext, conf *types.Conf, ticket string, refund bool, address, reason, by string) (*CancelResult, error) {
+	rezzies, err := ctx.Store.ListRegistrations()
+	if err != nil {
+		return nil, err
+	}
+
+	var tickets []*types.Registration
+	for _, rez := range cancelMatches(rezzies, conf.Ref, ticket) {
+		if rez.Voided.IsZero() {
+			tickets = append(tickets, rez)
+		}
+	}
+	if len(tickets) == 0 {
+		return nil, fmt.Errorf("no live tickets for %s", ticket)
+	}
+
+	res := &CancelResult{Tickets: tickets}
+	var refundRef string
+	/* Comps weren't paid for */
+	if refund && tickets[0].Platform != compPlatform {
+		res.Refund, err = refundTickets(ctx, rezzies, tickets, address)
+		if err != nil {
+			return nil, fmt.Errorf("refund failed, nothing cancelled: %s", err)
+		}
+		refundRef = res.Refund.ID
+	}
+
+	if err := voidTickets(ctx, tickets, by, refundRef); err != nil {
+		return res, err
+	}
+	ctx.Infos.Printf("%s cancelled %d tickets for %s (%s), refund %q", by, len(tickets), tickets[0].Email, ticket, refundRef)
+
+	res.MailErr = sendCancelMail(ctx, conf, tickets, res.Refund, reason)
+	if res.MailErr != nil {
+		ctx.Err.Printf("Unable to send cancel mail to %s: %s", tickets[0].Email, res.MailErr)
+	}
+	return res, nil
+}
+
+func voidTickets(ctx *config.AppContext, tickets []*types.Registration, by, refundRef string) error {
+	now := time.Now().UTC()
+	voided := make(map[string]bool)
+	for _, rez := range tickets {
+		if err := ctx.Store.VoidTicket(rez.RefID, now, by, refundRef); err != nil {
+			return fmt.Errorf("unable to cancel %s: %s", rez.RefID, err)
+		}
+		voided[rez.RefID] = true
+	}
+
+	dropMails(ctx, voided, "ticket cancelled")
+	return nil
+}
+
+/* Don't send tickets that don't work anymore */
+func dropMails(ctx *config.AppContext, tickets map[string]bool, why string) {
+	outbox, err := ctx.Store.ListOutbox()
+	if err != nil {
+		ctx.Err.Printf("Unable to load outbox to drop %d mails (%s): %s", len(tickets), why, err)
+		return
+	}
+	for _, mail := range outbox {
+		if tickets[mail.RefID] && mail.Status != types.MailSent && mail.Status != types.MailDead {
+			mail.LastErr = why
+			updateOutbox(ctx, mail, types.MailDead)
+		}
+	}
+}
+
+/* Refunded at the provider (e.g. from the Stripe dashboard) */
+func voidRefundedOrder(ctx *config.AppContext, provider types.PaymentProvider, orderID string) (types.WebhookStatus, string, error) {
+	rezzies, err := ctx.Store.ListRegistrations()
+	if err != nil {
+		return "", "", err
+	}
+	var tickets []*types.Registration
+	for _, rez := range rezzies {
+		if rez.LookupID == orderID && rez.Voided.IsZero() {
+			tickets = append(tickets, rez)
+		}
+	}
+	if len(tickets) == 0 {
+		return types.WebhookIgnored, "no live tickets", nil
+	}
+
+	if err := voidTickets(ctx, tickets, provider.Name(), ""); err != nil {
+		return "", "", err
+	}
+	ctx.Infos.Printf("%s order %s refunded, cancelled %d tickets", provider.Name(), orderID, len(tickets))
+
+	if conf := findConfByRef(ctx, tickets[0].ConfRef); conf != nil {
+		err = sendCancelMail(ctx, conf, tickets, &types.Refund{}, "")
+		if err != nil {
+			ctx.Err.Printf("Unable to send cancel mail to %s: %s", tickets[0].Email, err)
+		}
+	}
+	return types.WebhookDone, fmt.Sprintf("cancelled %d tickets", len(tickets)), nil
+}
+
+func sendCancelMail(ctx *config.AppContext, conf *types.Conf, tickets []*types.Registration, refund *types.Refund, reason string) error {
+	email := tickets[0].Email
+	data := &CancelTmpl{
+		URI:      ctx.Env.GetURI(),
+		Conf:     conf.Desc,
+		Count:    len(tickets),
+		Reason:   reason,
+		Refunded: refund != nil,
+	}
+	if refund != nil {
+		data.RefundLink = refund.Link
+	}
+
+	var htmlBody, textBody bytes.Buffer
+	if err := ctx.Template("email-html-cancel").Execute(&htmlBody, data); err != nil {
+		return err
+	}
+	if err := ctx.TextTemplate("email-text-cancel").Execute(&textBody, data); err != nil {
+		return err
+	}
+
+	if !ctx.Env.Prod {
+		ctx.Infos.Printf("About to send cancellation to %s, but desisting, not prod!\n", email)
+		return nil
+	}
+
+	return SendMailRequest(ctx, &mailer.MailRequest{
+		JobKey:   "btcpp-cancel-" + tickets[0].RefID,
+		ToAddr:   email,
+		FromAddr: "hello@btcpp.dev",
+		FromName: "bitcoin++ ✨",
+		Title:    fmt.Sprintf("[%s] Your ticket has been cancelled", conf.Desc),
+		HTMLBody: htmlBody.String(),
+		TextBody: textBody.String(),
+		SendAt:   float64(time.Now().UTC().Unix()),
+	})
+}
+
+func AdminCancel(w http.ResponseWriter, r *http.Request, ctx *config.AppContext) {
+	conf, err := findConf(r, ctx)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	me := requireStaff(w, r, ctx, types.RoleOrganizer, conf.Ref)
+	if me == nil || !requireCSRF(w, r, ctx) {
+		return
+	}
+
+	/* Only the posted form, never the query string */
+	ticket := strings.TrimSpace(r.PostForm.Get("ticket"))
+	var msg string
+	if ticket == "" {
+		msg = "Which ticket?"
+	} else {
+		res, err := CancelTickets(ctx, conf, ticket,
+			r.PostForm.Get("refund") == "yes",
+			strings.TrimSpace(r.PostForm.Get("address")),
+			strings.TrimSpace(r.PostForm.Get("reason")), me.Login)
+		switch {
+		case err != nil:
+			msg = fmt.Sprintf("Unable to cancel %s: %s", ticket, err)
+		default:
+			msg = fmt.Sprintf("Cancelled %d tickets for %s", len(res.Tickets), res.Tickets[0].Email)
+			if res.Refund != nil {
+				msg += ", refund " + res.Refund.ID
+			}
+			if res.MailErr != nil {
+				msg += ", but the email didn't go out"
+			}
+		}
+	}
+
+	http.Redirect(w, r, "/admin/"+conf.Tag+"?msg="+url.QueryEscape(msg), http.StatusSeeOther)
+}
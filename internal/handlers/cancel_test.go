@@ -0,0 +1,148 @@
+package handlers
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/base58btc/btcpp-web/external/getters"
+	"github.com/base58btc/btcpp-web/internal/types"
+)
+
+func TestCancelTicket(t *testing.T) {
+	ta := newTestApp(t)
+	fake := &fakeProvider{orders: make(map[string]*types.Order)}
+	ta.Payments = map[string]types.PaymentProvider{"fake": fake}
+
+	email := "bob@example.com"
+	fake.orders["fake_0"] = &types.Order{ID: "fake_0", Provider: "fake", ConfRef: "conf-atx25"}
+	err := ta.Store.AddTickets(&types.Entry{
+		ID:       "fake_0",
+		ConfRef:  "conf-atx25",
+		Currency: "usd",
+		Created:  time.Now(),
+		Email:    email,
+		Items: []types.Item{
+			{Total: 10000, Desc: "atx25 ticket", Type: "genpop"},
+			{Total: 10000, Desc: "atx25 ticket", Type: "genpop"},
+		},
+	}, "fake")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ticket := getters.UniqueID(email, "fake_0", 0)
+
+	cancel := func(client *http.Client, form url.Values) string {
+		t.Helper()
+		resp, err := client.PostForm(ta.Server.URL+"/admin/atx25/cancel", form)
+		if err != nil {
+			t.Fatal(err)
+		}
+		readBody(t, resp)
+		if resp.StatusCode != http.StatusSeeOther {
+			t.Fatalf("expected cancel to redirect, got %d", resp.StatusCode)
+		}
+		return resp.Header.Get("Location")
+	}
+
+	/* Door volunteers can't cancel */
+	door := noRedirects(ta.client(t))
+	resp, err := door.PostForm(ta.Server.URL+"/admin/atx25/cancel", loginForm("door"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	readBody(t, resp)
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected door to be turned away, got %d", resp.StatusCode)
+	}
+
+	/* Not without a token from our own page */
+	org := noRedirects(ta.client(t))
+	form := loginForm("organizer")
+	form.Set("ticket", ticket)
+	form.Set("refund", "yes")
+	resp, err = org.PostForm(ta.Server.URL+"/admin/atx25/cancel", form)
+	if err != nil {
+		t.Fatal(err)
+	}
+	readBody(t, resp)
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected cancel without a token to be refused, got %d", resp.StatusCode)
+	}
+	/* Nor from the query string */
+	token := ta.formToken(t, org, "/admin/atx25", "organizer")
+	resp, err = org.PostForm(ta.Server.URL+"/admin/atx25/cancel?ticket="+ticket+"&refund=yes&csrf="+token, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	readBody(t, resp)
+	if resp.StatusCode != http.StatusForbidden || len(fake.refunds) != 0 {
+		t.Fatalf("expected cancel from the query string to be refused, got %d", resp.StatusCode)
+	}
+
+	loc := cancel(org, url.Values{"ticket": {ticket}, "refund": {"yes"}, "reason": {"Event's full, sorry"}, "csrf": {token}})
+	if !strings.Contains(loc, "Cancelled+1+tickets") || !strings.Contains(loc, "re_fake_0") {
+		t.Fatalf("expected cancel with refund, got %s", loc)
+	}
+	/* Just the one ticket's worth */
+	if len(fake.refunds) != 1 || fake.refunds[0] != 10000 {
+		t.Fatalf("expected a partial refund, got %v", fake.refunds)
+	}
+
+	rezzies, err := ta.Store.ListRegistrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rez := range rezzies {
+		voided := rez.RefID == ticket
+		if voided != !rez.Voided.IsZero() {
+			t.Fatalf("wrong ticket voided: %+v", rez)
+		}
+		if voided && (rez.VoidedBy != "organizer" || rez.RefundRef != "re_fake_0") {
+			t.Fatalf("void not recorded right: %+v", rez)
+		}
+	}
+	sold, err := ta.Store.SoldTixCount("conf-atx25")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sold != 1 {
+		t.Fatalf("expected cancelled ticket to free a seat, got %d sold", sold)
+	}
+
+	mails := ta.Mailer.Mails()
+	if len(mails) != 1 || mails[0].ToAddr != email || mails[0].JobKey != "btcpp-cancel-"+ticket || !strings.Contains(mails[0].TextBody, "Event's full") {
+		t.Fatalf("expected a cancellation mail, got %d", len(mails))
+	}
+
+	/* The mailer doesn't send out the cancelled one */
+	CheckForNewMails(ta.AppContext)
+	if len(ta.Mailer.Mails()) != 2 {
+		t.Fatalf("expected only the live ticket to be mailed, got %d", len(ta.Mailer.Mails()))
+	}
+
+	/* Its QR code no longer gets them in */
+	scanURL := ta.scanURL(t, &types.Registration{RefID: ticket, ConfRef: "conf-atx25", Type: "genpop"})
+	resp, err = door.PostForm(scanURL, loginForm("door"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := readBody(t, resp)
+	if resp.StatusCode != http.StatusForbidden || !strings.Contains(body, "cancelled") {
+		t.Fatalf("expected cancelled ticket to be rejected, got %d %s", resp.StatusCode, body)
+	}
+
+	/* Once is enough */
+	loc = cancel(org, url.Values{"ticket": {ticket}, "refund": {"yes"}, "csrf": {token}})
+	if !strings.Contains(loc, "no+live+tickets") || len(fake.refunds) != 1 {
+		t.Fatalf("expected second cancel to be refused, got %s", loc)
+	}
+
+	/* The order ID takes what's left of it */
+	loc = cancel(org, url.Values{"ticket": {"fake_0"}, "refund": {"yes"}, "csrf": {token}})
+	if !strings.Contains(loc, "Cancelled+1+tickets") || len(fake.refunds) != 2 || fake.refunds[1] != 10000 {
+		t.Fatalf("expected the rest of the order cancelled, got %s %v", loc, fake.refunds)
+	}
+}
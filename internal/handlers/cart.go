@@ -0,0 +1,231 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/base58btc/btcpp-web/external/getters"
+	"github.com/base58btc/btcpp-web/internal/config"
+	"github.com/base58btc/btcpp-web/internal/types"
+)
+
+/* A cart is one or more ticket links, with a count each:
+ *   tix-id+default+fiat*3,tix-id+local+fiat
+ * Everything in it has to be for the same conf, and paid
+ * the same way. Each ticket still gets its own registration */
+
+const maxCartTix = 20
+
+type cartLine struct {
+	Choice *tixChoice
+	Count  uint
+}
+
+type tixCart struct {
+	Conf   *types.Conf
+	Method string
+	Lines  []*cartLine
+}
+
+func (l *cartLine) Type() string {
+	if l.Choice.Local {
+		return "local"
+	}
+	return "genpop"
+}
+
+func (l *cartLine) Desc() string {
+	desc := l.Choice.Tix.Tier
+	if l.Choice.Local {
+		desc += " (local)"
+	}
+	return desc
+}
+
+func (c *tixCart) Count() uint {
+	var count uint
+	for _, line := range c.Lines {
+		count += line.Count
+	}
+	return count
+}
+
+/* What each ticket on the line costs, with the discount if it
+ * covers them */
+func (l *cartLine) Each(discount *types.DiscountCode) uint {
+	if discount == nil || !discount.Covers(l.Choice.Tix, l.Choice.Local) {
+		return l.Choice.Price
+	}
+	return getters.ApplyDiscount(discount, l.Choice.Price)
+}
+
+/* The whole cart, with the discount on every ticket it covers */
+func (c *tixCart) Price(discount *types.DiscountCode) uint {
+	var price uint
+	for _, line := range c.Lines {
+		price += line.Each(discount) * line.Count
+	}
+	return price
+}
+
+/* Looks up the code, and checks it's good for this cart: it has to
+ * cover some of it, and have enough uses left for what it covers */
+func cartDiscount(ctx *config.AppContext, cart *tixCart, code string) (*types.DiscountCode, error) {
+	discount, err := getters.CalcDiscount(ctx.Store, cart.Conf.Ref, code)
+	if err != nil {
+		return nil, err
+	}
+
+	var covered uint
+	for _, line := range cart.Lines {
+		if discount.Covers(line.Choice.Tix, line.Choice.Local) {
+			covered += line.Count
+		}
+	}
+	if covered == 0 {
+		return nil, fmt.Errorf("Discount code \"%s\" isn't valid for these tickets", code)
+	}
+
+	if err = getters.CheckDiscountUses(ctx.Store, discount, covered); err != nil {
+		return nil, err
+	}
+	return discount, nil
+}
+
+func determineCart(ctx *config.AppContext, cartSlug string) (*tixCart, error) {
+	cart := &tixCart{}
+	for _, part := range strings.Split(cartSlug, ",") {
+		slug, count := part, uint(1)
+		if i := strings.LastIndex(part, "*"); i >= 0 {
+			n, err := strconv.ParseUint(part[i+1:], 10, 32)
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("bad count in %s", part)
+			}
+			slug, count = part[:i], uint(n)
+		}
+
+		choice, err := determineTixPrice(ctx, slug)
+		if err != nil {
+			return nil, err
+		}
+		if cart.Conf == nil {
+			cart.Conf, cart.Method = choice.Conf, choice.Method
+		}
+		if choice.Conf != cart.Conf || choice.Method != cart.Method {
+			return nil, fmt.Errorf("cart %s mixes confs or payment methods", cartSlug)
+		}
+		if len(cart.Lines) > 0 && choice.Tix.Currency != cart.Lines[0].Choice.Tix.Currency {
+			return nil, fmt.Errorf("cart %s mixes currencies", cartSlug)
+		}
+		cart.Lines = append(cart.Lines, &cartLine{Choice: choice, Count: count})
+	}
+
+	if cart.Count() > maxCartTix {
+		return nil, fmt.Errorf("cart %s has more than %d tickets", cartSlug, maxCartTix)
+	}
+	return cart, nil
+}
+
+type CartPage struct {
+	Conf   *types.Conf
+	Tiers  []*types.ConfTicket
+	HasBTC bool
+	Err    string
+}
+
+/* Tiers that are still on sale, cheapest (soonest) first */
+func cartTiers(conf *types.Conf, sold uint) []*types.ConfTicket {
+	tixs := types.ConfTickets(append([]*types.ConfTicket{}, conf.Tickets...))
+	sort.Sort(&tixs)
+
+	now := time.Now()
+	var tiers []*types.ConfTicket
+	for _, tix := range tixs {
+		if tix.Expires == nil || tix.Expires.Start.Before(now) || tix.Max <= sold {
+			continue
+		}
+		tiers = append(tiers, tix)
+	}
+	return tiers
+}
+
+/* The form sends qty-{tix id}-{default|local} for each tier */
+func cartSlug(r *http.Request, tiers []*types.ConfTicket, method string) (string, error) {
+	var parts []string
+	var total uint64
+	for _, tix := range tiers {
+		for _, kind := range []string{"default", "local"} {
+			qty := strings.TrimSpace(r.PostForm.Get("qty-" + tix.ID + "-" + kind))
+			if qty == "" || qty == "0" {
+				continue
+			}
+			n, err := strconv.ParseUint(qty, 10, 32)
+			if err != nil {
+				return "", fmt.Errorf("How many %s tickets?", tix.Tier)
+			}
+			total += n
+			parts = append(parts, fmt.Sprintf("%s+%s+%s*%d", tix.ID, kind, method, n))
+		}
+	}
+
+	switch {
+	case total == 0:
+		return "", fmt.Errorf("Pick at least one ticket")
+	case total > maxCartTix:
+		return "", fmt.Errorf("That's more than %d tickets; get in touch and we'll sort you out", maxCartTix)
+	}
+	return strings.Join(parts, ","), nil
+}
+
+func CartForm(w http.ResponseWriter, r *http.Request, ctx *config.AppContext) {
+	conf, err := findConf(r, ctx)
+	if err != nil || !conf.Active {
+		http.NotFound(w, r)
+		return
+	}
+
+	taken, err := tixTakenBy(r, ctx, conf.Ref)
+	if err != nil {
+		http.Error(w, "Unable to load page, please try again later", http.StatusInternalServerError)
+		ctx.Err.Printf("/conf/%s/cart unable to count tickets: %s", conf.Tag, err)
+		return
+	}
+
+	page := &CartPage{
+		Conf:   conf,
+		Tiers:  cartTiers(conf, taken),
+		HasBTC: paymentFor(ctx, "btc") != nil,
+		/* Sent back here if it sold out mid-checkout. Ours, never the link's */
+		Err: ctx.Session.PopString(r.Context(), "cart-err"),
+	}
+
+	if r.Method == http.MethodPost {
+		r.ParseForm()
+		method := r.PostForm.Get("method")
+		if method != "btc" {
+			method = "fiat"
+		}
+
+		var slug string
+		slug, err = cartSlug(r, page.Tiers, method)
+		if err == nil {
+			_, err = determineCart(ctx, slug)
+		}
+		if err == nil {
+			http.Redirect(w, r, "/tix/"+slug, http.StatusSeeOther)
+			return
+		}
+		page.Err = err.Error()
+		w.WriteHeader(http.StatusBadRequest)
+	}
+
+	err = ctx.Template("cart.tmpl").ExecuteTemplate(w, "cart.tmpl", page)
+	if err != nil {
+		http.Error(w, "Unable to load page, please try again later", http.StatusInternalServerError)
+		ctx.Err.Printf("/conf/%s/cart ExecuteTemplate failed ! %s", conf.Tag, err.Error())
+	}
+}
@@ -0,0 +1,96 @@
+package handlers
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/base58btc/btcpp-web/internal/types"
+)
+
+func TestCartCheckout(t *testing.T) {
+	ta := newTestApp(t)
+	fake := &fakeProvider{orders: make(map[string]*types.Order)}
+	ta.Payments = map[string]types.PaymentProvider{"fake": fake}
+	ta.Env.Payments.Fiat = "fake"
+	client := noRedirects(ta.client(t))
+
+	/* The cart page builds the link */
+	resp, err := client.Get(ta.Server.URL + "/conf/atx25/cart")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := readBody(t, resp); resp.StatusCode != http.StatusOK || !strings.Contains(body, "qty-tix-atx25-late-local") {
+		t.Fatalf("expected cart page, got %d", resp.StatusCode)
+	}
+	form := url.Values{
+		"qty-tix-atx25-early-default": {"2"},
+		"qty-tix-atx25-late-local":    {"1"},
+		"method":                      {"fiat"},
+	}
+	resp, err = client.PostForm(ta.Server.URL+"/conf/atx25/cart", form)
+	if err != nil {
+		t.Fatal(err)
+	}
+	readBody(t, resp)
+	slug := "tix-atx25-early+default+fiat*2,tix-atx25-late+local+fiat*1"
+	if resp.StatusCode != http.StatusSeeOther || resp.Header.Get("Location") != "/tix/"+slug {
+		t.Fatalf("expected redirect to cart, got %d %s", resp.StatusCode, resp.Header.Get("Location"))
+	}
+
+	form.Set("qty-tix-atx25-early-default", "20")
+	resp, err = client.PostForm(ta.Server.URL+"/conf/atx25/cart", form)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := readBody(t, resp); resp.StatusCode != http.StatusBadRequest || !strings.Contains(body, "more than 20") {
+		t.Fatalf("expected too many tickets to be refused, got %d", resp.StatusCode)
+	}
+	resp, err = client.Get(ta.Server.URL + "/tix/tix-atx25-early+default+fiat*21")
+	if err != nil {
+		t.Fatal(err)
+	}
+	readBody(t, resp)
+	if resp.StatusCode == http.StatusSeeOther {
+		t.Fatalf("expected a 21 ticket cart to be refused")
+	}
+
+	if loc := checkoutCart(t, ta, client, slug); loc != "https://pay.example.com/fake_0" {
+		t.Fatalf("expected redirect to checkout, got %s", loc)
+	}
+	order := fake.orders["fake_0"]
+	if len(order.Items) != 3 || order.Total() != 27500 || order.Items[2].TixID != "tix-atx25-late" || order.Items[2].Type != "local" || order.Items[2].Total != 7500 {
+		t.Fatalf("unexpected order: %+v", order)
+	}
+	if order.Cart() != "tix-atx25-early+genpop+10000*2,tix-atx25-late+local+7500*1" {
+		t.Fatalf("unexpected cart %s", order.Cart())
+	}
+
+	resp, err = client.PostForm(ta.Server.URL+"/callback/fake", url.Values{"id": {"fake_0"}, "sig": {"ok"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	readBody(t, resp)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("webhook failed, got %d", resp.StatusCode)
+	}
+
+	/* One registration a ticket, ready to hand out */
+	rezzies, err := ta.Store.ListRegistrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rezzies) != 3 {
+		t.Fatalf("expected three tickets, got %+v", rezzies)
+	}
+	refs := make(map[string]bool)
+	tiers := make(map[string]int)
+	for _, rez := range rezzies {
+		refs[rez.RefID] = true
+		tiers[rez.TixID+"/"+rez.Type]++
+	}
+	if len(refs) != 3 || tiers["tix-atx25-early/genpop"] != 2 || tiers["tix-atx25-late/local"] != 1 {
+		t.Fatalf("unexpected tickets %+v", rezzies)
+	}
+}
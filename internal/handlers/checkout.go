@@ -0,0 +1,227 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/base58btc/btcpp-web/internal/config"
+	"github.com/base58btc/btcpp-web/internal/types"
+	"github.com/gorilla/mux"
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+/* On-site bitcoin checkout. When a provider gives us the
+ * invoice itself, we show it here rather than sending them off
+ * to the hosted checkout. The checkout lives in their session,
+ * so nobody else can poll it */
+
+type CheckoutPage struct {
+	Provider   string
+	OrderID    string
+	ConfTag    string
+	ConfDesc   string
+	Lightning  string
+	Address    string
+	URI        string
+	Sats       uint64
+	ExpiresAt  time.Time
+	HostedURL  string
+	SuccessURL string
+	CancelURL  string
+
+	/* Filled in when rendered */
+	LightningQR template.URL      `json:"-"`
+	ChainQR     template.URL      `json:"-"`
+	Status      types.OrderStatus `json:"-"`
+}
+
+type CheckoutStatus struct {
+	Provider string
+	OrderID  string
+	Status   types.OrderStatus
+	ConfTag  string
+}
+
+func checkoutKey(provider, orderID string) string {
+	return "checkout:" + provider + ":" + orderID
+}
+
+func (c *CheckoutPage) BIP21() string {
+	if c.URI != "" {
+		return c.URI
+	}
+	uri := "bitcoin:" + c.Address
+	var params []string
+	if c.Sats > 0 {
+		params = append(params, fmt.Sprintf("amount=%.8f", float64(c.Sats)/1e8))
+	}
+	if c.Lightning != "" {
+		params = append(params, "lightning="+c.Lightning)
+	}
+	if len(params) > 0 {
+		uri += "?" + strings.Join(params, "&")
+	}
+	return uri
+}
+
+/* html/template won't let lightning: or bitcoin: links through
+ * on its own */
+func (c *CheckoutPage) LightningLink() template.URL {
+	return template.URL("lightning:" + c.Lightning)
+}
+
+func (c *CheckoutPage) BitcoinLink() template.URL {
+	return template.URL(c.BIP21())
+}
+
+func (c *CheckoutPage) ExpiresUnix() int64 {
+	return c.ExpiresAt.Unix()
+}
+
+func (c *CheckoutPage) SatsDesc() string {
+	if c.Sats == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%d sats", c.Sats)
+}
+
+/* Only checkouts we can actually show get the on-site page */
+func onSiteCheckout(checkout *types.Checkout) bool {
+	return checkout.Lightning != "" || checkout.Address != ""
+}
+
+func saveCheckout(r *http.Request, ctx *config.AppContext, provider types.PaymentProvider, order *types.Order, checkout *types.Checkout) (string, error) {
+	page := &CheckoutPage{
+		Provider:   provider.Name(),
+		OrderID:    checkout.OrderID,
+		ConfTag:    order.ConfTag,
+		Lightning:  checkout.Lightning,
+		Address:    checkout.Address,
+		URI:        checkout.URI,
+		Sats:       checkout.Sats,
+		ExpiresAt:  checkout.ExpiresAt,
+		HostedURL:  checkout.URL,
+		SuccessURL: order.SuccessURL,
+		CancelURL:  order.CancelURL,
+	}
+	/* Unset expiries come back as the epoch */
+	if checkout.ExpiresAt.Unix() <= 0 {
+		page.ExpiresAt = time.Time{}
+	}
+	if conf := findConfByRef(ctx, order.ConfRef); conf != nil {
+		page.ConfDesc = conf.Desc
+	}
+
+	data, err := json.Marshal(page)
+	if err != nil {
+		return "", err
+	}
+	ctx.Session.Put(r.Context(), checkoutKey(page.Provider, page.OrderID), string(data))
+	return fmt.Sprintf("/checkout/%s/%s", page.Provider, page.OrderID), nil
+}
+
+func loadCheckout(r *http.Request, ctx *config.AppContext) (*CheckoutPage, types.PaymentProvider) {
+	params := mux.Vars(r)
+	provider, ok := ctx.Payments[params["provider"]]
+	if !ok {
+		return nil, nil
+	}
+
+	data := ctx.Session.GetString(r.Context(), checkoutKey(params["provider"], params["order"]))
+	if data == "" {
+		return nil, nil
+	}
+
+	var page CheckoutPage
+	if err := json.Unmarshal([]byte(data), &page); err != nil {
+		ctx.Err.Printf("bad checkout in session: %s", err)
+		return nil, nil
+	}
+	return &page, provider
+}
+
+func qrDataURL(content string) (template.URL, error) {
+	png, err := qrcode.Encode(content, qrcode.Medium, 320)
+	if err != nil {
+		return "", err
+	}
+	return template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(png)), nil
+}
+
+func BitcoinCheckout(w http.ResponseWriter, r *http.Request, ctx *config.AppContext) {
+	page, _ := loadCheckout(r, ctx)
+	if page == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	var err error
+	if page.Lightning != "" {
+		/* Uppercase makes for a smaller QR code */
+		page.LightningQR, err = qrDataURL("LIGHTNING:" + strings.ToUpper(page.Lightning))
+		if err != nil {
+			http.Error(w, "Unable to load page, please try again later", http.StatusInternalServerError)
+			ctx.Err.Printf("/checkout unable to make lightning qr: %s", err)
+			return
+		}
+	}
+	if page.Address != "" {
+		page.ChainQR, err = qrDataURL(page.BIP21())
+		if err != nil {
+			http.Error(w, "Unable to load page, please try again later", http.StatusInternalServerError)
+			ctx.Err.Printf("/checkout unable to make bip21 qr: %s", err)
+			return
+		}
+	}
+	page.Status = types.OrderPending
+
+	w.Header().Set("Cache-Control", "no-store")
+	err = ctx.Template("checkout.tmpl").ExecuteTemplate(w, "checkout.tmpl", page)
+	if err != nil {
+		http.Error(w, "Unable to load page, please try again later", http.StatusInternalServerError)
+		ctx.Err.Printf("/checkout ExecuteTemplate failed ! %s", err.Error())
+	}
+}
+
+/* Polled by the checkout page (htmx). Once it's paid, htmx
+ * follows the HX-Redirect over to the success page */
+func BitcoinCheckoutStatus(w http.ResponseWriter, r *http.Request, ctx *config.AppContext) {
+	page, provider := loadCheckout(r, ctx)
+	if page == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	status := types.OrderPending
+	order, err := provider.FetchCharge(page.OrderID)
+	if err != nil {
+		/* Try again next poll */
+		ctx.Err.Printf("/checkout unable to fetch %s charge %s: %s", page.Provider, page.OrderID, err)
+	} else {
+		status = order.Status
+	}
+	if status == types.OrderPending && !page.ExpiresAt.IsZero() && time.Now().After(page.ExpiresAt) {
+		status = types.OrderExpired
+	}
+
+	if status == types.OrderPaid {
+		w.Header().Set("HX-Redirect", page.SuccessURL)
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	err = ctx.Template("checkout.tmpl").ExecuteTemplate(w, "checkout-status", &CheckoutStatus{
+		Provider: page.Provider,
+		OrderID:  page.OrderID,
+		Status:   status,
+		ConfTag:  page.ConfTag,
+	})
+	if err != nil {
+		http.Error(w, "Unable to load page, please try again later", http.StatusInternalServerError)
+		ctx.Err.Printf("/checkout status ExecuteTemplate failed ! %s", err.Error())
+	}
+}
@@ -0,0 +1,107 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/base58btc/btcpp-web/external/getters"
+	"github.com/base58btc/btcpp-web/internal/types"
+)
+
+func TestOnSiteCheckout(t *testing.T) {
+	ta := newTestApp(t)
+
+	status := "unpaid"
+	var created types.OpenNodeRequest
+	stub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "POST" && r.URL.Path == "/charges":
+			json.NewDecoder(r.Body).Decode(&created)
+			json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{
+				"id":                  "on_charge2",
+				"hosted_checkout_url": "https://checkout.opennode.com/on_charge2",
+				"amount":              21000,
+				"uri":                 "bitcoin:bc1qtest?amount=0.00021&lightning=lnbc210n1test",
+				"chain_invoice":       map[string]interface{}{"address": "bc1qtest"},
+				"lightning_invoice": map[string]interface{}{
+					"payreq":     "lnbc210n1test",
+					"expires_at": time.Now().Add(time.Hour).Unix(),
+				},
+			}})
+		case r.URL.Path == "/charge/on_charge2":
+			json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{
+				"id":          "on_charge2",
+				"status":      status,
+				"description": created.Description,
+				"fiat_value":  created.Amount,
+				"created_at":  time.Now().Format(time.RFC3339),
+				"metadata":    created.Metadata,
+			}})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer stub.Close()
+
+	ta.Payments = map[string]types.PaymentProvider{
+		"opennode": getters.NewOpenNodeProvider(types.OpenNodeConfig{Key: "on_key", Endpoint: stub.URL}, true),
+	}
+
+	client := noRedirects(ta.client(t))
+	resp, err := client.PostForm(ta.Server.URL+"/tix/tix-atx25-early+default+btc/collect-email", url.Values{
+		"Email":         {"hal@example.com"},
+		"Count":         {"1"},
+		"DiscountPrice": {"90"},
+		"HMAC":          {calcTixHMAC(ta.AppContext, findConfByRef(ta.AppContext, "conf-atx25"), 90, 90, "")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	readBody(t, resp)
+	if resp.StatusCode != http.StatusSeeOther || resp.Header.Get("Location") != "/checkout/opennode/on_charge2" {
+		t.Fatalf("expected redirect to on-site checkout, got %d %s", resp.StatusCode, resp.Header.Get("Location"))
+	}
+
+	resp, err = client.Get(ta.Server.URL + "/checkout/opennode/on_charge2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := readBody(t, resp)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(body, "lnbc210n1test") || !strings.Contains(body, "21000 sats") || !strings.Contains(body, "data:image/png;base64,") {
+		t.Fatalf("expected checkout page with the invoice, got %d %s", resp.StatusCode, body)
+	}
+
+	/* Nobody else gets to see it */
+	resp, err = noRedirects(ta.client(t)).Get(ta.Server.URL + "/checkout/opennode/on_charge2/status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	readBody(t, resp)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404 for another session, got %d", resp.StatusCode)
+	}
+
+	resp, err = client.Get(ta.Server.URL + "/checkout/opennode/on_charge2/status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body = readBody(t, resp)
+	if resp.Header.Get("HX-Redirect") != "" || !strings.Contains(body, "Waiting for your payment") {
+		t.Fatalf("expected pending status, got %s", body)
+	}
+
+	status = "paid"
+	resp, err = client.Get(ta.Server.URL + "/checkout/opennode/on_charge2/status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	readBody(t, resp)
+	if resp.Header.Get("HX-Redirect") != ta.Env.GetURI()+"/conf/atx25/success" {
+		t.Fatalf("expected redirect to success, got %q", resp.Header.Get("HX-Redirect"))
+	}
+}
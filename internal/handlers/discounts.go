@@ -0,0 +1,216 @@
+package handlers
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/base58btc/btcpp-web/external/getters"
+	"github.com/base58btc/btcpp-web/internal/config"
+	"github.com/base58btc/btcpp-web/internal/types"
+)
+
+/* Single use codes in bulk, for sponsors and speakers. Each
+ * batch is a campaign; its codes (and who used them) can be
+ * had as a CSV, here or from `btcpp-web discounts` */
+
+type AdminDiscounts struct {
+	Conf      *types.Conf
+	Campaigns []*CampaignStat
+}
+
+type CampaignStat struct {
+	Name     string
+	Codes    int
+	Redeemed int
+}
+
+func formatCSVTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+/* Spreadsheets run cells starting with these as formulas.
+ * Emails and campaign names are anyone's, so quote them */
+func csvText(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
+
+/* One row a code, with the ticket it went on if it's been used */
+func WriteCampaignCSV(w io.Writer, redeemed []*getters.Redemption) error {
+	out := csv.NewWriter(w)
+	out.Write([]string{"code", "campaign", "percent_off", "amount_off", "expires",
+		"redeemed", "ticket", "order", "email", "redeemed_at"})
+	for _, r := range redeemed {
+		row := []string{
+			r.Code.CodeName,
+			csvText(r.Code.Campaign),
+			strconv.FormatUint(uint64(r.Code.PercentOff), 10),
+			strconv.FormatUint(uint64(r.Code.AmountOff), 10),
+			formatCSVTime(r.Code.ValidUntil),
+		}
+		if r.Ticket != nil {
+			row = append(row, "yes", r.Ticket.RefID, r.Ticket.LookupID,
+				csvText(r.Ticket.Email), formatCSVTime(r.Ticket.Created))
+		} else {
+			row = append(row, "no", "", "", "", "")
+		}
+		out.Write(row)
+	}
+	out.Flush()
+	return out.Error()
+}
+
+/* A batch from a form (or flags): a percent or an amount
+ * off, and an optional expiry date (YYYY-MM-DD) */
+func ParseDiscountBatch(confRef, campaign, count, percent, amount, expires string) (*getters.DiscountBatch, error) {
+	batch := &getters.DiscountBatch{Campaign: campaign, ConfRef: confRef}
+
+	n, err := strconv.Atoi(count)
+	if err != nil {
+		return nil, fmt.Errorf("How many codes? %q isn't a number", count)
+	}
+	batch.Count = n
+
+	if percent != "" {
+		pct, err := strconv.ParseUint(percent, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("Percent off %q isn't a number", percent)
+		}
+		batch.PercentOff = uint(pct)
+	}
+	if amount != "" {
+		amt, err := strconv.ParseUint(amount, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("Amount off %q isn't a number", amount)
+		}
+		batch.AmountOff = uint(amt)
+	}
+	if expires != "" {
+		batch.ValidUntil, err = time.Parse("2006-01-02", expires)
+		if err != nil {
+			return nil, fmt.Errorf("Expires %q isn't a date (YYYY-MM-DD)", expires)
+		}
+	}
+	return batch, nil
+}
+
+func loadCampaigns(ctx *config.AppContext, conf *types.Conf) ([]*CampaignStat, error) {
+	names, err := getters.DiscountCampaigns(ctx.Store, conf.Ref)
+	if err != nil {
+		return nil, err
+	}
+
+	var campaigns []*CampaignStat
+	for _, name := range names {
+		redeemed, err := getters.CampaignRedemptions(ctx.Store, conf.Ref, name)
+		if err != nil {
+			return nil, err
+		}
+		stat := &CampaignStat{Name: name, Codes: len(redeemed)}
+		for _, r := range redeemed {
+			if r.Ticket != nil {
+				stat.Redeemed++
+			}
+		}
+		campaigns = append(campaigns, stat)
+	}
+	return campaigns, nil
+}
+
+func AdminDiscountCodes(w http.ResponseWriter, r *http.Request, ctx *config.AppContext) {
+	conf, err := findConf(r, ctx)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	me := requireStaff(w, r, ctx, types.RoleOrganizer, conf.Ref)
+	if me == nil {
+		return
+	}
+
+	/* A posted login lands here too, and only logs them in */
+	if r.Method == http.MethodPost && r.PostForm.Get("login") == "" {
+		if !requireCSRF(w, r, ctx) {
+			return
+		}
+
+		/* Only the posted form, never the query string */
+		var msg string
+		batch, err := ParseDiscountBatch(conf.Ref, r.PostForm.Get("campaign"), r.PostForm.Get("count"),
+			r.PostForm.Get("percent"), r.PostForm.Get("amount"), r.PostForm.Get("expires"))
+		if err == nil {
+			batch.Comp = r.PostForm.Get("comp") == "yes"
+			batch.TixType = r.PostForm.Get("type")
+			var codes []*types.DiscountCode
+			codes, err = getters.GenerateDiscounts(ctx.Store, batch)
+			if len(codes) > 0 {
+				ctx.Infos.Printf("%s made %d %s codes for %s", me.Login, len(codes), batch.Campaign, conf.Tag)
+			}
+			msg = fmt.Sprintf("Made %d codes for %s", len(codes), batch.Campaign)
+		}
+		if err != nil {
+			ctx.Err.Printf("/admin/%s/discounts unable to make codes: %s", conf.Tag, err)
+			msg = err.Error()
+		}
+		http.Redirect(w, r, "/admin/"+conf.Tag+"/discounts?msg="+url.QueryEscape(msg), http.StatusSeeOther)
+		return
+	}
+
+	campaigns, err := loadCampaigns(ctx, conf)
+	if err != nil {
+		http.Error(w, "Unable to load page, please try again later", http.StatusInternalServerError)
+		ctx.Err.Printf("/admin/%s/discounts unable to load campaigns: %s", conf.Tag, err)
+		return
+	}
+
+	renderAdmin(w, ctx, &AdminPage{
+		Me:        me,
+		Discounts: &AdminDiscounts{Conf: conf, Campaigns: campaigns},
+		Msg:       r.URL.Query().Get("msg"),
+		CSRF:      csrfToken(ctx, r),
+		Updated:   time.Now(),
+	})
+}
+
+func AdminDiscountsCSV(w http.ResponseWriter, r *http.Request, ctx *config.AppContext) {
+	conf, err := findConf(r, ctx)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	me := requireStaff(w, r, ctx, types.RoleOrganizer, conf.Ref)
+	if me == nil {
+		return
+	}
+
+	campaign := r.URL.Query().Get("campaign")
+	redeemed, err := getters.CampaignRedemptions(ctx.Store, conf.Ref, campaign)
+	if err != nil {
+		http.Error(w, "Unable to load page, please try again later", http.StatusInternalServerError)
+		ctx.Err.Printf("/admin/%s/discounts.csv unable to load %s: %s", conf.Tag, campaign, err)
+		return
+	}
+	if len(redeemed) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", conf.Tag+"-"+campaign+".csv"))
+	if err = WriteCampaignCSV(w, redeemed); err != nil {
+		ctx.Err.Printf("/admin/%s/discounts.csv unable to write %s: %s", conf.Tag, campaign, err)
+	}
+}
@@ -0,0 +1,656 @@
+package handlers
+
+import (
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/base58btc/btcpp-web/external/getters"
+	"github.com/base58btc/btcpp-web/internal/types"
+)
+
+func TestDiscountRules(t *testing.T) {
+	ta := newTestApp(t)
+	fake := &fakeProvider{orders: make(map[string]*types.Order)}
+	ta.Payments = map[string]types.PaymentProvider{"fake": &emailProvider{fake}}
+	ta.Env.Payments.Fiat = "fake"
+	client := noRedirects(ta.client(t))
+
+	apply := func(slug, code string) string {
+		resp, err := client.PostForm(ta.Server.URL+"/tix/"+slug+"/apply-discount", url.Values{
+			"Discount":      {code},
+			"DiscountPrice": {"0"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		body := readBody(t, resp)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("apply-discount %s on %s failed, got %d", code, slug, resp.StatusCode)
+		}
+		return body
+	}
+
+	if body := apply("tix-atx25-early+default+fiat", "LAPSED"); !strings.Contains(body, "has expired") {
+		t.Fatalf("expected LAPSED to have expired, got %s", body)
+	}
+	if body := apply("tix-atx25-late+default+fiat", "EARLY30"); !strings.Contains(body, "valid for these tickets") {
+		t.Fatalf("expected EARLY30 to be early only, got %s", body)
+	}
+	/* Only the early ticket gets the $30 off */
+	if body := apply("tix-atx25-early+default+fiat,tix-atx25-late+default+fiat", "EARLY30"); !strings.Contains(body, "$270USD") {
+		t.Fatalf("expected EARLY30 to take 30 off the early ticket, got %s", body)
+	}
+
+	slug := "tix-atx25-early+default+fiat"
+	conf := findConfByRef(ta.AppContext, "conf-atx25")
+	buy := func(count string) *http.Response {
+		resp, err := client.PostForm(ta.Server.URL+"/tix/"+slug+"/collect-email", url.Values{
+			"Email":         {"eve@example.com"},
+			"Count":         {count},
+			"Discount":      {"EARLY30"},
+			"DiscountPrice": {"70"},
+			"HMAC":          {calcTixHMAC(ta.AppContext, conf, 100, 70, "EARLY30")},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		readBody(t, resp)
+		if resp.StatusCode != http.StatusSeeOther {
+			t.Fatalf("expected a redirect, got %d", resp.StatusCode)
+		}
+		return resp
+	}
+
+	/* Single use is one ticket */
+	loc := buy("2").Header.Get("Location")
+	if loc != "/tix/"+slug+"/collect-email?q=EARLY30" {
+		t.Fatalf("expected two tickets on EARLY30 to be refused, got %s", loc)
+	}
+	resp, err := client.Get(ta.Server.URL + loc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := readBody(t, resp); !strings.Contains(body, "only has 1 use(s) left") {
+		t.Fatalf("expected the refusal to say why, got %s", body)
+	}
+	/* What the page says is up to us, not whoever made the link */
+	resp, err = client.Get(ta.Server.URL + loc + "&err=" + url.QueryEscape("Card declined, pay at evil.example"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := readBody(t, resp); strings.Contains(body, "evil.example") {
+		t.Fatalf("expected the link's err to be left off the page")
+	}
+
+	if loc := buy("1").Header.Get("Location"); loc != "https://pay.example.com/fake_0" {
+		t.Fatalf("expected a checkout, got %s", loc)
+	}
+	order := fake.orders["fake_0"]
+	if order.DiscountRef != "discount-early30" || order.Total() != 7000 {
+		t.Fatalf("unexpected order %+v", order)
+	}
+	resp, err = client.PostForm(ta.Server.URL+"/callback/fake", url.Values{"id": {"fake_0"}, "sig": {"ok"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	readBody(t, resp)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("webhook failed, got %d", resp.StatusCode)
+	}
+
+	if body := apply(slug, "EARLY30"); !strings.Contains(body, "has been used up") {
+		t.Fatalf("expected EARLY30 to be used up, got %s", body)
+	}
+	loc = buy("1").Header.Get("Location")
+	if !strings.Contains(loc, "/collect-email?") {
+		t.Fatalf("expected a used up code to be refused at checkout, got %s", loc)
+	}
+}
+
+func TestDiscountUsesHeld(t *testing.T) {
+	ta := newTestApp(t)
+	fake := &fakeProvider{orders: make(map[string]*types.Order)}
+	ta.Payments = map[string]types.PaymentProvider{"fake": &emailProvider{fake}}
+	ta.Env.Payments.Fiat = "fake"
+
+	slug := "tix-atx25-early+default+fiat"
+	conf := findConfByRef(ta.AppContext, "conf-atx25")
+	buy := func(email string) string {
+		resp, err := noRedirects(ta.client(t)).PostForm(ta.Server.URL+"/tix/"+slug+"/collect-email", url.Values{
+			"Email":         {email},
+			"Discount":      {"EARLY30"},
+			"DiscountPrice": {"70"},
+			"HMAC":          {calcTixHMAC(ta.AppContext, conf, 100, 70, "EARLY30")},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		readBody(t, resp)
+		return resp.Header.Get("Location")
+	}
+
+	/* An open checkout has the code's only use */
+	if loc := buy("ann@example.com"); loc != "https://pay.example.com/fake_0" {
+		t.Fatalf("expected a checkout, got %s", loc)
+	}
+	if loc := buy("ben@example.com"); !strings.Contains(loc, "/collect-email?") {
+		t.Fatalf("expected a held code to be refused, got %s", loc)
+	}
+
+	/* Even if two both got past the form at once */
+	discount, err := getters.FindDiscount(ta.Store, "EARLY30")
+	if err != nil {
+		t.Fatal(err)
+	}
+	order := newOrder(ta.AppContext, mustCart(t, ta, slug), "ben@example.com", discount)
+	order.Provider = "fake"
+	if _, usedUp, err := holdTickets(ta.AppContext, order, nil); err != nil || usedUp == nil {
+		t.Fatalf("expected a second hold on the code to be refused, got %v %v", usedUp, err)
+	}
+
+	/* They back out, and it's free again */
+	resp, err := noRedirects(ta.client(t)).Get(strings.Replace(fake.orders["fake_0"].CancelURL, ta.Env.GetURI(), ta.Server.URL, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	readBody(t, resp)
+	if loc := buy("ben@example.com"); loc != "https://pay.example.com/fake_1" {
+		t.Fatalf("expected the code to be free again, got %s", loc)
+	}
+}
+
+func TestDiscountCampaign(t *testing.T) {
+	ta := newTestApp(t)
+	org := noRedirects(ta.client(t))
+	resp, err := org.PostForm(ta.Server.URL+"/admin", loginForm("organizer"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	readBody(t, resp)
+
+	/* Not without a token from our own page */
+	resp, err = org.PostForm(ta.Server.URL+"/admin/atx25/discounts", url.Values{
+		"campaign": {"Forged"}, "count": {"500"}, "comp": {"yes"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	readBody(t, resp)
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected codes without a token to be refused, got %d", resp.StatusCode)
+	}
+	/* Nor from the query string */
+	token := ta.formToken(t, org, "/admin/atx25/discounts", "organizer")
+	resp, err = org.PostForm(ta.Server.URL+"/admin/atx25/discounts?campaign=Forged&count=500&comp=yes&csrf="+token, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	readBody(t, resp)
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected codes from the query string to be refused, got %d", resp.StatusCode)
+	}
+	if forged, err := getters.CampaignRedemptions(ta.Store, "conf-atx25", "Forged"); err != nil || len(forged) != 0 {
+		t.Fatalf("expected no forged codes, got %d (%v)", len(forged), err)
+	}
+
+	gen := func(form url.Values) string {
+		form.Set("csrf", token)
+		resp, err := org.PostForm(ta.Server.URL+"/admin/atx25/discounts", form)
+		if err != nil {
+			t.Fatal(err)
+		}
+		readBody(t, resp)
+		if resp.StatusCode != http.StatusSeeOther {
+			t.Fatalf("expected a redirect, got %d", resp.StatusCode)
+		}
+		msg, _ := url.ParseQuery(strings.SplitN(resp.Header.Get("Location"), "?", 2)[1])
+		return msg.Get("msg")
+	}
+	form := url.Values{
+		"campaign": {"Sponsors 2025"},
+		"count":    {"3"},
+		"percent":  {"50"},
+		"amount":   {"20"},
+		"expires":  {"2099-01-01"},
+	}
+	if msg := gen(form); !strings.Contains(msg, "not both") {
+		t.Fatalf("expected a percent and an amount to be refused, got %q", msg)
+	}
+	form.Del("amount")
+	if msg := gen(form); msg != "Made 3 codes for Sponsors 2025" {
+		t.Fatalf("expected 3 codes, got %q", msg)
+	}
+
+	redeemed, err := getters.CampaignRedemptions(ta.Store, "conf-atx25", "Sponsors 2025")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(redeemed) != 3 {
+		t.Fatalf("expected 3 codes, got %d", len(redeemed))
+	}
+	for _, r := range redeemed {
+		if !strings.HasPrefix(r.Code.CodeName, "SPONSORS-") || !r.Code.SingleUse || r.Code.ValidUntil.Year() != 2099 || r.Ticket != nil {
+			t.Fatalf("unexpected code %+v", r.Code)
+		}
+	}
+
+	/* A sponsor uses theirs */
+	used := redeemed[0].Code
+	err = ta.Store.AddTickets(&types.Entry{
+		ID: "cs_test_sponsor", ConfRef: "conf-atx25", Currency: "usd", Email: "jack@example.com",
+		Created: time.Now(), DiscountRef: used.Ref,
+		Items: []types.Item{{Total: 5000, Type: "genpop", TixID: "tix-atx25-early"}},
+	}, "stripe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = cartDiscount(ta.AppContext, mustCart(t, ta, "tix-atx25-early+default+fiat"), used.CodeName); err == nil || !strings.Contains(err.Error(), "used up") {
+		t.Fatalf("expected %s to be used up, got %v", used.CodeName, err)
+	}
+	if d, err := cartDiscount(ta.AppContext, mustCart(t, ta, "tix-atx25-early+default+fiat"), redeemed[1].Code.CodeName); err != nil || d.PercentOff != 50 {
+		t.Fatalf("expected %s to be good, got %v", redeemed[1].Code.CodeName, err)
+	}
+
+	resp, err = org.Get(ta.Server.URL + "/admin/atx25/discounts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := readBody(t, resp); !strings.Contains(body, "Sponsors 2025") {
+		t.Fatalf("expected the campaign to be listed, got %s", body)
+	}
+
+	resp, err = org.Get(ta.Server.URL + "/admin/atx25/discounts.csv?campaign=" + url.QueryEscape("Sponsors 2025"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := readBody(t, resp)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/csv" {
+		t.Fatalf("expected a csv, got %d %s", resp.StatusCode, body)
+	}
+	rows, err := csv.NewReader(strings.NewReader(body)).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 4 {
+		t.Fatalf("expected a header and 3 codes, got %v", rows)
+	}
+	var redeemedRows int
+	for _, row := range rows[1:] {
+		if row[5] == "yes" {
+			redeemedRows++
+			if row[0] != used.CodeName || row[7] != "cs_test_sponsor" || row[8] != "jack@example.com" {
+				t.Fatalf("unexpected redeemed row %v", row)
+			}
+		}
+	}
+	if redeemedRows != 1 {
+		t.Fatalf("expected one code used, got %v", rows)
+	}
+
+	/* Door volunteers can't make codes */
+	door := noRedirects(ta.client(t))
+	resp, err = door.PostForm(ta.Server.URL+"/admin/atx25/discounts", loginForm("door"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	readBody(t, resp)
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected door to be kept out, got %d", resp.StatusCode)
+	}
+}
+
+func TestCampaignCSVFormulas(t *testing.T) {
+	redeemed := []*getters.Redemption{{
+		Code:   &types.DiscountCode{CodeName: "SPONSORS-1", Campaign: "=HYPERLINK(\"https://evil.example\")"},
+		Ticket: &types.Registration{RefID: "tix-1", LookupID: "cs_1", Email: "@SUM(1+1)@example.com"},
+	}, {
+		Code: &types.DiscountCode{CodeName: "SPONSORS-2", Campaign: "Sponsors 2025"},
+	}}
+	var out strings.Builder
+	if err := WriteCampaignCSV(&out, redeemed); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := csv.NewReader(strings.NewReader(out.String())).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rows[1][1] != "'=HYPERLINK(\"https://evil.example\")" || rows[1][8] != "'@SUM(1+1)@example.com" {
+		t.Fatalf("expected formulas to be quoted, got %v", rows[1])
+	}
+	if rows[2][1] != "Sponsors 2025" {
+		t.Fatalf("expected plain text left alone, got %v", rows[2])
+	}
+}
+
+func TestCampaignCodeRace(t *testing.T) {
+	ta := newTestApp(t)
+	fake := &fakeProvider{orders: make(map[string]*types.Order)}
+	ta.Payments = map[string]types.PaymentProvider{"fake": &emailProvider{fake}}
+	ta.Env.Payments.Fiat = "fake"
+
+	codes, err := getters.GenerateDiscounts(ta.Store, &getters.DiscountBatch{
+		Campaign: "Leaked", ConfRef: "conf-atx25", Count: 1, PercentOff: 50,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := codes[0].CodeName
+
+	/* Everyone who saw it posted goes for it at once */
+	slug := "tix-atx25-early+default+fiat"
+	hmac := calcTixHMAC(ta.AppContext, findConfByRef(ta.AppContext, "conf-atx25"), 100, 50, code)
+	var wg sync.WaitGroup
+	locs := make([]string, 8)
+	for i := range locs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			resp, err := noRedirects(ta.client(t)).PostForm(ta.Server.URL+"/tix/"+slug+"/collect-email", url.Values{
+				"Email":         {fmt.Sprintf("fan%d@example.com", i)},
+				"Discount":      {code},
+				"DiscountPrice": {"50"},
+				"HMAC":          {hmac},
+			})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			resp.Body.Close()
+			locs[i] = resp.Header.Get("Location")
+		}(i)
+	}
+	wg.Wait()
+
+	var checkouts int
+	for _, loc := range locs {
+		if strings.HasPrefix(loc, "https://pay.example.com/") {
+			checkouts++
+		}
+	}
+	if checkouts != 1 {
+		t.Fatalf("expected one checkout on a single use code, got %d: %v", checkouts, locs)
+	}
+
+	/* Whoever got it pays, and that's the one use */
+	for id := range fake.orders {
+		resp, err := noRedirects(ta.client(t)).PostForm(ta.Server.URL+"/callback/fake", url.Values{"id": {id}, "sig": {"ok"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		readBody(t, resp)
+	}
+	redeemed, err := getters.CampaignRedemptions(ta.Store, "conf-atx25", "Leaked")
+	if err != nil {
+		t.Fatal(err)
+	}
+	uses, err := getters.DiscountUses(ta.Store, codes[0].Ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(redeemed) != 1 || redeemed[0].Ticket == nil || uses != 1 {
+		t.Fatalf("expected the code used once, got %d uses", uses)
+	}
+}
+
+func TestCompTickets(t *testing.T) {
+	ta := newTestApp(t)
+	fake := &fakeProvider{orders: make(map[string]*types.Order)}
+	ta.Payments = map[string]types.PaymentProvider{"fake": &emailProvider{fake}}
+	ta.Env.Payments.Fiat = "fake"
+	client := noRedirects(ta.client(t))
+
+	/* 100% off isn't free, unless it's a comp */
+	allin, err := getters.FindDiscount(ta.Store, "ALLIN")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if price := getters.ApplyDiscount(allin, 100); price != 1 {
+		t.Fatalf("expected ALLIN to leave 1 to pay, got %d", price)
+	}
+
+	slug := "tix-atx25-late+default+fiat"
+	conf := findConfByRef(ta.AppContext, "conf-atx25")
+	resp, err := client.PostForm(ta.Server.URL+"/tix/"+slug+"/collect-email", url.Values{
+		"Email":         {"grace@example.com"},
+		"Count":         {"1"},
+		"Discount":      {"SPEAKER"},
+		"DiscountPrice": {"0"},
+		"HMAC":          {calcTixHMAC(ta.AppContext, conf, 200, 0, "SPEAKER")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	readBody(t, resp)
+	if resp.StatusCode != http.StatusSeeOther || !strings.HasSuffix(resp.Header.Get("Location"), "/conf/atx25/success") {
+		t.Fatalf("expected a comp to go straight to success, got %d %s", resp.StatusCode, resp.Header.Get("Location"))
+	}
+	if len(fake.orders) != 0 {
+		t.Fatalf("expected the provider to be skipped, got %+v", fake.orders)
+	}
+
+	rezzies, err := ta.Store.ListRegistrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rezzies) != 1 {
+		t.Fatalf("expected one comp, got %d", len(rezzies))
+	}
+	rez := rezzies[0]
+	if rez.Platform != "comp" || rez.Type != "speaker" || rez.AmountPaid != 0 || rez.DiscountRef != "discount-speaker" || rez.TixID != "tix-atx25-late" {
+		t.Fatalf("unexpected comp %+v", rez)
+	}
+	holds, err := ta.Store.ListHolds()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(holds) != 1 || holds[0].Status != types.HoldConverted {
+		t.Fatalf("expected the comp's hold to be converted, got %+v", holds)
+	}
+
+	/* Mailed like any other ticket */
+	CheckForNewMails(ta.AppContext)
+	mails := ta.Mailer.Mails()
+	if len(mails) != 1 || mails[0].ToAddr != "grace@example.com" || mails[0].JobKey != "btcpp-"+rez.RefID {
+		t.Fatalf("expected a ticket mail, got %d", len(mails))
+	}
+
+	/* Nothing to refund on a comp */
+	res, err := CancelTickets(ta.AppContext, conf, rez.RefID, true, "", "", "organizer")
+	if err != nil || res.Refund != nil {
+		t.Fatalf("expected the comp to cancel without a refund, got %v", err)
+	}
+}
+
+func TestCompOnCardPath(t *testing.T) {
+	ta := newTestApp(t)
+	/* The card provider collects the email itself */
+	fake := &fakeProvider{orders: make(map[string]*types.Order)}
+	ta.Payments = map[string]types.PaymentProvider{"fake": fake}
+	ta.Env.Payments.Fiat = "fake"
+	client := noRedirects(ta.client(t))
+
+	slug := "tix-atx25-late+default+fiat"
+	conf := findConfByRef(ta.AppContext, "conf-atx25")
+	comp := url.Values{
+		"Count":         {"1"},
+		"Discount":      {"SPEAKER"},
+		"DiscountPrice": {"0"},
+		"HMAC":          {calcTixHMAC(ta.AppContext, conf, 200, 0, "SPEAKER")},
+	}
+
+	/* A comp skips the provider, so it has to ask */
+	resp, err := client.PostForm(ta.Server.URL+"/tix/"+slug+"/collect-email", comp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	readBody(t, resp)
+	loc := resp.Header.Get("Location")
+	if resp.StatusCode != http.StatusSeeOther || !strings.Contains(loc, "/collect-email?") {
+		t.Fatalf("expected a comp with no email to go back for one, got %d %s", resp.StatusCode, loc)
+	}
+	rezzies, err := ta.Store.ListRegistrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rezzies) != 0 {
+		t.Fatalf("expected no comp without an email, got %d", len(rezzies))
+	}
+
+	/* The field shows up once the comp code is on */
+	resp, err = client.Get(ta.Server.URL + loc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := readBody(t, resp); !strings.Contains(body, `name="Email"`) {
+		t.Fatalf("expected the comp page to ask for an email")
+	}
+	resp, err = client.PostForm(ta.Server.URL+"/tix/"+slug+"/apply-discount", url.Values{"Discount": {"SPEAKER"}, "DiscountPrice": {"200"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := readBody(t, resp); !strings.Contains(body, `name="Email"`) {
+		t.Fatalf("expected applying a comp code to ask for an email")
+	}
+
+	/* A paid card order still doesn't */
+	resp, err = client.Get(ta.Server.URL + "/tix/" + slug + "/collect-email")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := readBody(t, resp); strings.Contains(body, `name="Email"`) {
+		t.Fatalf("expected the card page to leave the email to the provider")
+	}
+
+	comp.Set("Email", "grace@example.com")
+	resp, err = client.PostForm(ta.Server.URL+"/tix/"+slug+"/collect-email", comp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	readBody(t, resp)
+	if resp.StatusCode != http.StatusSeeOther || !strings.HasSuffix(resp.Header.Get("Location"), "/conf/atx25/success") {
+		t.Fatalf("expected the comp to go through, got %d %s", resp.StatusCode, resp.Header.Get("Location"))
+	}
+	rezzies, err = ta.Store.ListRegistrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rezzies) != 1 || rezzies[0].Email != "grace@example.com" || rezzies[0].Platform != "comp" {
+		t.Fatalf("expected one comp for grace, got %+v", rezzies)
+	}
+}
+
+func TestEmailMissing(t *testing.T) {
+	ta := newTestApp(t)
+	fake := &fakeProvider{orders: make(map[string]*types.Order)}
+	ta.Payments = map[string]types.PaymentProvider{"fake": &emailProvider{fake}}
+	ta.Env.Payments.Fiat = "fake"
+	client := noRedirects(ta.client(t))
+
+	/* No email and no code sends them back, saying why */
+	slug := "tix-atx25-late+default+fiat"
+	conf := findConfByRef(ta.AppContext, "conf-atx25")
+	resp, err := client.PostForm(ta.Server.URL+"/tix/"+slug+"/collect-email", url.Values{
+		"Count":         {"1"},
+		"DiscountPrice": {"200"},
+		"HMAC":          {calcTixHMAC(ta.AppContext, conf, 200, 200, "")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	readBody(t, resp)
+	loc := resp.Header.Get("Location")
+	if resp.StatusCode != http.StatusSeeOther || !strings.Contains(loc, "/collect-email?") {
+		t.Fatalf("expected to go back for an email, got %d %s", resp.StatusCode, loc)
+	}
+	resp, err = client.Get(ta.Server.URL + loc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := readBody(t, resp); !strings.Contains(body, "We need an email to send your tickets to") {
+		t.Fatalf("expected the page to say it needs an email")
+	}
+	if len(fake.orders) != 0 {
+		t.Fatalf("expected no checkout without an email, got %d", len(fake.orders))
+	}
+	/* Only the once, and only from us */
+	resp, err = client.Get(ta.Server.URL + loc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := readBody(t, resp); strings.Contains(body, "We need an email") {
+		t.Fatalf("expected the message to go once it's been shown")
+	}
+	resp, err = client.Get(ta.Server.URL + "/tix/" + slug + "/collect-email?err=" + url.QueryEscape("Card declined, pay at evil.example"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := readBody(t, resp); strings.Contains(body, "evil.example") {
+		t.Fatalf("expected the link's err to be left off the page")
+	}
+
+	/* Clearing the code box isn't an error */
+	resp, err = client.PostForm(ta.Server.URL+"/tix/"+slug+"/apply-discount", url.Values{"Discount": {""}, "DiscountPrice": {"200"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := readBody(t, resp); strings.Contains(body, "text-red-300") {
+		t.Fatalf("expected no error for an empty code, got %s", body)
+	}
+}
+
+func TestCompCodeRace(t *testing.T) {
+	ta := newTestApp(t)
+	fake := &fakeProvider{orders: make(map[string]*types.Order)}
+	ta.Payments = map[string]types.PaymentProvider{"fake": &emailProvider{fake}}
+	ta.Env.Payments.Fiat = "fake"
+
+	codes, err := getters.GenerateDiscounts(ta.Store, &getters.DiscountBatch{
+		Campaign: "Speakers", ConfRef: "conf-atx25", Count: 1, Comp: true, TixType: "speaker",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := codes[0].CodeName
+
+	slug := "tix-atx25-late+default+fiat"
+	conf := findConfByRef(ta.AppContext, "conf-atx25")
+
+	/* A double click, or a shared link */
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			resp, err := noRedirects(ta.client(t)).PostForm(ta.Server.URL+"/tix/"+slug+"/collect-email", url.Values{
+				"Email":         {fmt.Sprintf("talker%d@example.com", i)},
+				"Discount":      {code},
+				"DiscountPrice": {"0"},
+				"HMAC":          {calcTixHMAC(ta.AppContext, conf, 200, 0, code)},
+			})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			resp.Body.Close()
+		}(i)
+	}
+	wg.Wait()
+
+	uses, err := getters.DiscountUses(ta.Store, codes[0].Ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rezzies, err := ta.Store.ListRegistrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rezzies) != 1 || uses != 1 {
+		t.Fatalf("expected one comp on a single use code, got %d tickets", len(rezzies))
+	}
+}
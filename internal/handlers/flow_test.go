@@ -0,0 +1,444 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alexedwards/scs/v2"
+	"github.com/base58btc/btcpp-web/external/getters"
+	"github.com/base58btc/btcpp-web/internal/config"
+	"github.com/base58btc/btcpp-web/internal/notiontest"
+	"github.com/base58btc/btcpp-web/internal/types"
+	mailer "github.com/base58btc/mailer/mail"
+)
+
+/* Everyone's secret, in here */
+const testSecret = "correct horse"
+
+type testMailer struct {
+	*httptest.Server
+
+	mu    sync.Mutex
+	mails []*mailer.MailRequest
+	/* When set, the mailer says no */
+	failWith string
+}
+
+func newTestMailer() *testMailer {
+	m := &testMailer{}
+	m.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var mail mailer.MailRequest
+		json.NewDecoder(r.Body).Decode(&mail)
+
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if m.failWith != "" {
+			json.NewEncoder(w).Encode(&mailer.ReturnVal{Code: http.StatusInternalServerError, Message: m.failWith})
+			return
+		}
+		m.mails = append(m.mails, &mail)
+
+		json.NewEncoder(w).Encode(&mailer.ReturnVal{Success: true, Code: http.StatusOK})
+	}))
+	return m
+}
+
+func (m *testMailer) Fail(msg string) {
+	m.mu.Lock()
+	m.failWith = msg
+	m.mu.Unlock()
+}
+
+func (m *testMailer) Mails() []*mailer.MailRequest {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]*mailer.MailRequest{}, m.mails...)
+}
+
+/* For mail that goes out after the answer does */
+func (m *testMailer) WaitMails(t *testing.T, n int) []*mailer.MailRequest {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if mails := m.Mails(); len(mails) >= n {
+			return mails
+		}
+	}
+	return m.Mails()
+}
+
+type testApp struct {
+	*config.AppContext
+
+	Notion *notiontest.Server
+	Mailer *testMailer
+	Server *httptest.Server
+}
+
+/* Spin up the whole site against a fake Notion + mailer */
+func newTestApp(t *testing.T) *testApp {
+	t.Helper()
+
+	/* Templates + static files are loaded relative to the repo root */
+	wd, _ := os.Getwd()
+	if err := os.Chdir("../.."); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	/* Every test logs in, a lot */
+	staffLoginByIP = newRateLimiter(staffLoginIPLimit, staffLoginWindow)
+	staffLoginBy = newRateLimiter(staffLoginLimit, staffLoginWindow)
+
+	fake := notiontest.NewServer()
+	t.Cleanup(fake.Close)
+	/* Small pages, so we walk the cursors */
+	fake.PageSize = 2
+	if err := fake.LoadFixtures("internal/handlers/testdata/notion"); err != nil {
+		t.Fatal(err)
+	}
+
+	mail := newTestMailer()
+	t.Cleanup(mail.Close)
+
+	env := &types.EnvConfig{
+		Prod:           true,
+		Host:           "btcpp.test",
+		MailerEndpoint: mail.URL,
+		Notion: types.NotionConfig{
+			Token:       "secret_test",
+			Endpoint:    fake.URL,
+			PurchasesDb: "purchases",
+			TalksDb:     "talks",
+			SpeakersDb:  "speakers",
+			ConfsDb:     "confs",
+			ConfsTixDb:  "confs_tix",
+			DiscountsDb: "discounts",
+			OutboxDb:    "outbox",
+			StaffDb:     "staff",
+			WebhooksDb:  "webhooks",
+			HoldsDb:     "holds",
+			WaitlistDb:  "waitlist",
+		},
+	}
+
+	app := &config.AppContext{
+		Env:     env,
+		Infos:   log.New(io.Discard, "", 0),
+		Err:     log.New(io.Discard, "", 0),
+		Session: scs.New(),
+	}
+
+	var err error
+	app.Store, err = getters.NewStore(env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.Confs, err = getters.ListConferences(app.Store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.Payments = getters.NewPayments(env)
+
+	/* A door volunteer + an organizer for atx25 */
+	_, err = getters.NewStaff(app.Store, "door", "Door Volunteer", testSecret, types.RoleDoor, []string{"conf-atx25"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = getters.NewStaff(app.Store, "organizer", "Organizer", testSecret, types.RoleOrganizer, []string{"conf-atx25"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	routes, err := Routes(app)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(app.Session.LoadAndSave(routes))
+	t.Cleanup(srv.Close)
+
+	return &testApp{
+		AppContext: app,
+		Notion:     fake,
+		Mailer:     mail,
+		Server:     srv,
+	}
+}
+
+func loginForm(login string) url.Values {
+	return url.Values{"login": {login}, "secret": {testSecret}}
+}
+
+var csrfRe = regexp.MustCompile(`name="csrf" value="([^"]+)"`)
+
+/* Logs in on a staff page, and picks up its form token */
+func (ta *testApp) formToken(t *testing.T, client *http.Client, page, login string) string {
+	t.Helper()
+	resp, err := client.PostForm(ta.Server.URL+page, loginForm(login))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := csrfRe.FindStringSubmatch(readBody(t, resp))
+	if m == nil {
+		t.Fatalf("no form token on %s", page)
+	}
+	return m[1]
+}
+
+func (ta *testApp) client(t *testing.T) *http.Client {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &http.Client{Jar: jar}
+}
+
+/* What a phone scanning the ticket's QR code would open */
+func (ta *testApp) scanURL(t *testing.T, rez *types.Registration) string {
+	t.Helper()
+	u, err := url.Parse(ticketCheckInURL(ta.AppContext, rez))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ta.Server.URL + u.RequestURI()
+}
+
+func readBody(t *testing.T, resp *http.Response) string {
+	t.Helper()
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+func TestPurchaseToCheckIn(t *testing.T) {
+	ta := newTestApp(t)
+
+	if len(ta.Confs) != 2 {
+		t.Fatalf("expected 2 confs, got %d", len(ta.Confs))
+	}
+	conf := findConfByRef(ta.AppContext, "conf-atx25")
+	if conf == nil || len(conf.Tickets) != 2 {
+		t.Fatalf("atx25 not loaded right: %+v", conf)
+	}
+
+	/* Someone buys two tickets */
+	email := "satoshi@example.com"
+	entry := &types.Entry{
+		ID:       "cs_test_123",
+		ConfRef:  conf.Ref,
+		Total:    20000,
+		Currency: "usd",
+		Created:  time.Now().UTC(),
+		Email:    email,
+		Items: []types.Item{
+			{Total: 10000, Desc: "atx25 ticket", Type: "genpop"},
+			{Total: 10000, Desc: "atx25 ticket", Type: "genpop"},
+		},
+	}
+	if err := ta.Store.AddTickets(entry, "stripe"); err != nil {
+		t.Fatal(err)
+	}
+
+	sold, err := ta.Store.SoldTixCount(conf.Ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sold != 2 {
+		t.Fatalf("expected 2 sold, got %d", sold)
+	}
+
+	/* They're both coming themselves, so there's nobody to claim for */
+	for i := range entry.Items {
+		err = ta.Store.UpdateAttendee(getters.UniqueID(email, entry.ID, int32(i)), &types.Attendee{Name: "Satoshi", Email: email})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	/* The mailer picks them up, once */
+	CheckForNewMails(ta.AppContext)
+	CheckForNewMails(ta.AppContext)
+
+	mails := ta.Mailer.Mails()
+	if len(mails) != 2 {
+		t.Fatalf("expected 2 ticket mails, got %d", len(mails))
+	}
+	for i, mail := range mails {
+		if mail.ToAddr != email {
+			t.Errorf("mail %d went to %s", i, mail.ToAddr)
+		}
+		if len(mail.Attachments) != 1 || mail.Attachments[0].Type != "application/pdf" {
+			t.Errorf("mail %d missing its ticket pdf", i)
+		} else if !bytes.HasPrefix(mail.Attachments[0].Content, []byte("%PDF-")) {
+			t.Errorf("mail %d ticket isn't a pdf", i)
+		}
+	}
+
+	outbox, err := ta.Store.ListOutbox()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(outbox) != 2 {
+		t.Fatalf("expected 2 outbox mails, got %d", len(outbox))
+	}
+	for _, mail := range outbox {
+		if mail.Status != types.MailSent || mail.Attempts != 1 {
+			t.Errorf("outbox mail %s is %s after %d attempts", mail.JobKey, mail.Status, mail.Attempts)
+		}
+	}
+
+	/* Door volunteer scans the first ticket */
+	ticket := getters.UniqueID(email, entry.ID, 0)
+	client := ta.client(t)
+	scanURL := ta.scanURL(t, &types.Registration{RefID: ticket, ConfRef: conf.Ref, Type: "genpop"})
+	resp, err := client.PostForm(scanURL, loginForm("door"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := readBody(t, resp)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(body, "genpop") {
+		t.Fatalf("check-in failed (%d): %s", resp.StatusCode, body)
+	}
+
+	var checkedIn int
+	for _, page := range ta.Notion.Pages("purchases") {
+		if len(page.Properties["Checked In"].RichText) > 0 {
+			checkedIn++
+		}
+	}
+	if checkedIn != 1 {
+		t.Fatalf("expected 1 checked in purchase, got %d", checkedIn)
+	}
+
+	/* Scanning it again is a no-go */
+	resp, err = client.Get(scanURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body = readBody(t, resp)
+	if !strings.Contains(body, "Already checked in") {
+		t.Fatalf("expected double check-in to fail: %s", body)
+	}
+
+	/* Unknown tickets don't get in either */
+	resp, err = client.Get(ta.Server.URL + "/check-in/nope")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body = readBody(t, resp)
+	if !strings.Contains(body, "Ticket not found") {
+		t.Fatalf("expected unknown ticket to fail: %s", body)
+	}
+}
+
+/* A payment provider that keeps its orders in memory */
+type fakeProvider struct {
+	mu      sync.Mutex
+	orders  map[string]*types.Order
+	refunds []int64
+}
+
+func (p *fakeProvider) Name() string     { return "fake" }
+func (p *fakeProvider) NeedsEmail() bool { return false }
+
+func (p *fakeProvider) CreateCheckout(order *types.Order) (*types.Checkout, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	order.ID = fmt.Sprintf("fake_%d", len(p.orders))
+	p.orders[order.ID] = order
+	return &types.Checkout{OrderID: order.ID, URL: "https://pay.example.com/" + order.ID}, nil
+}
+
+func (p *fakeProvider) VerifyWebhook(r *http.Request) (*types.PaymentEvent, error) {
+	r.ParseForm()
+	if r.Form.Get("sig") != "ok" {
+		return nil, fmt.Errorf("bad sig")
+	}
+	return &types.PaymentEvent{ID: r.Form.Get("id"), OrderID: r.Form.Get("id"), Status: types.OrderPaid}, nil
+}
+
+func (p *fakeProvider) FetchCharge(id string) (*types.Order, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	order, ok := p.orders[id]
+	if !ok {
+		return nil, fmt.Errorf("no order %s", id)
+	}
+	paid := *order
+	paid.Status = types.OrderPaid
+	paid.Email = "bob@example.com"
+	return &paid, nil
+}
+
+func (p *fakeProvider) Refund(order *types.Order, amount int64) (*types.Refund, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.refunds = append(p.refunds, amount)
+	return &types.Refund{ID: "re_" + order.ID}, nil
+}
+
+func noRedirects(client *http.Client) *http.Client {
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	return client
+}
+
+/* Through the pre-checkout page with no code or email, to
+ * wherever it sends us */
+func checkoutCart(t *testing.T, ta *testApp, client *http.Client, slug string) string {
+	t.Helper()
+	resp, err := client.Get(ta.Server.URL + "/tix/" + slug)
+	if err != nil {
+		t.Fatal(err)
+	}
+	readBody(t, resp)
+	if resp.StatusCode != http.StatusSeeOther || resp.Header.Get("Location") != "/tix/"+slug+"/collect-email" {
+		t.Fatalf("expected %s to stop before checkout, got %d %s", slug, resp.StatusCode, resp.Header.Get("Location"))
+	}
+
+	cart := mustCart(t, ta, slug)
+	price := cart.Price(nil)
+	resp, err = client.PostForm(ta.Server.URL+"/tix/"+slug+"/collect-email", url.Values{
+		"DiscountPrice": {fmt.Sprint(price)},
+		"HMAC":          {calcTixHMAC(ta.AppContext, cart.Conf, price, price, "")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	readBody(t, resp)
+	if resp.StatusCode != http.StatusSeeOther {
+		t.Fatalf("expected a redirect for %s, got %d", slug, resp.StatusCode)
+	}
+	return resp.Header.Get("Location")
+}
+
+/* A fake that asks for an email first, like the btc path */
+type emailProvider struct {
+	*fakeProvider
+}
+
+func (p *emailProvider) NeedsEmail() bool { return true }
+
+func mustCart(t *testing.T, ta *testApp, slug string) *tixCart {
+	cart, err := determineCart(ta.AppContext, slug)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cart
+}
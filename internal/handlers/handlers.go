@@ -5,14 +5,15 @@ import (
 	"crypto/sha256"
 	"encoding/binary"
 	"encoding/hex"
-	"encoding/json"
 	"fmt"
 	"html/template"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"sort"
 	"strings"
 	"strconv"
+	texttemplate "text/template"
 	"time"
 
 	"github.com/base58btc/btcpp-web/external/getters"
@@ -20,13 +21,6 @@ import (
 	"github.com/base58btc/btcpp-web/internal/types"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/schema"
-
-	"encoding/base64"
-	qrcode "github.com/skip2/go-qrcode"
-
-	stripe "github.com/stripe/stripe-go/v76"
-	"github.com/stripe/stripe-go/v76/checkout/session"
-	"github.com/stripe/stripe-go/v76/webhook"
 )
 
 func MiniCss() string {
@@ -39,30 +33,32 @@ func MiniCss() string {
 
 /* https://www.calhoun.io/intro-to-templates-p3-functions/ */
 func loadTemplates(app *config.AppContext) error {
+	cache := make(map[string]*template.Template)
+	text := make(map[string]*texttemplate.Template)
 
 	index, err := template.ParseFiles("templates/index.tmpl", "templates/main_nav.tmpl", "templates/section/about.tmpl")
 	if err != nil {
 		return err
 	}
-	app.TemplateCache["index.tmpl"] = index
+	cache["index.tmpl"] = index
 
 	success, err := template.ParseFiles("templates/success.tmpl", "templates/main_nav.tmpl", "templates/section/about.tmpl")
 	if err != nil {
 		return err
 	}
-	app.TemplateCache["success.tmpl"] = success
+	cache["success.tmpl"] = success
 
 	berlin, err := template.ParseFiles("templates/berlin.tmpl", "templates/conf_nav.tmpl", "templates/session.tmpl")
 	if err != nil {
 		return err
 	}
-	app.TemplateCache["berlin.tmpl"] = berlin
+	cache["berlin.tmpl"] = berlin
 
 	berlin24, err := template.ParseFiles("templates/berlin24.tmpl", "templates/conf_nav.tmpl", "templates/session.tmpl", "templates/btcbutton.tmpl")
 	if err != nil {
 		return err
 	}
-	app.TemplateCache["berlin24.tmpl"] = berlin24
+	cache["berlin24.tmpl"] = berlin24
 
 	talks, err := template.ParseFiles("templates/sched.tmpl",
 		"templates/sched_desc.tmpl",
@@ -70,50 +66,37 @@ func loadTemplates(app *config.AppContext) error {
 	if err != nil {
 		return err
 	}
-	app.TemplateCache["talks.tmpl"] = talks
+	cache["talks.tmpl"] = talks
 
 	buenos, err := template.ParseFiles("templates/buenos.tmpl", "templates/conf_nav.tmpl", "templates/session.tmpl", "templates/multi_session.tmpl", "templates/btcbutton.tmpl")
 	if err != nil {
 		return err
 	}
-	app.TemplateCache["buenos.tmpl"] = buenos
+	cache["buenos.tmpl"] = buenos
 
 	floripa, err := template.ParseFiles("templates/floripa.tmpl", "templates/conf_nav.tmpl", "templates/session.tmpl", "templates/multi_session.tmpl", "templates/btcbutton.tmpl")
 	if err != nil {
 		return err
 	}
-	app.TemplateCache["floripa.tmpl"] = floripa
+	cache["floripa.tmpl"] = floripa
 
 	atx, err := template.ParseFiles("templates/atx.tmpl", "templates/conf_nav.tmpl", "templates/session.tmpl", "templates/btcbutton.tmpl")
 	if err != nil {
 		return err
 	}
-	app.TemplateCache["atx.tmpl"] = atx
+	cache["atx.tmpl"] = atx
 
 	atx25, err := template.ParseFiles("templates/atx25.tmpl", "templates/conf_nav.tmpl", "templates/session.tmpl", "templates/btcbutton.tmpl")
 	if err != nil {
 		return err
 	}
-	app.TemplateCache["atx25.tmpl"] = atx25
+	cache["atx25.tmpl"] = atx25
 
 	atx24, err := template.ParseFiles("templates/atx24.tmpl", "templates/conf_nav.tmpl", "templates/session.tmpl", "templates/btcbutton.tmpl")
 	if err != nil {
 		return err
 	}
-	app.TemplateCache["atx24.tmpl"] = atx24
-
-	ticket, err := template.New("ticket.tmpl").Funcs(template.FuncMap{
-		"safesrc": func(s string) template.HTMLAttr {
-			return template.HTMLAttr(fmt.Sprintf(`src="%s"`, s))
-		},
-		"css": func(s string) template.HTML {
-			return template.HTML(fmt.Sprintf(`<style type="text/css">%s</style>`, s))
-		},
-	}).ParseFiles("templates/emails/ticket.tmpl")
-	if err != nil {
-		return err
-	}
-	app.TemplateCache["ticket.tmpl"] = ticket
+	cache["atx24.tmpl"] = atx24
 
 	for _, conf := range app.Confs {
 		if !conf.Active {
@@ -127,34 +110,143 @@ func loadTemplates(app *config.AppContext) error {
 		if err != nil {
 			return err
 		}
-		app.TemplateCache["email-html-"+conf.Tag] = htmlEmail
+		cache["email-html-"+conf.Tag] = htmlEmail
 
 		textEmail, err := template.ParseFiles(textEmailTmpl)
 		if err != nil {
 			return err
 		}
-		app.TemplateCache["email-text-"+conf.Tag] = textEmail
+		cache["email-text-"+conf.Tag] = textEmail
+	}
+
+	cart, err := template.ParseFiles("templates/cart.tmpl", "templates/main_nav.tmpl")
+	if err != nil {
+		return err
+	}
+	cache["cart.tmpl"] = cart
+
+	cancelHTML, err := template.ParseFiles("templates/emails/cancel.tmpl")
+	if err != nil {
+		return err
+	}
+	cache["email-html-cancel"] = cancelHTML
+
+	/* Not html/template, it'd escape the plain text */
+	cancelText, err := texttemplate.ParseFiles("templates/emails/cancel-text.tmpl")
+	if err != nil {
+		return err
+	}
+	text["email-text-cancel"] = cancelText
+
+	claimHTML, err := template.ParseFiles("templates/emails/claim.tmpl")
+	if err != nil {
+		return err
+	}
+	cache["email-html-claim"] = claimHTML
+
+	claimText, err := texttemplate.ParseFiles("templates/emails/claim-text.tmpl")
+	if err != nil {
+		return err
+	}
+	text["email-text-claim"] = claimText
+
+	claim, err := template.ParseFiles("templates/claim.tmpl", "templates/main_nav.tmpl")
+	if err != nil {
+		return err
+	}
+	cache["claim.tmpl"] = claim
+
+	attendee, err := template.ParseFiles("templates/attendee.tmpl", "templates/main_nav.tmpl")
+	if err != nil {
+		return err
+	}
+	cache["attendee.tmpl"] = attendee
+
+	transfer, err := template.ParseFiles("templates/transfer.tmpl", "templates/main_nav.tmpl")
+	if err != nil {
+		return err
+	}
+	cache["transfer.tmpl"] = transfer
+
+	lookupHTML, err := template.ParseFiles("templates/emails/lookup.tmpl")
+	if err != nil {
+		return err
+	}
+	cache["email-html-lookup"] = lookupHTML
+
+	lookupText, err := texttemplate.ParseFiles("templates/emails/lookup-text.tmpl")
+	if err != nil {
+		return err
+	}
+	text["email-text-lookup"] = lookupText
+
+	waitlistHTML, err := template.ParseFiles("templates/emails/waitlist.tmpl")
+	if err != nil {
+		return err
+	}
+	cache["email-html-waitlist"] = waitlistHTML
+
+	waitlistText, err := texttemplate.ParseFiles("templates/emails/waitlist-text.tmpl")
+	if err != nil {
+		return err
 	}
+	text["email-text-waitlist"] = waitlistText
+
+	waitlist, err := template.ParseFiles("templates/waitlist.tmpl", "templates/main_nav.tmpl")
+	if err != nil {
+		return err
+	}
+	cache["waitlist.tmpl"] = waitlist
+
+	tickets, err := template.ParseFiles("templates/tickets.tmpl", "templates/main_nav.tmpl")
+	if err != nil {
+		return err
+	}
+	cache["tickets.tmpl"] = tickets
 
 	checkin, err := template.ParseFiles("templates/checkin.tmpl", "templates/main_nav.tmpl")
 	if err != nil {
 		return err
 	}
-	app.TemplateCache["checkin.tmpl"] = checkin
+	cache["checkin.tmpl"] = checkin
+
+	staff, err := template.ParseFiles("templates/staff.tmpl")
+	if err != nil {
+		return err
+	}
+	cache["staff.tmpl"] = staff
+
+	admin, err := template.ParseFiles("templates/admin.tmpl")
+	if err != nil {
+		return err
+	}
+	cache["admin.tmpl"] = admin
+
+	checkout, err := template.ParseFiles("templates/checkout.tmpl", "templates/main_nav.tmpl")
+	if err != nil {
+		return err
+	}
+	cache["checkout.tmpl"] = checkout
+
+	station, err := template.ParseFiles("templates/station.tmpl")
+	if err != nil {
+		return err
+	}
+	cache["station.tmpl"] = station
 
 	collect, err := template.ParseGlob("templates/*.tmpl")
 	if err != nil {
 		return err
 	}
-	app.TemplateCache["collect-email.tmpl"] = collect
+	cache["collect-email.tmpl"] = collect
 
 	emailincludes, err := template.ParseFiles("templates/tix_details.tmpl")
 	if err != nil {
 		return err
 	}
-	app.TemplateCache["email-includes.tmpl"] = emailincludes
-
+	cache["email-includes.tmpl"] = emailincludes
 
+	app.SetTemplates(cache, text)
 	return nil
 }
 
@@ -210,38 +302,53 @@ func findTicket(app *config.AppContext, tixID string) (*types.ConfTicket, *types
 	return nil, nil
 }
 
-func determineTixPrice(ctx *config.AppContext, tixSlug string) (*types.Conf, *types.ConfTicket, uint, bool, error) {
+/* What a ticket link (tix id + type + currency) is asking for */
+type tixChoice struct {
+	Conf  *types.Conf
+	Tix   *types.ConfTicket
+	Price uint
+	Local bool
+	/* "btc" or "fiat"; see getters.PaymentFor */
+	Method string
+}
+
+func determineTixPrice(ctx *config.AppContext, tixSlug string) (*tixChoice, error) {
 
 	tixParts := strings.Split(tixSlug, "+")
 	if len(tixParts) != 3 {
-		return nil, nil, 0, false, fmt.Errorf("not enough ticket parts?? needed 3. %s", tixSlug)
+		return nil, fmt.Errorf("not enough ticket parts?? needed 3. %s", tixSlug)
 	}
 
 	tix, conf := findTicket(ctx, tixParts[0])
 	if tix == nil {
-		return nil, nil, 0, false, fmt.Errorf("Unable to find tix %s", tixParts[0])
+		return nil, fmt.Errorf("Unable to find tix %s", tixParts[0])
 	}
 	tixTypeOpts := []string{"default", "local"}
 	if !contains(tixTypeOpts, tixParts[1]) {
-		return nil, nil, 0, false, fmt.Errorf("type %s not in list %v", tixParts[1], tixTypeOpts)
+		return nil, fmt.Errorf("type %s not in list %v", tixParts[1], tixTypeOpts)
 	}
 	isLocal := tixParts[1] == "local"
 
 	currencyTypeOpts := []string{"btc", "fiat"}
 	if !contains(currencyTypeOpts, tixParts[2]) {
-		return nil, nil, 0, false, fmt.Errorf("type %s not in list %v", tixParts[2], currencyTypeOpts)
-	}
-	if tixParts[2] == "btc" {
-		if isLocal {
-			return conf, tix, tix.Local, true, nil
-		}
-		return conf, tix, tix.BTC, true, nil
+		return nil, fmt.Errorf("type %s not in list %v", tixParts[2], currencyTypeOpts)
 	}
 
-	if isLocal {
-		return conf, tix, tix.Local, false, nil
+	choice := &tixChoice{
+		Conf:   conf,
+		Tix:    tix,
+		Local:  isLocal,
+		Method: tixParts[2],
+	}
+	switch {
+	case isLocal:
+		choice.Price = tix.Local
+	case choice.Method == "btc":
+		choice.Price = tix.BTC
+	default:
+		choice.Price = tix.USD
 	}
-	return conf, tix, tix.USD, false, nil
+	return choice, nil
 }
 
 /* Find ticket where current sold + date > inputs */
@@ -251,7 +358,8 @@ func findCurrTix(conf *types.Conf, soldCount uint) *types.ConfTicket {
 	tixs := types.ConfTickets(conf.Tickets)
 	sort.Sort(&tixs)
 	for _, tix := range tixs {
-		if tix.Expires.Start.Before(now) {
+		/* No date, not on sale */
+		if tix.Expires == nil || tix.Expires.Start.Before(now) {
 			continue
 		}
 		if tix.Max <= soldCount {
@@ -320,6 +428,16 @@ func Routes(app *config.AppContext) (http.Handler, error) {
 		maybeReload(app)
 		RenderConfSuccess(w, r, app)
 	}).Methods("GET")
+	r.HandleFunc("/conf/{conf}/cart", func(w http.ResponseWriter, r *http.Request) {
+		maybeReload(app)
+		CartForm(w, r, app)
+	}).Methods("GET", "POST")
+	r.HandleFunc("/conf/{conf}/waitlist", func(w http.ResponseWriter, r *http.Request) {
+		JoinWaitlist(w, r, app)
+	}).Methods("GET", "POST")
+	r.HandleFunc("/waitlist/{ref}", func(w http.ResponseWriter, r *http.Request) {
+		WaitlistInvite(w, r, app)
+	}).Methods("GET")
 	r.HandleFunc("/conf/{conf}/talks", func(w http.ResponseWriter, r *http.Request) {
 		maybeReload(app)
 		RenderTalks(w, r, app)
@@ -343,6 +461,88 @@ func Routes(app *config.AppContext) (http.Handler, error) {
 		maybeReload(app)
 		ReloadConf(w, r, app)
 	}).Methods("GET", "POST")
+	r.HandleFunc("/check-in/station-sw.js", func(w http.ResponseWriter, r *http.Request) {
+		CheckInStationWorker(w, r, app)
+	}).Methods("GET")
+	r.HandleFunc("/check-in/station/{conf}", func(w http.ResponseWriter, r *http.Request) {
+		maybeReload(app)
+		CheckInStation(w, r, app)
+	}).Methods("GET", "POST")
+	r.HandleFunc("/check-in/station/{conf}/list", func(w http.ResponseWriter, r *http.Request) {
+		CheckInStationList(w, r, app)
+	}).Methods("GET")
+	r.HandleFunc("/check-in/station/{conf}/sync", func(w http.ResponseWriter, r *http.Request) {
+		CheckInStationSync(w, r, app)
+	}).Methods("POST")
+	r.HandleFunc("/logout", func(w http.ResponseWriter, r *http.Request) {
+		Logout(w, r, app)
+	}).Methods("GET", "POST")
+	r.HandleFunc("/staff", func(w http.ResponseWriter, r *http.Request) {
+		maybeReload(app)
+		StaffList(w, r, app)
+	}).Methods("GET", "POST")
+	r.HandleFunc("/staff/add", func(w http.ResponseWriter, r *http.Request) {
+		maybeReload(app)
+		StaffAdd(w, r, app)
+	}).Methods("POST")
+	r.HandleFunc("/staff/{ref}/revoke", func(w http.ResponseWriter, r *http.Request) {
+		maybeReload(app)
+		StaffRevoke(w, r, app)
+	}).Methods("POST")
+	r.HandleFunc("/admin", func(w http.ResponseWriter, r *http.Request) {
+		maybeReload(app)
+		Admin(w, r, app)
+	}).Methods("GET", "POST")
+	r.HandleFunc("/admin/webhooks", func(w http.ResponseWriter, r *http.Request) {
+		AdminWebhookLog(w, r, app)
+	}).Methods("GET", "POST")
+	r.HandleFunc("/admin/webhooks/{ref}/replay", func(w http.ResponseWriter, r *http.Request) {
+		maybeReload(app)
+		AdminWebhookReplay(w, r, app)
+	}).Methods("POST")
+	r.HandleFunc("/admin/{conf}/cancel", func(w http.ResponseWriter, r *http.Request) {
+		maybeReload(app)
+		AdminCancel(w, r, app)
+	}).Methods("POST")
+	r.HandleFunc("/admin/{conf}/discounts", func(w http.ResponseWriter, r *http.Request) {
+		maybeReload(app)
+		AdminDiscountCodes(w, r, app)
+	}).Methods("GET", "POST")
+	r.HandleFunc("/admin/{conf}/discounts.csv", func(w http.ResponseWriter, r *http.Request) {
+		maybeReload(app)
+		AdminDiscountsCSV(w, r, app)
+	}).Methods("GET")
+	r.HandleFunc("/admin/{conf}", func(w http.ResponseWriter, r *http.Request) {
+		maybeReload(app)
+		AdminConfStats(w, r, app)
+	}).Methods("GET", "POST")
+	r.HandleFunc("/claim/{order}", func(w http.ResponseWriter, r *http.Request) {
+		ClaimTickets(w, r, app)
+	}).Methods("GET", "POST")
+	r.HandleFunc("/attendee/{ticket}", func(w http.ResponseWriter, r *http.Request) {
+		EditAttendee(w, r, app)
+	}).Methods("GET", "POST")
+	r.HandleFunc("/transfer/{ticket}", func(w http.ResponseWriter, r *http.Request) {
+		TransferForm(w, r, app)
+	}).Methods("GET", "POST")
+	r.HandleFunc("/hold/{ref}/cancel", func(w http.ResponseWriter, r *http.Request) {
+		CancelHold(w, r, app)
+	}).Methods("GET")
+	r.HandleFunc("/tickets", func(w http.ResponseWriter, r *http.Request) {
+		TicketLookup(w, r, app)
+	}).Methods("GET", "POST")
+	r.HandleFunc("/tickets/{token}", func(w http.ResponseWriter, r *http.Request) {
+		TicketList(w, r, app)
+	}).Methods("GET")
+	r.HandleFunc("/tickets/{token}/{ticket}/pdf", func(w http.ResponseWriter, r *http.Request) {
+		TicketDownload(w, r, app)
+	}).Methods("GET")
+	r.HandleFunc("/tickets/{token}/{ticket}/resend", func(w http.ResponseWriter, r *http.Request) {
+		TicketResend(w, r, app)
+	}).Methods("POST")
+	r.HandleFunc("/check-in-key", func(w http.ResponseWriter, r *http.Request) {
+		CheckInKey(w, r, app)
+	}).Methods("GET")
 	r.HandleFunc("/check-in/{ticket}", func(w http.ResponseWriter, r *http.Request) {
 		maybeReload(app)
 		CheckIn(w, r, app)
@@ -351,23 +551,21 @@ func Routes(app *config.AppContext) (http.Handler, error) {
 		maybeReload(app)
 		TicketCheck(w, r, app)
 	}).Methods("GET")
-	r.HandleFunc("/ticket/{ticket}", func(w http.ResponseWriter, r *http.Request) {
-		maybeReload(app)
-		Ticket(w, r, app)
-	}).Methods("GET")
 	r.HandleFunc("/trial-email", func(w http.ResponseWriter, r *http.Request) {
 		maybeReload(app)
 		SendMailTest(w, r, app)
 	}).Methods("GET")
 
-	/* Setup stripe! */
-	stripe.Key = app.Env.StripeKey
-	r.HandleFunc("/callback/stripe", func(w http.ResponseWriter, r *http.Request) {
-		StripeCallback(w, r, app)
-	}).Methods("POST")
-	r.HandleFunc("/callback/opennode", func(w http.ResponseWriter, r *http.Request) {
-		OpenNodeCallback(w, r, app)
+	/* Payment providers tell us about payments here */
+	r.HandleFunc("/callback/{provider}", func(w http.ResponseWriter, r *http.Request) {
+		PaymentCallback(w, r, app)
 	}).Methods("GET", "POST")
+	r.HandleFunc("/checkout/{provider}/{order}", func(w http.ResponseWriter, r *http.Request) {
+		BitcoinCheckout(w, r, app)
+	}).Methods("GET")
+	r.HandleFunc("/checkout/{provider}/{order}/status", func(w http.ResponseWriter, r *http.Request) {
+		BitcoinCheckoutStatus(w, r, app)
+	}).Methods("GET")
 
 	// Create a file server to serve static files from the "static" directory
 	fs := http.FileServer(http.Dir("static"))
@@ -378,7 +576,6 @@ func Routes(app *config.AppContext) (http.Handler, error) {
 		return r, err
 	}
 
-	app.TemplateCache = make(map[string]*template.Template)
 	err = loadTemplates(app)
 
 	return r, err
@@ -433,6 +630,7 @@ type SuccessPage struct {
 type TixFormPage struct {
 	Conf     *types.Conf
 	Tix      *types.ConfTicket
+	Cart     *tixCart
 	TixSlug  string
 	Count    uint
 	TixPrice    uint
@@ -441,6 +639,8 @@ type TixFormPage struct {
 	DiscountRef string
 	HMAC	  string
 	Err       string
+	/* Do we ask for their email, or does the provider? */
+	NeedsEmail bool
 }
 
 func calcTixHMAC(ctx *config.AppContext, conf *types.Conf, tixPrice uint, discountPrice uint, discountCode string) string {
@@ -457,35 +657,16 @@ func calcTixHMAC(ctx *config.AppContext, conf *types.Conf, tixPrice uint, discou
 
 func GetReloadConf(w http.ResponseWriter, r *http.Request, ctx *config.AppContext) {
 	/* Check for logged in */
-	pin := ctx.Session.GetString(r.Context(), "pin")
-	tmpl := ctx.TemplateCache["checkin.tmpl"]
-
-	if pin == "" {
-		w.Header().Set("x-missing-field", "pin")
-		w.WriteHeader(http.StatusBadRequest)
-		err := tmpl.ExecuteTemplate(w, "checkin.tmpl", &CheckInPage{
-			NeedsPin: true,
-		})
-		if err != nil {
-			http.Error(w, "Unable to load page, please try again later", http.StatusInternalServerError)
-			ctx.Err.Printf("/conf/check-in ExecuteTemplate failed ! %s", err.Error())
-		}
+	staff := requireStaff(w, r, ctx, types.RoleOrganizer, "")
+	if staff == nil {
 		return
 	}
+	ctx.Infos.Printf("conf reload by %s", staff.Login)
 
-	if pin != ctx.Env.RegistryPin {
-		w.WriteHeader(http.StatusUnauthorized)
-		err := tmpl.ExecuteTemplate(w, "checkin.tmpl", &CheckInPage{
-			Msg: "Wrong registration PIN",
-		})
-		if err != nil {
-			http.Error(w, "Unable to load page, please try again later", http.StatusInternalServerError)
-			ctx.Err.Printf("/conf-reload ExecuteTemplate failed ! %s", err.Error())
-		}
-		return
-	}
+	/* Everything gets fetched fresh */
+	getters.InvalidateCache(ctx.Store)
 
-	confs, err := getters.ListConferences(ctx.Notion)
+	confs, err := getters.ListConferences(ctx.Store)
 	if err != nil {
 		http.Error(w, "Unable to load confereneces, please try again later", http.StatusInternalServerError)
 		ctx.Err.Printf("/conf-reload conf load failed ! %s", err.Error())
@@ -508,50 +689,14 @@ func GetReloadConf(w http.ResponseWriter, r *http.Request, ctx *config.AppContex
 
 func ReloadConf(w http.ResponseWriter, r *http.Request, ctx *config.AppContext) {
 	switch r.Method {
-	case http.MethodGet:
-		GetReloadConf(w, r, ctx)
-		return
-	case http.MethodPost:
-		r.ParseForm()
-		pin := r.Form.Get("pin")
-		if pin != ctx.Env.RegistryPin {
-			w.WriteHeader(http.StatusBadRequest)
-			err := ctx.TemplateCache["checkin.tmpl"].ExecuteTemplate(w, "checkin.tmpl", &CheckInPage{
-				NeedsPin: true,
-				Msg:      "Wrong pin",
-			})
-			if err != nil {
-				http.Error(w, "Unable to load page, please try again later", http.StatusInternalServerError)
-				ctx.Err.Printf("/conf-reload ExecuteTemplate failed ! %s", err.Error())
-				return
-			}
-			ctx.Err.Printf("/conf-reload wrong pin submitted! %s", pin)
-			return
-		}
-
-		/* Set pin?? */
-		ctx.Session.Put(r.Context(), "pin", pin)
+	case http.MethodGet, http.MethodPost:
 		GetReloadConf(w, r, ctx)
 	}
 }
 
-/* Implement a 5m refresh for the speakers 'cache' */
+/* The store caches these for us */
 func FetchSpeakers(ctx *config.AppContext) ([]*types.Speaker, error) {
-	/* FIXME: use a cache for notion fetches? */
-	now := time.Now()
-	deadline := now.Add(time.Duration(-5) * time.Minute)
-	if ctx.Speakers == nil || ctx.LastSpeakerFetch.Before(deadline) {
-		var err error
-		ctx.Speakers, err = getters.ListSpeakers(ctx.Notion)
-		/* Set last fetch to now even if there's errors */
-		ctx.LastSpeakerFetch = time.Now()
-
-		if err != nil {
-			return nil, err
-		}
-	}
-
-	return ctx.Speakers, nil
+	return ctx.Store.ListSpeakers()
 }
 
 func filterSpeakers(talks []*types.Talk) types.Speakers {
@@ -570,12 +715,12 @@ func filterSpeakers(talks []*types.Talk) types.Speakers {
 }
 
 func RenderTalks(w http.ResponseWriter, r *http.Request, ctx *config.AppContext) {
-	tmpl := ctx.TemplateCache["talks.tmpl"]
+	tmpl := ctx.Template("talks.tmpl")
 
 	conf, err := findConf(r, ctx)
 	if err != nil {
 		http.Error(w, "Unable to find page", 404)
-		ctx.Err.Printf("Unable to find conf %s: %s", err.Error())
+		ctx.Err.Printf("Unable to find conf: %s", err.Error())
 		return
 	}
 
@@ -587,7 +732,7 @@ func RenderTalks(w http.ResponseWriter, r *http.Request, ctx *config.AppContext)
 	}
 
 	var talks talkTime
-	talks, err = getters.GetTalksFor(ctx.Notion, conf.Tag, speakers)
+	talks, err = getters.GetTalksFor(ctx.Store, conf.Tag, speakers)
 	if err != nil {
 		http.Error(w, "Unable to load page, please try again later", http.StatusInternalServerError)
 		ctx.Err.Printf("Unable to fetch talks from Notion!! %s", err.Error())
@@ -616,11 +761,11 @@ func RenderConfSuccess(w http.ResponseWriter, r *http.Request, ctx *config.AppCo
 	conf, err := findConf(r, ctx)
 	if err != nil {
 		http.Error(w, "Unable to find page", 404)
-		ctx.Err.Printf("Unable to find conf %s: %s", err.Error())
+		ctx.Err.Printf("Unable to find conf: %s", err.Error())
 		return
 	}
 
-	tmpl := ctx.TemplateCache["success.tmpl"]
+	tmpl := ctx.Template("success.tmpl")
 	err = tmpl.ExecuteTemplate(w, "success.tmpl", &SuccessPage{
 		Conf: conf,
 	})
@@ -635,7 +780,7 @@ func RenderConf(w http.ResponseWriter, r *http.Request, ctx *config.AppContext)
 	conf, err := findConf(r, ctx)
 	if err != nil {
 		http.Error(w, "Unable to find page", 404)
-		ctx.Err.Printf("Unable to find conf %s: %s", err.Error())
+		ctx.Err.Printf("Unable to find conf: %s", err.Error())
 		return
 	}
 
@@ -646,7 +791,7 @@ func RenderConf(w http.ResponseWriter, r *http.Request, ctx *config.AppContext)
 		ctx.Err.Printf("Unable to fetch speakers from Notion!! %s", err.Error())
 		return
 	}
-	talks, err = getters.GetTalksFor(ctx.Notion, conf.Tag, speakers)
+	talks, err = getters.GetTalksFor(ctx.Store, conf.Tag, speakers)
 	if err != nil {
 		http.Error(w, "Unable to load page, please try again later", http.StatusInternalServerError)
 		ctx.Err.Printf("Unable to fetch talks from Notion!! %s", err.Error())
@@ -657,7 +802,7 @@ func RenderConf(w http.ResponseWriter, r *http.Request, ctx *config.AppContext)
 	evSpeakers = filterSpeakers(talks)
 	sort.Sort(evSpeakers)
 
-	soldCount, err := getters.SoldTixCount(ctx.Notion, conf.Ref)
+	soldCount, err := ctx.Store.SoldTixCount(conf.Ref)
 	if err != nil {
 		http.Error(w, "Unable to load page, please try again later", http.StatusInternalServerError)
 		ctx.Err.Printf("Unable to fetch ticket count from Notion!! %s", err.Error())
@@ -671,16 +816,23 @@ func RenderConf(w http.ResponseWriter, r *http.Request, ctx *config.AppContext)
 		return
 	}
 
-	currTix := findCurrTix(conf, soldCount)
+	/* Tickets held for open checkouts aren't for sale either */
+	taken, err := tixTakenBy(r, ctx, conf.Ref)
+	if err != nil {
+		http.Error(w, "Unable to load page, please try again later", http.StatusInternalServerError)
+		ctx.Err.Printf("Unable to fetch held ticket count!! %s", err.Error())
+		return
+	}
+	currTix := findCurrTix(conf, taken)
 	maxTix := findMaxTix(conf)
 
 	var tixLeft uint
 	if currTix == nil {
 		tixLeft = 0
 	} else {
-		tixLeft = currTix.Max - soldCount
+		tixLeft = currTix.Max - taken
 	}
-	tmpl := ctx.TemplateCache[conf.Template]
+	tmpl := ctx.Template(conf.Template)
 	err = tmpl.ExecuteTemplate(w, conf.Template, &ConfPage{
 		Conf:    conf,
 		Tix:     currTix,
@@ -701,7 +853,7 @@ func RenderConf(w http.ResponseWriter, r *http.Request, ctx *config.AppContext)
 func Home(w http.ResponseWriter, r *http.Request, ctx *config.AppContext) {
 
 	// Define the data to be rendered in the template
-	tmpl := ctx.TemplateCache["index.tmpl"]
+	tmpl := ctx.Template("index.tmpl")
 
 	err := tmpl.ExecuteTemplate(w, "index.tmpl", &HomePage{})
 	if err != nil {
@@ -796,16 +948,10 @@ func bucketTalks(conf *types.Conf, talks talkTime) (map[string]sessionTime, erro
 }
 
 type EmailTmpl struct {
-	URI string
-	CSS string
-}
-
-type TicketTmpl struct {
-	QRCodeURI string
-	Domain    string
-	CSS       string
-	Type      string
-	Conf      *types.Conf
+	URI          string
+	CSS          string
+	EditLink     string
+	TransferLink string
 }
 
 func SendMailTest(w http.ResponseWriter, r *http.Request, ctx *config.AppContext) {
@@ -844,56 +990,12 @@ func sendMail(w http.ResponseWriter, r *http.Request, ctx *config.AppContext, re
 	}
 }
 
-func Ticket(w http.ResponseWriter, r *http.Request, ctx *config.AppContext) {
-	params := mux.Vars(r)
-	ticket := params["ticket"]
-
-	tixType, _ := getSessionKey("type", r)
-	confRef, _ := getSessionKey("conf", r)
-
-	/* make it pretty */
-	if tixType == "genpop" {
-		tixType = "general"
-	}
-
-	conf := findConfByRef(ctx, confRef)
-	if conf == nil {
-		http.Error(w, "Unable to load page, please try again later", http.StatusInternalServerError)
-		ctx.Err.Printf("/ticket-pdf unable to find conf! %s", confRef)
-		return
-	}
-
-	/* URL */
-	url := fmt.Sprintf("%s/check-in/%s", ctx.Env.GetURI(), ticket)
-
-	/* Turn the URL into a QR code! */
-	qrpng, err := qrcode.Encode(url, qrcode.Medium, 256)
-	qrcode := base64.StdEncoding.EncodeToString(qrpng)
-
-	/* Turn the QR code into a data URI! */
-	dataURI := fmt.Sprintf("data:image/png;base64,%s", qrcode)
-
-	tix := &TicketTmpl{
-		QRCodeURI: dataURI,
-		CSS:       MiniCss(),
-		Domain:    ctx.Env.GetDomain(),
-		Type:      tixType,
-		Conf:      conf,
-	}
-
-	err = ctx.TemplateCache["ticket.tmpl"].Execute(w, tix)
-	if err != nil {
-		http.Error(w, "Unable to load page, please try again later", http.StatusInternalServerError)
-		ctx.Infos.Printf("/ticket-pdf ExecuteTemplate failed ! %s", err.Error())
-	}
-}
-
 func TicketCheck(w http.ResponseWriter, r *http.Request, ctx *config.AppContext) {
 	confTag, _ := getSessionKey("tag", r)
 
 	tmplTag := "email-html-" + confTag
-	tmpl, ok := ctx.TemplateCache[tmplTag]
-	if !ok {
+	tmpl := ctx.Template(tmplTag)
+	if tmpl == nil {
 		http.Error(w, "Unable to load page, please try again later", http.StatusInternalServerError)
 		ctx.Infos.Printf("/welcome-email template %s not found", tmplTag)
 		return
@@ -908,77 +1010,139 @@ func TicketCheck(w http.ResponseWriter, r *http.Request, ctx *config.AppContext)
 }
 
 type CheckInPage struct {
-	NeedsPin   bool
+	NeedsLogin bool
 	TicketType string
 	Msg        string
+	/* Which conf this door is for */
+	Confs      []*types.Conf
 }
 
-func CheckIn(w http.ResponseWriter, r *http.Request, ctx *config.AppContext) {
-	switch r.Method {
-	case http.MethodGet:
-		CheckInGet(w, r, ctx)
-		return
-	case http.MethodPost:
-		r.ParseForm()
-		pin := r.Form.Get("pin")
-		if pin != ctx.Env.RegistryPin {
-			w.WriteHeader(http.StatusBadRequest)
-			err := ctx.TemplateCache["checkin.tmpl"].ExecuteTemplate(w, "checkin.tmpl", &CheckInPage{
-				NeedsPin: true,
-				Msg:      "Wrong pin",
-			})
-			if err != nil {
-				http.Error(w, "Unable to load page, please try again later", http.StatusInternalServerError)
-				ctx.Err.Printf("/conf/check-in ExecuteTemplate failed ! %s", err.Error())
-				return
+func activeConfs(ctx *config.AppContext) []*types.Conf {
+	var confs []*types.Conf
+	for _, conf := range ctx.Confs {
+		if conf.Active {
+			confs = append(confs, conf)
+		}
+	}
+	return confs
+}
+
+/* Signed tickets tell us enough to turn away fakes and
+ * tickets for some other conf, before we touch the store */
+func checkScanned(ctx *config.AppContext, scanned *ScannedTicket, door string) string {
+	if !scanned.Valid {
+		return "Invalid ticket"
+	}
+
+	conf := findConfByRef(ctx, scanned.ConfRef)
+	if conf == nil {
+		return "Ticket is for an unknown conference"
+	}
+	if door != "" && conf.Tag != door {
+		return fmt.Sprintf("Ticket is for %s", conf.Desc)
+	}
+	if !conf.Active {
+		return fmt.Sprintf("Ticket is for %s, which is over", conf.Desc)
+	}
+	return ""
+}
+
+/* The purchase for a ticket, nil if there isn't one. Misses
+ * skip the cache, in case it's newer than our list */
+func findRegistration(ctx *config.AppContext, ticket string) (*types.Registration, error) {
+	for fresh := false; ; fresh = true {
+		rezzies, err := ctx.Store.ListRegistrations()
+		if err != nil {
+			return nil, err
+		}
+		for _, rez := range rezzies {
+			if rez.RefID == ticket {
+				return rez, nil
 			}
-			ctx.Err.Printf("/check-in wrong pin submitted! %s", pin)
-			return
 		}
+		if fresh {
+			return nil, nil
+		}
+		getters.InvalidatePurchases(ctx.Store)
+	}
+}
 
-		/* Set pin?? */
-		ctx.Session.Put(r.Context(), "pin", pin)
+func CheckIn(w http.ResponseWriter, r *http.Request, ctx *config.AppContext) {
+	switch r.Method {
+	case http.MethodGet, http.MethodPost:
 		CheckInGet(w, r, ctx)
 	}
 }
 
 func CheckInGet(w http.ResponseWriter, r *http.Request, ctx *config.AppContext) {
 	/* Check for logged in */
-	pin := ctx.Session.GetString(r.Context(), "pin")
-	tmpl := ctx.TemplateCache["checkin.tmpl"]
+	staff := requireStaff(w, r, ctx, types.RoleDoor, "")
+	if staff == nil {
+		return
+	}
+	tmpl := ctx.Template("checkin.tmpl")
 
-	if pin == "" {
-		w.Header().Set("x-missing-field", "pin")
-		w.WriteHeader(http.StatusBadRequest)
+	params := mux.Vars(r)
+	ticket := params["ticket"]
+
+	reject := func(msg string) {
+		ctx.Infos.Printf("check-in rejected %s by %s: %s", ticket, staff.Login, msg)
+		w.WriteHeader(http.StatusForbidden)
 		err := tmpl.ExecuteTemplate(w, "checkin.tmpl", &CheckInPage{
-			NeedsPin: true,
+			Msg: msg,
 		})
 		if err != nil {
 			http.Error(w, "Unable to load page, please try again later", http.StatusInternalServerError)
 			ctx.Err.Printf("/conf/check-in ExecuteTemplate failed ! %s", err.Error())
 		}
-		return
 	}
 
-	if pin != ctx.Env.RegistryPin {
-		w.WriteHeader(http.StatusUnauthorized)
-		err := tmpl.ExecuteTemplate(w, "checkin.tmpl", &CheckInPage{
-			Msg: "Wrong registration PIN",
-		})
-		if err != nil {
-			http.Error(w, "Unable to load page, please try again later", http.StatusInternalServerError)
-			ctx.Err.Printf("/conf/check-in ExecuteTemplate failed ! %s", err.Error())
+	scanned, signed := scanTicket(ctx, ticket, r)
+	if signed {
+		door := ctx.Session.GetString(r.Context(), "door")
+		if msg := checkScanned(ctx, scanned, door); msg != "" {
+			reject(msg)
+			return
 		}
+	}
+
+	rez, err := findRegistration(ctx, ticket)
+	if err != nil {
+		http.Error(w, "Unable to load page, please try again later", http.StatusInternalServerError)
+		ctx.Err.Printf("Unable to check-in %s: %s", ticket, err.Error())
 		return
 	}
 
-	params := mux.Vars(r)
-	ticket := params["ticket"]
+	/* Door volunteers only get to check in for their confs */
+	var confRef string
+	switch {
+	case scanned != nil:
+		confRef = scanned.ConfRef
+	case rez != nil:
+		confRef = rez.ConfRef
+	}
+	/* Can't tell whose door it is, so it's no one's */
+	if confRef == "" {
+		reject("Ticket not found")
+		return
+	}
+	if !staff.Can(types.RoleDoor, confRef) {
+		reject("You're not on the door for this conference")
+		return
+	}
+	if rez != nil && rez.TransferredTo() != "" {
+		reject("This ticket was transferred to someone else")
+		return
+	}
+	if rez != nil && !rez.Voided.IsZero() {
+		reject("This ticket was cancelled")
+		return
+	}
 
-	tix_type, ok, err := getters.CheckIn(ctx.Notion, ticket)
+	tix_type, ok, err := ctx.Store.CheckIn(ticket, time.Now(), staff.Login)
 	if !ok && err != nil {
 		http.Error(w, "Unable to load page, please try again later", http.StatusInternalServerError)
-		ctx.Err.Printf("Unable to check-in %s:", ticket, err.Error())
+		ctx.Err.Printf("Unable to check-in %s: %s", ticket, err.Error())
 		return
 	}
 
@@ -986,6 +1150,8 @@ func CheckInGet(w http.ResponseWriter, r *http.Request, ctx *config.AppContext)
 	if err != nil {
 		msg = err.Error()
 		ctx.Infos.Println("check-in problem:", msg)
+	} else {
+		ctx.Infos.Printf("%s checked in %s", staff.Login, ticket)
 	}
 	err = tmpl.ExecuteTemplate(w, "checkin.tmpl", &CheckInPage{
 		TicketType: tix_type,
@@ -1008,104 +1174,6 @@ func ticketMatch(tickets []string, desc string) bool {
 	return false
 }
 
-func computeHash(key, id string) string {
-	mac := hmac.New(sha256.New, []byte(key))
-	mac.Write([]byte(id))
-	return hex.EncodeToString(mac.Sum(nil))
-}
-
-func validHash(key, id, msgMAC string) bool {
-	actual := computeHash(key, id)
-	return msgMAC == actual
-}
-
-var decoder = schema.NewDecoder()
-
-func OpenNodeCallback(w http.ResponseWriter, r *http.Request, ctx *config.AppContext) {
-	err := r.ParseForm()
-	if err != nil {
-		ctx.Err.Printf("Error reading request body: %v", err)
-		w.WriteHeader(http.StatusBadRequest)
-		return
-	}
-
-	var ev ChargeEvent
-	decoder.IgnoreUnknownKeys(true)
-	err = decoder.Decode(&ev, r.PostForm)
-	if err != nil {
-		ctx.Err.Printf("Unable to unmarshal: %v", err)
-		w.WriteHeader(http.StatusBadRequest)
-		return
-	}
-
-	/* Check the hashed order is ok */
-	if !validHash(ctx.Env.OpenNode.Key, ev.ID, ev.HashedOrder) {
-		ctx.Err.Printf("Invalid request from opennode %s %s", ev.ID, ev.HashedOrder)
-		w.WriteHeader(http.StatusBadRequest)
-		return
-	}
-
-	/* Go get the actual event data */
-	charge, err := GetCharge(ctx, ev.ID)
-	if err != nil {
-		ctx.Err.Printf("Unable to fetch charge", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-
-	if ev.Status != "paid" {
-		ctx.Infos.Printf("User did not complete charge. charge-id: %s status: %s email: %s conf-ref: %s", ev.ID, ev.Status, charge.Metadata.Email, charge.Metadata.ConfRef)
-		w.WriteHeader(http.StatusOK)
-		return
-	}
-
-	ctx.Infos.Println("opennode charge!", charge)
-	entry := types.Entry{
-		ID:       charge.ID,
-		ConfRef:  charge.Metadata.ConfRef,
-		Total:    int64(charge.FiatVal * 100),
-		Currency: charge.Metadata.Currency,
-		Created:  charge.CreatedAt,
-		Email:    charge.Metadata.Email,
-		DiscountRef: charge.Metadata.DiscountRef,
-	}
-
-	if err != nil {
-		ctx.Err.Printf("Failed to fetch charge %s", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-
-	tixType := "genpop"
-	if charge.Metadata.TixLocal {
-		tixType = "local"
-	}
-	for i := 0; i < int(charge.Metadata.Quantity); i++ {
-		item := types.Item{
-			Total: int64(charge.FiatVal * 100),
-			Desc:  charge.Description,
-			Type:  tixType,
-		}
-		entry.Items = append(entry.Items, item)
-	}
-
-	if len(entry.Items) == 0 {
-		ctx.Infos.Println("No valid items bought")
-		w.WriteHeader(http.StatusOK)
-		return
-	}
-
-	err = getters.AddTickets(ctx.Notion, &entry, "opennode")
-
-	if err != nil {
-		ctx.Err.Printf("!!! Unable to add ticket %s: %v", err, entry)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-	ctx.Infos.Println("Added ticket!", entry.ID)
-	w.WriteHeader(http.StatusOK)
-}
-
 func HandleTixSelection(w http.ResponseWriter, r *http.Request, ctx *config.AppContext) {
 	params := mux.Vars(r)
 	tixSlug := params["tix"]
@@ -1115,18 +1183,22 @@ func HandleTixSelection(w http.ResponseWriter, r *http.Request, ctx *config.AppC
 		return
 	}
 
-	conf, tix, tixPrice, processBTC, err := determineTixPrice(ctx, tixSlug)
+	cart, err := determineCart(ctx, tixSlug)
 	if err != nil {
 		ctx.Err.Printf("/tix/%s unable to determine tix price: %s", tixSlug, err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	if !processBTC {
-		StripeInit(w, r, ctx, conf, tix, tixPrice)
+	provider := paymentFor(ctx, cart.Method)
+	if provider == nil {
+		ctx.Err.Printf("/tix/%s no payment provider for %s", tixSlug, cart.Method)
+		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
+	/* Everyone stops here first, for a discount code (and an
+	 * email, if the provider won't ask for one) */
 	http.Redirect(w, r, fmt.Sprintf("/tix/%s/collect-email", tixSlug), http.StatusSeeOther)
 }
 
@@ -1153,27 +1225,34 @@ func HandleDiscount(w http.ResponseWriter, r *http.Request, ctx *config.AppConte
 		return
 	}
 
-	conf, tix, tixPrice, _, err := determineTixPrice(ctx, tixSlug)
+	cart, err := determineCart(ctx, tixSlug)
 	if err != nil {
 		/* FIXME: have this return an error message, not a status code error */
 		ctx.Err.Printf("/tix/%s/apply-discount unable to determine tix price: %s", tixSlug, err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	conf, tix, tixPrice := cart.Conf, cart.Lines[0].Choice.Tix, cart.Price(nil)
 
 	/* Calculate the discount */
 	var discountRef string
-	discountPrice, discount, err := getters.CalcDiscount(ctx.Notion, conf.Ref, discountCode, tixPrice)
+	discount, err := cartDiscount(ctx, cart, discountCode)
 	if discount != nil {
 		discountRef = discount.Ref
 	}
+	discountPrice = cart.Price(discount)
 	errStr := ""
-	if err != nil {
+	/* An emptied code box isn't a bad code */
+	if err != nil && discountCode != "" {
 		ctx.Err.Printf("/tix/%s/apply-discount discount not available: %s", tixSlug, err)
 		/* We don't bail though.. just continue */
 		errStr = err.Error()
 	}
 	
+	/* A comp has no provider to ask them for an email */
+	provider := paymentFor(ctx, cart.Method)
+	needsEmail := provider != nil && provider.NeedsEmail()
+
 	tmpl := template.Must(template.ParseFiles("templates/tix_details.tmpl"))
 	w.Header().Set("Content-Type", "text/html")
 	err = tmpl.Execute(w, &TixFormPage{
@@ -1186,7 +1265,9 @@ func HandleDiscount(w http.ResponseWriter, r *http.Request, ctx *config.AppConte
 		DiscountRef:  discountRef,
 		Err:      errStr,
 		HMAC:     calcTixHMAC(ctx, conf, tixPrice, discountPrice, discountCode),
-		Count:    uint(1),
+		Count:    cart.Count(),
+		Cart:     cart,
+		NeedsEmail: needsEmail,
 	})
 
 	if err != nil {
@@ -1205,14 +1286,16 @@ func HandleEmail(w http.ResponseWriter, r *http.Request, ctx *config.AppContext)
 		return
 	}
 
-	conf, tix, tixPrice, processBTC, err := determineTixPrice(ctx, tixSlug)
+	cart, err := determineCart(ctx, tixSlug)
 	if err != nil {
 		ctx.Err.Printf("/tix/%s/collect-email unable to determine tix price: %s", tixSlug, err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	conf, tix, tixPrice := cart.Conf, cart.Lines[0].Choice.Tix, cart.Price(nil)
 
-	if !processBTC {
+	provider := paymentFor(ctx, cart.Method)
+	if provider == nil {
 		http.Redirect(w, r, fmt.Sprintf("/tix/%s", tixSlug), http.StatusSeeOther)
 		return
 	}
@@ -1227,18 +1310,23 @@ func HandleEmail(w http.ResponseWriter, r *http.Request, ctx *config.AppContext)
 		var discountRef string
 		if discountCode != "" {
 			var discount *types.DiscountCode
-			discountPrice, discount, err = getters.CalcDiscount(ctx.Notion, conf.Ref, discountCode, tixPrice)
+			discount, err = cartDiscount(ctx, cart, discountCode)
+			discountPrice = cart.Price(discount)
 			if err != nil {
 				ctx.Err.Printf("/tix/%s/apply-discount discount not available: %s", tixSlug, err)
 				/* We don't bail though.. just continue */
 				errStr = err.Error()
 			}
-
 			if discount != nil {
 				discountRef = discount.Ref
 			}
 		}
-		pageTpl := ctx.TemplateCache["collect-email.tmpl"]
+		/* Set if the post sent them back, e.g. the code was turned
+		 * down at checkout. Ours, never the link's */
+		if msg := ctx.Session.PopString(r.Context(), "checkout-err"); msg != "" {
+			errStr = msg
+		}
+		pageTpl := ctx.Template("collect-email.tmpl")
 		err = pageTpl.ExecuteTemplate(w, "collect-email.tmpl", &TixFormPage{
 			Conf:     conf,
 			Tix:      tix,
@@ -1249,7 +1337,9 @@ func HandleEmail(w http.ResponseWriter, r *http.Request, ctx *config.AppContext)
 			DiscountRef: discountRef,
 			Err:      errStr,
 			HMAC:     calcTixHMAC(ctx, conf, tixPrice, discountPrice, discountCode),
-			Count:    uint(1),
+			Count:    cart.Count(),
+			Cart:     cart,
+			NeedsEmail: provider.NeedsEmail(),
 		})
 		if err != nil {
 			http.Error(w, "Unable to load page, please try again later", http.StatusInternalServerError)
@@ -1269,10 +1359,6 @@ func HandleEmail(w http.ResponseWriter, r *http.Request, ctx *config.AppContext)
 			return
 		}
 
-		if form.Email == "" || form.Count < 1 {
-			http.Redirect(w, r, fmt.Sprintf("/collect-email/%s", tixSlug), http.StatusSeeOther)
-		}
-
 		/*  Validate HMAC */
 		expectedHMAC := calcTixHMAC(ctx, conf, tixPrice, form.DiscountPrice, form.Discount)
 		if expectedHMAC != form.HMAC {
@@ -1281,173 +1367,40 @@ func HandleEmail(w http.ResponseWriter, r *http.Request, ctx *config.AppContext)
 			return
 		}
 
-
-		/* The goal is that we hit opennode init, with an email! */
-		isLocal := tixPrice == tix.Local
-		OpenNodeInit(w, r, ctx, conf, tix, form.DiscountPrice, &form, isLocal)
-		return
-	default:
-		http.NotFound(w, r)
-		return
-	}
-}
-
-func OpenNodeInit(w http.ResponseWriter, r *http.Request, ctx *config.AppContext, conf *types.Conf, tix *types.ConfTicket, tixPrice uint, tixForm *types.TixForm, isLocal bool) {
-	payment, err := getters.InitOpenNodeCheckout(ctx, tixPrice, tix, conf, isLocal, tixForm.Count, tixForm.Email, tixForm.DiscountRef)
-
-	if err != nil {
-		http.Error(w, "unable to init btc payment", http.StatusInternalServerError)
-		ctx.Err.Printf("opennode payment init failed", err.Error())
-		return
-	}
-
-	/* FIXME: v2: implement on-site btc checkout */
-	/* for now we go ahead and just redirect to opennode, see you latrrr */
-	http.Redirect(w, r, payment.HostedCheckoutURL, http.StatusSeeOther)
-}
-
-func StripeInit(w http.ResponseWriter, r *http.Request, ctx *config.AppContext, conf *types.Conf, tix *types.ConfTicket, tixPrice uint) {
-
-	domain := ctx.Env.GetURI()
-	priceAsCents := int64(tixPrice * 100)
-	confDesc := fmt.Sprintf("1 ticket for the %s", conf.Desc)
-	metadata := make(map[string]string)
-	metadata["conf-tag"] = conf.Tag
-	metadata["conf-ref"] = conf.Ref
-	metadata["tix-id"] = tix.ID
-	if tixPrice == tix.Local {
-		metadata["tix-local"] = "yes"
-	}
-	params := &stripe.CheckoutSessionParams{
-		LineItems: []*stripe.CheckoutSessionLineItemParams{
-			{
-				PriceData: &stripe.CheckoutSessionLineItemPriceDataParams{
-					ProductData: &stripe.CheckoutSessionLineItemPriceDataProductDataParams{
-						Description: stripe.String(confDesc),
-						Name:        stripe.String(conf.Desc),
-						Metadata:    metadata,
-					},
-					UnitAmount: stripe.Int64(priceAsCents),
-					Currency:   stripe.String(tix.Currency),
-				},
-				Quantity: stripe.Int64(1),
-			}},
-		Metadata:            metadata,
-		Mode:                stripe.String(string(stripe.CheckoutSessionModePayment)),
-		SuccessURL:          stripe.String(domain + "/conf/" + conf.Tag + "/success"),
-		CancelURL:           stripe.String(domain + "/conf/" + conf.Tag),
-		AutomaticTax:        &stripe.CheckoutSessionAutomaticTaxParams{Enabled: stripe.Bool(true)},
-		AllowPromotionCodes: stripe.Bool(true),
-	}
-
-	s, err := session.New(params)
-	if err != nil {
-		ctx.Err.Printf("!!! Unable to create stripe session: %s", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-
-	http.Redirect(w, r, s.URL, http.StatusSeeOther)
-}
-
-func StripeCallback(w http.ResponseWriter, r *http.Request, ctx *config.AppContext) {
-	const MaxBodyBytes = int64(65536)
-	r.Body = http.MaxBytesReader(w, r.Body, MaxBodyBytes)
-	payload, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		ctx.Err.Printf("Error reading request body: %v", err)
-		w.WriteHeader(http.StatusServiceUnavailable)
-		return
-	}
-
-	event, err := webhook.ConstructEvent(payload, r.Header.Get("Stripe-Signature"), ctx.Env.StripeEndpointSec)
-
-	if err != nil {
-		ctx.Err.Println("Error verifying webhook sig", err)
-		w.WriteHeader(http.StatusBadRequest)
-		return
-	}
-
-	switch event.Type {
-	case "checkout.session.completed":
-		var checkout stripe.CheckoutSession
-		err := json.Unmarshal(event.Data.Raw, &checkout)
-		if err != nil {
-			ctx.Err.Printf("Error parsing webhook JSON: %v", err)
-			w.WriteHeader(http.StatusBadRequest)
-			return
-		}
-
-		confRef, ok := checkout.Metadata["conf-ref"]
-		if !ok {
-			ctx.Infos.Println("No conf-ref present")
-			w.WriteHeader(http.StatusOK)
-			return
-		}
-		conf := findConfByRef(ctx, confRef)
-		if conf == nil {
-			ctx.Err.Println("Couldn't find conf %s", confRef)
-			w.WriteHeader(http.StatusOK)
-			return
-		}
-
-		entry := types.Entry{
-			ID:       checkout.ID,
-			ConfRef:  conf.Ref,
-			Total:    checkout.AmountTotal,
-			Currency: string(checkout.Currency),
-			Created:  time.Unix(checkout.Created, 0).UTC(),
-			Email:    checkout.CustomerDetails.Email,
-		}
-
-		itemParams := &stripe.CheckoutSessionListLineItemsParams{
-			Session: stripe.String(checkout.ID),
-		}
-
-		_, isLocal := checkout.Metadata["tix-local"]
-		var tixType string
-		if isLocal {
-			tixType = "local"
-		} else {
-			tixType = "genpop"
-		}
-		items := session.ListLineItems(itemParams)
-		for items.Next() {
-			si := items.LineItem()
-			var i int64
-			for i = 0; i < si.Quantity; i++ {
-				item := types.Item{
-					Total: si.AmountTotal,
-					Desc:  si.Description,
-					Type:  tixType,
-				}
-				entry.Items = append(entry.Items, item)
+		/* A single ticket can be bought more than once */
+		if cart.Count() == 1 && form.Count > 1 {
+			if form.Count > maxCartTix {
+				form.Count = maxCartTix
 			}
+			cart.Lines[0].Count = form.Count
 		}
 
-		if err := items.Err(); err != nil {
-			ctx.Err.Println(err)
-			w.WriteHeader(http.StatusInternalServerError)
-			return
+		var discount *types.DiscountCode
+		if form.Discount != "" {
+			discount, err = cartDiscount(ctx, cart, form.Discount)
+			if err != nil {
+				ctx.Err.Printf("/tix/%s/collect-email discount %s gone: %s", tixSlug, form.Discount, err)
+				ctx.Session.Put(r.Context(), "checkout-err", err.Error())
+				http.Redirect(w, r, fmt.Sprintf("/tix/%s/collect-email?q=%s", tixSlug,
+					url.QueryEscape(form.Discount)), http.StatusSeeOther)
+				return
+			}
 		}
 
-		if len(entry.Items) == 0 {
-			ctx.Infos.Println("No valid items bought")
-			w.WriteHeader(http.StatusOK)
+		/* Otherwise the provider's checkout asks them for it. A
+		 * comp skips the provider, so it always needs one */
+		if form.Email == "" && (provider.NeedsEmail() || cart.Price(discount) == 0) {
+			ctx.Session.Put(r.Context(), "checkout-err", "We need an email to send your tickets to")
+			http.Redirect(w, r, fmt.Sprintf("/tix/%s/collect-email?q=%s", tixSlug,
+				url.QueryEscape(form.Discount)), http.StatusSeeOther)
 			return
 		}
 
-		err = getters.AddTickets(ctx.Notion, &entry, "stripe")
-
-		if err != nil {
-			ctx.Err.Printf("!!! Unable to add ticket %s: %v", err)
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-		ctx.Infos.Printf("Added %d tickets!!", len(entry.Items))
+		/* The goal is that we hit checkout, with an email if we need one! */
+		startCheckout(w, r, ctx, provider, newOrder(ctx, cart, form.Email, discount))
+		return
 	default:
-		ctx.Infos.Printf("Unhandled event type: %s", event.Type)
+		http.NotFound(w, r)
+		return
 	}
-
-	w.WriteHeader(http.StatusOK)
 }
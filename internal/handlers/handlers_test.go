@@ -0,0 +1,104 @@
+package handlers
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/base58btc/btcpp-web/internal/types"
+)
+
+func TestConfPageCached(t *testing.T) {
+	ta := newTestApp(t)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := http.Get(ta.Server.URL + "/conf/atx25")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			body := readBody(t, resp)
+			if resp.StatusCode != http.StatusOK {
+				t.Errorf("conf page failed (%d): %s", resp.StatusCode, body)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := ta.Notion.Queries("talks"); n != 1 {
+		t.Errorf("expected talks to be fetched once, got %d", n)
+	}
+	if n := ta.Notion.Queries("purchases"); n != 1 {
+		t.Errorf("expected sold count to be fetched once, got %d", n)
+	}
+
+	/* A purchase means a fresh sold count */
+	err := ta.Store.AddTickets(&types.Entry{
+		ID:      "cs_test_cache",
+		ConfRef: "conf-atx25",
+		Created: time.Now(),
+		Email:   "hal@example.com",
+		Items:   []types.Item{{Total: 10000, Type: "genpop"}},
+	}, "stripe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sold, err := ta.Store.SoldTixCount("conf-atx25")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sold != 1 {
+		t.Errorf("expected 1 sold after purchase, got %d", sold)
+	}
+	/* One to check for tickets already in, one for the count */
+	if n := ta.Notion.Queries("purchases"); n != 3 {
+		t.Errorf("expected purchase to refetch sold count, got %d", n)
+	}
+
+	/* A conf reload drops everything */
+	resp, err := ta.client(t).PostForm(ta.Server.URL+"/conf-reload", loginForm("organizer"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	readBody(t, resp)
+	resp, err = http.Get(ta.Server.URL + "/conf/atx25")
+	if err != nil {
+		t.Fatal(err)
+	}
+	readBody(t, resp)
+	if n := ta.Notion.Queries("talks"); n != 2 {
+		t.Errorf("expected reload to refetch talks, got %d", n)
+	}
+}
+
+func TestCurrTixNoExpiry(t *testing.T) {
+	soon := &types.Times{Start: time.Now().Add(time.Hour)}
+	conf := &types.Conf{Tickets: []*types.ConfTicket{
+		{ID: "tix-door", Max: 100},
+		{ID: "tix-early", Max: 10, Expires: soon},
+	}}
+
+	/* A tier with no date isn't on sale, but doesn't break the others */
+	tests := []struct {
+		sold uint
+		want string
+	}{
+		{0, "tix-early"},
+		{10, ""},
+	}
+	for _, tc := range tests {
+		tix := findCurrTix(conf, tc.sold)
+		got := ""
+		if tix != nil {
+			got = tix.ID
+		}
+		if got != tc.want {
+			t.Fatalf("%d sold: expected %q, got %q", tc.sold, tc.want, got)
+		}
+	}
+}
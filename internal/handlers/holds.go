@@ -0,0 +1,210 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/base58btc/btcpp-web/external/getters"
+	"github.com/base58btc/btcpp-web/internal/config"
+	"github.com/base58btc/btcpp-web/internal/types"
+	"github.com/gorilla/mux"
+)
+
+/* Starting a checkout holds its tickets until the checkout
+ * expires, so a rush on the last few can't oversell a tier.
+ * Paying converts the hold; an expired checkout, or backing
+ * out of one, puts the tickets back on sale */
+
+const checkoutHoldTTL = time.Hour
+
+/* So two checkouts can't both take the last ticket. This only
+ * covers checkouts in this process: neither store can count and
+ * hold in one step (Notion has no transactions), so the app has
+ * to run as a single instance */
+var holdMu sync.Mutex
+
+/* Sold, plus held for checkouts still open */
+func tixTaken(ctx *config.AppContext, confRef string) (uint, error) {
+	sold, err := ctx.Store.SoldTixCount(confRef)
+	if err != nil {
+		return 0, err
+	}
+	held, err := getters.HeldTixCount(ctx.Store, confRef, time.Now())
+	if err != nil {
+		return 0, err
+	}
+	return sold + held, nil
+}
+
+/* Tier maxes count everything sold so far, cheapest tier
+ * first, so that's the order the order's tickets fill them */
+func checkTixLeft(ctx *config.AppContext, order *types.Order, taken uint) error {
+	lines := order.Lines()
+	tiers := make(map[string]*types.ConfTicket)
+	for _, line := range lines {
+		tix, conf := findTicket(ctx, line.TixID)
+		if tix == nil || conf.Ref != order.ConfRef {
+			return fmt.Errorf("No tickets for %s", line.TixID)
+		}
+		tiers[line.TixID] = tix
+	}
+	sort.SliceStable(lines, func(i, j int) bool {
+		a, b := tiers[lines[i].TixID].Expires, tiers[lines[j].TixID].Expires
+		return a != nil && (b == nil || a.Start.Before(b.Start))
+	})
+
+	for _, line := range lines {
+		tix := tiers[line.TixID]
+		if taken >= tix.Max {
+			return fmt.Errorf("Sorry, %s tickets are sold out", tix.Tier)
+		}
+		if taken+uint(line.Count) > tix.Max {
+			return fmt.Errorf("Sorry, there's only %d %s tickets left", tix.Max-taken, tix.Tier)
+		}
+		taken += uint(line.Count)
+	}
+	return nil
+}
+
+/* How many of the order's tickets its code is on. The code's
+ * uses are held along with the tickets, so if it doesn't have
+ * that many left, usedUp says why */
+func discountLeft(ctx *config.AppContext, order *types.Order) (count uint, usedUp error, err error) {
+	discount, err := getters.FindDiscountByRef(ctx.Store, order.DiscountRef)
+	if err != nil {
+		return 0, nil, err
+	}
+	if discount == nil {
+		return 0, fmt.Errorf("That discount code is gone"), nil
+	}
+
+	for _, item := range order.Items {
+		tix, _ := findTicket(ctx, item.TixID)
+		if tix != nil && discount.Covers(tix, item.Type == "local") {
+			count++
+		}
+	}
+	return count, getters.CheckDiscountUses(ctx.Store, discount, count), nil
+}
+
+/* Holds the order's tickets, and its discount code's uses. If
+ * there aren't enough left, soldOut says why and there's no
+ * hold. A waitlist invite's hold is handed over to this one */
+func holdTickets(ctx *config.AppContext, order *types.Order, invite *types.Hold) (hold *types.Hold, soldOut error, err error) {
+	holdMu.Lock()
+	defer holdMu.Unlock()
+
+	taken, err := tixTaken(ctx, order.ConfRef)
+	if err != nil {
+		return nil, nil, err
+	}
+	if invite != nil && invite.Count <= taken {
+		taken -= invite.Count
+	}
+	if soldOut = checkTixLeft(ctx, order, taken); soldOut != nil {
+		return nil, soldOut, nil
+	}
+	var discounted uint
+	if order.DiscountRef != "" {
+		discounted, soldOut, err = discountLeft(ctx, order)
+		if err != nil || soldOut != nil {
+			return nil, soldOut, err
+		}
+	}
+
+	now := time.Now().UTC()
+	hold = &types.Hold{
+		ConfRef:     order.ConfRef,
+		Provider:    order.Provider,
+		OrderID:     order.ID,
+		Count:       uint(len(order.Items)),
+		Status:      types.HoldActive,
+		Expires:     order.Expires,
+		Updated:     now,
+		DiscountRef: order.DiscountRef,
+		Discounted:  discounted,
+	}
+	if err = ctx.Store.AddHold(hold); err != nil {
+		return nil, nil, err
+	}
+	if invite != nil {
+		if err := setHold(ctx, invite, types.HoldReleased); err != nil {
+			ctx.Err.Printf("Unable to hand over waitlist hold %s: %s", invite.Ref, err)
+		}
+	}
+	return hold, nil, nil
+}
+
+/* Now we know the checkout (and when it really expires) */
+func holdCheckout(ctx *config.AppContext, hold *types.Hold, checkout *types.Checkout) {
+	hold.OrderID = checkout.OrderID
+	/* Unset expiries come back as the epoch */
+	if checkout.ExpiresAt.Unix() > 0 {
+		hold.Expires = checkout.ExpiresAt.UTC()
+	}
+	hold.Updated = time.Now().UTC()
+	if err := ctx.Store.UpdateHold(hold); err != nil {
+		/* It'll still run out on its own */
+		ctx.Err.Printf("Unable to update hold %s for %s order %s: %s", hold.Ref, hold.Provider, hold.OrderID, err)
+	}
+}
+
+func setHold(ctx *config.AppContext, hold *types.Hold, status types.HoldStatus) error {
+	if hold.Status != types.HoldActive {
+		return nil
+	}
+	/* Could be a cached copy; don't touch it */
+	done := *hold
+	done.Status = status
+	done.Updated = time.Now().UTC()
+	if err := ctx.Store.UpdateHold(&done); err != nil {
+		return err
+	}
+	ctx.Infos.Printf("Hold %s on %d tickets (%s order %s) %s", hold.Ref, hold.Count, hold.Provider, hold.OrderID, status)
+	return nil
+}
+
+/* The order's hold, if it has one, goes to 'status' */
+func finishHold(ctx *config.AppContext, provider, orderID string, status types.HoldStatus) {
+	hold, err := getters.FindHold(ctx.Store, provider, orderID)
+	if err == nil && hold != nil {
+		err = setHold(ctx, hold, status)
+	}
+	if err != nil {
+		/* Holds run out on their own; not worth failing over */
+		ctx.Err.Printf("Unable to mark %s order %s hold %s: %s", provider, orderID, status, err)
+	}
+}
+
+func holdCancelLink(ctx *config.AppContext, hold *types.Hold) string {
+	return fmt.Sprintf("%s/hold/%s/cancel?s=%s", ctx.Env.GetURI(), url.PathEscape(hold.Ref), linkSig(ctx, "hold", hold.Ref))
+}
+
+/* Where checkouts send them if they back out */
+func CancelHold(w http.ResponseWriter, r *http.Request, ctx *config.AppContext) {
+	ref := mux.Vars(r)["ref"]
+	if !linkSigOk(ctx, "hold", ref, r.URL.Query().Get("s")) {
+		http.NotFound(w, r)
+		return
+	}
+
+	hold, err := getters.FindHoldByRef(ctx.Store, ref)
+	if err == nil && hold != nil {
+		err = setHold(ctx, hold, types.HoldReleased)
+	}
+	if err != nil {
+		ctx.Err.Printf("/hold/%s unable to release: %s", ref, err)
+	}
+
+	back := "/"
+	if hold != nil {
+		if conf := findConfByRef(ctx, hold.ConfRef); conf != nil {
+			back = "/conf/" + conf.Tag
+		}
+	}
+	http.Redirect(w, r, back, http.StatusSeeOther)
+}
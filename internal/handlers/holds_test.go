@@ -0,0 +1,152 @@
+package handlers
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/base58btc/btcpp-web/external/getters"
+	"github.com/base58btc/btcpp-web/internal/types"
+)
+
+func TestInventoryHolds(t *testing.T) {
+	ta := newTestApp(t)
+	fake := &fakeProvider{orders: make(map[string]*types.Order)}
+	ta.Payments = map[string]types.PaymentProvider{"fake": fake}
+	ta.Env.Payments.Fiat = "fake"
+
+	/* Two early tickets left */
+	sold, err := ta.Store.SoldTixCount("conf-atx25")
+	if err != nil {
+		t.Fatal(err)
+	}
+	early, _ := findTicket(ta.AppContext, "tix-atx25-early")
+	early.Max = sold + 2
+	taken := func() uint {
+		n, err := tixTaken(ta.AppContext, "conf-atx25")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	client := noRedirects(ta.client(t))
+	checkout := func(slug string) string {
+		return checkoutCart(t, ta, client, slug)
+	}
+
+	if loc := checkout("tix-atx25-early+default+fiat*2"); loc != "https://pay.example.com/fake_0" {
+		t.Fatalf("expected a checkout, got %s", loc)
+	}
+	if n := taken(); n != sold+2 {
+		t.Fatalf("expected 2 tickets held, got %d taken of %d sold", n, sold)
+	}
+
+	/* Someone else is too late for early, but not for late */
+	if loc := checkout("tix-atx25-early+default+fiat"); loc != "/conf/atx25/cart" {
+		t.Fatalf("expected early to be sold out, got %s", loc)
+	}
+	resp, err := client.Get(ta.Server.URL + "/conf/atx25/cart")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := readBody(t, resp)
+	if strings.Contains(body, "qty-tix-atx25-early") || !strings.Contains(body, "qty-tix-atx25-late") {
+		t.Fatalf("expected only late tickets in the cart")
+	}
+	if !strings.Contains(body, "sold out") {
+		t.Fatalf("expected the cart to say early sold out")
+	}
+	/* What the page says is up to us, not whoever made the link */
+	resp, err = client.Get(ta.Server.URL + "/conf/atx25/cart?err=" + url.QueryEscape("Card declined, pay at evil.example"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body = readBody(t, resp); strings.Contains(body, "evil.example") || strings.Contains(body, "sold out") {
+		t.Fatalf("expected only our message, and only the once")
+	}
+	if loc := checkout("tix-atx25-late+default+fiat"); loc != "https://pay.example.com/fake_1" {
+		t.Fatalf("expected a late checkout, got %s", loc)
+	}
+
+	/* Backing out puts them back */
+	cancel := fake.orders["fake_0"].CancelURL
+	resp, err = client.Get(ta.Server.URL + strings.TrimPrefix(cancel, ta.Env.GetURI()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	readBody(t, resp)
+	if resp.StatusCode != http.StatusSeeOther || resp.Header.Get("Location") != "/conf/atx25" {
+		t.Fatalf("expected cancel to go back to the conf, got %d", resp.StatusCode)
+	}
+	if n := taken(); n != sold+1 {
+		t.Fatalf("expected the early hold released, got %d taken of %d sold", n, sold)
+	}
+
+	/* Paying converts it; the tickets stay taken. Tier maxes
+	 * count every ticket, so the late hold takes an early seat */
+	if loc := checkout("tix-atx25-early+default+fiat"); loc != "https://pay.example.com/fake_2" {
+		t.Fatalf("expected a checkout, got %s", loc)
+	}
+	resp, err = client.PostForm(ta.Server.URL+"/callback/fake", url.Values{"id": {"fake_2"}, "sig": {"ok"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	readBody(t, resp)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("webhook failed, got %d", resp.StatusCode)
+	}
+	hold, err := getters.FindHold(ta.Store, "fake", "fake_2")
+	if err != nil || hold == nil || hold.Status != types.HoldConverted {
+		t.Fatalf("expected the hold converted, got %+v (%v)", hold, err)
+	}
+	if n := taken(); n != sold+2 {
+		t.Fatalf("expected 1 sold + 1 held, got %d taken of %d sold", n, sold)
+	}
+
+	/* And an abandoned checkout runs out on its own */
+	hold, err = getters.FindHold(ta.Store, "fake", "fake_1")
+	if err != nil || hold == nil {
+		t.Fatalf("no hold for fake_1: %v", err)
+	}
+	expired := *hold
+	expired.Expires = time.Now().Add(-time.Minute)
+	if err = ta.Store.UpdateHold(&expired); err != nil {
+		t.Fatal(err)
+	}
+	if n := taken(); n != sold+1 {
+		t.Fatalf("expected the expired hold to not count, got %d taken of %d sold", n, sold)
+	}
+
+	/* The checkout they backed out of is still open at the
+	 * provider. Paying it now gets them their tickets, but only
+	 * one early seat is left, so it's flagged */
+	resp, err = client.PostForm(ta.Server.URL+"/callback/fake", url.Values{"id": {"fake_0"}, "sig": {"ok"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	readBody(t, resp)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("late payment webhook failed, got %d", resp.StatusCode)
+	}
+	if n := taken(); n != sold+3 {
+		t.Fatalf("expected the late payment's tickets added, got %d taken of %d sold", n, sold)
+	}
+	logged, err := ta.Store.FindWebhookEvent(types.WebhookKey("fake", "fake_0"))
+	if err != nil || logged == nil || logged.Status != types.WebhookOversold {
+		t.Fatalf("expected the late payment flagged, got %+v (%v)", logged, err)
+	}
+	if _, err = getters.NewStaff(ta.Store, "admin", "Admin", testSecret, types.RoleAdmin, nil); err != nil {
+		t.Fatal(err)
+	}
+	admin := noRedirects(ta.client(t))
+	resp, err = admin.PostForm(ta.Server.URL+"/admin/webhooks", loginForm("admin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := readBody(t, resp); !strings.Contains(body, "Oversold") || !strings.Contains(body, "fake_0") {
+		t.Fatalf("expected the admin to list the oversold order")
+	}
+}
@@ -0,0 +1,399 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/base58btc/btcpp-web/external/getters"
+	"github.com/base58btc/btcpp-web/internal/config"
+	"github.com/base58btc/btcpp-web/internal/types"
+	mailer "github.com/base58btc/mailer/mail"
+	"github.com/gorilla/mux"
+)
+
+/* Lost your ticket? /tickets mails a magic link to whoever asks,
+ * if that email has any tickets. The link lists them, to
+ * download or have mailed again. We answer the same way either
+ * way, and rate limit it, so it can't be used to find out who's
+ * coming */
+
+const (
+	lookupLinkTTL = 24 * time.Hour
+	/* Per IP, and per email asked about */
+	lookupIPLimit    = 5
+	lookupEmailLimit = 3
+	lookupWindow     = 15 * time.Minute
+	/* Resends, per ticket */
+	resendLimit  = 3
+	resendWindow = time.Hour
+)
+
+/* How many times each key has been seen in the last window */
+type rateLimiter struct {
+	mu     sync.Mutex
+	limit  int
+	window time.Duration
+	hits   map[string][]time.Time
+}
+
+func newRateLimiter(limit int, window time.Duration) *rateLimiter {
+	return &rateLimiter{limit: limit, window: window, hits: make(map[string][]time.Time)}
+}
+
+func (l *rateLimiter) Allow(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	/* Forget anyone we haven't seen in a while */
+	for k, hits := range l.hits {
+		if now.Sub(hits[len(hits)-1]) > l.window {
+			delete(l.hits, k)
+		}
+	}
+
+	var recent []time.Time
+	for _, hit := range l.hits[key] {
+		if now.Sub(hit) <= l.window {
+			recent = append(recent, hit)
+		}
+	}
+	if len(recent) >= l.limit {
+		l.hits[key] = recent
+		return false
+	}
+	l.hits[key] = append(recent, now)
+	return true
+}
+
+var (
+	lookupByIP    = newRateLimiter(lookupIPLimit, lookupWindow)
+	lookupByEmail = newRateLimiter(lookupEmailLimit, lookupWindow)
+	resendByTix   = newRateLimiter(resendLimit, resendWindow)
+)
+
+type LookupTmpl struct {
+	URI  string
+	Link string
+}
+
+type LookupPage struct {
+	Sent    bool
+	Email   string
+	Tickets []*LookupTicket
+	Claims  []*LookupClaim
+	Token   string
+	Msg     string
+	Err     string
+}
+
+type LookupTicket struct {
+	Rez  *types.Registration
+	Conf *types.Conf
+	Tier string
+}
+
+/* Orders they bought that still need names on them */
+type LookupClaim struct {
+	Conf  *types.Conf
+	Count int
+	Link  string
+}
+
+/* expiry.email.sig, all url-safe */
+func lookupToken(ctx *config.AppContext, email string, expires time.Time) string {
+	exp := strconv.FormatInt(expires.Unix(), 10)
+	return exp + "." + base64.RawURLEncoding.EncodeToString([]byte(email)) + "." + linkSig(ctx, "tickets", exp+"\n"+email)
+}
+
+func lookupEmail(ctx *config.AppContext, token string) (string, bool) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", false
+	}
+	exp, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || time.Now().Unix() > exp {
+		return "", false
+	}
+	email, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || !linkSigOk(ctx, "tickets", parts[0]+"\n"+string(email), parts[2]) {
+		return "", false
+	}
+	return string(email), true
+}
+
+/* Who's asking. Behind a proxy that's always the proxy, so if
+ * ClientIPHeader is set we go by it instead. Only set it if the
+ * proxy always does, or anyone can pick their own. In a list
+ * (X-Forwarded-For) the last one is what our proxy added */
+func clientIP(ctx *config.AppContext, r *http.Request) string {
+	if ctx.Env.ClientIPHeader != "" {
+		ips := strings.Split(r.Header.Get(ctx.Env.ClientIPHeader), ",")
+		if ip := strings.TrimSpace(ips[len(ips)-1]); ip != "" {
+			return ip
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+/* Live tickets they hold, at confs that are on */
+func heldTickets(ctx *config.AppContext, email string) ([]*types.Registration, error) {
+	rezzies, err := getters.FetchBtcppRegistrations(ctx, true)
+	if err != nil {
+		return nil, err
+	}
+	var held []*types.Registration
+	for _, rez := range rezzies {
+		if rez.Voided.IsZero() && strings.EqualFold(rez.MailTo(), email) {
+			held = append(held, rez)
+		}
+	}
+	return held, nil
+}
+
+func lookupPage(ctx *config.AppContext, email string) (*LookupPage, error) {
+	rezzies, err := getters.FetchBtcppRegistrations(ctx, true)
+	if err != nil {
+		return nil, err
+	}
+
+	page := &LookupPage{Email: email}
+	sizes := orderSizes(rezzies)
+	claims := make(map[string]*LookupClaim)
+	for _, rez := range rezzies {
+		if !rez.Voided.IsZero() {
+			continue
+		}
+		conf := findConfByRef(ctx, rez.ConfRef)
+		if conf == nil {
+			continue
+		}
+		if awaitingClaim(rez, sizes) {
+			if !strings.EqualFold(rez.Email, email) {
+				continue
+			}
+			claim, ok := claims[rez.LookupID]
+			if !ok {
+				claim = &LookupClaim{Conf: conf, Link: claimLink(ctx, rez.LookupID)}
+				claims[rez.LookupID] = claim
+				page.Claims = append(page.Claims, claim)
+			}
+			claim.Count++
+			continue
+		}
+		if !strings.EqualFold(rez.MailTo(), email) {
+			continue
+		}
+		tier := prettyTixType(rez.Type)
+		for _, tix := range conf.Tickets {
+			if tix.ID == rez.TixID {
+				tier = tix.Tier
+			}
+		}
+		page.Tickets = append(page.Tickets, &LookupTicket{Rez: rez, Conf: conf, Tier: tier})
+	}
+	return page, nil
+}
+
+func sendLookupMail(ctx *config.AppContext, email string) error {
+	expires := time.Now().Add(lookupLinkTTL)
+	data := &LookupTmpl{
+		URI:  ctx.Env.GetURI(),
+		Link: ctx.Env.GetURI() + "/tickets/" + lookupToken(ctx, email, expires),
+	}
+	var htmlBody, textBody bytes.Buffer
+	if err := ctx.Template("email-html-lookup").Execute(&htmlBody, data); err != nil {
+		return err
+	}
+	if err := ctx.TextTemplate("email-text-lookup").Execute(&textBody, data); err != nil {
+		return err
+	}
+
+	if !ctx.Env.Prod {
+		ctx.Infos.Printf("About to send ticket lookup link to %s, but desisting, not prod!\n", email)
+		return nil
+	}
+
+	h := sha256.Sum256([]byte(email))
+	return SendMailRequest(ctx, &mailer.MailRequest{
+		JobKey:   fmt.Sprintf("btcpp-lookup-%s-%d", hex.EncodeToString(h[:8]), expires.Unix()),
+		ToAddr:   email,
+		FromAddr: "hello@btcpp.dev",
+		FromName: "bitcoin++ ✨",
+		Title:    "Your bitcoin++ tickets",
+		HTMLBody: htmlBody.String(),
+		TextBody: textBody.String(),
+		SendAt:   float64(time.Now().UTC().Unix()),
+	})
+}
+
+func renderLookup(w http.ResponseWriter, ctx *config.AppContext, page *LookupPage) {
+	err := ctx.Template("tickets.tmpl").ExecuteTemplate(w, "tickets.tmpl", page)
+	if err != nil {
+		http.Error(w, "Unable to load page, please try again later", http.StatusInternalServerError)
+		ctx.Err.Printf("/tickets ExecuteTemplate failed ! %s", err.Error())
+	}
+}
+
+func TicketLookup(w http.ResponseWriter, r *http.Request, ctx *config.AppContext) {
+	page := &LookupPage{}
+	if r.Method != http.MethodPost {
+		renderLookup(w, ctx, page)
+		return
+	}
+
+	r.ParseForm()
+	email := strings.ToLower(strings.TrimSpace(r.PostForm.Get("email")))
+	if !strings.Contains(email, "@") {
+		page.Err = "That doesn't look like an email"
+		w.WriteHeader(http.StatusBadRequest)
+		renderLookup(w, ctx, page)
+		return
+	}
+	if !lookupByIP.Allow(clientIP(ctx, r)) {
+		page.Err = "That's a lot of tries. Give it a few minutes and try again"
+		w.WriteHeader(http.StatusTooManyRequests)
+		renderLookup(w, ctx, page)
+		return
+	}
+
+	/* Whatever happens next, they see the same thing, and just as
+	 * fast: the looking up and mailing happen after we answer */
+	page.Sent = true
+	page.Email = email
+	if lookupByEmail.Allow(email) {
+		go mailLookup(ctx, email)
+	} else {
+		ctx.Infos.Printf("/tickets too many lookups for %s", email)
+	}
+	renderLookup(w, ctx, page)
+}
+
+func mailLookup(ctx *config.AppContext, email string) {
+	held, err := lookupPage(ctx, email)
+	if err != nil {
+		ctx.Err.Printf("/tickets unable to look up %s: %s", email, err)
+		return
+	}
+	if len(held.Tickets)+len(held.Claims) == 0 {
+		return
+	}
+	if err = sendLookupMail(ctx, email); err != nil {
+		ctx.Err.Printf("/tickets unable to mail %s: %s", email, err)
+	}
+}
+
+/* The magic link, and the ticket it's asking about if any */
+func lookupTicket(w http.ResponseWriter, r *http.Request, ctx *config.AppContext) (string, *types.Registration, bool) {
+	vars := mux.Vars(r)
+	email, ok := lookupEmail(ctx, vars["token"])
+	if !ok {
+		w.WriteHeader(http.StatusForbidden)
+		renderLookup(w, ctx, &LookupPage{Err: "That link's expired. Pop your email in again for a fresh one"})
+		return "", nil, false
+	}
+	if vars["ticket"] == "" {
+		return email, nil, true
+	}
+
+	held, err := heldTickets(ctx, email)
+	if err != nil {
+		http.Error(w, "Unable to load page, please try again later", http.StatusInternalServerError)
+		ctx.Err.Printf("/tickets unable to load tickets for %s: %s", email, err)
+		return "", nil, false
+	}
+	for _, rez := range held {
+		if rez.RefID == vars["ticket"] {
+			return email, rez, true
+		}
+	}
+	http.NotFound(w, r)
+	return "", nil, false
+}
+
+func TicketList(w http.ResponseWriter, r *http.Request, ctx *config.AppContext) {
+	email, _, ok := lookupTicket(w, r, ctx)
+	if !ok {
+		return
+	}
+
+	page, err := lookupPage(ctx, email)
+	if err != nil {
+		http.Error(w, "Unable to load page, please try again later", http.StatusInternalServerError)
+		ctx.Err.Printf("/tickets unable to look up %s: %s", email, err)
+		return
+	}
+	page.Token = mux.Vars(r)["token"]
+	/* Set by a resend; ours, never the link's */
+	page.Msg = ctx.Session.PopString(r.Context(), "lookup-msg")
+	renderLookup(w, ctx, page)
+}
+
+func TicketDownload(w http.ResponseWriter, r *http.Request, ctx *config.AppContext) {
+	_, rez, ok := lookupTicket(w, r, ctx)
+	if !ok {
+		return
+	}
+
+	pdf, err := MakeTicketPDF(ctx, rez)
+	if err != nil {
+		http.Error(w, "Unable to make ticket, please try again later", http.StatusInternalServerError)
+		ctx.Err.Printf("/tickets unable to make pdf for %s: %s", rez.RefID, err)
+		return
+	}
+
+	name := rez.RefID
+	if conf := findConfByRef(ctx, rez.ConfRef); conf != nil {
+		name = fmt.Sprintf("btcpp_%s_ticket_%s", conf.Tag, rez.RefID[:6])
+	}
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+".pdf"))
+	w.Write(pdf)
+}
+
+func TicketResend(w http.ResponseWriter, r *http.Request, ctx *config.AppContext) {
+	email, rez, ok := lookupTicket(w, r, ctx)
+	if !ok {
+		return
+	}
+
+	msg := "Sent! Check your inbox"
+	if !resendByTix.Allow(rez.RefID) {
+		msg = "We've sent that one a few times already; try again later"
+	} else if err := resendTicket(ctx, rez, email); err != nil {
+		ctx.Err.Printf("/tickets unable to resend %s to %s: %s", rez.RefID, email, err)
+		msg = "Unable to send it just now, please try again later"
+	}
+
+	ctx.Session.Put(r.Context(), "lookup-msg", msg)
+	http.Redirect(w, r, "/tickets/"+mux.Vars(r)["token"], http.StatusSeeOther)
+}
+
+/* The mailer only sends a job key once, so a resend gets its own */
+func resendTicket(ctx *config.AppContext, rez *types.Registration, email string) error {
+	pdf, err := MakeTicketPDF(ctx, rez)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	tickets := []*types.Ticket{{
+		ID:     rez.RefID,
+		Pdf:    pdf,
+		JobKey: fmt.Sprintf("%s-resend-%d", rez.RefID, now.Unix()),
+	}}
+	return SendTickets(ctx, tickets, rez.ConfRef, email, now)
+}
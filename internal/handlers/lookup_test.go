@@ -0,0 +1,180 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/base58btc/btcpp-web/external/getters"
+	"github.com/base58btc/btcpp-web/internal/types"
+)
+
+func TestTicketLookup(t *testing.T) {
+	ta := newTestApp(t)
+	lookupByIP = newRateLimiter(lookupIPLimit, lookupWindow)
+	lookupByEmail = newRateLimiter(lookupEmailLimit, lookupWindow)
+	resendByTix = newRateLimiter(resendLimit, resendWindow)
+
+	alice := "alice@example.com"
+	err := ta.Store.AddTickets(&types.Entry{
+		ID:       "cs_lost",
+		ConfRef:  "conf-atx25",
+		Currency: "usd",
+		Created:  time.Now(),
+		Email:    alice,
+		Items:    []types.Item{{Total: 10000, Desc: "atx25 ticket", Type: "genpop", TixID: "tix-atx25-early"}},
+	}, "stripe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ticket := getters.UniqueID(alice, "cs_lost", 0)
+
+	client := noRedirects(ta.client(t))
+	resp, err := client.PostForm(ta.Server.URL+"/tickets", url.Values{"email": {"nobody@example.com"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	nobody := readBody(t, resp)
+	if resp.StatusCode != http.StatusOK || len(ta.Mailer.Mails()) != 0 {
+		t.Fatalf("expected no mail for an unknown email, got %d and %d mails", resp.StatusCode, len(ta.Mailer.Mails()))
+	}
+	resp, err = client.PostForm(ta.Server.URL+"/tickets", url.Values{"email": {"Alice@Example.com"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := readBody(t, resp)
+	if resp.StatusCode != http.StatusOK || body != strings.Replace(nobody, "nobody@example.com", alice, 1) {
+		t.Fatalf("expected the same answer for a known email, got %d", resp.StatusCode)
+	}
+
+	mails := ta.Mailer.WaitMails(t, 1)
+	if len(mails) != 1 || mails[0].ToAddr != alice {
+		t.Fatalf("expected a lookup mail to %s, got %d", alice, len(mails))
+	}
+	link := ta.Env.GetURI() + "/tickets/"
+	start := strings.Index(mails[0].TextBody, link)
+	if start < 0 {
+		t.Fatalf("no lookup link in %q", mails[0].TextBody)
+	}
+	token := strings.Fields(mails[0].TextBody[start+len(link):])[0]
+	listURL := ta.Server.URL + "/tickets/" + token
+
+	resp, err = client.Get(ta.Server.URL + "/tickets/" + token + "x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	readBody(t, resp)
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected a bad link to be refused, got %d", resp.StatusCode)
+	}
+	resp, err = client.Get(listURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body = readBody(t, resp)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(body, ticket+"/pdf") {
+		t.Fatalf("expected the list to have the ticket, got %d", resp.StatusCode)
+	}
+
+	resp, err = client.Get(listURL + "/" + getters.UniqueID("eve@example.com", "cs_other", 0) + "/pdf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	readBody(t, resp)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected someone else's ticket to 404, got %d", resp.StatusCode)
+	}
+	resp, err = client.Get(listURL + "/" + ticket + "/pdf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body = readBody(t, resp)
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(body, "%PDF-") {
+		t.Fatalf("expected a pdf, got %d", resp.StatusCode)
+	}
+
+	resp, err = client.PostForm(listURL+"/"+ticket+"/resend", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	readBody(t, resp)
+	if resp.StatusCode != http.StatusSeeOther {
+		t.Fatalf("expected resend to redirect, got %d", resp.StatusCode)
+	}
+	mails = ta.Mailer.Mails()
+	if len(mails) != 2 || mails[1].ToAddr != alice || !strings.HasPrefix(mails[1].JobKey, "btcpp-"+ticket+"-resend-") || len(mails[1].Attachments) != 1 {
+		t.Fatalf("expected the ticket to be mailed again, got %d mails", len(mails))
+	}
+	resp, err = client.Get(listURL + "?msg=Pay+at+evil.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body = readBody(t, resp)
+	if !strings.Contains(body, "Sent! Check your inbox") || strings.Contains(body, "evil.example") {
+		t.Fatalf("expected our message and not the link's")
+	}
+	resp, err = client.Get(listURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body = readBody(t, resp); strings.Contains(body, "Sent! Check your inbox") {
+		t.Fatalf("expected the message to show only once")
+	}
+
+	/* Keep asking and the door shuts */
+	for i := 0; ; i++ {
+		resp, err = client.PostForm(ta.Server.URL+"/tickets", url.Values{"email": {fmt.Sprintf("guess%d@example.com", i)}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		readBody(t, resp)
+		if resp.StatusCode == http.StatusTooManyRequests {
+			break
+		}
+		if i > lookupIPLimit {
+			t.Fatalf("expected lookups to be rate limited")
+		}
+	}
+}
+
+func TestLookupBehindProxy(t *testing.T) {
+	ta := newTestApp(t)
+	lookupByIP = newRateLimiter(lookupIPLimit, lookupWindow)
+	lookupByEmail = newRateLimiter(lookupEmailLimit, lookupWindow)
+	ta.Env.ClientIPHeader = "X-Forwarded-For"
+
+	/* Everyone comes through the proxy, so RemoteAddr's the same */
+	lookup := func(forwarded string, i int) int {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodPost, ta.Server.URL+"/tickets",
+			strings.NewReader(url.Values{"email": {fmt.Sprintf("guess%d@example.com", i)}}.Encode()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("X-Forwarded-For", forwarded)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		readBody(t, resp)
+		return resp.StatusCode
+	}
+
+	/* One busy client doesn't shut out the rest, even if it
+	 * makes up the first part of the header */
+	for i := 0; i < lookupIPLimit; i++ {
+		if status := lookup(fmt.Sprintf("10.0.0.%d, 203.0.113.1", i), i); status != http.StatusOK {
+			t.Fatalf("expected lookup %d through, got %d", i, status)
+		}
+	}
+	if status := lookup("10.0.0.99, 203.0.113.1", 99); status != http.StatusTooManyRequests {
+		t.Fatalf("expected the busy client to be rate limited, got %d", status)
+	}
+	if status := lookup("203.0.113.2", 100); status != http.StatusOK {
+		t.Fatalf("expected another client through, got %d", status)
+	}
+}
@@ -2,7 +2,6 @@ package handlers
 
 import (
 	"bytes"
-	"context"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
@@ -18,93 +17,197 @@ import (
 	"github.com/base58btc/btcpp-web/internal/config"
 	"github.com/base58btc/btcpp-web/internal/types"
 	mailer "github.com/base58btc/mailer/mail"
-
-	"github.com/chromedp/cdproto/emulation"
-	"github.com/chromedp/cdproto/page"
-	"github.com/chromedp/chromedp"
 )
 
-var rezziesSent map[string]*types.Registration
+const defaultMailerEndpoint = "http://45.55.129.100:9998"
 
-func CheckForNewMails(ctx *config.AppContext) {
+const (
+	/* Retry backoff doubles from here, up to the cap */
+	mailRetryBase = time.Minute
+	mailRetryCap  = 6 * time.Hour
+	mailMaxTries  = 8
+	/* A send that's been 'rendering' this long never finished */
+	mailStaleAfter = 10 * time.Minute
+)
+
+func mailBackoff(attempts uint) time.Duration {
+	wait := mailRetryBase
+	for i := uint(1); i < attempts; i++ {
+		wait *= 2
+		if wait >= mailRetryCap {
+			return mailRetryCap
+		}
+	}
+	return wait
+}
 
-	if rezziesSent == nil {
-		rezziesSent = make(map[string]*types.Registration)
+func mailReady(mail *types.OutboxMail, now time.Time) bool {
+	if mail.Status == types.MailRendering {
+		return now.Sub(mail.Updated) > mailStaleAfter
 	}
+	return mail.Due(now)
+}
 
-	var success, fails, resent int
+/* Put a mail in the outbox for every registration that
+ * doesn't have one yet. Multi-ticket orders get a claim
+ * mail instead, until someone's on each ticket */
+func queueNewMails(ctx *config.AppContext, outbox map[string]*types.OutboxMail) int {
 	rezzies, err := getters.FetchBtcppRegistrations(ctx, true)
 	if err != nil {
 		ctx.Err.Println(err)
-		return
+		return 0
 	}
 
+	/* Tickets sent right away have their own job key */
+	mailed := make(map[string]bool)
+	for _, mail := range outbox {
+		if mail.Type != types.MailClaim && mail.Type != types.MailWaitlist {
+			mailed[mail.RefID] = true
+		}
+	}
+
+	var queued int
+	now := time.Now().UTC()
+	sizes := orderSizes(rezzies)
 	for _, rez := range rezzies {
-		/* check local list (has sent already?) gets lost on restart */
-		_, has := rezziesSent[rez.RefID]
-		if has {
+		if _, has := outbox[rez.RefID]; has || mailed[rez.RefID] || !rez.Voided.IsZero() {
+			continue
+		}
+
+		mail := &types.OutboxMail{
+			JobKey:  rez.RefID,
+			RefID:   rez.RefID,
+			ConfRef: rez.ConfRef,
+			Type:    rez.Type,
+			Email:   rez.MailTo(),
+			Status:  types.MailPending,
+			Created: now,
+			Updated: now,
+		}
+		if awaitingClaim(rez, sizes) {
+			mail.JobKey = "claim-" + rez.LookupID
+			if _, has := outbox[mail.JobKey]; has {
+				continue
+			}
+			mail.RefID = rez.LookupID
+			mail.Type = types.MailClaim
+		}
+		if err := ctx.Store.AddOutbox(mail); err != nil {
+			ctx.Err.Printf("Unable to queue mail for %s: %s", rez.RefID, err)
+			continue
+		}
+		outbox[mail.JobKey] = mail
+		queued++
+	}
+
+	return queued
+}
+
+func updateOutbox(ctx *config.AppContext, mail *types.OutboxMail, status types.MailStatus) error {
+	mail.Status = status
+	mail.Updated = time.Now().UTC()
+	err := ctx.Store.UpdateOutbox(mail)
+	if err != nil {
+		ctx.Err.Printf("Unable to update outbox for %s: %s", mail.JobKey, err)
+	}
+	return err
+}
+
+/* Sends whatever's due in the outbox, retrying failures
+ * with backoff until they run out of attempts */
+func CheckForNewMails(ctx *config.AppContext) {
+	mails, err := ctx.Store.ListOutbox()
+	if err != nil {
+		ctx.Err.Printf("Unable to load outbox: %s", err)
+		return
+	}
+
+	outbox := make(map[string]*types.OutboxMail)
+	for _, mail := range mails {
+		outbox[mail.JobKey] = mail
+	}
+
+	queued := queueNewMails(ctx, outbox)
+
+	var success, fails, resent, dead int
+	now := time.Now().UTC()
+	for _, mail := range outbox {
+		if !mailReady(mail, now) {
+			continue
+		}
+
+		/* Mark it before we start, so a crash mid-send shows up */
+		mail.Attempts++
+		mail.RetryAt = time.Time{}
+		if updateOutbox(ctx, mail, types.MailRendering) != nil {
 			continue
 		}
 
-		err = SendMail(ctx, rez)
+		switch mail.Type {
+		case types.MailClaim:
+			err = SendClaimMail(ctx, mail)
+		case types.MailWaitlist:
+			err = SendWaitlistMail(ctx, mail)
+		default:
+			err = SendMail(ctx, mail.Registration())
+		}
 		if err == nil {
-			rezziesSent[rez.RefID] = rez
+			mail.LastErr = ""
+			updateOutbox(ctx, mail, types.MailSent)
 			success++
 		} else if strings.Contains(err.Error(), "UNIQUE constraint failed") {
-			rezziesSent[rez.RefID] = rez
+			/* The mailer already has it */
+			mail.LastErr = ""
+			updateOutbox(ctx, mail, types.MailSent)
 			resent++
+		} else if mail.Attempts >= mailMaxTries {
+			mail.LastErr = err.Error()
+			updateOutbox(ctx, mail, types.MailDead)
+			ctx.Err.Printf("Giving up on mail %s to %s after %d attempts: %s", mail.JobKey, mail.Email, mail.Attempts, err)
+			dead++
 		} else {
-			ctx.Err.Printf("Unable to send mail: %s", err.Error())
+			mail.LastErr = err.Error()
+			mail.RetryAt = time.Now().UTC().Add(mailBackoff(mail.Attempts))
+			updateOutbox(ctx, mail, types.MailFailed)
+			ctx.Err.Printf("Unable to send mail %s (attempt %d, retry at %s): %s", mail.JobKey, mail.Attempts, mail.RetryAt.Format(time.RFC3339), err)
 			fails++
 		}
 	}
-	if (success+fails+resent > 0) {
-		ctx.Infos.Printf("Of %d, sent %d mails, %d failed, %d retries", success+fails+resent, success, fails, resent)
-	}
-}
 
-func pdfGrabber(url string, res *[]byte) chromedp.Tasks {
-	return chromedp.Tasks{
-		emulation.SetUserAgentOverride("WebScraper 1.0"),
-		chromedp.Navigate(url),
-		chromedp.WaitVisible(`body`, chromedp.ByQuery),
-		chromedp.ActionFunc(func(ctx context.Context) error {
-			buf, _, err := page.PrintToPDF().WithPrintBackground(true).WithPreferCSSPageSize(true).WithPaperWidth(3.8).WithPaperHeight(12.0).Do(ctx)
-			if err != nil {
-				return err
-			}
-			*res = buf
-			return nil
-		}),
+	if queued+success+fails+resent+dead > 0 {
+		ctx.Infos.Printf("Outbox: %d queued, %d sent, %d failed, %d already sent, %d dead", queued, success, fails, resent, dead)
 	}
 }
 
-func buildChromePdf(ctx *config.AppContext, fromURL string) ([]byte, error) {
-	opts := append(chromedp.DefaultExecAllocatorOptions[:],
-		chromedp.Flag("allow-insecure-localhost", true),
-		chromedp.Flag("ignore-certificate-errors", true),
-		chromedp.Flag("accept-insecure-certs", true),
-	)
-
-	allocCtx, cancel := chromedp.NewExecAllocator(context.Background(), opts...)
-	defer cancel()
-
-	taskCtx, cancel := chromedp.NewContext(
-		allocCtx,
-		chromedp.WithLogf(ctx.Infos.Printf),
-	)
-	defer cancel()
-	var pdfBuffer []byte
-	if err := chromedp.Run(taskCtx, pdfGrabber(fromURL, &pdfBuffer)); err != nil {
-		return pdfBuffer, err
+/* Sends a ticket now, instead of waiting for the job. It goes
+ * through the outbox, so if it fails the job tries again. The
+ * job may have queued it already, so it gets its own key; the
+ * mailer still only sends the ticket once */
+func mailTicketNow(ctx *config.AppContext, rez *types.Registration) error {
+	now := time.Now().UTC()
+	mail := &types.OutboxMail{
+		JobKey:   fmt.Sprintf("%s-now-%d", rez.RefID, now.Unix()),
+		RefID:    rez.RefID,
+		ConfRef:  rez.ConfRef,
+		Type:     rez.Type,
+		Email:    rez.MailTo(),
+		Status:   types.MailRendering,
+		Attempts: 1,
+		Created:  now,
+		Updated:  now,
+	}
+	if err := ctx.Store.AddOutbox(mail); err != nil {
+		return err
 	}
 
-	return pdfBuffer, nil
-}
-
-func MakeTicketPDF(ctx *config.AppContext, rez *types.Registration) ([]byte, error) {
-	ticketPage := fmt.Sprintf("http://localhost:%s/ticket/%s?type=%s&conf=%s", ctx.Env.Port, rez.RefID, rez.Type, rez.ConfRef)
-	return buildChromePdf(ctx, ticketPage)
+	err := SendMail(ctx, mail.Registration())
+	if err != nil {
+		mail.LastErr = err.Error()
+		mail.RetryAt = now.Add(mailBackoff(mail.Attempts))
+		updateOutbox(ctx, mail, types.MailFailed)
+		return err
+	}
+	return updateOutbox(ctx, mail, types.MailSent)
 }
 
 func SendMail(ctx *config.AppContext, rez *types.Registration) error {
@@ -130,10 +233,20 @@ func SendTickets(ctx *config.AppContext, tickets []*types.Ticket, confRef, email
 		return fmt.Errorf("No conference found for ref %s", confRef)
 	}
 
+	/* One ticket is one person, who can fix their details
+	 * or hand it on */
+	var editLink, transferLink string
+	if len(tickets) == 1 {
+		editLink = attendeeLink(ctx, tickets[0].ID)
+		transferLink = ticketTransferLink(ctx, tickets[0].ID)
+	}
+
 	var htmlBody bytes.Buffer
-	err := ctx.TemplateCache["email-html-"+conf.Tag].Execute(io.Writer(&htmlBody), &EmailTmpl{
-		URI: ctx.Env.GetURI(),
-		CSS: MiniCss(),
+	err := ctx.Template("email-html-"+conf.Tag).Execute(io.Writer(&htmlBody), &EmailTmpl{
+		URI:          ctx.Env.GetURI(),
+		CSS:          MiniCss(),
+		EditLink:     editLink,
+		TransferLink: transferLink,
 	})
 	if err != nil {
 		return err
@@ -144,8 +257,10 @@ func SendTickets(ctx *config.AppContext, tickets []*types.Ticket, confRef, email
 	}
 
 	var textBody bytes.Buffer
-	err = ctx.TemplateCache["email-text-"+conf.Tag].Execute(io.Writer(&textBody), &EmailTmpl{
-		URI: ctx.Env.GetURI(),
+	err = ctx.Template("email-text-"+conf.Tag).Execute(io.Writer(&textBody), &EmailTmpl{
+		URI:          ctx.Env.GetURI(),
+		EditLink:     editLink,
+		TransferLink: transferLink,
 	})
 	if err != nil {
 		return err
@@ -162,6 +277,9 @@ func SendTickets(ctx *config.AppContext, tickets []*types.Ticket, confRef, email
 	}
 
 	ticketJob := tickets[0].ID
+	if tickets[0].JobKey != "" {
+		ticketJob = tickets[0].JobKey
+	}
 	/* Hack to push thru the test ticket, every time! */
 	if !ctx.Env.Prod && ticketJob == "testticket" {
 		ticketJob = ticketJob + strconv.Itoa(int(sendAt.UTC().Unix()))
@@ -212,7 +330,11 @@ func SendMailRequest(ctx *config.AppContext, mail *mailer.MailRequest) error {
 
 	client := &http.Client{}
 
-	url := "http://45.55.129.100:9998/job"
+	endpoint := ctx.Env.MailerEndpoint
+	if endpoint == "" {
+		endpoint = defaultMailerEndpoint
+	}
+	url := endpoint + "/job"
 	req, err := http.NewRequest(http.MethodPut, url, bytes.NewBuffer(payload))
 	if err != nil {
 		return err
@@ -0,0 +1,144 @@
+package handlers
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/base58btc/btcpp-web/external/getters"
+	"github.com/base58btc/btcpp-web/internal/types"
+)
+
+func TestOutboxRetries(t *testing.T) {
+	ta := newTestApp(t)
+
+	err := ta.Store.AddTickets(&types.Entry{
+		ID:      "cs_test_retry",
+		ConfRef: "conf-atx25",
+		Created: time.Now(),
+		Email:   "adam@example.com",
+		Items:   []types.Item{{Total: 10000, Type: "genpop"}},
+	}, "stripe")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	outboxMail := func() *types.OutboxMail {
+		t.Helper()
+		outbox, err := ta.Store.ListOutbox()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(outbox) != 1 {
+			t.Fatalf("expected 1 outbox mail, got %d", len(outbox))
+		}
+		return outbox[0]
+	}
+
+	/* Mailer is down; it backs off */
+	ta.Mailer.Fail("mailer is down")
+	CheckForNewMails(ta.AppContext)
+	mail := outboxMail()
+	if mail.Status != types.MailFailed || mail.Attempts != 1 {
+		t.Fatalf("expected failed after 1 attempt, got %s/%d", mail.Status, mail.Attempts)
+	}
+	if !mail.RetryAt.After(time.Now()) || !strings.Contains(mail.LastErr, "mailer is down") {
+		t.Fatalf("expected a retry later, got %s (%s)", mail.RetryAt, mail.LastErr)
+	}
+
+	/* Not due yet, so nothing happens */
+	CheckForNewMails(ta.AppContext)
+	if mail = outboxMail(); mail.Attempts != 1 {
+		t.Fatalf("retried before it was due (%d attempts)", mail.Attempts)
+	}
+
+	/* Run out of attempts, and it's dead */
+	mail.Attempts = mailMaxTries - 1
+	mail.RetryAt = time.Now().Add(-time.Minute)
+	if err := ta.Store.UpdateOutbox(mail); err != nil {
+		t.Fatal(err)
+	}
+	CheckForNewMails(ta.AppContext)
+	if mail = outboxMail(); mail.Status != types.MailDead {
+		t.Fatalf("expected dead, got %s", mail.Status)
+	}
+
+	/* Dead mail stays put, even once the mailer's back */
+	ta.Mailer.Fail("")
+	CheckForNewMails(ta.AppContext)
+	if len(ta.Mailer.Mails()) != 0 {
+		t.Fatalf("dead mail was sent")
+	}
+}
+
+func TestMailTicketNow(t *testing.T) {
+	ta := newTestApp(t)
+	/* sqlite holds each job key to one row */
+	store, err := getters.NewSQLiteStore(filepath.Join(t.TempDir(), "btcpp.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ta.Store = store
+
+	issue := func(id, email string) *types.Registration {
+		t.Helper()
+		err := ta.Store.AddTickets(&types.Entry{
+			ID:      id,
+			ConfRef: "conf-atx25",
+			Created: time.Now(),
+			Email:   email,
+			Items:   []types.Item{{Total: 10000, Type: "genpop"}},
+		}, "stripe")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &types.Registration{RefID: getters.UniqueID(email, id, 0), ConfRef: "conf-atx25", Type: "genpop", Email: email}
+	}
+	outboxFor := func(rez *types.Registration) []*types.OutboxMail {
+		t.Helper()
+		outbox, err := ta.Store.ListOutbox()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var mails []*types.OutboxMail
+		for _, mail := range outbox {
+			if mail.RefID == rez.RefID {
+				mails = append(mails, mail)
+			}
+		}
+		return mails
+	}
+
+	/* The job got to it first, but couldn't send it */
+	queued := issue("cs_queued", "amy@example.com")
+	ta.Mailer.Fail("mailer is down")
+	CheckForNewMails(ta.AppContext)
+	ta.Mailer.Fail("")
+	if err = mailTicketNow(ta.AppContext, queued); err != nil {
+		t.Fatalf("expected sending now to work alongside the queued mail, got %s", err)
+	}
+	mails := outboxFor(queued)
+	if len(mails) != 2 || mails[0].JobKey == mails[1].JobKey {
+		t.Fatalf("expected two outbox mails with their own keys, got %+v", mails)
+	}
+
+	/* Sent right away, so the job leaves it be */
+	now := issue("cs_now", "bob@example.com")
+	if err = mailTicketNow(ta.AppContext, now); err != nil {
+		t.Fatal(err)
+	}
+	CheckForNewMails(ta.AppContext)
+	if mails = outboxFor(now); len(mails) != 1 || mails[0].Status != types.MailSent {
+		t.Fatalf("expected just the one mail, got %+v", mails)
+	}
+	var sent int
+	for _, mail := range ta.Mailer.Mails() {
+		if mail.ToAddr == "bob@example.com" {
+			sent++
+		}
+	}
+	if sent != 1 {
+		t.Fatalf("expected bob's ticket mailed once, got %d", sent)
+	}
+}
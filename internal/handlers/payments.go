@@ -0,0 +1,327 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/base58btc/btcpp-web/external/getters"
+	"github.com/base58btc/btcpp-web/internal/config"
+	"github.com/base58btc/btcpp-web/internal/types"
+	"github.com/gorilla/mux"
+)
+
+/* What free (comp) orders are added as, in place of a provider */
+const compPlatform = "comp"
+
+func paymentFor(ctx *config.AppContext, method string) types.PaymentProvider {
+	return getters.PaymentFor(ctx.Env, ctx.Payments, method)
+}
+
+/* Every ticket in the cart, less any discount */
+func newOrder(ctx *config.AppContext, cart *tixCart, email string, discount *types.DiscountCode) *types.Order {
+	domain := ctx.Env.GetURI()
+	conf := cart.Conf
+
+	order := &types.Order{
+		Status:     types.OrderPending,
+		ConfRef:    conf.Ref,
+		ConfTag:    conf.Tag,
+		Email:      email,
+		Currency:   cart.Lines[0].Choice.Tix.Currency,
+		Created:    time.Now().UTC(),
+		Expires:    time.Now().Add(checkoutHoldTTL),
+		SuccessURL: domain + "/conf/" + conf.Tag + "/success",
+		CancelURL:  domain + "/conf/" + conf.Tag,
+	}
+	if discount != nil {
+		order.DiscountRef = discount.Ref
+	}
+	for _, line := range cart.Lines {
+		price := line.Each(discount)
+		tixType := line.Type()
+		/* Comps are issued as whatever the code says */
+		if price == 0 && discount != nil && discount.TixType != "" {
+			tixType = discount.TixType
+		}
+		for i := uint(0); i < line.Count; i++ {
+			order.Items = append(order.Items, types.Item{
+				Total: int64(price) * 100,
+				Desc:  conf.Desc,
+				Type:  tixType,
+				TixID: line.Choice.Tix.ID,
+			})
+		}
+	}
+	return order
+}
+
+func startCheckout(w http.ResponseWriter, r *http.Request, ctx *config.AppContext, provider types.PaymentProvider, order *types.Order) {
+	/* Only a comp code gets an order to free */
+	if order.Total() == 0 && order.DiscountRef != "" {
+		compCheckout(w, r, ctx, order)
+		return
+	}
+
+	order.Provider = provider.Name()
+	order.CallbackURL = ctx.Env.GetURI() + "/callback/" + provider.Name()
+
+	hold, soldOut, err := holdTickets(ctx, order, sessionInvite(r, ctx, order.ConfRef))
+	if err != nil {
+		http.Error(w, "Unable to start checkout, please try again later", http.StatusInternalServerError)
+		ctx.Err.Printf("!!! Unable to hold %d %s tickets: %s", len(order.Items), order.ConfTag, err)
+		return
+	}
+	if soldOut != nil {
+		ctx.Infos.Printf("Not enough %s tickets left for %d: %s", order.ConfTag, len(order.Items), soldOut)
+		ctx.Session.Put(r.Context(), "cart-err", soldOut.Error())
+		http.Redirect(w, r, "/conf/"+order.ConfTag+"/cart", http.StatusSeeOther)
+		return
+	}
+	order.CancelURL = holdCancelLink(ctx, hold)
+
+	checkout, err := provider.CreateCheckout(order)
+	if err != nil {
+		if err := setHold(ctx, hold, types.HoldReleased); err != nil {
+			ctx.Err.Printf("Unable to release hold %s: %s", hold.Ref, err)
+		}
+		http.Error(w, "Unable to start checkout, please try again later", http.StatusInternalServerError)
+		ctx.Err.Printf("!!! Unable to start %s checkout: %s", provider.Name(), err)
+		return
+	}
+	holdCheckout(ctx, hold, checkout)
+
+	if onSiteCheckout(checkout) {
+		url, err := saveCheckout(r, ctx, provider, order, checkout)
+		if err == nil {
+			http.Redirect(w, r, url, http.StatusSeeOther)
+			return
+		}
+		/* Their hosted checkout works too */
+		ctx.Err.Printf("Unable to save %s checkout %s: %s", provider.Name(), checkout.OrderID, err)
+	}
+
+	http.Redirect(w, r, checkout.URL, http.StatusSeeOther)
+}
+
+/* Nothing to pay, so the tickets are added right away, the
+ * same as a paid order's. The outbox mails them as usual. The
+ * hold takes the code's use, so two at once can't both have it */
+func compCheckout(w http.ResponseWriter, r *http.Request, ctx *config.AppContext, order *types.Order) {
+	/* No provider to ask them, and nowhere to send the tickets */
+	if order.Email == "" {
+		http.Error(w, "We need an email to send your tickets to", http.StatusBadRequest)
+		ctx.Err.Printf("Comp order for %s with no email", order.ConfTag)
+		return
+	}
+
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		http.Error(w, "Unable to start checkout, please try again later", http.StatusInternalServerError)
+		ctx.Err.Printf("!!! Unable to make a comp order id: %s", err)
+		return
+	}
+	order.ID = compPlatform + "_" + hex.EncodeToString(id)
+	order.Provider = compPlatform
+	order.Status = types.OrderPaid
+
+	hold, soldOut, err := holdTickets(ctx, order, sessionInvite(r, ctx, order.ConfRef))
+	if err != nil {
+		http.Error(w, "Unable to start checkout, please try again later", http.StatusInternalServerError)
+		ctx.Err.Printf("!!! Unable to hold %d %s comps: %s", len(order.Items), order.ConfTag, err)
+		return
+	}
+	if soldOut != nil {
+		ctx.Infos.Printf("Not enough %s tickets left for %d comps: %s", order.ConfTag, len(order.Items), soldOut)
+		ctx.Session.Put(r.Context(), "cart-err", soldOut.Error())
+		http.Redirect(w, r, "/conf/"+order.ConfTag+"/cart", http.StatusSeeOther)
+		return
+	}
+
+	/* Adding them converts the hold */
+	_, _, err = addOrderTickets(ctx, order)
+	if err != nil {
+		if err := setHold(ctx, hold, types.HoldReleased); err != nil {
+			ctx.Err.Printf("Unable to release hold %s: %s", hold.Ref, err)
+		}
+		http.Error(w, "Unable to start checkout, please try again later", http.StatusInternalServerError)
+		ctx.Err.Printf("!!! Unable to add comp order %s: %s", order.ID, err)
+		return
+	}
+
+	http.Redirect(w, r, order.SuccessURL, http.StatusSeeOther)
+}
+
+/* One webhook at a time, so a retry racing the original
+ * can't add the tickets twice */
+var webhookMu sync.Mutex
+
+/* Every provider's webhook lands here. We only trust what we
+ * fetch back from the provider, not what was posted to us.
+ * Each event is logged, so a redelivery is a no-op */
+func PaymentCallback(w http.ResponseWriter, r *http.Request, ctx *config.AppContext) {
+	name := mux.Vars(r)["provider"]
+	provider, ok := ctx.Payments[name]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	ev, err := provider.VerifyWebhook(r)
+	if err != nil {
+		ctx.Err.Printf("Invalid %s webhook: %s", name, err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if ev.OrderID == "" {
+		ctx.Infos.Printf("Unhandled %s event type: %s", name, ev.Type)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	eventID := ev.ID
+	if eventID == "" {
+		eventID = ev.OrderID + ":" + string(ev.Status)
+	}
+
+	webhookMu.Lock()
+	defer webhookMu.Unlock()
+
+	key := types.WebhookKey(name, eventID)
+	logged, err := ctx.Store.FindWebhookEvent(key)
+	if err != nil {
+		ctx.Err.Printf("Unable to look up %s webhook %s: %s", name, eventID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if logged != nil && logged.Handled() {
+		ctx.Infos.Printf("Already handled %s webhook %s (%s)", name, eventID, logged.Status)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if logged == nil {
+		now := time.Now().UTC()
+		logged = &types.WebhookEvent{
+			Key:         key,
+			Provider:    name,
+			EventID:     eventID,
+			Type:        ev.Type,
+			OrderID:     ev.OrderID,
+			OrderStatus: ev.Status,
+			Status:      types.WebhookReceived,
+			Created:     now,
+			Updated:     now,
+		}
+		if err = ctx.Store.AddWebhookEvent(logged); err != nil {
+			ctx.Err.Printf("Unable to log %s webhook %s: %s", name, eventID, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.WriteHeader(runWebhookEvent(ctx, provider, logged))
+}
+
+/* Does what the event asks and records how it went. Returns
+ * the status to give the provider: anything but a 200 and
+ * they'll try again. Call with webhookMu held */
+func runWebhookEvent(ctx *config.AppContext, provider types.PaymentProvider, logged *types.WebhookEvent) int {
+	code := http.StatusOK
+	status, result, err := handlePaymentEvent(ctx, provider, logged.PaymentEvent())
+	if err != nil {
+		ctx.Err.Printf("!!! %s webhook %s failed: %s", logged.Provider, logged.EventID, err)
+		status = types.WebhookFailed
+		result = err.Error()
+		code = http.StatusInternalServerError
+	}
+
+	/* Could be a cached copy; don't touch it */
+	done := *logged
+	done.Status = status
+	done.Result = result
+	done.Attempts++
+	done.Updated = time.Now().UTC()
+	if err = ctx.Store.UpdateWebhookEvent(&done); err != nil {
+		/* Not worth a retry, the tickets may be in already */
+		ctx.Err.Printf("!!! Unable to update %s webhook %s: %s", logged.Provider, logged.EventID, err)
+	}
+	return code
+}
+
+/* An error means it might work if tried again */
+func handlePaymentEvent(ctx *config.AppContext, provider types.PaymentProvider, ev *types.PaymentEvent) (types.WebhookStatus, string, error) {
+	if ev.Status == types.OrderRefunded {
+		return voidRefundedOrder(ctx, provider, ev.OrderID)
+	}
+	if ev.Status == types.OrderExpired {
+		finishHold(ctx, provider.Name(), ev.OrderID, types.HoldReleased)
+	}
+	if ev.Status != types.OrderPaid {
+		ctx.Infos.Printf("%s order %s not paid (%s)", provider.Name(), ev.OrderID, ev.Type)
+		return types.WebhookIgnored, "order " + string(ev.Status), nil
+	}
+
+	order, err := provider.FetchCharge(ev.OrderID)
+	if err != nil {
+		return "", "", fmt.Errorf("unable to fetch charge %s: %s", ev.OrderID, err)
+	}
+
+	return addOrderTickets(ctx, order)
+}
+
+/* Turns a paid order into tickets */
+func addOrderTickets(ctx *config.AppContext, order *types.Order) (types.WebhookStatus, string, error) {
+	if order.Status != types.OrderPaid {
+		ctx.Infos.Printf("%s order %s is %s, not adding tickets", order.Provider, order.ID, order.Status)
+		return types.WebhookIgnored, "order " + string(order.Status), nil
+	}
+
+	/* Retrying won't help, but someone can fix the conf
+	 * and replay it from the admin */
+	if order.ConfRef == "" || findConfByRef(ctx, order.ConfRef) == nil {
+		ctx.Err.Printf("%s order %s has no conf we know of (%q)", order.Provider, order.ID, order.ConfRef)
+		return types.WebhookFailed, fmt.Sprintf("no conf %q", order.ConfRef), nil
+	}
+
+	if len(order.Items) == 0 {
+		ctx.Infos.Println("No valid items bought")
+		return types.WebhookIgnored, "no items", nil
+	}
+
+	/* Their checkout can outlive its hold (they backed out, then
+	 * paid anyway). They've paid, so they get their tickets, but
+	 * if the seats went to someone else it's flagged */
+	hold, err := getters.FindHold(ctx.Store, order.Provider, order.ID)
+	if err != nil {
+		return "", "", fmt.Errorf("unable to find hold for %s: %s", order.ID, err)
+	}
+	var oversold error
+	if hold != nil && hold.Status != types.HoldConverted && !hold.Active(time.Now()) {
+		holdMu.Lock()
+		defer holdMu.Unlock()
+		taken, err := tixTaken(ctx, order.ConfRef)
+		if err != nil {
+			return "", "", fmt.Errorf("unable to count tickets for %s: %s", order.ID, err)
+		}
+		oversold = checkTixLeft(ctx, order, taken)
+	}
+
+	err = ctx.Store.AddTickets(order.Entry(), order.Provider)
+	if err != nil {
+		return "", "", fmt.Errorf("unable to add tickets for %s: %s", order.ID, err)
+	}
+
+	finishHold(ctx, order.Provider, order.ID, types.HoldConverted)
+	waitlistBought(ctx, order)
+	ctx.Infos.Printf("Added %d %s tickets for %s!!", len(order.Items), order.Provider, order.ID)
+	if oversold != nil {
+		ctx.Err.Printf("!!! %s order %s paid after its hold was let go, oversold: %s", order.Provider, order.ID, oversold)
+		return types.WebhookOversold, fmt.Sprintf("added %d tickets, paid after its hold was let go: %s", len(order.Items), oversold), nil
+	}
+	return types.WebhookDone, fmt.Sprintf("added %d tickets", len(order.Items)), nil
+}
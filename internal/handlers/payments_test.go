@@ -0,0 +1,526 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/base58btc/btcpp-web/external/getters"
+	"github.com/base58btc/btcpp-web/internal/btcpaytest"
+	"github.com/base58btc/btcpp-web/internal/types"
+	stripe "github.com/stripe/stripe-go/v76"
+	"github.com/stripe/stripe-go/v76/webhook"
+)
+
+func TestPaymentProviders(t *testing.T) {
+	ta := newTestApp(t)
+	fake := &fakeProvider{orders: make(map[string]*types.Order)}
+	ta.Payments = map[string]types.PaymentProvider{"fake": fake}
+	ta.Env.Payments.Fiat = "fake"
+
+	/* A new provider just needs to be in the map */
+	client := noRedirects(ta.client(t))
+	if loc := checkoutCart(t, ta, client, "tix-atx25-early+default+fiat"); loc != "https://pay.example.com/fake_0" {
+		t.Fatalf("expected redirect to checkout, got %s", loc)
+	}
+	order := fake.orders["fake_0"]
+	if order.ConfRef != "conf-atx25" || order.Total() != 10000 || order.Items[0].TixID != "tix-atx25-early" || order.Items[0].Type != "genpop" {
+		t.Fatalf("unexpected order: %+v", order)
+	}
+	if order.CallbackURL != "https://btcpp.test/callback/fake" {
+		t.Fatalf("unexpected callback url %s", order.CallbackURL)
+	}
+
+	resp, err := client.PostForm(ta.Server.URL+"/callback/fake", url.Values{"id": {"fake_0"}, "sig": {"nope"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	readBody(t, resp)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected bad webhook to be refused, got %d", resp.StatusCode)
+	}
+
+	resp, err = client.PostForm(ta.Server.URL+"/callback/fake", url.Values{"id": {"fake_0"}, "sig": {"ok"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	readBody(t, resp)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("webhook failed, got %d", resp.StatusCode)
+	}
+
+	rezzies, err := ta.Store.ListRegistrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rezzies) != 1 || rezzies[0].Platform != "fake" || rezzies[0].LookupID != "fake_0" || rezzies[0].AmountPaid != 10000 {
+		t.Fatalf("expected one fake ticket, got %+v", rezzies)
+	}
+
+	resp, err = client.Post(ta.Server.URL+"/callback/nobody", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	readBody(t, resp)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected unknown provider to 404, got %d", resp.StatusCode)
+	}
+}
+
+func TestWebhookEventLog(t *testing.T) {
+	ta := newTestApp(t)
+	fake := &fakeProvider{orders: make(map[string]*types.Order)}
+	ta.Payments = map[string]types.PaymentProvider{"fake": fake}
+	ta.Env.Payments.Fiat = "fake"
+
+	client := noRedirects(ta.client(t))
+	checkoutCart(t, ta, client, "tix-atx25-early+default+fiat")
+
+	/* The provider retries; only the first one adds tickets */
+	for i := 0; i < 3; i++ {
+		resp, err := client.PostForm(ta.Server.URL+"/callback/fake", url.Values{"id": {"fake_0"}, "sig": {"ok"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		readBody(t, resp)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("webhook %d failed, got %d", i, resp.StatusCode)
+		}
+	}
+	rezzies, err := ta.Store.ListRegistrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rezzies) != 1 {
+		t.Fatalf("expected one ticket after redeliveries, got %d", len(rezzies))
+	}
+	events, err := ta.Store.ListWebhookEvents()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].Status != types.WebhookDone || events[0].Attempts != 1 || events[0].Result != "added 1 tickets" {
+		t.Fatalf("expected one done event, got %+v", events)
+	}
+
+	/* A charge for a conf we don't know about fails... */
+	fake.orders["fake_x"] = &types.Order{
+		ID:       "fake_x",
+		Provider: "fake",
+		ConfRef:  "conf-gone",
+		Currency: "usd",
+		Items:    []types.Item{{Total: 10000, Desc: "bitcoin++", Type: "genpop"}},
+	}
+	resp, err := client.PostForm(ta.Server.URL+"/callback/fake", url.Values{"id": {"fake_x"}, "sig": {"ok"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	readBody(t, resp)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected failed event to be acked, got %d", resp.StatusCode)
+	}
+	failed, err := ta.Store.FindWebhookEvent(types.WebhookKey("fake", "fake_x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if failed == nil || failed.Status != types.WebhookFailed || !strings.Contains(failed.Result, "conf-gone") {
+		t.Fatalf("expected failed event, got %+v", failed)
+	}
+
+	/* ...and only admins get to replay it */
+	replayURL := ta.Server.URL + "/admin/webhooks/" + failed.Ref + "/replay"
+	org := noRedirects(ta.client(t))
+	resp, err = org.PostForm(replayURL, loginForm("organizer"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	readBody(t, resp)
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected organizer to be turned away, got %d", resp.StatusCode)
+	}
+
+	_, err = getters.NewStaff(ta.Store, "admin", "Admin", testSecret, types.RoleAdmin, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	admin := noRedirects(ta.client(t))
+	token := ta.formToken(t, admin, "/admin/webhooks", "admin")
+	resp, err = admin.Get(ta.Server.URL + "/admin/webhooks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := readBody(t, resp)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(body, "/admin/webhooks/"+failed.Ref+"/replay") {
+		t.Fatalf("expected failed event on the admin page, got %d %s", resp.StatusCode, body)
+	}
+
+	/* Fix the cause, then replay */
+	fake.mu.Lock()
+	fake.orders["fake_x"].ConfRef = "conf-atx25"
+	fake.mu.Unlock()
+	/* Not from another site's form */
+	resp, err = admin.PostForm(replayURL, url.Values{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	readBody(t, resp)
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected replay without a token to be refused, got %d", resp.StatusCode)
+	}
+	resp, err = admin.PostForm(replayURL, url.Values{"csrf": {token}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	readBody(t, resp)
+	if resp.StatusCode != http.StatusSeeOther {
+		t.Fatalf("expected replay to redirect, got %d", resp.StatusCode)
+	}
+	replayed, err := ta.Store.FindWebhookEvent(types.WebhookKey("fake", "fake_x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replayed.Status != types.WebhookDone || replayed.Attempts != 2 {
+		t.Fatalf("expected replayed event to be done, got %+v", replayed)
+	}
+	rezzies, err = ta.Store.ListRegistrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rezzies) != 2 {
+		t.Fatalf("expected replay to add a ticket, got %d", len(rezzies))
+	}
+
+	/* Done events don't get replayed */
+	resp, err = admin.PostForm(replayURL, url.Values{"csrf": {token}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	readBody(t, resp)
+	if !strings.Contains(resp.Header.Get("Location"), "only+failed") {
+		t.Fatalf("expected replay of a done event to be refused, got %s", resp.Header.Get("Location"))
+	}
+	rezzies, err = ta.Store.ListRegistrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rezzies) != 2 {
+		t.Fatalf("expected no more tickets, got %d", len(rezzies))
+	}
+}
+
+func TestOpenNodeProvider(t *testing.T) {
+	ta := newTestApp(t)
+
+	var created types.OpenNodeRequest
+	stub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "on_key" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch {
+		case r.Method == "POST" && r.URL.Path == "/charges":
+			json.NewDecoder(r.Body).Decode(&created)
+			json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{
+				"id":                  "on_charge1",
+				"hosted_checkout_url": "https://checkout.opennode.com/on_charge1",
+			}})
+		case r.URL.Path == "/charge/on_charge1":
+			json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{
+				"id":          "on_charge1",
+				"status":      "paid",
+				"description": created.Description,
+				"fiat_value":  created.Amount,
+				"created_at":  time.Now().Format(time.RFC3339),
+				"metadata":    created.Metadata,
+			}})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer stub.Close()
+
+	ta.Payments = map[string]types.PaymentProvider{
+		"opennode": getters.NewOpenNodeProvider(types.OpenNodeConfig{Key: "on_key", Endpoint: stub.URL}, true),
+	}
+
+	slug := "tix-atx25-early+local+btc"
+	client := noRedirects(ta.client(t))
+	resp, err := client.PostForm(ta.Server.URL+"/tix/"+slug+"/collect-email", url.Values{
+		"Email":         {"hal@example.com"},
+		"Count":         {"2"},
+		"DiscountPrice": {"50"},
+		"HMAC":          {calcTixHMAC(ta.AppContext, findConfByRef(ta.AppContext, "conf-atx25"), 50, 50, "")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	readBody(t, resp)
+	if resp.StatusCode != http.StatusSeeOther || resp.Header.Get("Location") != "https://checkout.opennode.com/on_charge1" {
+		t.Fatalf("expected redirect to opennode, got %d %s", resp.StatusCode, resp.Header.Get("Location"))
+	}
+	if created.Amount != 100 || created.Metadata.Quantity != 2 || !created.Metadata.TixLocal || created.Metadata.TixID != "tix-atx25-early" {
+		t.Fatalf("unexpected charge request: %+v %+v", created, created.Metadata)
+	}
+
+	/* OpenNode signs the charge id with our key */
+	mac := hmac.New(sha256.New, []byte("on_key"))
+	mac.Write([]byte("on_charge1"))
+	resp, err = client.PostForm(ta.Server.URL+"/callback/opennode", url.Values{
+		"id":           {"on_charge1"},
+		"status":       {"paid"},
+		"hashed_order": {hex.EncodeToString(mac.Sum(nil))},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	readBody(t, resp)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("opennode webhook failed, got %d", resp.StatusCode)
+	}
+
+	rezzies, err := ta.Store.ListRegistrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rezzies) != 2 {
+		t.Fatalf("expected 2 tickets, got %d", len(rezzies))
+	}
+	for _, rez := range rezzies {
+		if rez.Type != "local" || rez.Email != "hal@example.com" || rez.AmountPaid != 5000 || rez.Platform != "opennode" {
+			t.Fatalf("unexpected ticket: %+v", rez)
+		}
+	}
+}
+
+func TestStripeDiscounts(t *testing.T) {
+	ta := newTestApp(t)
+
+	var created url.Values
+	session := func() map[string]interface{} {
+		meta := make(map[string]string)
+		for key := range created {
+			if strings.HasPrefix(key, "metadata[") {
+				meta[strings.TrimSuffix(strings.TrimPrefix(key, "metadata["), "]")] = created.Get(key)
+			}
+		}
+		return map[string]interface{}{
+			"id":               "cs_1",
+			"object":           "checkout.session",
+			"status":           "complete",
+			"payment_status":   "paid",
+			"currency":         "usd",
+			"created":          time.Now().Unix(),
+			"metadata":         meta,
+			"payment_intent":   "pi_1",
+			"customer_details": map[string]interface{}{"email": "dave@example.com"},
+		}
+	}
+	stub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "POST" && r.URL.Path == "/v1/checkout/sessions":
+			r.ParseForm()
+			created = r.PostForm
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"id":         "cs_1",
+				"object":     "checkout.session",
+				"url":        "https://checkout.stripe.com/cs_1",
+				"expires_at": time.Now().Add(time.Hour).Unix(),
+			})
+		case r.URL.Path == "/v1/checkout/sessions/cs_1":
+			json.NewEncoder(w).Encode(session())
+		case r.URL.Path == "/v1/checkout/sessions/cs_1/line_items":
+			line := "line_items[0][price_data]"
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"object":   "list",
+				"has_more": false,
+				"data": []map[string]interface{}{{
+					"id":           "li_1",
+					"object":       "item",
+					"quantity":     2,
+					"amount_total": 16000,
+					"description":  created.Get(line + "[product_data][description]"),
+					"price": map[string]interface{}{
+						"id": "price_1",
+						"product": map[string]interface{}{
+							"id":       "prod_1",
+							"metadata": map[string]string{"tix-id": created.Get(line + "[product_data][metadata][tix-id]")},
+						},
+					},
+				}},
+			})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer stub.Close()
+
+	ta.Payments = map[string]types.PaymentProvider{
+		"stripe": getters.NewStripeProviderAt("sk_test", "whsec_test", stub.URL),
+	}
+	ta.Env.Payments.Fiat = "stripe"
+
+	/* Stripe asks for the email, so we don't */
+	slug := "tix-atx25-early+default+fiat"
+	client := noRedirects(ta.client(t))
+	resp, err := client.Get(ta.Server.URL + "/tix/" + slug + "/collect-email?q=HODL")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := readBody(t, resp); resp.StatusCode != http.StatusOK || strings.Contains(body, `name="Email"`) {
+		t.Fatalf("expected a code but no email for stripe, got %d", resp.StatusCode)
+	}
+
+	resp, err = client.PostForm(ta.Server.URL+"/tix/"+slug+"/collect-email", url.Values{
+		"Count":         {"2"},
+		"Discount":      {"HODL"},
+		"DiscountPrice": {"80"},
+		"HMAC":          {calcTixHMAC(ta.AppContext, findConfByRef(ta.AppContext, "conf-atx25"), 100, 80, "HODL")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	readBody(t, resp)
+	if resp.StatusCode != http.StatusSeeOther || resp.Header.Get("Location") != "https://checkout.stripe.com/cs_1" {
+		t.Fatalf("expected redirect to stripe, got %d %s", resp.StatusCode, resp.Header.Get("Location"))
+	}
+	if created.Get("line_items[0][price_data][unit_amount]") != "8000" || created.Get("line_items[0][quantity]") != "2" {
+		t.Fatalf("expected the discount in the price, got %v", created)
+	}
+	if created.Get("metadata[discount]") != "discount-hodl" || created.Get("customer_email") != "" {
+		t.Fatalf("unexpected session metadata: %v", created)
+	}
+	if _, ok := created["allow_promotion_codes"]; ok {
+		t.Fatalf("expected no stripe promo codes, they'd skip the store")
+	}
+
+	payload, _ := json.Marshal(map[string]interface{}{
+		"id":          "evt_1",
+		"object":      "event",
+		"type":        "checkout.session.completed",
+		"api_version": stripe.APIVersion,
+		"data":        map[string]interface{}{"object": session()},
+	})
+	signed := webhook.GenerateTestSignedPayload(&webhook.UnsignedPayload{Payload: payload, Secret: "whsec_test"})
+	req, _ := http.NewRequest("POST", ta.Server.URL+"/callback/stripe", bytes.NewReader(payload))
+	req.Header.Set("Stripe-Signature", signed.Header)
+	resp, err = client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	readBody(t, resp)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("stripe webhook failed, got %d", resp.StatusCode)
+	}
+
+	rezzies, err := ta.Store.ListRegistrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rezzies) != 2 {
+		t.Fatalf("expected 2 tickets, got %d", len(rezzies))
+	}
+	for _, rez := range rezzies {
+		if rez.DiscountRef != "discount-hodl" || rez.AmountPaid != 8000 || rez.Email != "dave@example.com" || rez.Platform != "stripe" {
+			t.Fatalf("unexpected ticket: %+v", rez)
+		}
+	}
+}
+
+func TestBTCPayProvider(t *testing.T) {
+	ta := newTestApp(t)
+
+	stub := btcpaytest.NewServer("store1", "bp_key")
+	defer stub.Close()
+	stub.WebhookURL = ta.Server.URL + "/callback/btcpay"
+	stub.WebhookSecret = "whsec"
+
+	btcpay := getters.NewBTCPayProvider(types.BTCPayConfig{
+		Host:          stub.URL,
+		StoreID:       "store1",
+		APIKey:        "bp_key",
+		WebhookSecret: "whsec",
+	})
+	ta.Payments = map[string]types.PaymentProvider{"btcpay": btcpay}
+	ta.Env.Payments.BTC = "btcpay"
+
+	client := noRedirects(ta.client(t))
+	resp, err := client.PostForm(ta.Server.URL+"/tix/tix-atx25-early+default+btc/collect-email", url.Values{
+		"Email":         {"adam@example.com"},
+		"Count":         {"1"},
+		"DiscountPrice": {"90"},
+		"HMAC":          {calcTixHMAC(ta.AppContext, findConfByRef(ta.AppContext, "conf-atx25"), 90, 90, "")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	readBody(t, resp)
+
+	invoices := stub.Invoices()
+	if len(invoices) != 1 {
+		t.Fatalf("expected an invoice, got %d", len(invoices))
+	}
+	inv := invoices[0]
+	if resp.StatusCode != http.StatusSeeOther || resp.Header.Get("Location") != inv.CheckoutLink {
+		t.Fatalf("expected redirect to btcpay, got %d %s", resp.StatusCode, resp.Header.Get("Location"))
+	}
+	if inv.Amount != "90.00" || inv.Currency != "USD" || inv.Metadata.ConfRef != "conf-atx25" || inv.Metadata.TixID != "tix-atx25-early" || inv.Metadata.BuyerEmail != "adam@example.com" {
+		t.Fatalf("unexpected invoice: %+v %+v", inv, inv.Metadata)
+	}
+
+	/* Bad signatures are turned away */
+	code, err := stub.DeliverRaw([]byte(`{"type":"InvoiceSettled","invoiceId":"`+inv.ID+`"}`), "sha256=00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != http.StatusBadRequest {
+		t.Fatalf("expected bad sig to be refused, got %d", code)
+	}
+
+	/* We check with BTCPay, not just the webhook */
+	code, err = stub.Deliver("InvoiceSettled", inv.ID, "delivery1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rezzies, err := ta.Store.ListRegistrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != http.StatusOK || len(rezzies) != 0 {
+		t.Fatalf("unsettled invoice made tickets (%d): %d", code, len(rezzies))
+	}
+
+	stub.PayWith(inv.ID, "BTC-LightningNetwork")
+	code, err = stub.Deliver("InvoiceSettled", inv.ID, "delivery2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != http.StatusOK {
+		t.Fatalf("settled webhook failed, got %d", code)
+	}
+	rezzies, err = ta.Store.ListRegistrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rezzies) != 1 || rezzies[0].Platform != "btcpay" || rezzies[0].LookupID != inv.ID || rezzies[0].AmountPaid != 9000 || rezzies[0].TixID != "tix-atx25-early" {
+		t.Fatalf("expected a btcpay ticket, got %+v", rezzies)
+	}
+
+	order, err := btcpay.FetchCharge(inv.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	refund, err := btcpay.Refund(order, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req := stub.Refund(inv.ID); refund.Link == "" || req.RefundVariant != "Fiat" || req.PaymentMethod != "BTC-LightningNetwork" {
+		t.Fatalf("unexpected refund: %+v", refund)
+	}
+}
@@ -0,0 +1,175 @@
+package handlers
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/base58btc/btcpp-web/internal/config"
+	"github.com/base58btc/btcpp-web/internal/types"
+)
+
+/* Checks every paid order at the providers made it into the
+ * purchases, by Lookup ID. AddTickets goes one ticket at a
+ * time, so a failure partway leaves someone short */
+
+const defaultReconcileHours = 72
+
+type ReconcileReport struct {
+	Since   time.Time
+	Checked int
+	Issues  []*ReconcileIssue
+	/* Providers we couldn't list */
+	Errs []string
+}
+
+type ReconcileIssue struct {
+	Provider string
+	OrderID  string
+	Email    string
+	ConfRef  string
+	Paid     int
+	Have     int
+	Repaired bool
+	Err      string
+}
+
+func (i *ReconcileIssue) Kind() string {
+	switch {
+	case i.Have == 0:
+		return "missing"
+	case i.Have < i.Paid:
+		return "partial"
+	}
+	return "extra"
+}
+
+func (i *ReconcileIssue) String() string {
+	desc := fmt.Sprintf("%s %s order %s (%s): paid for %d, have %d", i.Kind(), i.Provider, i.OrderID, i.Email, i.Paid, i.Have)
+	switch {
+	case i.Repaired:
+		desc += ", repaired"
+		if i.Err != "" {
+			desc += ": " + i.Err
+		}
+	case i.Err != "":
+		desc += ", " + i.Err
+	}
+	return desc
+}
+
+func (r *ReconcileReport) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Checked %d paid orders since %s, %d issues\n", r.Checked, r.Since.Format(time.RFC3339), len(r.Issues))
+	for _, issue := range r.Issues {
+		fmt.Fprintf(&b, "  %s\n", issue)
+	}
+	for _, err := range r.Errs {
+		fmt.Fprintf(&b, "  error: %s\n", err)
+	}
+	return b.String()
+}
+
+/* With 'repair', missing tickets get added */
+func Reconcile(ctx *config.AppContext, since time.Time, repair bool) (*ReconcileReport, error) {
+	rezzies, err := ctx.Store.ListRegistrations()
+	if err != nil {
+		return nil, err
+	}
+	have := make(map[string]int)
+	for _, rez := range rezzies {
+		/* Transfers don't add to what was paid for */
+		if rez.LookupID != "" && rez.TransferredFrom() == "" {
+			have[rez.LookupID]++
+		}
+	}
+
+	var names []string
+	for name := range ctx.Payments {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	report := &ReconcileReport{Since: since}
+	for _, name := range names {
+		lister, ok := ctx.Payments[name].(types.OrderLister)
+		if !ok {
+			continue
+		}
+		orders, err := lister.ListPaidOrders(since)
+		if err != nil {
+			report.Errs = append(report.Errs, fmt.Sprintf("%s: %s", name, err))
+			continue
+		}
+
+		for _, order := range orders {
+			if order.Status != types.OrderPaid || len(order.Items) == 0 {
+				continue
+			}
+			report.Checked++
+			if have[order.ID] == len(order.Items) {
+				continue
+			}
+
+			issue := &ReconcileIssue{
+				Provider: name,
+				OrderID:  order.ID,
+				Email:    order.Email,
+				ConfRef:  order.ConfRef,
+				Paid:     len(order.Items),
+				Have:     have[order.ID],
+			}
+			report.Issues = append(report.Issues, issue)
+			if !repair || issue.Have > issue.Paid {
+				continue
+			}
+
+			/* Not while a webhook might be adding them too */
+			webhookMu.Lock()
+			status, result, err := addOrderTickets(ctx, order)
+			webhookMu.Unlock()
+			switch {
+			case err != nil:
+				issue.Err = err.Error()
+			case status == types.WebhookOversold:
+				issue.Repaired = true
+				issue.Err = result
+			case status != types.WebhookDone:
+				issue.Err = result
+			default:
+				issue.Repaired = true
+			}
+		}
+	}
+
+	return report, nil
+}
+
+/* For the periodic job: log what's wrong, loudly */
+func RunReconcile(ctx *config.AppContext) {
+	conf := ctx.Env.Reconcile
+	hours := conf.LookbackHours
+	if hours == 0 {
+		hours = defaultReconcileHours
+	}
+	since := time.Now().Add(-time.Duration(hours) * time.Hour)
+
+	report, err := Reconcile(ctx, since, conf.Repair)
+	if err != nil {
+		ctx.Err.Printf("!!! Unable to reconcile payments: %s", err)
+		return
+	}
+
+	for _, issue := range report.Issues {
+		if issue.Repaired {
+			ctx.Infos.Printf("Reconcile: %s", issue)
+		} else {
+			ctx.Err.Printf("!!! Reconcile: %s", issue)
+		}
+	}
+	for _, err := range report.Errs {
+		ctx.Err.Printf("!!! Reconcile: %s", err)
+	}
+	ctx.Infos.Printf("Reconciled %d paid orders, %d issues", report.Checked, len(report.Issues))
+}
@@ -0,0 +1,109 @@
+package handlers
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/base58btc/btcpp-web/external/getters"
+	"github.com/base58btc/btcpp-web/internal/btcpaytest"
+	"github.com/base58btc/btcpp-web/internal/types"
+)
+
+func TestReconcile(t *testing.T) {
+	ta := newTestApp(t)
+
+	stub := btcpaytest.NewServer("store1", "bp_key")
+	defer stub.Close()
+	btcpay := getters.NewBTCPayProvider(types.BTCPayConfig{
+		Host:    stub.URL,
+		StoreID: "store1",
+		APIKey:  "bp_key",
+	})
+	ta.Payments = map[string]types.PaymentProvider{"btcpay": btcpay}
+
+	newPaid := func(email string, count uint) *types.Order {
+		cart, err := determineCart(ta.AppContext, fmt.Sprintf("tix-atx25-early+default+btc*%d", count))
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkout, err := btcpay.CreateCheckout(newOrder(ta.AppContext, cart, email, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		stub.SetStatus(checkout.OrderID, "Settled")
+		order, err := btcpay.FetchCharge(checkout.OrderID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return order
+	}
+
+	/* One that died partway, one that never made it, one that's fine */
+	partial := newPaid("part@example.com", 3)
+	short := partial.Entry()
+	short.Items = short.Items[:1]
+	if err := ta.Store.AddTickets(short, "btcpay"); err != nil {
+		t.Fatal(err)
+	}
+	missing := newPaid("miss@example.com", 1)
+	fine := newPaid("fine@example.com", 2)
+	if err := ta.Store.AddTickets(fine.Entry(), "btcpay"); err != nil {
+		t.Fatal(err)
+	}
+
+	since := time.Now().Add(-time.Hour)
+	report, err := Reconcile(ta.AppContext, since, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Checked != 3 || len(report.Issues) != 2 || len(report.Errs) != 0 {
+		t.Fatalf("expected 2 issues in 3 orders, got %s", report)
+	}
+	kinds := map[string]string{}
+	for _, issue := range report.Issues {
+		if issue.Repaired {
+			t.Fatalf("report only shouldn't repair: %s", issue)
+		}
+		kinds[issue.OrderID] = issue.Kind()
+	}
+	if kinds[partial.ID] != "partial" || kinds[missing.ID] != "missing" {
+		t.Fatalf("unexpected issues: %s", report)
+	}
+
+	report, err = Reconcile(ta.AppContext, since, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, issue := range report.Issues {
+		if !issue.Repaired {
+			t.Fatalf("expected repair, got %s", issue)
+		}
+	}
+
+	/* The partial one only gets what it was missing */
+	rezzies, err := ta.Store.ListRegistrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	have := map[string]int{}
+	refIDs := map[string]bool{}
+	for _, rez := range rezzies {
+		have[rez.LookupID]++
+		if refIDs[rez.RefID] {
+			t.Fatalf("duplicate ticket %s", rez.RefID)
+		}
+		refIDs[rez.RefID] = true
+	}
+	if have[partial.ID] != 3 || have[missing.ID] != 1 || have[fine.ID] != 2 {
+		t.Fatalf("unexpected tickets after repair: %v", have)
+	}
+
+	report, err = Reconcile(ta.AppContext, since, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Issues) != 0 {
+		t.Fatalf("expected nothing left to fix, got %s", report)
+	}
+}
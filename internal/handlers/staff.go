@@ -0,0 +1,319 @@
+package handlers
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/base58btc/btcpp-web/external/getters"
+	"github.com/base58btc/btcpp-web/internal/config"
+	"github.com/base58btc/btcpp-web/internal/types"
+	"github.com/gorilla/mux"
+)
+
+const (
+	/* Login tries, per IP and per login. The whole door team
+	 * can be on the venue wifi, so the IP gets more */
+	staffLoginIPLimit = 20
+	staffLoginLimit   = 5
+	staffLoginWindow  = 15 * time.Minute
+)
+
+var (
+	staffLoginByIP = newRateLimiter(staffLoginIPLimit, staffLoginWindow)
+	staffLoginBy   = newRateLimiter(staffLoginLimit, staffLoginWindow)
+)
+
+type StaffPage struct {
+	Me    *types.Staff
+	Staff []*StaffRow
+	Confs []*types.Conf
+	Roles []types.StaffRole
+	Msg   string
+	CSRF  string
+}
+
+type StaffRow struct {
+	*types.Staff
+	ConfTags []string
+	CanEdit  bool
+}
+
+/* Who's logged in, if anyone. Revoked staff get logged out */
+func currentStaff(ctx *config.AppContext, r *http.Request) *types.Staff {
+	ref := ctx.Session.GetString(r.Context(), "staff")
+	if ref == "" {
+		return nil
+	}
+
+	staff, err := getters.FindStaffByRef(ctx.Store, ref)
+	if err != nil {
+		ctx.Err.Printf("unable to load staff: %s", err)
+		return nil
+	}
+	if staff == nil || staff.Revoked {
+		ctx.Session.Remove(r.Context(), "staff")
+		return nil
+	}
+	return staff
+}
+
+func renderLogin(w http.ResponseWriter, ctx *config.AppContext, status int, msg string) {
+	w.WriteHeader(status)
+	err := ctx.Template("checkin.tmpl").ExecuteTemplate(w, "checkin.tmpl", &CheckInPage{
+		NeedsLogin: true,
+		Msg:        msg,
+		Confs:      activeConfs(ctx),
+	})
+	if err != nil {
+		http.Error(w, "Unable to load page, please try again later", http.StatusInternalServerError)
+		ctx.Err.Printf("login ExecuteTemplate failed ! %s", err.Error())
+	}
+}
+
+func renderNoEntry(w http.ResponseWriter, ctx *config.AppContext, staff *types.Staff) {
+	w.WriteHeader(http.StatusForbidden)
+	err := ctx.Template("checkin.tmpl").ExecuteTemplate(w, "checkin.tmpl", &CheckInPage{
+		Msg: "Sorry " + staff.Login + ", you can't do that here",
+	})
+	if err != nil {
+		http.Error(w, "Unable to load page, please try again later", http.StatusInternalServerError)
+		ctx.Err.Printf("login ExecuteTemplate failed ! %s", err.Error())
+	}
+}
+
+/* Handles a posted login form. Returns false if it
+ * already wrote out a response */
+func staffLogin(w http.ResponseWriter, r *http.Request, ctx *config.AppContext) bool {
+	r.ParseForm()
+	login := r.Form.Get("login")
+	if login == "" {
+		return true
+	}
+
+	if !staffLoginByIP.Allow(clientIP(ctx, r)) || !staffLoginBy.Allow(strings.ToLower(login)) {
+		ctx.Infos.Printf("too many logins for %q", login)
+		renderLogin(w, ctx, http.StatusTooManyRequests, "That's a lot of tries. Give it a few minutes and try again")
+		return false
+	}
+
+	staff, err := getters.AuthStaff(ctx.Store, login, r.Form.Get("secret"))
+	if err != nil {
+		http.Error(w, "Unable to log in, please try again later", http.StatusInternalServerError)
+		ctx.Err.Printf("unable to check login for %q: %s", login, err)
+		return false
+	}
+	if staff == nil {
+		ctx.Infos.Printf("failed login for %q", login)
+		renderLogin(w, ctx, http.StatusUnauthorized, "Wrong login or secret")
+		return false
+	}
+
+	/* New session for a new login */
+	if err = ctx.Session.RenewToken(r.Context()); err != nil {
+		http.Error(w, "Unable to log in, please try again later", http.StatusInternalServerError)
+		ctx.Err.Printf("unable to renew session: %s", err)
+		return false
+	}
+	ctx.Session.Put(r.Context(), "staff", staff.Ref)
+	ctx.Session.Put(r.Context(), "door", r.Form.Get("door"))
+	ctx.Session.Remove(r.Context(), "csrf")
+	ctx.Infos.Printf("%s logged in (%s)", staff.Login, staff.Role)
+	return true
+}
+
+/* Gate for staff-only pages. A posted login form is handled
+ * here too. Returns nil if they can't come in, having already
+ * told them so. An empty confRef means any conf */
+func requireStaff(w http.ResponseWriter, r *http.Request, ctx *config.AppContext, role types.StaffRole, confRef string) *types.Staff {
+	if r.Method == http.MethodPost && !staffLogin(w, r, ctx) {
+		return nil
+	}
+
+	staff := currentStaff(ctx, r)
+	if staff == nil {
+		renderLogin(w, ctx, http.StatusUnauthorized, "")
+		return nil
+	}
+
+	ok := staff.CanAny(role)
+	if confRef != "" {
+		ok = staff.Can(role, confRef)
+	}
+	if !ok {
+		renderNoEntry(w, ctx, staff)
+		return nil
+	}
+	return staff
+}
+
+/* Staff forms carry a token from the session, so another
+ * site can't post them on a logged-in organizer's behalf */
+func csrfToken(ctx *config.AppContext, r *http.Request) string {
+	token := ctx.Session.GetString(r.Context(), "csrf")
+	if token != "" {
+		return token
+	}
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		ctx.Err.Printf("unable to make a form token: %s", err)
+		return ""
+	}
+	token = hex.EncodeToString(b)
+	ctx.Session.Put(r.Context(), "csrf", token)
+	return token
+}
+
+/* Returns false if the posted form didn't come from one of
+ * our pages, having already told them so */
+func requireCSRF(w http.ResponseWriter, r *http.Request, ctx *config.AppContext) bool {
+	r.ParseForm()
+	token := ctx.Session.GetString(r.Context(), "csrf")
+	if token != "" && hmac.Equal([]byte(token), []byte(r.PostForm.Get("csrf"))) {
+		return true
+	}
+
+	ctx.Infos.Printf("%s %s without a form token", r.Method, r.URL.Path)
+	http.Error(w, "That form has expired, please reload the page and try again", http.StatusForbidden)
+	return false
+}
+
+func Logout(w http.ResponseWriter, r *http.Request, ctx *config.AppContext) {
+	ctx.Session.Remove(r.Context(), "staff")
+	ctx.Session.Remove(r.Context(), "door")
+	ctx.Session.Remove(r.Context(), "csrf")
+	ctx.Session.RenewToken(r.Context())
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+/* Organizers look after the door volunteers for their confs;
+ * admins look after everyone */
+func canManage(me *types.Staff, staff *types.Staff) bool {
+	if me.Role == types.RoleAdmin {
+		return true
+	}
+	if me.Role != types.RoleOrganizer || staff.Role != types.RoleDoor || len(staff.ConfRefs) == 0 {
+		return false
+	}
+	for _, ref := range staff.ConfRefs {
+		if !me.HasConf(ref) {
+			return false
+		}
+	}
+	return true
+}
+
+func renderStaff(w http.ResponseWriter, r *http.Request, ctx *config.AppContext, me *types.Staff, msg string) {
+	staff, err := ctx.Store.ListStaff()
+	if err != nil {
+		http.Error(w, "Unable to load staff, please try again later", http.StatusInternalServerError)
+		ctx.Err.Printf("/staff unable to list staff: %s", err)
+		return
+	}
+
+	page := &StaffPage{Me: me, Msg: msg, CSRF: csrfToken(ctx, r)}
+	for _, st := range staff {
+		if me.Role != types.RoleAdmin && !canManage(me, st) && st.Ref != me.Ref {
+			continue
+		}
+		row := &StaffRow{Staff: st, CanEdit: canManage(me, st) && st.Ref != me.Ref}
+		for _, ref := range st.ConfRefs {
+			if conf := findConfByRef(ctx, ref); conf != nil {
+				row.ConfTags = append(row.ConfTags, conf.Tag)
+			}
+		}
+		page.Staff = append(page.Staff, row)
+	}
+
+	for _, conf := range ctx.Confs {
+		if me.Role == types.RoleAdmin || me.HasConf(conf.Ref) {
+			page.Confs = append(page.Confs, conf)
+		}
+	}
+	page.Roles = []types.StaffRole{types.RoleDoor}
+	if me.Role == types.RoleAdmin {
+		page.Roles = append(page.Roles, types.RoleOrganizer, types.RoleAdmin)
+	}
+
+	err = ctx.Template("staff.tmpl").ExecuteTemplate(w, "staff.tmpl", page)
+	if err != nil {
+		http.Error(w, "Unable to load page, please try again later", http.StatusInternalServerError)
+		ctx.Err.Printf("/staff ExecuteTemplate failed ! %s", err.Error())
+	}
+}
+
+func StaffList(w http.ResponseWriter, r *http.Request, ctx *config.AppContext) {
+	me := requireStaff(w, r, ctx, types.RoleOrganizer, "")
+	if me == nil {
+		return
+	}
+	renderStaff(w, r, ctx, me, "")
+}
+
+func StaffAdd(w http.ResponseWriter, r *http.Request, ctx *config.AppContext) {
+	me := requireStaff(w, r, ctx, types.RoleOrganizer, "")
+	if me == nil || !requireCSRF(w, r, ctx) {
+		return
+	}
+
+	role, ok := types.ParseStaffRole(r.PostForm.Get("role"))
+	if !ok {
+		renderStaff(w, r, ctx, me, "Pick a role")
+		return
+	}
+
+	var confRefs []string
+	for _, tag := range r.PostForm["conf"] {
+		for _, conf := range ctx.Confs {
+			if conf.Tag == tag {
+				confRefs = append(confRefs, conf.Ref)
+			}
+		}
+	}
+
+	proposed := &types.Staff{Role: role, ConfRefs: confRefs}
+	if !canManage(me, proposed) {
+		renderStaff(w, r, ctx, me, "You can't add that kind of staff")
+		return
+	}
+
+	staff, err := getters.NewStaff(ctx.Store, r.PostForm.Get("new-login"), r.PostForm.Get("name"), r.PostForm.Get("new-secret"), role, confRefs)
+	if err != nil {
+		renderStaff(w, r, ctx, me, err.Error())
+		return
+	}
+
+	ctx.Infos.Printf("%s added %s staff %s", me.Login, staff.Role, staff.Login)
+	renderStaff(w, r, ctx, me, "Added "+staff.Login)
+}
+
+func StaffRevoke(w http.ResponseWriter, r *http.Request, ctx *config.AppContext) {
+	me := requireStaff(w, r, ctx, types.RoleOrganizer, "")
+	if me == nil || !requireCSRF(w, r, ctx) {
+		return
+	}
+
+	staff, err := getters.FindStaffByRef(ctx.Store, mux.Vars(r)["ref"])
+	if err != nil {
+		http.Error(w, "Unable to load staff, please try again later", http.StatusInternalServerError)
+		ctx.Err.Printf("/staff revoke unable to find staff: %s", err)
+		return
+	}
+	if staff == nil || !canManage(me, staff) || staff.Ref == me.Ref {
+		renderStaff(w, r, ctx, me, "You can't revoke them")
+		return
+	}
+
+	if err = getters.RevokeStaff(ctx.Store, staff); err != nil {
+		http.Error(w, "Unable to revoke, please try again later", http.StatusInternalServerError)
+		ctx.Err.Printf("/staff unable to revoke %s: %s", staff.Login, err)
+		return
+	}
+
+	ctx.Infos.Printf("%s revoked %s", me.Login, staff.Login)
+	renderStaff(w, r, ctx, me, "Revoked "+staff.Login)
+}
@@ -0,0 +1,222 @@
+package handlers
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/base58btc/btcpp-web/external/getters"
+	"github.com/base58btc/btcpp-web/internal/types"
+)
+
+func TestStaffAccess(t *testing.T) {
+	ta := newTestApp(t)
+	var logs bytes.Buffer
+	ta.Infos = log.New(&logs, "", 0)
+
+	for i, conf := range []string{"conf-atx25", "conf-berlin23"} {
+		err := ta.Store.AddTickets(&types.Entry{
+			ID:      fmt.Sprintf("cs_test_staff%d", i),
+			ConfRef: conf,
+			Created: time.Now(),
+			Email:   "len@example.com",
+			Items:   []types.Item{{Total: 10000, Type: "genpop"}},
+		}, "stripe")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	atxTix := getters.UniqueID("len@example.com", "cs_test_staff0", 0)
+	berlinTix := getters.UniqueID("len@example.com", "cs_test_staff1", 0)
+
+	/* Wrong secrets don't get in, or end up in the logs */
+	door := ta.client(t)
+	resp, err := door.PostForm(ta.Server.URL+"/check-in/"+atxTix, url.Values{"login": {"door"}, "secret": {"hunter22"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	readBody(t, resp)
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected wrong secret to be refused, got %d", resp.StatusCode)
+	}
+	if strings.Contains(logs.String(), "hunter22") {
+		t.Fatalf("secret ended up in the logs: %s", logs.String())
+	}
+
+	/* Check-ins are on the volunteer who did them */
+	resp, err = door.PostForm(ta.Server.URL+"/check-in/"+atxTix, loginForm("door"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := readBody(t, resp); resp.StatusCode != http.StatusOK || !strings.Contains(body, "genpop") {
+		t.Fatalf("check-in failed (%d): %s", resp.StatusCode, body)
+	}
+	rezzies, err := ta.Store.ListRegistrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rez := range rezzies {
+		if rez.RefID == atxTix && rez.CheckedInBy != "door" {
+			t.Fatalf("expected check-in by door, got %q", rez.CheckedInBy)
+		}
+	}
+
+	/* Not their conf, not their job */
+	resp, err = door.Get(ta.Server.URL + "/check-in/" + berlinTix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := readBody(t, resp); resp.StatusCode != http.StatusForbidden || !strings.Contains(body, "not on the door") {
+		t.Fatalf("expected other conf to be refused (%d): %s", resp.StatusCode, body)
+	}
+
+	/* Even if it was added somewhere our cache didn't see */
+	other, err := getters.NewStore(ta.Env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = other.AddTickets(&types.Entry{
+		ID:      "cs_test_staff2",
+		ConfRef: "conf-berlin23",
+		Created: time.Now(),
+		Email:   "len@example.com",
+		Items:   []types.Item{{Total: 10000, Type: "genpop"}},
+	}, "stripe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lateTix := getters.UniqueID("len@example.com", "cs_test_staff2", 0)
+	resp, err = door.Get(ta.Server.URL + "/check-in/" + lateTix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := readBody(t, resp); resp.StatusCode != http.StatusForbidden || !strings.Contains(body, "not on the door") {
+		t.Fatalf("expected an uncached other conf ticket to be refused (%d): %s", resp.StatusCode, body)
+	}
+	rezzies, err = other.ListRegistrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rez := range rezzies {
+		if rez.RefID == lateTix && !rez.CheckedIn.IsZero() {
+			t.Fatalf("door checked in a ticket for another conf")
+		}
+	}
+	resp, err = door.Get(ta.Server.URL + "/conf-reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	readBody(t, resp)
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("door volunteers can't reload, got %d", resp.StatusCode)
+	}
+
+	/* Organizers can add door volunteers, but not admins */
+	org := ta.client(t)
+	token := ta.formToken(t, org, "/staff", "organizer")
+	resp, err = org.Get(ta.Server.URL + "/staff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := readBody(t, resp); !strings.Contains(body, "door") {
+		t.Fatalf("expected staff list (%d): %s", resp.StatusCode, body)
+	}
+	resp, err = org.PostForm(ta.Server.URL+"/staff/add", url.Values{"new-login": {"boss"}, "new-secret": {testSecret}, "role": {"admin"}, "csrf": {token}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := readBody(t, resp); !strings.Contains(body, "can&#39;t add") {
+		t.Fatalf("organizer added an admin: %s", body)
+	}
+
+	/* After the event, the volunteer's access goes */
+	staff, err := getters.FindStaff(ta.Store, "door")
+	if err != nil || staff == nil {
+		t.Fatalf("can't find door staff: %v", err)
+	}
+	/* Only from our own page, not a link or another site's form */
+	resp, err = org.Get(ta.Server.URL + "/staff/" + staff.Ref + "/revoke")
+	if err != nil {
+		t.Fatal(err)
+	}
+	readBody(t, resp)
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("expected revoke on GET to be refused, got %d", resp.StatusCode)
+	}
+	resp, err = org.PostForm(ta.Server.URL+"/staff/"+staff.Ref+"/revoke", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	readBody(t, resp)
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected revoke without a token to be refused, got %d", resp.StatusCode)
+	}
+	resp, err = org.PostForm(ta.Server.URL+"/staff/"+staff.Ref+"/revoke", url.Values{"csrf": {token}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := readBody(t, resp); !strings.Contains(body, "Revoked door") {
+		t.Fatalf("revoke failed (%d): %s", resp.StatusCode, body)
+	}
+
+	resp, err = door.Get(ta.Server.URL + "/check-in/" + atxTix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	readBody(t, resp)
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("revoked staff still logged in, got %d", resp.StatusCode)
+	}
+	resp, err = door.PostForm(ta.Server.URL+"/check-in/"+atxTix, loginForm("door"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	readBody(t, resp)
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("revoked staff logged back in, got %d", resp.StatusCode)
+	}
+}
+
+func TestStaffLoginLimit(t *testing.T) {
+	ta := newTestApp(t)
+
+	/* Guessing at a secret gets shut down */
+	client := ta.client(t)
+	for i := 0; ; i++ {
+		resp, err := client.PostForm(ta.Server.URL+"/check-in/nope", url.Values{"login": {"door"}, "secret": {fmt.Sprintf("guess%d", i)}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		readBody(t, resp)
+		if resp.StatusCode == http.StatusTooManyRequests {
+			break
+		}
+		if i > staffLoginLimit {
+			t.Fatalf("expected logins to be rate limited")
+		}
+	}
+	/* Even once they get it right */
+	resp, err := client.PostForm(ta.Server.URL+"/check-in/nope", url.Values{"login": {"Door"}, "secret": {testSecret}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	readBody(t, resp)
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("expected the login to stay locked, got %d", resp.StatusCode)
+	}
+
+	/* Someone else's login still works */
+	resp, err = ta.client(t).PostForm(ta.Server.URL+"/staff", loginForm("organizer"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	readBody(t, resp)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected organizer to get in, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,293 @@
+package handlers
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/base58btc/btcpp-web/internal/config"
+	"github.com/base58btc/btcpp-web/internal/types"
+)
+
+/* Check-in stations work off a copy of the registration list,
+ * check people in locally (venue wifi is what it is), and sync
+ * their queued check-ins back here whenever they can.
+ *
+ * The first check-in to reach the store wins. Anything after
+ * that comes back as a duplicate, with the time it was
+ * actually checked in at, so the station can flag it. */
+
+type StationTicket struct {
+	ID        string     `json:"id"`
+	Type      string     `json:"type"`
+	CheckedIn *time.Time `json:"checked_in,omitempty"`
+	Voided    bool       `json:"voided,omitempty"`
+}
+
+type StationList struct {
+	ConfRef string           `json:"conf_ref"`
+	ConfTag string           `json:"conf_tag"`
+	Conf    string           `json:"conf"`
+	Key     string           `json:"key"`
+	Fetched time.Time        `json:"fetched"`
+	Tickets []*StationTicket `json:"tickets"`
+}
+
+type StationCheckIn struct {
+	ID string    `json:"id"`
+	At time.Time `json:"at"`
+}
+
+type StationSync struct {
+	Station  string            `json:"station"`
+	CheckIns []*StationCheckIn `json:"checkins"`
+}
+
+const (
+	SyncOK        = "ok"
+	SyncDuplicate = "duplicate"
+	SyncUnknown   = "unknown"
+	SyncVoided    = "voided"
+	SyncError     = "error"
+)
+
+type StationResult struct {
+	ID        string     `json:"id"`
+	Status    string     `json:"status"`
+	Type      string     `json:"type,omitempty"`
+	CheckedIn *time.Time `json:"checked_in,omitempty"`
+	Msg       string     `json:"msg,omitempty"`
+}
+
+type StationSyncResult struct {
+	Results []*StationResult `json:"results"`
+	List    *StationList     `json:"list"`
+}
+
+type StationPage struct {
+	Conf *types.Conf
+}
+
+func stationConf(w http.ResponseWriter, r *http.Request, ctx *config.AppContext) *types.Conf {
+	conf, err := findConf(r, ctx)
+	if err != nil {
+		http.NotFound(w, r)
+		return nil
+	}
+	return conf
+}
+
+func stationTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+func stationRegistrations(ctx *config.AppContext, conf *types.Conf) (map[string]*types.Registration, error) {
+	rezzies, err := ctx.Store.ListRegistrations()
+	if err != nil {
+		return nil, err
+	}
+
+	regis := make(map[string]*types.Registration)
+	for _, rez := range rezzies {
+		if rez.RefID != "" && rez.ConfRef == conf.Ref {
+			regis[rez.RefID] = rez
+		}
+	}
+	return regis, nil
+}
+
+func buildStationList(ctx *config.AppContext, conf *types.Conf) (*StationList, error) {
+	regis, err := stationRegistrations(ctx, conf)
+	if err != nil {
+		return nil, err
+	}
+
+	list := &StationList{
+		ConfRef: conf.Ref,
+		ConfTag: conf.Tag,
+		Conf:    conf.Desc,
+		Key:     hex.EncodeToString(TicketPublicKey(ctx)),
+		Fetched: time.Now().UTC(),
+		Tickets: make([]*StationTicket, 0, len(regis)),
+	}
+	for _, rez := range regis {
+		list.Tickets = append(list.Tickets, &StationTicket{
+			ID:        rez.RefID,
+			Type:      rez.Type,
+			CheckedIn: stationTime(rez.CheckedIn),
+			Voided:    !rez.Voided.IsZero(),
+		})
+	}
+	sort.Slice(list.Tickets, func(i, j int) bool {
+		return list.Tickets[i].ID < list.Tickets[j].ID
+	})
+
+	return list, nil
+}
+
+/* The station itself; all the work happens in station.js */
+func CheckInStation(w http.ResponseWriter, r *http.Request, ctx *config.AppContext) {
+	conf := stationConf(w, r, ctx)
+	if conf == nil {
+		return
+	}
+
+	if requireStaff(w, r, ctx, types.RoleDoor, conf.Ref) == nil {
+		return
+	}
+
+	err := ctx.Template("station.tmpl").ExecuteTemplate(w, "station.tmpl", &StationPage{
+		Conf: conf,
+	})
+	if err != nil {
+		http.Error(w, "Unable to load page, please try again later", http.StatusInternalServerError)
+		ctx.Err.Printf("/check-in/station ExecuteTemplate failed ! %s", err.Error())
+	}
+}
+
+func writeStationJSON(w http.ResponseWriter, ctx *config.AppContext, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		ctx.Err.Printf("/check-in/station unable to write json: %s", err)
+	}
+}
+
+/* Everything a station needs to work offline */
+func CheckInStationList(w http.ResponseWriter, r *http.Request, ctx *config.AppContext) {
+	conf := stationConf(w, r, ctx)
+	if conf == nil {
+		return
+	}
+	if !currentStaff(ctx, r).Can(types.RoleDoor, conf.Ref) {
+		http.Error(w, "Not authorized", http.StatusUnauthorized)
+		return
+	}
+
+	list, err := buildStationList(ctx, conf)
+	if err != nil {
+		http.Error(w, "Unable to load registrations", http.StatusInternalServerError)
+		ctx.Err.Printf("/check-in/station/%s/list failed: %s", conf.Tag, err)
+		return
+	}
+	writeStationJSON(w, ctx, list)
+}
+
+/* Stations push their queued check-ins here. It's safe to resend
+ * a batch: a check-in we already have, at the same time, is ok */
+func CheckInStationSync(w http.ResponseWriter, r *http.Request, ctx *config.AppContext) {
+	conf := stationConf(w, r, ctx)
+	if conf == nil {
+		return
+	}
+	staff := currentStaff(ctx, r)
+	if !staff.Can(types.RoleDoor, conf.Ref) {
+		http.Error(w, "Not authorized", http.StatusUnauthorized)
+		return
+	}
+
+	var sync StationSync
+	if err := json.NewDecoder(r.Body).Decode(&sync); err != nil {
+		http.Error(w, "Bad sync request", http.StatusBadRequest)
+		return
+	}
+
+	regis, err := stationRegistrations(ctx, conf)
+	if err != nil {
+		http.Error(w, "Unable to load registrations", http.StatusInternalServerError)
+		ctx.Err.Printf("/check-in/station/%s/sync failed: %s", conf.Tag, err)
+		return
+	}
+
+	/* Earliest scans first, so they win */
+	sort.SliceStable(sync.CheckIns, func(i, j int) bool {
+		return sync.CheckIns[i].At.Before(sync.CheckIns[j].At)
+	})
+
+	/* The registrations may be cached, so track this batch here */
+	checkedIn := make(map[string]time.Time)
+	for id, rez := range regis {
+		checkedIn[id] = rez.CheckedIn
+	}
+
+	var dupes int
+	results := make([]*StationResult, 0, len(sync.CheckIns))
+	for _, checkin := range sync.CheckIns {
+		res := &StationResult{ID: checkin.ID}
+		results = append(results, res)
+
+		/* Tickets for other confs don't exist, as far as this door's concerned */
+		rez, ok := regis[checkin.ID]
+		if !ok {
+			res.Status = SyncUnknown
+			res.Msg = "Ticket not found"
+			continue
+		}
+		res.Type = rez.Type
+		if !rez.Voided.IsZero() {
+			res.Status = SyncVoided
+			res.Msg = "Ticket was cancelled"
+			continue
+		}
+
+		/* Timestamps are kept to the second */
+		at := checkin.At.UTC().Truncate(time.Second)
+		if at.IsZero() || at.After(time.Now().Add(time.Minute)) {
+			at = time.Now().UTC().Truncate(time.Second)
+		}
+
+		if prev := checkedIn[checkin.ID]; !prev.IsZero() {
+			res.CheckedIn = stationTime(prev)
+			if prev.Equal(at) {
+				res.Status = SyncOK
+			} else {
+				res.Status = SyncDuplicate
+				res.Msg = "Already checked in"
+				dupes++
+			}
+			continue
+		}
+
+		_, ok, err = ctx.Store.CheckIn(checkin.ID, at, staff.Login)
+		switch {
+		case err == nil:
+			res.Status = SyncOK
+			res.CheckedIn = stationTime(at)
+			checkedIn[checkin.ID] = at
+		case ok:
+			/* Someone beat us to it since we loaded the list */
+			res.Status = SyncDuplicate
+			res.Msg = err.Error()
+			dupes++
+		default:
+			res.Status = SyncError
+			res.Msg = "Unable to check in, try again"
+			ctx.Err.Printf("station %s (%s) unable to check in %s: %s", sync.Station, staff.Login, checkin.ID, err)
+		}
+	}
+
+	if len(results) > 0 {
+		ctx.Infos.Printf("station %s (%s) synced %d check-ins for %s (%d duplicates)", sync.Station, staff.Login, len(results), conf.Tag, dupes)
+	}
+
+	list, err := buildStationList(ctx, conf)
+	if err != nil {
+		ctx.Err.Printf("/check-in/station/%s/sync unable to reload list: %s", conf.Tag, err)
+	}
+	writeStationJSON(w, ctx, &StationSyncResult{
+		Results: results,
+		List:    list,
+	})
+}
+
+/* Keeps the station page around when the wifi isn't */
+func CheckInStationWorker(w http.ResponseWriter, r *http.Request, ctx *config.AppContext) {
+	w.Header().Set("Content-Type", "text/javascript")
+	w.Header().Set("Service-Worker-Allowed", "/check-in/")
+	http.ServeFile(w, r, "static/js/station-sw.js")
+}
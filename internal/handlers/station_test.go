@@ -0,0 +1,177 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/base58btc/btcpp-web/external/getters"
+	"github.com/base58btc/btcpp-web/internal/types"
+)
+
+func TestCheckInStation(t *testing.T) {
+	ta := newTestApp(t)
+
+	err := ta.Store.AddTickets(&types.Entry{
+		ID:      "cs_test_station",
+		ConfRef: "conf-atx25",
+		Created: time.Now(),
+		Email:   "nick@example.com",
+		Items: []types.Item{
+			{Total: 10000, Type: "genpop"},
+			{Total: 10000, Type: "volunteer"},
+		},
+	}, "stripe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := getters.UniqueID("nick@example.com", "cs_test_station", 0)
+	second := getters.UniqueID("nick@example.com", "cs_test_station", 1)
+
+	stationURL := ta.Server.URL + "/check-in/station/atx25"
+	if resp, err := http.Get(stationURL + "/list"); err != nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("list without a pin should be refused: %v", resp)
+	}
+
+	/* Two stations, both log in + grab the list while the wifi works */
+	login := func() *http.Client {
+		client := ta.client(t)
+		resp, err := client.PostForm(stationURL, loginForm("door"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body := readBody(t, resp)
+		if resp.StatusCode != http.StatusOK || !strings.Contains(body, "station.js") {
+			t.Fatalf("station page failed (%d): %s", resp.StatusCode, body)
+		}
+		return client
+	}
+	doorA, doorB := login(), login()
+
+	resp, err := doorA.Get(stationURL + "/list")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var list StationList
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if len(list.Tickets) != 2 || list.ConfRef != "conf-atx25" || list.Key == "" {
+		t.Fatalf("bad station list: %+v", list)
+	}
+
+	sync := func(client *http.Client, station string, checkins ...*StationCheckIn) map[string]*StationResult {
+		t.Helper()
+		payload, _ := json.Marshal(&StationSync{Station: station, CheckIns: checkins})
+		resp, err := client.Post(stationURL+"/sync", "application/json", bytes.NewReader(payload))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var res StationSyncResult
+		if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+			t.Fatal(err)
+		}
+		results := make(map[string]*StationResult)
+		for _, r := range res.Results {
+			results[r.ID] = r
+		}
+		return results
+	}
+
+	/* Both stations let the first ticket in while offline; A syncs first */
+	early := time.Now().Add(-10 * time.Minute).UTC().Truncate(time.Second)
+	late := early.Add(5 * time.Minute)
+	res := sync(doorA, "a", &StationCheckIn{ID: first, At: early})
+	if res[first].Status != SyncOK || res[first].Type != "genpop" {
+		t.Fatalf("expected first check-in ok: %+v", res[first])
+	}
+
+	res = sync(doorB, "b",
+		&StationCheckIn{ID: first, At: late},
+		&StationCheckIn{ID: second, At: late},
+		&StationCheckIn{ID: "forged", At: late})
+	if res[first].Status != SyncDuplicate || res[first].CheckedIn == nil || !res[first].CheckedIn.Equal(early) {
+		t.Fatalf("expected duplicate check-in at %s: %+v", early, res[first])
+	}
+	if res[second].Status != SyncOK {
+		t.Fatalf("expected second ticket ok: %+v", res[second])
+	}
+	if res["forged"].Status != SyncUnknown {
+		t.Fatalf("expected unknown ticket: %+v", res["forged"])
+	}
+
+	/* A's sync response got lost; resending it is fine */
+	res = sync(doorA, "a", &StationCheckIn{ID: first, At: early})
+	if res[first].Status != SyncOK {
+		t.Fatalf("expected resent check-in to be ok: %+v", res[first])
+	}
+
+	/* The online check-in agrees */
+	resp, err = doorA.Get(ta.Server.URL + "/check-in/" + first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := readBody(t, resp); !strings.Contains(body, "Already checked in") {
+		t.Fatalf("expected ticket to be checked in: %s", body)
+	}
+}
+
+func TestStationSyncRetries(t *testing.T) {
+	ta := newTestApp(t)
+	err := ta.Store.AddTickets(&types.Entry{
+		ID:      "cs_test_busy",
+		ConfRef: "conf-atx25",
+		Created: time.Now(),
+		Email:   "olga@example.com",
+		Items:   []types.Item{{Total: 10000, Type: "genpop"}},
+	}, "stripe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ticket := getters.UniqueID("olga@example.com", "cs_test_busy", 0)
+
+	stationURL := ta.Server.URL + "/check-in/station/atx25"
+	door := ta.client(t)
+	resp, err := door.PostForm(stationURL, loginForm("door"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	readBody(t, resp)
+	resp, err = door.Get(stationURL + "/list")
+	if err != nil {
+		t.Fatal(err)
+	}
+	readBody(t, resp)
+
+	sync := func() *StationResult {
+		t.Helper()
+		payload, _ := json.Marshal(&StationSync{Station: "a", CheckIns: []*StationCheckIn{{ID: ticket, At: time.Now().UTC().Truncate(time.Second)}}})
+		resp, err := door.Post(stationURL+"/sync", "application/json", bytes.NewReader(payload))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var res StationSyncResult
+		if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+			t.Fatal(err)
+		}
+		if len(res.Results) != 1 {
+			t.Fatalf("expected one result, got %d", len(res.Results))
+		}
+		return res.Results[0]
+	}
+
+	/* Notion's busy: the station keeps it and tries again */
+	ta.Notion.FailQueries("purchases", 1)
+	if res := sync(); res.Status != SyncError {
+		t.Fatalf("expected a retry, not %+v", res)
+	}
+	if res := sync(); res.Status != SyncOK {
+		t.Fatalf("expected the retry to check in: %+v", res)
+	}
+}
@@ -0,0 +1,126 @@
+package handlers
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/base58btc/btcpp-web/internal/config"
+	"github.com/base58btc/btcpp-web/internal/types"
+	"github.com/go-pdf/fpdf"
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+/* Ticket page is 3.8in x 12in, same as we used to print
+ * out of chrome. Everything below is in inches */
+const (
+	tixPageW   = 3.8
+	tixPageH   = 12.0
+	tixMargin  = 0.2
+	tixPadding = 0.25
+	tixQRSize  = 2.6
+)
+
+var (
+	/* Tailwind's bitcoin + gray-900 */
+	tixOrange = [3]int{0xFF, 0xA8, 0x00}
+	tixInk    = [3]int{0x11, 0x18, 0x27}
+)
+
+/* make it pretty */
+func prettyTixType(tixType string) string {
+	if tixType == "genpop" {
+		return "general"
+	}
+	return tixType
+}
+
+/* The QR code that gets you in the door */
+func ticketQRCode(ctx *config.AppContext, rez *types.Registration, size int) ([]byte, error) {
+	return qrcode.Encode(ticketCheckInURL(ctx, rez), qrcode.Medium, size)
+}
+
+func MakeTicketPDF(ctx *config.AppContext, rez *types.Registration) ([]byte, error) {
+	conf := findConfByRef(ctx, rez.ConfRef)
+	if conf == nil {
+		return nil, fmt.Errorf("No conference found for ref %s", rez.ConfRef)
+	}
+
+	qrpng, err := ticketQRCode(ctx, rez, 512)
+	if err != nil {
+		return nil, err
+	}
+
+	return renderTicketPDF(conf, ctx.Env.GetDomain(), prettyTixType(rez.Type), qrpng)
+}
+
+/* Lays out templates/emails/ticket.tmpl, without a browser */
+func renderTicketPDF(conf *types.Conf, domain, tixType string, qrpng []byte) ([]byte, error) {
+	pdf := fpdf.NewCustom(&fpdf.InitType{
+		UnitStr: "in",
+		Size:    fpdf.SizeType{Wd: tixPageW, Ht: tixPageH},
+	})
+	pdf.SetMargins(tixMargin+tixPadding, tixMargin+tixPadding, tixMargin+tixPadding)
+	pdf.SetAutoPageBreak(false, 0)
+	pdf.SetTitle(conf.Desc+", Admit One", true)
+	pdf.AddPage()
+
+	/* The core fonts are cp1252, so translate */
+	tr := pdf.UnicodeTranslatorFromDescriptor("")
+	width := tixPageW - 2*(tixMargin+tixPadding)
+	pt := func(size float64) float64 { return size / 72 }
+
+	pdf.SetFillColor(tixOrange[0], tixOrange[1], tixOrange[2])
+	pdf.Rect(0, 0, tixPageW, tixPageH, "F")
+	pdf.SetFillColor(255, 255, 255)
+	pdf.RoundedRect(tixMargin, tixMargin, tixPageW-2*tixMargin, tixPageH-2*tixMargin, 0.1, "1234", "F")
+
+	pdf.SetTextColor(tixInk[0], tixInk[1], tixInk[2])
+	pdf.SetFont("Helvetica", "BI", 20)
+	pdf.CellFormat(width, pt(28), tr("bitcoin++"), "", 1, "L", false, 0, "https://"+domain+"/")
+
+	pdf.Ln(0.6)
+	pdf.SetFont("Helvetica", "B", 18)
+	pdf.MultiCell(width, pt(24), tr(conf.Desc), "", "L", false)
+	pdf.Ln(0.05)
+
+	pdf.SetFont("Helvetica", "", 11)
+	for _, line := range []string{conf.DateDesc, conf.Venue} {
+		if line == "" {
+			continue
+		}
+		pdf.MultiCell(width, pt(16), tr(line), "", "L", false)
+		pdf.Ln(0.1)
+	}
+
+	pdf.Ln(0.1)
+	pdf.MultiCell(width, pt(16), tr("Thank you for registering. This QR code is your ticket!"), "", "L", false)
+
+	pdf.Ln(0.2)
+	pdf.RegisterImageOptionsReader("qr", fpdf.ImageOptions{ImageType: "PNG"}, bytes.NewReader(qrpng))
+	pdf.ImageOptions("qr", (tixPageW-tixQRSize)/2, pdf.GetY(), tixQRSize, tixQRSize, true, fpdf.ImageOptions{ImageType: "PNG"}, 0, "")
+	pdf.Ln(0.2)
+
+	pdf.MultiCell(width, pt(16), tr("Present this QR code at the conference registration desk to check in and receive your conference badge."), "", "L", false)
+	pdf.Ln(0.1)
+
+	pdf.Write(pt(16), tr("This is a "))
+	pdf.SetFont("Helvetica", "B", 11)
+	pdf.Write(pt(16), tr(tixType))
+	pdf.SetFont("Helvetica", "", 11)
+	pdf.Write(pt(16), tr(" ticket"))
+	pdf.Ln(pt(16) + 0.4)
+
+	pdf.MultiCell(width, pt(16), tr("<3 the btcpp conf team"), "", "L", false)
+	pdf.Ln(0.3)
+
+	pdf.SetFont("Helvetica", "U", 11)
+	pdf.WriteLinkString(pt(16), tr("Conf Agenda"), fmt.Sprintf("https://btcpp.dev/%s#agenda", conf.Tag))
+	pdf.Ln(pt(16) + 0.3)
+	pdf.WriteLinkString(pt(16), tr("Follow us on Twitter"), "https://twitter.com/btcplusplus")
+
+	var buf bytes.Buffer
+	if err := pdf.Output(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
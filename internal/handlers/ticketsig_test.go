@@ -0,0 +1,96 @@
+package handlers
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/base58btc/btcpp-web/external/getters"
+	"github.com/base58btc/btcpp-web/internal/types"
+)
+
+func TestSignedCheckIn(t *testing.T) {
+	ta := newTestApp(t)
+
+	ticket := getters.UniqueID("finney@example.com", "cs_test_signed", 0)
+	err := ta.Store.AddTickets(&types.Entry{
+		ID:      "cs_test_signed",
+		ConfRef: "conf-atx25",
+		Created: time.Now(),
+		Email:   "finney@example.com",
+		Items:   []types.Item{{Total: 10000, Type: "speaker"}},
+	}, "stripe")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	/* This door is for atx25 */
+	client := ta.client(t)
+	resp, err := client.PostForm(ta.Server.URL+"/check-in/nope", url.Values{"login": {"door"}, "secret": {testSecret}, "door": {"atx25"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	readBody(t, resp)
+
+	scan := func(scanURL, expect string) {
+		t.Helper()
+		resp, err := client.Get(scanURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body := readBody(t, resp)
+		if !strings.Contains(body, expect) {
+			t.Fatalf("expected %q from %s, got (%d): %s", expect, scanURL, resp.StatusCode, body)
+		}
+	}
+
+	good := ta.scanURL(t, &types.Registration{RefID: ticket, ConfRef: "conf-atx25", Type: "speaker"})
+
+	/* Someone upgrades their own ticket */
+	scan(strings.Replace(good, "t=speaker", "t=volunteer", 1), "Invalid ticket")
+	/* Or makes one up */
+	scan(ta.Server.URL+"/check-in/"+ticket+"?c=conf-atx25&t=speaker&s=AAAA", "Invalid ticket")
+	/* Real ticket, wrong conf */
+	scan(ta.scanURL(t, &types.Registration{RefID: "old", ConfRef: "conf-berlin23", Type: "genpop"}), "Ticket is for")
+
+	/* Nothing got checked in along the way */
+	scan(good, "speaker")
+	scan(good, "Already checked in")
+
+	/* Stations can fetch the key to check these themselves */
+	resp, err = http.Get(ta.Server.URL + "/check-in-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var key TicketKey
+	if err := json.NewDecoder(resp.Body).Decode(&key); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	pubkey, err := hex.DecodeString(key.Key)
+	if err != nil || key.Alg != "ed25519" {
+		t.Fatalf("bad key %+v: %v", key, err)
+	}
+	u, _ := url.Parse(good)
+	q := u.Query()
+	if !VerifyTicketSig(pubkey, ticket, q.Get("c"), q.Get("t"), q.Get("s")) {
+		t.Fatalf("published key doesn't verify tickets")
+	}
+}
+
+func TestNoSigningForStrangers(t *testing.T) {
+	ta := newTestApp(t)
+
+	/* Only tickets we've issued get a signed QR code */
+	resp, err := ta.client(t).Get(ta.Server.URL + "/ticket/made-up?conf=conf-atx25&type=speaker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := readBody(t, resp); resp.StatusCode != http.StatusNotFound || strings.Contains(body, "data:image/png") {
+		t.Fatalf("expected no QR code for a made up ticket, got %d", resp.StatusCode)
+	}
+}
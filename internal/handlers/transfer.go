@@ -0,0 +1,117 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/base58btc/btcpp-web/external/getters"
+	"github.com/base58btc/btcpp-web/internal/config"
+	"github.com/base58btc/btcpp-web/internal/types"
+	"github.com/gorilla/mux"
+)
+
+/* Can't make it? The ticket mail links to /transfer/{ticket},
+ * where whoever has it can hand it on. The old ticket (and its
+ * QR code) is voided and a new one's mailed to the new holder */
+
+type TransferPage struct {
+	Conf *types.Conf
+	Rez  *types.Registration
+	/* Set once it's gone, to whom */
+	Gone string
+	Err  string
+}
+
+func ticketTransferLink(ctx *config.AppContext, ticket string) string {
+	return fmt.Sprintf("%s/transfer/%s?s=%s", ctx.Env.GetURI(), url.PathEscape(ticket), linkSig(ctx, "transfer", ticket))
+}
+
+func transferTicket(ctx *config.AppContext, rez *types.Registration, to *types.Attendee) (*types.Registration, error) {
+	if !rez.Voided.IsZero() {
+		return nil, fmt.Errorf("This ticket isn't valid anymore")
+	}
+	if !rez.CheckedIn.IsZero() {
+		return nil, fmt.Errorf("This ticket's already been checked in")
+	}
+	if strings.EqualFold(to.Email, rez.MailTo()) {
+		return nil, fmt.Errorf("That's who has it now")
+	}
+
+	xfer := &types.Transfer{
+		At:      time.Now().UTC(),
+		From:    rez.MailTo(),
+		To:      to.Email,
+		FromRef: rez.RefID,
+		ToRef:   getters.UniqueID(to.Email, rez.RefID, int32(len(rez.Transfers))),
+	}
+	if err := ctx.Store.TransferTicket(xfer, to); err != nil {
+		return nil, err
+	}
+	ctx.Infos.Printf("Ticket %s transferred from %s to %s, now %s", xfer.FromRef, xfer.From, xfer.To, xfer.ToRef)
+	dropMails(ctx, map[string]bool{rez.RefID: true}, "ticket transferred")
+
+	issued := *rez
+	issued.RefID = xfer.ToRef
+	issued.Attendee = *to
+	issued.Transfers = append(append([]types.Transfer{}, rez.Transfers...), *xfer)
+	issued.Voided = time.Time{}
+	issued.VoidedBy = ""
+	return &issued, nil
+}
+
+func TransferForm(w http.ResponseWriter, r *http.Request, ctx *config.AppContext) {
+	ticket := mux.Vars(r)["ticket"]
+	if !linkSigOk(ctx, "transfer", ticket, r.URL.Query().Get("s")) {
+		http.NotFound(w, r)
+		return
+	}
+
+	rez, err := findRegistration(ctx, ticket)
+	if err != nil {
+		http.Error(w, "Unable to load page, please try again later", http.StatusInternalServerError)
+		ctx.Err.Printf("/transfer/%s unable to load ticket: %s", ticket, err)
+		return
+	}
+	if rez == nil {
+		http.NotFound(w, r)
+		return
+	}
+	conf := findConfByRef(ctx, rez.ConfRef)
+	if conf == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	page := &TransferPage{Conf: conf, Rez: rez, Gone: rez.TransferredTo()}
+	if page.Gone == "" && !rez.Voided.IsZero() {
+		http.NotFound(w, r)
+		return
+	}
+
+	if r.Method == http.MethodPost && page.Gone == "" {
+		r.ParseForm()
+		to, err := attendeeForm(r, "")
+		if err == nil {
+			var issued *types.Registration
+			issued, err = transferTicket(ctx, rez, to)
+			if err == nil {
+				if err := mailTicketNow(ctx, issued); err != nil {
+					ctx.Err.Printf("Unable to mail transferred ticket %s to %s, it'll be retried: %s", issued.RefID, to.Email, err)
+				}
+				http.Redirect(w, r, r.URL.Path+"?s="+r.URL.Query().Get("s"), http.StatusSeeOther)
+				return
+			}
+		}
+		page.Err = err.Error()
+		w.WriteHeader(http.StatusBadRequest)
+	}
+
+	err = ctx.Template("transfer.tmpl").ExecuteTemplate(w, "transfer.tmpl", page)
+	if err != nil {
+		http.Error(w, "Unable to load page, please try again later", http.StatusInternalServerError)
+		ctx.Err.Printf("/transfer/%s ExecuteTemplate failed ! %s", ticket, err.Error())
+	}
+}
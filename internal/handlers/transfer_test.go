@@ -0,0 +1,131 @@
+package handlers
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/base58btc/btcpp-web/external/getters"
+	"github.com/base58btc/btcpp-web/internal/types"
+)
+
+func TestTransferTicket(t *testing.T) {
+	ta := newTestApp(t)
+	alice := "alice@example.com"
+	err := ta.Store.AddTickets(&types.Entry{
+		ID:       "cs_solo",
+		ConfRef:  "conf-atx25",
+		Currency: "usd",
+		Created:  time.Now(),
+		Email:    alice,
+		Items:    []types.Item{{Total: 10000, Desc: "atx25 ticket", Type: "genpop", TixID: "tix-atx25-early"}},
+	}, "stripe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ticket := getters.UniqueID(alice, "cs_solo", 0)
+
+	CheckForNewMails(ta.AppContext)
+	mails := ta.Mailer.Mails()
+	link := ticketTransferLink(ta.AppContext, ticket)
+	if len(mails) != 1 || !strings.Contains(mails[0].TextBody, link) {
+		t.Fatalf("expected a ticket mail with a transfer link, got %d", len(mails))
+	}
+	transferURL := ta.Server.URL + strings.TrimPrefix(link, ta.Env.GetURI())
+
+	client := noRedirects(ta.client(t))
+	resp, err := client.PostForm(ta.Server.URL+"/transfer/"+ticket+"?s=nope", url.Values{"name": {"Eve"}, "email": {"eve@example.com"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	readBody(t, resp)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected a bad link to 404, got %d", resp.StatusCode)
+	}
+	resp, err = client.PostForm(transferURL, url.Values{"name": {"Alice"}, "email": {"Alice@example.com"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	readBody(t, resp)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected transfer to themselves to be refused, got %d", resp.StatusCode)
+	}
+
+	resp, err = client.PostForm(transferURL, url.Values{"name": {"Bob"}, "email": {"bob@example.com"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	readBody(t, resp)
+	if resp.StatusCode != http.StatusSeeOther {
+		t.Fatalf("expected transfer to go through, got %d", resp.StatusCode)
+	}
+
+	rezzies, err := ta.Store.ListRegistrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var old, issued *types.Registration
+	for _, rez := range rezzies {
+		if rez.RefID == ticket {
+			old = rez
+		} else {
+			issued = rez
+		}
+	}
+	if len(rezzies) != 2 || old == nil || issued == nil {
+		t.Fatalf("expected the old ticket and a new one, got %+v", rezzies)
+	}
+	if old.Voided.IsZero() || old.VoidedBy != types.VoidedByTransfer || old.TransferredTo() != "bob@example.com" {
+		t.Fatalf("old ticket not voided right: %+v", old)
+	}
+	if issued.TransferredFrom() != ticket || issued.MailTo() != "bob@example.com" || issued.Attendee.Name != "Bob" ||
+		issued.LookupID != "cs_solo" || issued.AmountPaid != 10000 || issued.TixID != "tix-atx25-early" || !issued.Voided.IsZero() {
+		t.Fatalf("new ticket not issued right: %+v", issued)
+	}
+	xfer := issued.Transfers[0]
+	if len(issued.Transfers) != 1 || xfer.From != alice || xfer.To != "bob@example.com" || xfer.ToRef != issued.RefID {
+		t.Fatalf("transfer not recorded right: %+v", issued.Transfers)
+	}
+	sold, err := ta.Store.SoldTixCount("conf-atx25")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sold != 1 {
+		t.Fatalf("expected still 1 sold, got %d", sold)
+	}
+
+	/* Bob gets his ticket right away, and only once */
+	CheckForNewMails(ta.AppContext)
+	mails = ta.Mailer.Mails()
+	if len(mails) != 2 || mails[1].ToAddr != "bob@example.com" || mails[1].JobKey != "btcpp-"+issued.RefID || len(mails[1].Attachments) != 1 {
+		t.Fatalf("expected the new ticket mailed to bob, got %d", len(mails))
+	}
+
+	resp, err = client.Get(transferURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := readBody(t, resp); !strings.Contains(body, "now belongs to bob@example.com") {
+		t.Fatalf("expected the old link to say where it went: %s", body)
+	}
+
+	/* The old QR code is no good, the new one is */
+	door := ta.client(t)
+	resp, err = door.PostForm(ta.scanURL(t, old), loginForm("door"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := readBody(t, resp); resp.StatusCode != http.StatusForbidden || !strings.Contains(body, "transferred") {
+		t.Fatalf("expected the old ticket to be turned away, got %d", resp.StatusCode)
+	}
+	resp, err = door.Get(ta.scanURL(t, issued))
+	if err != nil {
+		t.Fatal(err)
+	}
+	readBody(t, resp)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected the new ticket to check in, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,446 @@
+package handlers
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/base58btc/btcpp-web/external/getters"
+	"github.com/base58btc/btcpp-web/internal/config"
+	"github.com/base58btc/btcpp-web/internal/types"
+	mailer "github.com/base58btc/mailer/mail"
+	"github.com/gorilla/mux"
+)
+
+/* Sold out? /conf/{tag}/waitlist takes their email, for the
+ * conf or one tier of it. Whenever a ticket opens up (a
+ * cancellation, a bigger Max, a checkout that ran out) the
+ * mailer job holds it for the next one in line and mails them
+ * a signed link to it. Whoever doesn't use theirs in time
+ * loses their place to the next */
+
+const (
+	waitlistInviteTTL = 24 * time.Hour
+	/* Joins, per IP and per email. Each invite holds a real
+	 * ticket, so the line can't be stuffed */
+	waitlistIPLimit    = 5
+	waitlistEmailLimit = 3
+	waitlistWindow     = time.Hour
+)
+
+var (
+	waitlistByIP    = newRateLimiter(waitlistIPLimit, waitlistWindow)
+	waitlistByEmail = newRateLimiter(waitlistEmailLimit, waitlistWindow)
+)
+
+type WaitlistPage struct {
+	Conf  *types.Conf
+	Tiers []*types.ConfTicket
+	/* Where they are in line, once they've joined */
+	Place int
+	Err   string
+}
+
+type WaitlistTmpl struct {
+	URI     string
+	Conf    string
+	Tier    string
+	Link    string
+	Expires string
+}
+
+func waitlistLink(ctx *config.AppContext, entry *types.WaitlistEntry) string {
+	exp := strconv.FormatInt(entry.Expires.Unix(), 10)
+	return fmt.Sprintf("%s/waitlist/%s?e=%s&s=%s", ctx.Env.GetURI(), url.PathEscape(entry.Ref), exp, linkSig(ctx, "waitlist", entry.Ref+"\n"+exp))
+}
+
+/* Where an invite's hold rides along, till they check out */
+func waitlistKey(confRef string) string {
+	return "waitlist:" + confRef
+}
+
+/* The hold from their waitlist invite, if they've got one */
+func sessionInvite(r *http.Request, ctx *config.AppContext, confRef string) *types.Hold {
+	ref := ctx.Session.GetString(r.Context(), waitlistKey(confRef))
+	if ref == "" {
+		return nil
+	}
+	hold, err := getters.FindHoldByRef(ctx.Store, ref)
+	if err != nil {
+		ctx.Err.Printf("Unable to find waitlist hold %s: %s", ref, err)
+		return nil
+	}
+	if hold == nil || hold.ConfRef != confRef || !hold.Active(time.Now()) {
+		return nil
+	}
+	return hold
+}
+
+/* What's taken, less whatever's being held for them */
+func tixTakenBy(r *http.Request, ctx *config.AppContext, confRef string) (uint, error) {
+	taken, err := tixTaken(ctx, confRef)
+	if err != nil {
+		return 0, err
+	}
+	if invite := sessionInvite(r, ctx, confRef); invite != nil && invite.Count <= taken {
+		taken -= invite.Count
+	}
+	return taken, nil
+}
+
+/* Tiers still on sale by date, sold out or not */
+func waitlistTiers(conf *types.Conf) []*types.ConfTicket {
+	now := time.Now()
+	var tiers []*types.ConfTicket
+	for _, tix := range conf.Tickets {
+		if tix.Expires != nil && tix.Expires.Start.After(now) {
+			tiers = append(tiers, tix)
+		}
+	}
+	sorted := types.ConfTickets(tiers)
+	sort.Stable(&sorted)
+	return sorted
+}
+
+func sortedWaitlist(ctx *config.AppContext) ([]*types.WaitlistEntry, error) {
+	entries, err := ctx.Store.ListWaitlist()
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Created.Before(entries[j].Created)
+	})
+	return entries, nil
+}
+
+func renderWaitlist(w http.ResponseWriter, ctx *config.AppContext, page *WaitlistPage) {
+	err := ctx.Template("waitlist.tmpl").ExecuteTemplate(w, "waitlist.tmpl", page)
+	if err != nil {
+		http.Error(w, "Unable to load page, please try again later", http.StatusInternalServerError)
+		ctx.Err.Printf("/waitlist ExecuteTemplate failed ! %s", err.Error())
+	}
+}
+
+func JoinWaitlist(w http.ResponseWriter, r *http.Request, ctx *config.AppContext) {
+	conf, err := findConf(r, ctx)
+	if err != nil || !conf.Active {
+		http.NotFound(w, r)
+		return
+	}
+
+	page := &WaitlistPage{Conf: conf, Tiers: waitlistTiers(conf)}
+	if r.Method != http.MethodPost {
+		renderWaitlist(w, ctx, page)
+		return
+	}
+
+	r.ParseForm()
+	email := strings.ToLower(strings.TrimSpace(r.PostForm.Get("email")))
+	tixID := r.PostForm.Get("tier")
+	if !strings.Contains(email, "@") {
+		page.Err = fmt.Sprintf("%q doesn't look like an email", email)
+	} else if tix, _ := findTicket(ctx, tixID); tixID != "" && (tix == nil || tix.ConfRef != conf.Ref) {
+		page.Err = "That's not a ticket we have"
+	}
+	if page.Err != "" {
+		w.WriteHeader(http.StatusBadRequest)
+		renderWaitlist(w, ctx, page)
+		return
+	}
+	if !waitlistByIP.Allow(clientIP(ctx, r)) || !waitlistByEmail.Allow(email) {
+		ctx.Infos.Printf("/conf/%s/waitlist too many joins for %s", conf.Tag, email)
+		page.Err = "That's a lot of tries. Give it a few minutes and try again"
+		w.WriteHeader(http.StatusTooManyRequests)
+		renderWaitlist(w, ctx, page)
+		return
+	}
+
+	entries, err := sortedWaitlist(ctx)
+	if err != nil {
+		http.Error(w, "Unable to load page, please try again later", http.StatusInternalServerError)
+		ctx.Err.Printf("/conf/%s/waitlist unable to load waitlist: %s", conf.Tag, err)
+		return
+	}
+
+	/* Joining twice doesn't lose them their place, nor get them
+	 * a second one. Waiting on the whole conf covers any tier */
+	var joined bool
+	for _, entry := range entries {
+		if entry.ConfRef != conf.Ref || (entry.Status != types.WaitWaiting && entry.Status != types.WaitInvited) {
+			continue
+		}
+		page.Place++
+		if strings.EqualFold(entry.Email, email) && (entry.TixID == tixID || entry.TixID == "" || tixID == "") {
+			joined = true
+			break
+		}
+	}
+	if !joined {
+		now := time.Now().UTC()
+		err = ctx.Store.AddWaitlist(&types.WaitlistEntry{
+			ConfRef: conf.Ref,
+			TixID:   tixID,
+			Email:   email,
+			Status:  types.WaitWaiting,
+			Updated: now,
+		})
+		if err != nil {
+			http.Error(w, "Unable to load page, please try again later", http.StatusInternalServerError)
+			ctx.Err.Printf("/conf/%s/waitlist unable to add %s: %s", conf.Tag, email, err)
+			return
+		}
+		page.Place++
+		ctx.Infos.Printf("%s joined the %s waitlist, #%d", email, conf.Tag, page.Place)
+	}
+	renderWaitlist(w, ctx, page)
+}
+
+/* The link in their invite. Sends them to the cart, with
+ * their held ticket in their session */
+func WaitlistInvite(w http.ResponseWriter, r *http.Request, ctx *config.AppContext) {
+	ref := mux.Vars(r)["ref"]
+	exp := r.URL.Query().Get("e")
+	if !linkSigOk(ctx, "waitlist", ref+"\n"+exp, r.URL.Query().Get("s")) {
+		http.NotFound(w, r)
+		return
+	}
+
+	entries, err := ctx.Store.ListWaitlist()
+	if err != nil {
+		http.Error(w, "Unable to load page, please try again later", http.StatusInternalServerError)
+		ctx.Err.Printf("/waitlist/%s unable to load waitlist: %s", ref, err)
+		return
+	}
+	var entry *types.WaitlistEntry
+	for _, e := range entries {
+		if e.Ref == ref {
+			entry = e
+		}
+	}
+	if entry == nil {
+		http.NotFound(w, r)
+		return
+	}
+	conf := findConfByRef(ctx, entry.ConfRef)
+	if conf == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	expires, _ := strconv.ParseInt(exp, 10, 64)
+	if !entry.InviteOpen(time.Now()) || entry.Expires.Unix() != expires {
+		w.WriteHeader(http.StatusGone)
+		renderWaitlist(w, ctx, &WaitlistPage{
+			Conf:  conf,
+			Tiers: waitlistTiers(conf),
+			Err:   "Sorry, that invite's run out. Join again and we'll let you know if another ticket opens up",
+		})
+		return
+	}
+
+	ctx.Session.Put(r.Context(), waitlistKey(conf.Ref), entry.HoldRef)
+	http.Redirect(w, r, "/conf/"+conf.Tag+"/cart", http.StatusSeeOther)
+}
+
+/* Holds a ticket for them and queues their invite. False if
+ * there's nothing for them yet */
+func inviteNext(ctx *config.AppContext, conf *types.Conf, entry *types.WaitlistEntry) (bool, error) {
+	var tix *types.ConfTicket
+	if entry.TixID == "" {
+		taken, err := tixTaken(ctx, conf.Ref)
+		if err != nil {
+			return false, err
+		}
+		tix = findCurrTix(conf, taken)
+	} else {
+		for _, t := range waitlistTiers(conf) {
+			if t.ID == entry.TixID {
+				tix = t
+			}
+		}
+	}
+	if tix == nil {
+		return false, nil
+	}
+
+	now := time.Now().UTC()
+	order := &types.Order{
+		ID:       entry.Ref,
+		Provider: "waitlist",
+		ConfRef:  conf.Ref,
+		ConfTag:  conf.Tag,
+		Items:    []types.Item{{TixID: tix.ID, Type: "genpop"}},
+		Expires:  now.Add(waitlistInviteTTL),
+	}
+	hold, soldOut, err := holdTickets(ctx, order, nil)
+	if err != nil || soldOut != nil {
+		return false, err
+	}
+
+	invited := *entry
+	invited.Status = types.WaitInvited
+	invited.HoldRef = hold.Ref
+	invited.Invited = now
+	invited.Expires = hold.Expires
+	invited.Updated = now
+	if err = ctx.Store.UpdateWaitlist(&invited); err != nil {
+		setHold(ctx, hold, types.HoldReleased)
+		return false, err
+	}
+
+	err = ctx.Store.AddOutbox(&types.OutboxMail{
+		JobKey:  fmt.Sprintf("waitlist-%s-%d", entry.Ref, now.Unix()),
+		RefID:   entry.Ref,
+		ConfRef: conf.Ref,
+		Type:    types.MailWaitlist,
+		Email:   entry.Email,
+		Status:  types.MailPending,
+		Created: now,
+		Updated: now,
+	})
+	if err != nil {
+		/* They're invited either way; the link's in the admin */
+		ctx.Err.Printf("Unable to queue waitlist invite for %s: %s", entry.Email, err)
+	}
+	ctx.Infos.Printf("Invited %s off the %s waitlist, held until %s", entry.Email, conf.Tag, hold.Expires.Format(time.RFC3339))
+	return true, nil
+}
+
+/* Lapses invites that ran out, then invites whoever's next
+ * for every ticket that's opened up. Run by the mailer job */
+func CheckWaitlist(ctx *config.AppContext) {
+	entries, err := sortedWaitlist(ctx)
+	if err != nil {
+		ctx.Err.Printf("Unable to load waitlist: %s", err)
+		return
+	}
+
+	now := time.Now().UTC()
+	for _, entry := range entries {
+		if entry.Status != types.WaitInvited || entry.InviteOpen(now) {
+			continue
+		}
+		lapsed := *entry
+		lapsed.Status = types.WaitLapsed
+		lapsed.Updated = now
+		if err = ctx.Store.UpdateWaitlist(&lapsed); err != nil {
+			ctx.Err.Printf("Unable to lapse waitlist invite for %s: %s", entry.Email, err)
+		}
+	}
+
+	/* Once one's full, everyone behind them waits too */
+	full := make(map[string]bool)
+	var invited int
+	for _, entry := range entries {
+		key := entry.ConfRef + "/" + entry.TixID
+		if entry.Status != types.WaitWaiting || full[key] {
+			continue
+		}
+		conf := findConfByRef(ctx, entry.ConfRef)
+		if conf == nil || !conf.Active {
+			continue
+		}
+		ok, err := inviteNext(ctx, conf, entry)
+		if err != nil {
+			ctx.Err.Printf("Unable to invite %s off the %s waitlist: %s", entry.Email, conf.Tag, err)
+		}
+		if !ok {
+			full[key] = true
+			continue
+		}
+		invited++
+	}
+	if invited > 0 {
+		ctx.Infos.Printf("Invited %d off the waitlist", invited)
+	}
+}
+
+/* They bought in, invited or not; any ticket still held
+ * for them can go to the next in line */
+func waitlistBought(ctx *config.AppContext, order *types.Order) {
+	entries, err := ctx.Store.ListWaitlist()
+	if err != nil {
+		ctx.Err.Printf("Unable to load waitlist for %s: %s", order.ID, err)
+		return
+	}
+
+	now := time.Now().UTC()
+	for _, entry := range entries {
+		if entry.ConfRef != order.ConfRef || !strings.EqualFold(entry.Email, order.Email) {
+			continue
+		}
+		if entry.Status != types.WaitWaiting && entry.Status != types.WaitInvited {
+			continue
+		}
+		if entry.HoldRef != "" {
+			finishHold(ctx, "waitlist", entry.Ref, types.HoldReleased)
+		}
+		bought := *entry
+		bought.Status = types.WaitBought
+		bought.Updated = now
+		if err = ctx.Store.UpdateWaitlist(&bought); err != nil {
+			ctx.Err.Printf("Unable to mark %s bought on the waitlist: %s", entry.Email, err)
+		}
+	}
+}
+
+/* The invite; mail.RefID is the waitlist entry */
+func SendWaitlistMail(ctx *config.AppContext, mail *types.OutboxMail) error {
+	conf := findConfByRef(ctx, mail.ConfRef)
+	if conf == nil {
+		return fmt.Errorf("No conference found for ref %s", mail.ConfRef)
+	}
+	entries, err := ctx.Store.ListWaitlist()
+	if err != nil {
+		return err
+	}
+	var entry *types.WaitlistEntry
+	for _, e := range entries {
+		if e.Ref == mail.RefID {
+			entry = e
+		}
+	}
+	/* Bought, or ran out, before we got to it */
+	if entry == nil || !entry.InviteOpen(time.Now()) {
+		ctx.Infos.Printf("Waitlist invite %s isn't open anymore, not sending", mail.JobKey)
+		return nil
+	}
+
+	data := &WaitlistTmpl{
+		URI:     ctx.Env.GetURI(),
+		Conf:    conf.Desc,
+		Link:    waitlistLink(ctx, entry),
+		Expires: entry.Expires.UTC().Format("Mon Jan 2, 3:04pm MST"),
+	}
+	if tix, _ := findTicket(ctx, entry.TixID); tix != nil {
+		data.Tier = tix.Tier
+	}
+	var htmlBody, textBody bytes.Buffer
+	if err := ctx.Template("email-html-waitlist").Execute(&htmlBody, data); err != nil {
+		return err
+	}
+	if err := ctx.TextTemplate("email-text-waitlist").Execute(&textBody, data); err != nil {
+		return err
+	}
+
+	if !ctx.Env.Prod {
+		ctx.Infos.Printf("About to send waitlist invite to %s, but desisting, not prod!\n", mail.Email)
+		return nil
+	}
+
+	return SendMailRequest(ctx, &mailer.MailRequest{
+		JobKey:   "btcpp-" + mail.JobKey,
+		ToAddr:   mail.Email,
+		FromAddr: "hello@btcpp.dev",
+		FromName: "bitcoin++ ✨",
+		Title:    fmt.Sprintf("[%s] A ticket's opened up for you", conf.Desc),
+		HTMLBody: htmlBody.String(),
+		TextBody: textBody.String(),
+		SendAt:   float64(time.Now().UTC().Unix()),
+	})
+}
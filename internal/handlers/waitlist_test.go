@@ -0,0 +1,227 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/base58btc/btcpp-web/internal/types"
+)
+
+func TestWaitlist(t *testing.T) {
+	ta := newTestApp(t)
+	waitlistByIP = newRateLimiter(waitlistIPLimit, waitlistWindow)
+	waitlistByEmail = newRateLimiter(waitlistEmailLimit, waitlistWindow)
+	fake := &fakeProvider{orders: make(map[string]*types.Order)}
+	ta.Payments = map[string]types.PaymentProvider{"fake": fake}
+	ta.Env.Payments.Fiat = "fake"
+
+	/* One ticket left, in any tier */
+	sold, err := ta.Store.SoldTixCount("conf-atx25")
+	if err != nil {
+		t.Fatal(err)
+	}
+	early, _ := findTicket(ta.AppContext, "tix-atx25-early")
+	late, _ := findTicket(ta.AppContext, "tix-atx25-late")
+	early.Max, late.Max = sold+1, sold+1
+
+	get := func(client *http.Client, path string) (*http.Response, string) {
+		resp, err := client.Get(ta.Server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp, readBody(t, resp)
+	}
+	join := func(email string) string {
+		resp, err := http.PostForm(ta.Server.URL+"/conf/atx25/waitlist", url.Values{"email": {email}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		body := readBody(t, resp)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected %s to join, got %d", email, resp.StatusCode)
+		}
+		return body
+	}
+	inviteMail := func(email string) string {
+		for _, mail := range ta.Mailer.Mails() {
+			if mail.ToAddr == email && strings.Contains(mail.JobKey, "waitlist") {
+				start := strings.Index(mail.TextBody, ta.Env.GetURI()+"/waitlist/")
+				return ta.Server.URL + strings.TrimPrefix(strings.Fields(mail.TextBody[start:])[0], ta.Env.GetURI())
+			}
+		}
+		return ""
+	}
+
+	/* Someone's checking out with the last one */
+	someone := noRedirects(ta.client(t))
+	if loc := checkoutCart(t, ta, someone, "tix-atx25-early+default+fiat"); loc != "https://pay.example.com/fake_0" {
+		t.Fatalf("expected a checkout, got %s", loc)
+	}
+	_, body := get(someone, "/conf/atx25")
+	if !strings.Contains(body, "/conf/atx25/waitlist") {
+		t.Fatalf("expected a sold out conf page to link the waitlist")
+	}
+
+	if body = join("bob@example.com"); !strings.Contains(body, "#1 in line") {
+		t.Fatalf("expected bob first in line")
+	}
+	if body = join("carol@example.com"); !strings.Contains(body, "#2 in line") {
+		t.Fatalf("expected carol second in line")
+	}
+	if body = join("bob@example.com"); !strings.Contains(body, "#1 in line") {
+		t.Fatalf("expected joining twice to keep bob's place")
+	}
+
+	CheckWaitlist(ta.AppContext)
+	CheckForNewMails(ta.AppContext)
+	if len(ta.Mailer.Mails()) != 0 {
+		t.Fatalf("expected nobody invited while it's held")
+	}
+
+	/* They back out; the ticket goes to bob, not the public */
+	get(someone, strings.TrimPrefix(fake.orders["fake_0"].CancelURL, ta.Env.GetURI()))
+	CheckWaitlist(ta.AppContext)
+	CheckForNewMails(ta.AppContext)
+	link := inviteMail("bob@example.com")
+	if link == "" || len(ta.Mailer.Mails()) != 1 {
+		t.Fatalf("expected just bob to be invited, got %d mails", len(ta.Mailer.Mails()))
+	}
+	if loc := checkoutCart(t, ta, someone, "tix-atx25-early+default+fiat"); loc != "/conf/atx25/cart" {
+		t.Fatalf("expected bob's ticket to be held from the public, got %s", loc)
+	}
+
+	bob := noRedirects(ta.client(t))
+	resp, _ := get(bob, strings.Replace(strings.TrimPrefix(link, ta.Server.URL), "s=", "s=00", 1))
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected a bad invite link to 404, got %d", resp.StatusCode)
+	}
+	resp, _ = get(bob, strings.TrimPrefix(link, ta.Server.URL))
+	if resp.StatusCode != http.StatusSeeOther || resp.Header.Get("Location") != "/conf/atx25/cart" {
+		t.Fatalf("expected the invite to go to the cart, got %d %s", resp.StatusCode, resp.Header.Get("Location"))
+	}
+	if _, body = get(bob, "/conf/atx25/cart"); !strings.Contains(body, "qty-tix-atx25-early") {
+		t.Fatalf("expected bob to see his held ticket in the cart")
+	}
+	if loc := checkoutCart(t, ta, bob, "tix-atx25-early+default+fiat"); loc != "https://pay.example.com/fake_1" {
+		t.Fatalf("expected bob to check out, got %s", loc)
+	}
+	resp, err = bob.PostForm(ta.Server.URL+"/callback/fake", url.Values{"id": {"fake_1"}, "sig": {"ok"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	readBody(t, resp)
+	if n, _ := tixTaken(ta.AppContext, "conf-atx25"); n != sold+1 {
+		t.Fatalf("expected bob's ticket to be the only one taken, got %d of %d", n, sold)
+	}
+
+	/* A bigger Max opens one up for carol, who lets it lapse */
+	early.Max, late.Max = sold+2, sold+2
+	CheckWaitlist(ta.AppContext)
+	CheckForNewMails(ta.AppContext)
+	link = inviteMail("carol@example.com")
+	if link == "" {
+		t.Fatalf("expected carol to be invited")
+	}
+	entries, err := ta.Store.ListWaitlist()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if entry.Email == "carol@example.com" {
+			lapsed := *entry
+			lapsed.Expires = time.Now().Add(-time.Minute)
+			if err = ta.Store.UpdateWaitlist(&lapsed); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	CheckWaitlist(ta.AppContext)
+	resp, _ = get(noRedirects(ta.client(t)), strings.TrimPrefix(link, ta.Server.URL))
+	if resp.StatusCode != http.StatusGone {
+		t.Fatalf("expected a lapsed invite to be gone, got %d", resp.StatusCode)
+	}
+
+	conf := findConfByRef(ta.AppContext, "conf-atx25")
+	stats, err := loadAdminConfs(ta.AppContext, []*types.Conf{conf})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wl := stats[0].Waitlist
+	if wl.Converted != 1 || wl.Lapsed != 1 || wl.Waiting != 0 || wl.Conversion() != "50%" {
+		t.Fatalf("unexpected waitlist stats: %+v", wl)
+	}
+}
+
+func TestWaitlistJoinOnce(t *testing.T) {
+	ta := newTestApp(t)
+	waitlistByIP = newRateLimiter(waitlistIPLimit, waitlistWindow)
+	waitlistByEmail = newRateLimiter(waitlistEmailLimit, waitlistWindow)
+
+	join := func(email, tier string) (int, string) {
+		resp, err := http.PostForm(ta.Server.URL+"/conf/atx25/waitlist", url.Values{"email": {email}, "tier": {tier}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		body := readBody(t, resp)
+		return resp.StatusCode, body
+	}
+
+	/* Once for the conf, then again for a tier, however it's typed */
+	if status, body := join("dan@example.com", ""); status != http.StatusOK || !strings.Contains(body, "#1 in line") {
+		t.Fatalf("expected dan to join, got %d", status)
+	}
+	if status, body := join(" Dan@Example.com", "tix-atx25-early"); status != http.StatusOK || !strings.Contains(body, "#1 in line") {
+		t.Fatalf("expected dan to keep his place, got %d", status)
+	}
+	entries, err := ta.Store.ListWaitlist()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expected dan in line once, got %d entries", len(entries))
+	}
+
+	/* Nor can one address be signed up over and over */
+	if status, _ := join("dan@example.com", "tix-atx25-late"); status != http.StatusOK {
+		t.Fatalf("expected a third try through, got %d", status)
+	}
+	if status, _ := join("dan@example.com", "tix-atx25-late"); status != http.StatusTooManyRequests {
+		t.Fatalf("expected dan to be rate limited, got %d", status)
+	}
+
+	/* Nor one client fill the line with made up ones */
+	for i := 0; ; i++ {
+		status, _ := join(fmt.Sprintf("junk%d@example.com", i), "")
+		if status == http.StatusTooManyRequests {
+			break
+		}
+		if i > waitlistIPLimit {
+			t.Fatalf("expected joins to be rate limited")
+		}
+	}
+	if entries, _ = ta.Store.ListWaitlist(); len(entries) > waitlistIPLimit {
+		t.Fatalf("expected at most %d in line, got %d", waitlistIPLimit, len(entries))
+	}
+}
+
+func TestWaitlistTiers(t *testing.T) {
+	soon := &types.Times{Start: time.Now().Add(time.Hour)}
+	later := &types.Times{Start: time.Now().Add(48 * time.Hour)}
+	past := &types.Times{Start: time.Now().Add(-time.Hour)}
+	conf := &types.Conf{Tickets: []*types.ConfTicket{
+		{ID: "tix-late", Max: 10, Expires: later},
+		{ID: "tix-door", Max: 100},
+		{ID: "tix-gone", Max: 10, Expires: past},
+		{ID: "tix-early", Max: 10, Expires: soon},
+	}}
+
+	/* Only the dated tiers still on sale, soonest first */
+	tiers := waitlistTiers(conf)
+	if len(tiers) != 2 || tiers[0].ID != "tix-early" || tiers[1].ID != "tix-late" {
+		t.Fatalf("expected the early then late tiers, got %d", len(tiers))
+	}
+}
@@ -0,0 +1,181 @@
+package notiontest
+
+import (
+	"strings"
+
+	"github.com/sorcererxw/go-notion"
+)
+
+/* The go-notion filter structs use omitempty everywhere, so
+ * a zero value means "not set". We follow suit. */
+func matchFilter(f *notion.Filter, page *notion.Page) bool {
+	if f == nil {
+		return true
+	}
+
+	if len(f.And) > 0 {
+		for _, sub := range f.And {
+			if !matchFilter(sub, page) {
+				return false
+			}
+		}
+		return true
+	}
+
+	if len(f.Or) > 0 {
+		for _, sub := range f.Or {
+			if matchFilter(sub, page) {
+				return true
+			}
+		}
+		return false
+	}
+
+	prop := page.Properties[f.Property]
+	switch {
+	case f.Text != nil:
+		return matchText(f.Text, textOf(prop))
+	case f.Number != nil:
+		return matchNumber(f.Number, prop.Number)
+	case f.Checkbox != nil:
+		if f.Checkbox.DoesNotEqual {
+			return !prop.Checkbox
+		}
+		return prop.Checkbox == f.Checkbox.Equals
+	case f.Select != nil:
+		return matchSelect(f.Select, prop.Select)
+	case f.Relation != nil:
+		return matchRelation(f.Relation, prop.Relation)
+	case f.Date != nil:
+		return matchDate(f.Date, prop.Date)
+	}
+
+	/* Filters we don't know about match everything */
+	return true
+}
+
+func textOf(prop notion.PropertyValue) string {
+	var b strings.Builder
+	for _, rt := range append(prop.Title, prop.RichText...) {
+		if rt == nil {
+			continue
+		}
+		if rt.Text != nil {
+			b.WriteString(rt.Text.Content)
+		} else {
+			b.WriteString(rt.PlainText)
+		}
+	}
+	b.WriteString(prop.Email)
+	b.WriteString(prop.URL)
+	b.WriteString(prop.PhoneNumber)
+	return b.String()
+}
+
+func matchText(c *notion.TextFilterCondition, val string) bool {
+	switch {
+	case c.Equals != "":
+		return val == c.Equals
+	case c.DoesNotEqual != "":
+		return val != c.DoesNotEqual
+	case c.Contains != "":
+		return strings.Contains(val, c.Contains)
+	case c.DoesNotContain != "":
+		return !strings.Contains(val, c.DoesNotContain)
+	case c.StartsWith != "":
+		return strings.HasPrefix(val, c.StartsWith)
+	case c.EndsWith != "":
+		return strings.HasSuffix(val, c.EndsWith)
+	case c.IsEmpty:
+		return val == ""
+	case c.IsNotEmpty:
+		return val != ""
+	}
+	return true
+}
+
+func matchNumber(c *notion.NumberFilterCondition, val float64) bool {
+	switch {
+	case c.Equals != 0:
+		return val == c.Equals
+	case c.DoesNotEqual != 0:
+		return val != c.DoesNotEqual
+	case c.GreaterThan != 0:
+		return val > c.GreaterThan
+	case c.LessThan != 0:
+		return val < c.LessThan
+	case c.GreaterThanOrEqualTo != 0:
+		return val >= c.GreaterThanOrEqualTo
+	case c.LessThanOrEqualTo != 0:
+		return val <= c.LessThanOrEqualTo
+	case c.IsEmpty:
+		return val == 0
+	case c.IsNotEmpty:
+		return val != 0
+	}
+	return true
+}
+
+func matchSelect(c *notion.SelectFilterCondition, opt *notion.SelectOption) bool {
+	name := ""
+	if opt != nil {
+		name = opt.Name
+	}
+	switch {
+	case c.Equals != "":
+		return name == c.Equals
+	case c.DoesNotEqual != "":
+		return name != c.DoesNotEqual
+	case c.IsEmpty:
+		return name == ""
+	case c.IsNotEmpty:
+		return name != ""
+	}
+	return true
+}
+
+func hasRelation(rels []*notion.ObjectReference, id string) bool {
+	for _, rel := range rels {
+		if rel != nil && rel.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+func matchRelation(c *notion.RelationFilterCondition, rels []*notion.ObjectReference) bool {
+	switch {
+	case c.Contains != "":
+		return hasRelation(rels, c.Contains)
+	case c.DoesNotContain != "":
+		return !hasRelation(rels, c.DoesNotContain)
+	case c.IsEmpty:
+		return len(rels) == 0
+	case c.IsNotEmpty:
+		return len(rels) != 0
+	}
+	return true
+}
+
+func matchDate(c *notion.DateFilterCondition, date *notion.Date) bool {
+	if c.IsEmpty {
+		return date == nil
+	}
+	if date == nil {
+		return false
+	}
+
+	switch {
+	case c.Equals != nil:
+		return date.Start.Equal(*c.Equals)
+	case c.Before != nil:
+		return date.Start.Before(*c.Before)
+	case c.After != nil:
+		return date.Start.After(*c.After)
+	case c.OnOrBefore != nil:
+		return !date.Start.After(*c.OnOrBefore)
+	case c.OnOrAfter != nil:
+		return !date.Start.Before(*c.OnOrAfter)
+	}
+	return true
+}
@@ -0,0 +1,337 @@
+/* Package notiontest is an in-process fake of the bits of the
+ * Notion REST API that we use: database queries (with filters
+ * and cursors), page creates and page property updates.
+ *
+ * Point NotionConfig.Endpoint at Server.URL to use it. */
+package notiontest
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sorcererxw/go-notion"
+)
+
+/* Notion caps page_size at 100 */
+const maxPageSize = 100
+
+type Server struct {
+	*httptest.Server
+
+	/* Max results per query page; lower it to exercise cursors */
+	PageSize int
+
+	mu      sync.Mutex
+	dbs     map[string][]*notion.Page
+	pages   map[string]*notion.Page
+	queries map[string]int
+	/* Queries left to turn down, per database */
+	fails map[string]int
+}
+
+func NewServer() *Server {
+	s := &Server{
+		PageSize: maxPageSize,
+		dbs:      make(map[string][]*notion.Page),
+		pages:    make(map[string]*notion.Page),
+		queries:  make(map[string]int),
+		fails:    make(map[string]int),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.route))
+	return s
+}
+
+/* Every *.json file in dir seeds the database named after
+ * the file (confs.json -> "confs"). Each file is a list of
+ * pages, in the same shape the Notion API returns them. */
+func (s *Server) LoadFixtures(dir string) error {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+
+		var pages []*notion.Page
+		if err = json.Unmarshal(data, &pages); err != nil {
+			return fmt.Errorf("%s: %s", file, err)
+		}
+
+		dbID := strings.TrimSuffix(filepath.Base(file), ".json")
+		s.AddDatabase(dbID)
+		for _, page := range pages {
+			s.AddPage(dbID, page)
+		}
+	}
+
+	return nil
+}
+
+/* Empty databases are still databases */
+func (s *Server) AddDatabase(dbID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.dbs[dbID]; !ok {
+		s.dbs[dbID] = []*notion.Page{}
+	}
+}
+
+/* Add a page to a database, making one up if needed */
+func (s *Server) AddPage(dbID string, page *notion.Page) *notion.Page {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if page.ID == "" {
+		page.ID = newID()
+	}
+	if page.CreatedTime.IsZero() {
+		page.CreatedTime = time.Now().UTC()
+	}
+	page.LastEditedTime = page.CreatedTime
+	page.Parent = notion.NewDatabaseParent(dbID)
+	if page.Properties == nil {
+		page.Properties = make(map[string]notion.PropertyValue)
+	}
+
+	s.dbs[dbID] = append(s.dbs[dbID], page)
+	s.pages[page.ID] = page
+	return page
+}
+
+/* A copy of every page currently in the database */
+func (s *Server) Pages(dbID string) []*notion.Page {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pages := make([]*notion.Page, len(s.dbs[dbID]))
+	for i, page := range s.dbs[dbID] {
+		pages[i] = copyPage(page)
+	}
+	return pages
+}
+
+/* How many query calls have hit this database */
+func (s *Server) Queries(dbID string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.queries[dbID]
+}
+
+/* The next n queries on the database are rate limited, the
+ * way Notion turns us down when it's busy */
+func (s *Server) FailQueries(dbID string, n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fails[dbID] = n
+}
+
+func newID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	h := hex.EncodeToString(b)
+	return fmt.Sprintf("%s-%s-%s-%s-%s", h[:8], h[8:12], h[12:16], h[16:20], h[20:])
+}
+
+func copyPage(page *notion.Page) *notion.Page {
+	cp := *page
+	cp.Properties = make(map[string]notion.PropertyValue, len(page.Properties))
+	for k, v := range page.Properties {
+		cp.Properties[k] = v
+	}
+	return &cp
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeErr(w http.ResponseWriter, status int, code, msg string) {
+	writeJSON(w, status, map[string]interface{}{
+		"object":  "error",
+		"status":  status,
+		"code":    code,
+		"message": msg,
+	})
+}
+
+func (s *Server) route(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/v1/")
+	parts := strings.Split(path, "/")
+
+	switch {
+	case len(parts) == 3 && parts[0] == "databases" && parts[2] == "query" && r.Method == http.MethodPost:
+		s.queryDatabase(w, r, parts[1])
+	case len(parts) == 1 && parts[0] == "pages" && r.Method == http.MethodPost:
+		s.createPage(w, r)
+	case len(parts) == 2 && parts[0] == "pages" && r.Method == http.MethodPatch:
+		s.updatePage(w, r, parts[1])
+	case len(parts) == 2 && parts[0] == "pages" && r.Method == http.MethodGet:
+		s.retrievePage(w, parts[1])
+	default:
+		writeErr(w, http.StatusNotFound, "invalid_request_url", "fake notion doesn't do "+r.Method+" "+r.URL.Path)
+	}
+}
+
+func (s *Server) queryDatabase(w http.ResponseWriter, r *http.Request, dbID string) {
+	var param notion.QueryDatabaseParam
+	if err := json.NewDecoder(r.Body).Decode(&param); err != nil {
+		writeErr(w, http.StatusBadRequest, "invalid_json", err.Error())
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.queries[dbID]++
+	if s.fails[dbID] > 0 {
+		s.fails[dbID]--
+		writeErr(w, http.StatusTooManyRequests, "rate_limited", "You have been rate limited. Please try again in a few minutes.")
+		return
+	}
+	pages, ok := s.dbs[dbID]
+	if !ok {
+		writeErr(w, http.StatusNotFound, "object_not_found", "Could not find database with ID: "+dbID)
+		return
+	}
+
+	var matched []*notion.Page
+	for _, page := range pages {
+		if matchFilter(param.Filter, page) {
+			matched = append(matched, page)
+		}
+	}
+
+	/* Cursors are just offsets into the result set */
+	start := 0
+	if param.StartCursor != "" {
+		var err error
+		start, err = strconv.Atoi(param.StartCursor)
+		if err != nil || start < 0 || start > len(matched) {
+			writeErr(w, http.StatusBadRequest, "validation_error", "bad start_cursor "+param.StartCursor)
+			return
+		}
+	}
+
+	size := s.PageSize
+	if param.PageSize > 0 && int(param.PageSize) < size {
+		size = int(param.PageSize)
+	}
+	end := start + size
+	if end > len(matched) {
+		end = len(matched)
+	}
+
+	results := make([]*notion.Page, 0, end-start)
+	for _, page := range matched[start:end] {
+		results = append(results, copyPage(page))
+	}
+
+	resp := map[string]interface{}{
+		"object":   "list",
+		"results":  results,
+		"has_more": end < len(matched),
+	}
+	if end < len(matched) {
+		resp["next_cursor"] = strconv.Itoa(end)
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+type pageBody struct {
+	Parent     notion.Parent                    `json:"parent"`
+	Properties map[string]*notion.PropertyValue `json:"properties"`
+}
+
+func (s *Server) createPage(w http.ResponseWriter, r *http.Request) {
+	var body pageBody
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeErr(w, http.StatusBadRequest, "invalid_json", err.Error())
+		return
+	}
+
+	dbID := body.Parent.DatabaseID
+	s.mu.Lock()
+	_, ok := s.dbs[dbID]
+	s.mu.Unlock()
+	if !ok {
+		writeErr(w, http.StatusNotFound, "object_not_found", "Could not find database with ID: "+dbID)
+		return
+	}
+
+	page := &notion.Page{Properties: make(map[string]notion.PropertyValue)}
+	for k, v := range body.Properties {
+		if v != nil {
+			page.Properties[k] = fillPlainText(*v)
+		}
+	}
+	page = s.AddPage(dbID, page)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	writeJSON(w, http.StatusOK, copyPage(page))
+}
+
+func (s *Server) updatePage(w http.ResponseWriter, r *http.Request, pageID string) {
+	var body pageBody
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeErr(w, http.StatusBadRequest, "invalid_json", err.Error())
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	page, ok := s.pages[pageID]
+	if !ok {
+		writeErr(w, http.StatusNotFound, "object_not_found", "Could not find page with ID: "+pageID)
+		return
+	}
+
+	for k, v := range body.Properties {
+		if v != nil {
+			page.Properties[k] = fillPlainText(*v)
+		}
+	}
+	page.LastEditedTime = time.Now().UTC()
+
+	writeJSON(w, http.StatusOK, copyPage(page))
+}
+
+func (s *Server) retrievePage(w http.ResponseWriter, pageID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	page, ok := s.pages[pageID]
+	if !ok {
+		writeErr(w, http.StatusNotFound, "object_not_found", "Could not find page with ID: "+pageID)
+		return
+	}
+	writeJSON(w, http.StatusOK, copyPage(page))
+}
+
+/* Notion fills in plain_text on the way back out */
+func fillPlainText(val notion.PropertyValue) notion.PropertyValue {
+	for _, rt := range append(val.Title, val.RichText...) {
+		if rt != nil && rt.Text != nil && rt.PlainText == "" {
+			rt.PlainText = rt.Text.Content
+		}
+	}
+	return val
+}
@@ -0,0 +1,82 @@
+package types
+
+type (
+	BTCPayConfig struct {
+		Host          string
+		StoreID       string
+		APIKey        string
+		WebhookSecret string
+	}
+
+	/* Same fields we give OpenNode, plus the ones BTCPay
+	 * knows what to do with */
+	BTCPayMetadata struct {
+		OrderID    string `json:"orderId,omitempty"`
+		BuyerEmail string `json:"buyerEmail,omitempty"`
+		ItemDesc   string `json:"itemDesc,omitempty"`
+		OpenNodeMetadata
+	}
+
+	BTCPayCheckoutOptions struct {
+		RedirectURL           string `json:"redirectURL,omitempty"`
+		RedirectAutomatically bool   `json:"redirectAutomatically"`
+		ExpirationMinutes     int    `json:"expirationMinutes,omitempty"`
+	}
+
+	BTCPayInvoiceRequest struct {
+		Amount   string                 `json:"amount"`
+		Currency string                 `json:"currency"`
+		Metadata *BTCPayMetadata        `json:"metadata"`
+		Checkout *BTCPayCheckoutOptions `json:"checkout,omitempty"`
+	}
+
+	BTCPayInvoice struct {
+		ID             string          `json:"id"`
+		StoreID        string          `json:"storeId"`
+		Status         string          `json:"status"`
+		Amount         string          `json:"amount"`
+		Currency       string          `json:"currency"`
+		CheckoutLink   string          `json:"checkoutLink"`
+		CreatedTime    int64           `json:"createdTime"`
+		ExpirationTime int64           `json:"expirationTime"`
+		Metadata       *BTCPayMetadata `json:"metadata"`
+	}
+
+	/* What BTCPay posts to our webhook */
+	BTCPayEvent struct {
+		DeliveryID         string `json:"deliveryId"`
+		WebhookID          string `json:"webhookId"`
+		OriginalDeliveryID string `json:"originalDeliveryId"`
+		IsRedelivery       bool   `json:"isRedelivery"`
+		Type               string `json:"type"`
+		Timestamp          int64  `json:"timestamp"`
+		StoreID            string `json:"storeId"`
+		InvoiceID          string `json:"invoiceId"`
+	}
+
+	/* One way the invoice could be paid, and what came in by it */
+	BTCPayPaymentMethod struct {
+		PaymentMethod string           `json:"paymentMethod"`
+		Payments      []*BTCPayPayment `json:"payments"`
+	}
+
+	BTCPayPayment struct {
+		ID     string `json:"id"`
+		Value  string `json:"value"`
+		Status string `json:"status"`
+	}
+
+	BTCPayRefundRequest struct {
+		/* e.g. BTC or BTC-LightningNetwork; BTCPay needs one */
+		PaymentMethod  string `json:"paymentMethod"`
+		RefundVariant  string `json:"refundVariant"`
+		CustomAmount   string `json:"customAmount,omitempty"`
+		CustomCurrency string `json:"customCurrency,omitempty"`
+	}
+
+	/* Refunds are pull payments; the buyer claims them at ViewLink */
+	BTCPayPullPayment struct {
+		ID       string `json:"id"`
+		ViewLink string `json:"viewLink"`
+	}
+)
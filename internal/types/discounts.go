@@ -0,0 +1,33 @@
+package types
+
+import (
+	"strings"
+	"time"
+)
+
+/* How many tickets it's good for; 0 is no limit */
+func (d *DiscountCode) Limit() uint {
+	if d.SingleUse {
+		return 1
+	}
+	return d.MaxUses
+}
+
+/* Can it be used at time now? */
+func (d *DiscountCode) Open(now time.Time) bool {
+	if !d.ValidFrom.IsZero() && now.Before(d.ValidFrom) {
+		return false
+	}
+	return d.ValidUntil.IsZero() || now.Before(d.ValidUntil)
+}
+
+/* Does it take anything off this ticket, at the local price or not? */
+func (d *DiscountCode) Covers(tix *ConfTicket, local bool) bool {
+	if d.TixID != "" && d.TixID != tix.ID {
+		return false
+	}
+	if d.Currency != "" && !strings.EqualFold(d.Currency, tix.Currency) {
+		return false
+	}
+	return local || !d.LocalOnly
+}
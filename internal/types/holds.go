@@ -0,0 +1,42 @@
+package types
+
+import (
+	"time"
+)
+
+type (
+	HoldStatus string
+
+	/* Tickets set aside while someone's checking out, so the
+	 * last few can't be sold twice. Made before the checkout
+	 * is, so OrderID is filled in after */
+	Hold struct {
+		Ref      string
+		ConfRef  string
+		Provider string
+		OrderID  string
+		Count    uint
+		Status   HoldStatus
+		/* The order's discount code, and how many of its tickets
+		 * it's on. Those count as uses of the code while held */
+		DiscountRef string
+		Discounted  uint
+		/* When the checkout stops taking payment */
+		Expires time.Time
+		Created time.Time
+		Updated time.Time
+	}
+)
+
+const (
+	HoldActive HoldStatus = "held"
+	/* Expired or cancelled; the tickets are back on sale */
+	HoldReleased HoldStatus = "released"
+	/* Paid for; they're sold now */
+	HoldConverted HoldStatus = "converted"
+)
+
+/* Still keeping tickets off the shelf at time now? */
+func (h *Hold) Active(now time.Time) bool {
+	return h.Status == HoldActive && now.Before(h.Expires)
+}
@@ -7,6 +7,7 @@ import (
 type (
 	NotionConfig struct {
 		Token       string
+		Endpoint    string
 		EmailDb     string
 		PurchasesDb string
 		TalksDb     string
@@ -14,6 +15,11 @@ type (
 		ConfsDb     string
 		ConfsTixDb  string
 		DiscountsDb string
+		OutboxDb    string
+		StaffDb     string
+		WebhooksDb  string
+		HoldsDb     string
+		WaitlistDb  string
 	}
 
 	Notion struct {
@@ -23,6 +29,10 @@ type (
 )
 
 func (n *Notion) Setup(token string) {
-	client := notion.NewClient(notion.Settings{Token: token})
+	/* Endpoint is only set when testing against a fake */
+	client := notion.NewClient(notion.Settings{
+		Token:    token,
+		Endpoint: n.Config.Endpoint,
+	})
 	n.Client = client
 }
@@ -28,6 +28,9 @@ type (
 		TixLocal bool    `json:"tix-local"`
 		DiscountRef string  `json:"discount,omitempty"`
 		Currency    string  `json:"currency"`
+		TixID       string  `json:"tix-id,omitempty"`
+		/* Every ticket, for mixed orders; see Order.Cart */
+		Cart string `json:"cart,omitempty"`
 	}
 
 	OpenNodeChainInvoice struct {
@@ -0,0 +1,64 @@
+package types
+
+import (
+	"time"
+)
+
+type (
+	MailStatus string
+
+	/* One mail we owe someone. The mailer job works through
+	 * these; see handlers.CheckForNewMails */
+	OutboxMail struct {
+		Ref      string
+		JobKey   string
+		RefID    string
+		ConfRef  string
+		Type     string
+		Email    string
+		Status   MailStatus
+		Attempts uint
+		RetryAt  time.Time
+		LastErr  string
+		Created  time.Time
+		Updated  time.Time
+	}
+)
+
+const (
+	MailPending   MailStatus = "pending"
+	MailRendering MailStatus = "rendering"
+	MailSent      MailStatus = "sent"
+	MailFailed    MailStatus = "failed"
+	/* Ran out of attempts; someone needs to take a look */
+	MailDead MailStatus = "dead"
+)
+
+/* Outbox mails are tickets, with the ticket's Type, unless
+ * they're one of these. A claim asks the buyer of a multi-ticket
+ * order who's coming; its RefID is the order's Lookup ID. A
+ * waitlist invite's RefID is the waitlist entry */
+const (
+	MailClaim    = "claim"
+	MailWaitlist = "waitlist"
+)
+
+func (m *OutboxMail) Registration() *Registration {
+	return &Registration{
+		RefID:   m.RefID,
+		ConfRef: m.ConfRef,
+		Type:    m.Type,
+		Email:   m.Email,
+	}
+}
+
+/* Ready to go out at time now? */
+func (m *OutboxMail) Due(now time.Time) bool {
+	switch m.Status {
+	case MailPending:
+		return true
+	case MailFailed:
+		return !m.RetryAt.After(now)
+	}
+	return false
+}
@@ -0,0 +1,199 @@
+package types
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type (
+	OrderStatus string
+
+	/* Which provider takes which kind of payment. The ticket
+	 * links say "btc" or "fiat"; this says who handles it */
+	PaymentsConfig struct {
+		BTC  string
+		Fiat string
+	}
+
+	/* An order, the same for every payment provider. The
+	 * provider fills in ID when the checkout's created */
+	Order struct {
+		ID          string
+		Provider    string
+		Status      OrderStatus
+		ConfRef     string
+		ConfTag     string
+		Email       string
+		Currency    string
+		DiscountRef string
+		/* One per ticket */
+		Items   []Item
+		Created time.Time
+		/* When the checkout should stop taking payment;
+		 * zero leaves it up to the provider */
+		Expires time.Time
+		/* Where to send them after, and where the
+		 * provider tells us about it */
+		SuccessURL  string
+		CancelURL   string
+		CallbackURL string
+		/* The provider's handle for refunds (e.g. Stripe's
+		 * payment intent), if it's not the ID */
+		PaymentRef string
+		/* Where a bitcoin refund goes, for providers
+		 * that need us to say */
+		RefundAddress string
+	}
+
+	/* A started checkout, ready to send the buyer to. Bitcoin
+	 * providers that hand back the invoice itself get paid
+	 * on our own checkout page instead of at URL */
+	Checkout struct {
+		OrderID   string
+		URL       string
+		ExpiresAt time.Time
+		/* BOLT11 */
+		Lightning string
+		Address   string
+		/* BIP21, if the provider made one */
+		URI  string
+		Sats uint64
+	}
+
+	/* Some refunds (e.g. BTCPay's) have to be claimed
+	 * by the buyer, at Link */
+	Refund struct {
+		ID   string
+		Link string
+	}
+
+	/* A verified webhook. Providers that don't give their
+	 * events IDs get one made up from the order + status */
+	PaymentEvent struct {
+		ID      string
+		Type    string
+		OrderID string
+		Status  OrderStatus
+	}
+
+	/* PaymentProvider is everything the ticket flow needs from
+	 * a payment processor. See getters.NewPayments */
+	PaymentProvider interface {
+		Name() string
+		/* Do we need their email before starting checkout? */
+		NeedsEmail() bool
+		CreateCheckout(order *Order) (*Checkout, error)
+		VerifyWebhook(r *http.Request) (*PaymentEvent, error)
+		FetchCharge(orderID string) (*Order, error)
+		/* Amount in cents; 0 refunds the whole order */
+		Refund(order *Order, amount int64) (*Refund, error)
+	}
+
+	/* Providers that can list what's been paid, so we can
+	 * check every order made it into the purchases */
+	OrderLister interface {
+		ListPaidOrders(since time.Time) ([]*Order, error)
+	}
+
+	ReconcileConfig struct {
+		/* How often to run it; 0 is never */
+		JobSec int
+		/* How far back to look; 72 by default */
+		LookbackHours int
+		/* Add missing tickets, instead of just reporting */
+		Repair bool
+	}
+)
+
+const (
+	OrderPending  OrderStatus = "pending"
+	OrderPaid     OrderStatus = "paid"
+	OrderExpired  OrderStatus = "expired"
+	OrderRefunded OrderStatus = "refunded"
+)
+
+func (o *Order) Total() int64 {
+	var total int64
+	for _, item := range o.Items {
+		total += item.Total
+	}
+	return total
+}
+
+/* The same ticket, bought more than once */
+type CartLine struct {
+	TixID string
+	Type  string
+	/* Cents, per ticket */
+	Each  int64
+	Count int
+}
+
+/* Runs of the same ticket, in order */
+func (o *Order) Lines() []*CartLine {
+	var lines []*CartLine
+	for _, item := range o.Items {
+		if n := len(lines); n > 0 {
+			last := lines[n-1]
+			if last.TixID == item.TixID && last.Type == item.Type && last.Each == item.Total {
+				last.Count++
+				continue
+			}
+		}
+		lines = append(lines, &CartLine{TixID: item.TixID, Type: item.Type, Each: item.Total, Count: 1})
+	}
+	return lines
+}
+
+/* The items, squashed down to fit in a provider's metadata:
+ * tixID+type+cents*count, comma separated */
+func (o *Order) Cart() string {
+	var parts []string
+	for _, line := range o.Lines() {
+		parts = append(parts, fmt.Sprintf("%s+%s+%d*%d", line.TixID, line.Type, line.Each, line.Count))
+	}
+	return strings.Join(parts, ",")
+}
+
+func ParseCart(cart, desc string) ([]Item, error) {
+	var items []Item
+	for _, part := range strings.Split(cart, ",") {
+		line := strings.Split(part, "*")
+		if len(line) != 2 {
+			return nil, fmt.Errorf("bad cart line %q", part)
+		}
+		count, err := strconv.Atoi(line[1])
+		if err != nil || count < 1 {
+			return nil, fmt.Errorf("bad cart count %q", part)
+		}
+		tix := strings.Split(line[0], "+")
+		if len(tix) != 3 {
+			return nil, fmt.Errorf("bad cart line %q", part)
+		}
+		each, err := strconv.ParseInt(tix[2], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad cart price %q", part)
+		}
+		for i := 0; i < count; i++ {
+			items = append(items, Item{Total: each, Desc: desc, Type: tix[1], TixID: tix[0]})
+		}
+	}
+	return items, nil
+}
+
+/* What gets written to the store once it's paid */
+func (o *Order) Entry() *Entry {
+	return &Entry{
+		ID:          o.ID,
+		ConfRef:     o.ConfRef,
+		Total:       o.Total(),
+		Currency:    o.Currency,
+		Created:     o.Created,
+		Email:       o.Email,
+		Items:       o.Items,
+		DiscountRef: o.DiscountRef,
+	}
+}
@@ -0,0 +1,80 @@
+package types
+
+import (
+	"time"
+)
+
+type (
+	StaffRole string
+
+	/* Someone who works the conf. Door volunteers and
+	 * organizers only get the confs in ConfRefs; admins
+	 * get everything */
+	Staff struct {
+		Ref   string
+		Login string
+		Name  string
+		/* bcrypt, never the secret itself */
+		Hash     string
+		Role     StaffRole
+		ConfRefs []string
+		Revoked  bool
+		Created  time.Time
+	}
+)
+
+const (
+	RoleDoor      StaffRole = "door"
+	RoleOrganizer StaffRole = "organizer"
+	RoleAdmin     StaffRole = "admin"
+)
+
+func ParseStaffRole(role string) (StaffRole, bool) {
+	switch StaffRole(role) {
+	case RoleDoor, RoleOrganizer, RoleAdmin:
+		return StaffRole(role), true
+	}
+	return "", false
+}
+
+func (r StaffRole) rank() int {
+	switch r {
+	case RoleDoor:
+		return 1
+	case RoleOrganizer:
+		return 2
+	case RoleAdmin:
+		return 3
+	}
+	return 0
+}
+
+/* Does this role cover what 'need' can do? */
+func (r StaffRole) Covers(need StaffRole) bool {
+	return r.rank() >= need.rank() && need.rank() > 0
+}
+
+func (s *Staff) HasConf(confRef string) bool {
+	for _, ref := range s.ConfRefs {
+		if ref == confRef {
+			return true
+		}
+	}
+	return false
+}
+
+/* Can they act as 'role' for the conf? */
+func (s *Staff) Can(role StaffRole, confRef string) bool {
+	if s == nil || s.Revoked || !s.Role.Covers(role) {
+		return false
+	}
+	return s.Role == RoleAdmin || s.HasConf(confRef)
+}
+
+/* Can they act as 'role' for any conf at all? */
+func (s *Staff) CanAny(role StaffRole) bool {
+	if s == nil || s.Revoked || !s.Role.Covers(role) {
+		return false
+	}
+	return s.Role == RoleAdmin || len(s.ConfRefs) > 0
+}
@@ -0,0 +1,79 @@
+package types
+
+import (
+	"time"
+)
+
+type (
+	SQLiteConfig struct {
+		Path string
+	}
+
+	/* How long (in seconds) to cache each thing; 0 is the default */
+	CacheConfig struct {
+		Off          bool
+		ConfsSec     int
+		TalksSec     int
+		SpeakersSec  int
+		DiscountsSec int
+		PurchasesSec int
+		StaffSec     int
+	}
+
+	/* Store is where all the conference data lives.
+	 * Notion is the original backend; sqlite lets us run
+	 * the site without a Notion account at all */
+	Store interface {
+		ListConfs() ([]*Conf, error)
+		ListConfTickets() ([]*ConfTicket, error)
+		ListSpeakers() ([]*Speaker, error)
+		ListTalks(speakers []*Speaker) ([]*Talk, error)
+		ListDiscounts() ([]*DiscountCode, error)
+		AddDiscount(discount *DiscountCode) error
+
+		/* Purchases! */
+		ListRegistrations() ([]*Registration, error)
+		SoldTixCount(confRef string) (uint, error)
+		/* Tickets already in are skipped, so a retry
+		 * picks up where a failed one left off */
+		AddTickets(entry *Entry, src string) error
+		/* Checks a ticket in as of 'at', by staff 'by';
+		 * the first check-in sticks */
+		CheckIn(ticket string, at time.Time, by string) (string, bool, error)
+		/* Cancels a ticket; it won't check in or count as
+		 * sold anymore. 'refundRef' is the provider's refund */
+		VoidTicket(ticket string, at time.Time, by string, refundRef string) error
+		/* Sets who's coming on a ticket */
+		UpdateAttendee(ticket string, attendee *Attendee) error
+		/* Voids xfer.FromRef and issues xfer.ToRef to 'to' in
+		 * its place, same order and price. Both keep the history */
+		TransferTicket(xfer *Transfer, to *Attendee) error
+
+		/* Mail outbox */
+		ListOutbox() ([]*OutboxMail, error)
+		AddOutbox(mail *OutboxMail) error
+		UpdateOutbox(mail *OutboxMail) error
+
+		/* Staff accounts */
+		ListStaff() ([]*Staff, error)
+		AddStaff(staff *Staff) error
+		UpdateStaff(staff *Staff) error
+
+		/* Tickets held for checkouts in progress */
+		ListHolds() ([]*Hold, error)
+		AddHold(hold *Hold) error
+		UpdateHold(hold *Hold) error
+
+		/* Waiting on sold-out confs, in the order they joined */
+		ListWaitlist() ([]*WaitlistEntry, error)
+		AddWaitlist(entry *WaitlistEntry) error
+		UpdateWaitlist(entry *WaitlistEntry) error
+
+		/* Payment webhooks we've taken in */
+		ListWebhookEvents() ([]*WebhookEvent, error)
+		/* Just the one, by its key; nil if we haven't had it */
+		FindWebhookEvent(key string) (*WebhookEvent, error)
+		AddWebhookEvent(ev *WebhookEvent) error
+		UpdateWebhookEvent(ev *WebhookEvent) error
+	}
+)
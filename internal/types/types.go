@@ -13,18 +13,26 @@ type (
 		Port              string
 		Prod              bool
 		MailerSecret      string
+		MailerEndpoint    string
 		MailerJob         int
 		MailOff           bool
 		StripeKey         string
 		StripeEndpointSec string
-		RegistryPin       string
 		LogFile           string
+		Store             string
 		Notion            NotionConfig
+		SQLite            SQLiteConfig
+		Cache             CacheConfig
 		SendGrid          SendGridConfig
 		Google            GoogleConfig
 		OpenNode          OpenNodeConfig
+		BTCPay            BTCPayConfig
+		Payments          PaymentsConfig
+		Reconcile         ReconcileConfig
 		Host              string
 		LocalExternal     string
+		/* Set by our proxy to who's really asking, e.g. X-Forwarded-For */
+		ClientIPHeader    string
 		HMACSecret        string
 		HMACKey           [32]byte
 	}
@@ -75,6 +83,27 @@ type (
 		CodeName   string
 		PercentOff uint
 		ConfRef	   string
+		/* Off each ticket, in its currency; beats PercentOff */
+		AmountOff  uint
+		/* How many tickets it's good for; 0 is no limit */
+		MaxUses    uint
+		/* Good for one ticket, ever */
+		SingleUse  bool
+		/* Zero is no limit */
+		ValidFrom  time.Time
+		ValidUntil time.Time
+		/* Only for this tier / currency / local price, if set */
+		TixID      string
+		Currency   string
+		LocalOnly  bool
+		/* Codes made in bulk (see getters.GenerateDiscounts)
+		 * share a campaign */
+		Campaign   string
+		/* Only comps can take a ticket all the way to free;
+		 * those skip paying. They're issued as TixType (e.g.
+		 * speaker), if it's set */
+		Comp       bool
+		TixType    string
 	}
 
 	Speaker struct {
@@ -110,6 +139,8 @@ type (
 	Ticket struct {
 		ID  string
 		Pdf []byte
+		/* The mailer sends each key once; ID if empty */
+		JobKey string
 	}
 
 	Times struct {
@@ -118,17 +149,55 @@ type (
 	}
 
 	Registration struct {
-		RefID      string
-		ConfRef    string
-		Type       string
-		Email      string
-		ItemBought string
+		RefID       string
+		ConfRef     string
+		Type        string
+		Email       string
+		ItemBought  string
+		LookupID    string
+		Platform    string
+		Currency    string
+		AmountPaid  int64 /* cents */
+		DiscountRef string
+		TixID       string /* empty for older purchases */
+		Created     time.Time
+		/* Zero if they haven't shown up yet */
+		CheckedIn   time.Time
+		CheckedInBy string
+		/* Set once it's cancelled; a voided ticket won't check in */
+		Voided    time.Time
+		VoidedBy  string
+		RefundRef string
+		/* Who's coming on it; empty until the buyer says */
+		Attendee Attendee
+		/* Every hand it's passed through, oldest first */
+		Transfers []Transfer
+	}
+
+	/* A ticket handed on. The old ticket's voided, and a
+	 * new one (ToRef) is issued in its place */
+	Transfer struct {
+		At      time.Time
+		From    string
+		To      string
+		FromRef string
+		ToRef   string
+	}
+
+	/* One person's details, for one ticket */
+	Attendee struct {
+		Name          string
+		Email         string
+		ShirtSize     ShirtSize
+		Dietary       string
+		Accessibility string
 	}
 
 	Item struct {
 		Total int64
 		Desc  string
 		Type  string
+		TixID string
 	}
 
 	Entry struct {
@@ -257,6 +326,40 @@ func ParseShirtSize(str string) (ShirtSize, bool) {
 	return ss, ok
 }
 
+/* Smallest first, for forms */
+func ShirtSizes() []ShirtSize {
+	return []ShirtSize{Small, Med, Large, XL, XXL}
+}
+
+/* Where their ticket goes: the attendee, or whoever bought it */
+func (r *Registration) MailTo() string {
+	if r.Attendee.Email != "" {
+		return r.Attendee.Email
+	}
+	return r.Email
+}
+
+/* VoidedBy on a ticket that was handed on */
+const VoidedByTransfer = "transfer"
+
+/* The ticket this one was issued in place of, if any */
+func (r *Registration) TransferredFrom() string {
+	if n := len(r.Transfers); n > 0 && r.Transfers[n-1].ToRef == r.RefID {
+		return r.Transfers[n-1].FromRef
+	}
+	return ""
+}
+
+/* Where it went, if this one was handed on */
+func (r *Registration) TransferredTo() string {
+	for _, xfer := range r.Transfers {
+		if xfer.FromRef == r.RefID {
+			return xfer.To
+		}
+	}
+	return ""
+}
+
 func (c *Conf) GetColor() string {
 	if c.Color == "" {
 		return "indigo-600"
@@ -274,7 +377,10 @@ func (t ConfTickets) Swap(i, j int) {
 }
 
 func (s ConfTickets) Less(i, j int) bool {
-	/* Sort by time first */
+	/* Sort by time first. Tiers with no date go last */
+	if s[i].Expires == nil || s[j].Expires == nil {
+		return s[j].Expires == nil && s[i].Expires != nil
+	}
 	return s[i].Expires.Start.Before(s[j].Expires.Start)
 }
 
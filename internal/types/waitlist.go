@@ -0,0 +1,40 @@
+package types
+
+import (
+	"time"
+)
+
+type (
+	WaitStatus string
+
+	/* Someone waiting on a sold-out conf, or one tier of it
+	 * if TixID is set. When a ticket opens up, the next one in
+	 * line is held a ticket (HoldRef) and mailed a link to it,
+	 * good until Expires */
+	WaitlistEntry struct {
+		Ref     string
+		ConfRef string
+		TixID   string
+		Email   string
+		Status  WaitStatus
+		HoldRef string
+		Invited time.Time
+		Expires time.Time
+		Created time.Time
+		Updated time.Time
+	}
+)
+
+const (
+	WaitWaiting WaitStatus = "waiting"
+	WaitInvited WaitStatus = "invited"
+	/* Bought a ticket, invited or not */
+	WaitBought WaitStatus = "bought"
+	/* Didn't use their invite in time */
+	WaitLapsed WaitStatus = "lapsed"
+)
+
+/* Still holding on to an invite at time now? */
+func (e *WaitlistEntry) InviteOpen(now time.Time) bool {
+	return e.Status == WaitInvited && now.Before(e.Expires)
+}
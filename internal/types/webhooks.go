@@ -0,0 +1,58 @@
+package types
+
+import (
+	"time"
+)
+
+type (
+	WebhookStatus string
+
+	/* Every payment webhook we've taken in. Providers retry,
+	 * so Key (provider + their event id) is how we know
+	 * we've seen one before */
+	WebhookEvent struct {
+		Ref      string
+		Key      string
+		Provider string
+		EventID  string
+		Type     string
+		OrderID  string
+		/* What the provider said about the order */
+		OrderStatus OrderStatus
+		Status      WebhookStatus
+		Result      string
+		Attempts    uint
+		Created     time.Time
+		Updated     time.Time
+	}
+)
+
+const (
+	WebhookReceived WebhookStatus = "received"
+	WebhookDone     WebhookStatus = "done"
+	/* Nothing for us to do, e.g. an expired checkout */
+	WebhookIgnored WebhookStatus = "ignored"
+	/* Can be replayed from the admin */
+	WebhookFailed WebhookStatus = "failed"
+	/* Tickets added, but paid after their hold was let go
+	 * and there weren't enough left: someone should look */
+	WebhookOversold WebhookStatus = "oversold"
+)
+
+func WebhookKey(provider, eventID string) string {
+	return provider + ":" + eventID
+}
+
+func (e *WebhookEvent) PaymentEvent() *PaymentEvent {
+	return &PaymentEvent{
+		ID:      e.EventID,
+		Type:    e.Type,
+		OrderID: e.OrderID,
+		Status:  e.OrderStatus,
+	}
+}
+
+/* Already handled? Then a redelivery is a no-op */
+func (e *WebhookEvent) Handled() bool {
+	return e.Status == WebhookDone || e.Status == WebhookIgnored || e.Status == WebhookOversold
+}
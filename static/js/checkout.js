@@ -0,0 +1,38 @@
+/* Counts down to when the invoice expires, and copies
+ * invoices/addresses to the clipboard */
+function tickCountdown(el) {
+	var left = parseInt(el.dataset.expires, 10) - Math.floor(Date.now() / 1000);
+	if (left <= 0) {
+		el.textContent = "0:00";
+		return false;
+	}
+	var mins = Math.floor(left / 60);
+	var secs = left % 60;
+	el.textContent = mins + ":" + (secs < 10 ? "0" : "") + secs;
+	return true;
+}
+
+document.addEventListener("DOMContentLoaded", function () {
+	var el = document.getElementById("countdown");
+	if (el) {
+		tickCountdown(el);
+		var timer = setInterval(function () {
+			if (!tickCountdown(el)) {
+				clearInterval(timer);
+			}
+		}, 1000);
+	}
+
+	document.querySelectorAll("[data-copy]").forEach(function (btn) {
+		btn.addEventListener("click", function () {
+			if (!navigator.clipboard) {
+				return;
+			}
+			navigator.clipboard.writeText(btn.dataset.copy).then(function () {
+				var text = btn.textContent;
+				btn.textContent = "Copied!";
+				setTimeout(function () { btn.textContent = text; }, 1500);
+			});
+		});
+	});
+});
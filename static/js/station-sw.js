@@ -0,0 +1,44 @@
+/* Serves the check-in station from cache when the venue
+ * wifi is down. The registration list + queue live in
+ * localStorage, so this only needs the page itself. */
+
+var CACHE = "btcpp-station-v1";
+var ASSETS = ["/static/css/mini.css", "/static/js/station.js"];
+
+self.addEventListener("install", function (e) {
+	e.waitUntil(caches.open(CACHE).then(function (cache) {
+		return cache.addAll(ASSETS);
+	}));
+	self.skipWaiting();
+});
+
+self.addEventListener("activate", function (e) {
+	e.waitUntil(self.clients.claim());
+});
+
+function isStationPage(url) {
+	return /^\/check-in\/station\/[^/]+$/.test(url.pathname);
+}
+
+/* Network first, so a fresh page wins when we have one */
+self.addEventListener("fetch", function (e) {
+	var url = new URL(e.request.url);
+	if (e.request.method !== "GET" || url.origin !== self.location.origin) {
+		return;
+	}
+	if (!isStationPage(url) && ASSETS.indexOf(url.pathname) === -1) {
+		return;
+	}
+
+	e.respondWith(fetch(e.request).then(function (resp) {
+		if (resp.ok) {
+			var copy = resp.clone();
+			caches.open(CACHE).then(function (cache) {
+				cache.put(e.request, copy);
+			});
+		}
+		return resp;
+	}).catch(function () {
+		return caches.match(e.request);
+	}));
+});
@@ -0,0 +1,364 @@
+/* Offline check-in station. Keeps the conf's registration list
+ * and a queue of check-ins in localStorage, and syncs the queue
+ * back to the server whenever we're online. */
+
+var station = {
+	conf: "",
+	id: "",
+	list: null,
+	queue: [],
+	conflicts: [],
+	pubkey: null,
+	syncing: false,
+};
+
+var typeColors = {
+	sponsor: "bg-red-300",
+	genpop: "bg-blue-600",
+	local: "bg-blue-300",
+	volunteer: "bg-green-600",
+	speaker: "bg-orange-300",
+};
+
+var SIG_VERSION = "btcpp-tix-v1";
+
+function storeKey(name) {
+	return "station:" + station.conf + ":" + name;
+}
+
+function load(name, dflt) {
+	var val = localStorage.getItem(storeKey(name));
+	return val ? JSON.parse(val) : dflt;
+}
+
+function save() {
+	localStorage.setItem(storeKey("list"), JSON.stringify(station.list));
+	localStorage.setItem(storeKey("queue"), JSON.stringify(station.queue));
+	localStorage.setItem(storeKey("conflicts"), JSON.stringify(station.conflicts));
+}
+
+function stationID() {
+	var id = localStorage.getItem("station:id");
+	if (!id) {
+		id = Math.random().toString(36).slice(2, 10);
+		localStorage.setItem("station:id", id);
+	}
+	return id;
+}
+
+function fromHex(hex) {
+	var out = new Uint8Array(hex.length / 2);
+	for (var i = 0; i < out.length; i++) {
+		out[i] = parseInt(hex.substr(i * 2, 2), 16);
+	}
+	return out;
+}
+
+function fromBase64URL(s) {
+	s = s.replace(/-/g, "+").replace(/_/g, "/");
+	while (s.length % 4) {
+		s += "=";
+	}
+	var bin = atob(s);
+	var out = new Uint8Array(bin.length);
+	for (var i = 0; i < bin.length; i++) {
+		out[i] = bin.charCodeAt(i);
+	}
+	return out;
+}
+
+/* Not every browser does ed25519 yet; without it we
+ * go off the registration list alone */
+async function loadKey() {
+	if (!station.list || !station.list.key || !window.crypto || !crypto.subtle) {
+		return;
+	}
+	try {
+		station.pubkey = await crypto.subtle.importKey("raw", fromHex(station.list.key),
+			{ name: "Ed25519" }, false, ["verify"]);
+	} catch (e) {
+		station.pubkey = null;
+	}
+}
+
+async function verifySig(tix) {
+	if (!station.pubkey) {
+		return null;
+	}
+	var msg = [SIG_VERSION, tix.id, tix.conf, tix.type].join("\n");
+	try {
+		return await crypto.subtle.verify({ name: "Ed25519" }, station.pubkey,
+			fromBase64URL(tix.sig), new TextEncoder().encode(msg));
+	} catch (e) {
+		return false;
+	}
+}
+
+/* Scanners hand us the check-in URL; people might type the id */
+function parseScan(raw) {
+	raw = raw.trim();
+	try {
+		var url = new URL(raw);
+		var parts = url.pathname.split("/");
+		return {
+			id: parts[parts.length - 1],
+			conf: url.searchParams.get("c"),
+			type: url.searchParams.get("t"),
+			sig: url.searchParams.get("s"),
+		};
+	} catch (e) {
+		return { id: raw };
+	}
+}
+
+function findTicket(id) {
+	if (!station.list) {
+		return null;
+	}
+	for (var i = 0; i < station.list.tickets.length; i++) {
+		if (station.list.tickets[i].id === id) {
+			return station.list.tickets[i];
+		}
+	}
+	return null;
+}
+
+function showResult(type, msg) {
+	var result = document.getElementById("result");
+	result.hidden = false;
+	result.className = "mt-8 py-24 " + (type ? (typeColors[type] || "bg-blue-300") : "bg-red-500");
+	document.getElementById("result-type").textContent = type || "No entry";
+	document.getElementById("result-msg").textContent = msg || "";
+}
+
+function timeStr(at) {
+	return new Date(at).toLocaleTimeString();
+}
+
+async function scan(raw) {
+	var tix = parseScan(raw);
+	if (!tix.id) {
+		return;
+	}
+	if (!station.list) {
+		showResult("", "No registration list yet, get online and sync");
+		return;
+	}
+
+	/* Only tickets in the downloaded list get in. A signature
+	 * catches a doctored code, but never vouches for a ticket on
+	 * its own. Unsigned codes (older tickets, typed in ids) are
+	 * taken on the list alone, same as the door page does */
+	if (tix.sig) {
+		var valid = await verifySig(tix);
+		if (valid === false) {
+			showResult("", "Invalid ticket");
+			return;
+		}
+		if (tix.conf && tix.conf !== station.list.conf_ref) {
+			showResult("", "Ticket is for another conference");
+			return;
+		}
+	}
+
+	var ticket = findTicket(tix.id);
+	if (!ticket) {
+		/* Maybe bought since we grabbed the list */
+		showResult("", "Not in this station's list, sync and try again");
+		return;
+	}
+	if (ticket.voided) {
+		showResult("", "Ticket was cancelled");
+		return;
+	}
+	if (ticket.checked_in) {
+		showResult("", "Already checked in at " + timeStr(ticket.checked_in));
+		return;
+	}
+
+	ticket.checked_in = new Date().toISOString();
+	station.queue.push({ id: ticket.id, at: ticket.checked_in });
+	save();
+	showResult(ticket.type, "");
+	render();
+	sync();
+}
+
+/* A fresh list from the server, plus whatever we haven't sent yet */
+function mergeList(list) {
+	station.list = list;
+	station.queue.forEach(function (checkin) {
+		var ticket = findTicket(checkin.id);
+		if (ticket && !ticket.checked_in) {
+			ticket.checked_in = checkin.at;
+		}
+	});
+	save();
+	loadKey();
+}
+
+async function fetchList() {
+	var resp = await fetch("/check-in/station/" + station.conf + "/list", { credentials: "same-origin" });
+	if (resp.status === 401) {
+		throw new Error("logged out, reload to log in again");
+	}
+	if (!resp.ok) {
+		throw new Error("server said " + resp.status);
+	}
+	mergeList(await resp.json());
+}
+
+async function sync() {
+	if (station.syncing || !navigator.onLine) {
+		render();
+		return;
+	}
+	station.syncing = true;
+
+	var sending = station.queue.slice();
+	try {
+		if (sending.length === 0) {
+			await fetchList();
+			return;
+		}
+
+		var resp = await fetch("/check-in/station/" + station.conf + "/sync", {
+			method: "POST",
+			credentials: "same-origin",
+			headers: { "Content-Type": "application/json" },
+			body: JSON.stringify({ station: station.id, checkins: sending }),
+		});
+		if (resp.status === 401) {
+			throw new Error("logged out, reload to log in again");
+		}
+		if (!resp.ok) {
+			throw new Error("server said " + resp.status);
+		}
+		var body = await resp.json();
+
+		var done = {};
+		body.results.forEach(function (res) {
+			if (res.status === "error") {
+				return;
+			}
+			done[res.id] = true;
+			if (res.status !== "ok") {
+				var mine = sending.find(function (c) { return c.id === res.id; });
+				station.conflicts.unshift({
+					id: res.id,
+					type: res.type,
+					msg: res.msg,
+					ours: mine ? mine.at : null,
+					theirs: res.checked_in,
+				});
+			}
+		});
+		station.queue = station.queue.filter(function (c) { return !done[c.id]; });
+
+		if (body.list) {
+			mergeList(body.list);
+		} else {
+			save();
+		}
+		station.lastErr = "";
+	} catch (e) {
+		station.lastErr = e.message;
+	} finally {
+		station.syncing = false;
+		render();
+	}
+}
+
+function render() {
+	var status = document.getElementById("status");
+	if (!station.list) {
+		status.textContent = navigator.onLine ? "Loading registrations..." : "Offline, and no registrations downloaded yet!";
+		return;
+	}
+
+	var checkedIn = station.list.tickets.filter(function (t) { return t.checked_in; }).length;
+	var parts = [
+		navigator.onLine ? "Online" : "Offline",
+		checkedIn + "/" + station.list.tickets.length + " checked in",
+		station.queue.length + " waiting to sync",
+		"list from " + timeStr(station.list.fetched),
+	];
+	if (station.lastErr) {
+		parts.push("sync failed: " + station.lastErr);
+	}
+	status.textContent = parts.join(" · ");
+
+	var ul = document.getElementById("conflicts");
+	ul.innerHTML = "";
+	station.conflicts.forEach(function (c) {
+		var li = document.createElement("li");
+		li.className = "mt-2";
+		var text = c.id.slice(0, 8) + " (" + (c.type || "?") + "): " + c.msg;
+		if (c.ours) {
+			text += ", scanned here " + timeStr(c.ours);
+		}
+		if (c.theirs) {
+			text += ", checked in " + timeStr(c.theirs);
+		}
+		li.textContent = text;
+		ul.appendChild(li);
+	});
+}
+
+async function startCamera() {
+	var video = document.getElementById("camera-view");
+	var detector = new BarcodeDetector({ formats: ["qr_code"] });
+	video.srcObject = await navigator.mediaDevices.getUserMedia({ video: { facingMode: "environment" } });
+	video.hidden = false;
+	await video.play();
+
+	var last = "";
+	setInterval(async function () {
+		var codes = await detector.detect(video);
+		if (codes.length === 0 || codes[0].rawValue === last) {
+			return;
+		}
+		/* Don't check the same person in five times a second */
+		last = codes[0].rawValue;
+		setTimeout(function () { last = ""; }, 3000);
+		scan(last);
+	}, 300);
+}
+
+document.addEventListener("DOMContentLoaded", function () {
+	station.conf = document.getElementById("station").dataset.conf;
+	station.id = stationID();
+	station.list = load("list", null);
+	station.queue = load("queue", []);
+	station.conflicts = load("conflicts", []);
+	loadKey();
+
+	if ("serviceWorker" in navigator) {
+		navigator.serviceWorker.register("/check-in/station-sw.js", { scope: "/check-in/" });
+	}
+
+	var input = document.getElementById("scan-input");
+	document.getElementById("scan").addEventListener("submit", function (e) {
+		e.preventDefault();
+		scan(input.value);
+		input.value = "";
+		input.focus();
+	});
+	document.getElementById("sync").addEventListener("click", sync);
+
+	if ("BarcodeDetector" in window) {
+		var camera = document.getElementById("camera");
+		camera.hidden = false;
+		camera.addEventListener("click", function () {
+			camera.hidden = true;
+			startCamera().catch(function (e) { showResult("", "Camera: " + e.message); });
+		});
+	}
+
+	window.addEventListener("online", sync);
+	window.addEventListener("offline", render);
+	setInterval(sync, 30000);
+
+	render();
+	sync();
+});